@@ -0,0 +1,266 @@
+package sqssrv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// QueueAttributes are the settings of a queue, typed. The nil fields are not
+// set (or, when read, were not returned by SQS).
+//
+// The durations are sent to SQS in seconds, so they must be whole seconds.
+type QueueAttributes struct {
+	// VisibilityTimeout hides the messages received from the other
+	// consumers. 0s to 12h.
+	VisibilityTimeout *time.Duration `yaml:"visibility_timeout"`
+	// MessageRetentionPeriod is how long the messages are kept. 1m to 14d.
+	MessageRetentionPeriod *time.Duration `yaml:"message_retention_period"`
+	// Delay of the messages sent before they can be received. 0s to 15m.
+	Delay *time.Duration `yaml:"delay"`
+	// MaximumMessageSize of the messages, in bytes. 1 KB to 256 KB.
+	MaximumMessageSize *int64 `yaml:"maximum_message_size"`
+	// ReceiveMessageWaitTime is the long polling of the ReceiveMessage calls
+	// without a WaitTimeSeconds. 0s to 20s.
+	ReceiveMessageWaitTime *time.Duration `yaml:"receive_message_wait_time"`
+	// RedrivePolicy moves the messages received too many times to a dead
+	// letter queue.
+	RedrivePolicy *RedrivePolicy `yaml:"redrive_policy"`
+	// Policy is the access policy of the queue, as JSON.
+	Policy *string `yaml:"policy"`
+
+	// QueueArn is read only.
+	QueueArn *string `yaml:"-"`
+	// ApproximateNumberOfMessages is read only.
+	ApproximateNumberOfMessages *int64 `yaml:"-"`
+	// ApproximateNumberOfMessagesNotVisible is read only.
+	ApproximateNumberOfMessagesNotVisible *int64 `yaml:"-"`
+	// ApproximateNumberOfMessagesDelayed is read only.
+	ApproximateNumberOfMessagesDelayed *int64 `yaml:"-"`
+}
+
+// RedrivePolicy is the `RedrivePolicy` attribute of a queue.
+type RedrivePolicy struct {
+	// DeadLetterTargetArn is the ARN of the dead letter queue.
+	DeadLetterTargetArn string `json:"deadLetterTargetArn" yaml:"dead_letter_target_arn"`
+	// MaxReceiveCount is how many times a message is received before being
+	// moved to the dead letter queue. 1 to 1000.
+	MaxReceiveCount int `json:"maxReceiveCount" yaml:"max_receive_count"`
+}
+
+// attributeRange is the valid range of a numeric attribute, as sent to SQS.
+type attributeRange struct {
+	min, max int64
+}
+
+var queueAttributeRanges = map[string]attributeRange{
+	sqs.QueueAttributeNameVisibilityTimeout:             {0, 43200},
+	sqs.QueueAttributeNameMessageRetentionPeriod:        {60, 1209600},
+	sqs.QueueAttributeNameDelaySeconds:                  {0, 900},
+	sqs.QueueAttributeNameMaximumMessageSize:            {1024, 262144},
+	sqs.QueueAttributeNameReceiveMessageWaitTimeSeconds: {0, 20},
+}
+
+// Validate checks the attributes are in the ranges accepted by SQS.
+func (attributes *QueueAttributes) Validate() error {
+	_, err := attributes.Map()
+	return err
+}
+
+// Map converts the attributes to the map of the SDK (e.g. the Attributes of
+// the sqs.SetQueueAttributesInput), validating them. The read only attributes
+// are left out.
+func (attributes *QueueAttributes) Map() (map[string]*string, error) {
+	m := make(map[string]*string)
+	durations := []struct {
+		name  string
+		value *time.Duration
+	}{
+		{sqs.QueueAttributeNameVisibilityTimeout, attributes.VisibilityTimeout},
+		{sqs.QueueAttributeNameMessageRetentionPeriod, attributes.MessageRetentionPeriod},
+		{sqs.QueueAttributeNameDelaySeconds, attributes.Delay},
+		{sqs.QueueAttributeNameReceiveMessageWaitTimeSeconds, attributes.ReceiveMessageWaitTime},
+	}
+	for _, d := range durations {
+		if d.value == nil {
+			continue
+		}
+		if *d.value%time.Second != 0 {
+			return nil, fmt.Errorf("invalid %s: %s is not a whole number of seconds", d.name, *d.value)
+		}
+		if err := setAttribute(m, d.name, int64(*d.value/time.Second)); err != nil {
+			return nil, err
+		}
+	}
+	if attributes.MaximumMessageSize != nil {
+		if err := setAttribute(m, sqs.QueueAttributeNameMaximumMessageSize, *attributes.MaximumMessageSize); err != nil {
+			return nil, err
+		}
+	}
+	if attributes.RedrivePolicy != nil {
+		policy := attributes.RedrivePolicy
+		if policy.DeadLetterTargetArn == "" {
+			return nil, fmt.Errorf("invalid %s: the deadLetterTargetArn is missing", sqs.QueueAttributeNameRedrivePolicy)
+		}
+		if policy.MaxReceiveCount < 1 || policy.MaxReceiveCount > 1000 {
+			return nil, fmt.Errorf("invalid %s: the maxReceiveCount %d is out of the range 1-1000", sqs.QueueAttributeNameRedrivePolicy, policy.MaxReceiveCount)
+		}
+		data, err := json.Marshal(policy)
+		if err != nil {
+			return nil, err
+		}
+		m[sqs.QueueAttributeNameRedrivePolicy] = aws.String(string(data))
+	}
+	if attributes.Policy != nil {
+		if !json.Valid([]byte(*attributes.Policy)) {
+			return nil, fmt.Errorf("invalid %s: it is not a JSON", sqs.QueueAttributeNamePolicy)
+		}
+		m[sqs.QueueAttributeNamePolicy] = attributes.Policy
+	}
+	return m, nil
+}
+
+func setAttribute(m map[string]*string, name string, value int64) error {
+	r := queueAttributeRanges[name]
+	if value < r.min || value > r.max {
+		return fmt.Errorf("invalid %s: %d is out of the range %d-%d", name, value, r.min, r.max)
+	}
+	m[name] = aws.String(strconv.FormatInt(value, 10))
+	return nil
+}
+
+// ParseQueueAttributes converts the map of the SDK (e.g. the Attributes of the
+// sqs.GetQueueAttributesOutput) to QueueAttributes. The unknown attributes
+// are ignored.
+func ParseQueueAttributes(m map[string]*string) (*QueueAttributes, error) {
+	attributes := &QueueAttributes{
+		QueueArn: m[sqs.QueueAttributeNameQueueArn],
+		Policy:   m[sqs.QueueAttributeNamePolicy],
+	}
+	durations := map[string]**time.Duration{
+		sqs.QueueAttributeNameVisibilityTimeout:             &attributes.VisibilityTimeout,
+		sqs.QueueAttributeNameMessageRetentionPeriod:        &attributes.MessageRetentionPeriod,
+		sqs.QueueAttributeNameDelaySeconds:                  &attributes.Delay,
+		sqs.QueueAttributeNameReceiveMessageWaitTimeSeconds: &attributes.ReceiveMessageWaitTime,
+	}
+	numbers := map[string]**int64{
+		sqs.QueueAttributeNameMaximumMessageSize:                    &attributes.MaximumMessageSize,
+		sqs.QueueAttributeNameApproximateNumberOfMessages:           &attributes.ApproximateNumberOfMessages,
+		sqs.QueueAttributeNameApproximateNumberOfMessagesNotVisible: &attributes.ApproximateNumberOfMessagesNotVisible,
+		sqs.QueueAttributeNameApproximateNumberOfMessagesDelayed:    &attributes.ApproximateNumberOfMessagesDelayed,
+	}
+	for name, value := range m {
+		if value == nil {
+			continue
+		}
+		if name == sqs.QueueAttributeNameRedrivePolicy {
+			if *value == "" {
+				continue
+			}
+			policy, err := parseRedrivePolicy(*value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %s", name, err.Error())
+			}
+			attributes.RedrivePolicy = policy
+			continue
+		}
+		durationField, isDuration := durations[name]
+		number, isNumber := numbers[name]
+		if !isDuration && !isNumber {
+			continue
+		}
+		n, err := strconv.ParseInt(*value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %s", name, *value)
+		}
+		if isDuration {
+			*durationField = duration(time.Duration(n) * time.Second)
+		} else {
+			*number = aws.Int64(n)
+		}
+	}
+	return attributes, nil
+}
+
+// parseRedrivePolicy parses the JSON of a redrive policy. The
+// `maxReceiveCount` is accepted both as a number and as a string, as SQS does.
+func parseRedrivePolicy(value string) (*RedrivePolicy, error) {
+	var raw struct {
+		DeadLetterTargetArn string      `json:"deadLetterTargetArn"`
+		MaxReceiveCount     json.Number `json:"maxReceiveCount"`
+	}
+	if err := json.Unmarshal([]byte(value), &raw); err != nil {
+		return nil, err
+	}
+	count, err := strconv.Atoi(raw.MaxReceiveCount.String())
+	if err != nil {
+		return nil, err
+	}
+	return &RedrivePolicy{
+		DeadLetterTargetArn: raw.DeadLetterTargetArn,
+		MaxReceiveCount:     count,
+	}, nil
+}
+
+// duration returns a pointer to the duration, for the QueueAttributes.
+func duration(d time.Duration) *time.Duration {
+	return &d
+}
+
+// GetQueueAttributes is a wrapper for the `sqs.SQS.GetQueueAttributes`.
+func (service *SQSService) GetQueueAttributes(input *sqs.GetQueueAttributesInput) (*sqs.GetQueueAttributesOutput, error) {
+	return service.GetQueueAttributesWithContext(context.Background(), input)
+}
+
+// GetQueueAttributesWithContext is a wrapper for the `sqs.SQS.GetQueueAttributesWithContext`.
+func (service *SQSService) GetQueueAttributesWithContext(ctx context.Context, input *sqs.GetQueueAttributesInput) (*sqs.GetQueueAttributesOutput, error) {
+	input.QueueUrl = service.queueURL(input.QueueUrl)
+	output, err := service.invoke(ctx, MessageMetricMethodGetQueueAttributes, input.QueueUrl, input)
+	out, _ := output.(*sqs.GetQueueAttributesOutput)
+	return out, err
+}
+
+// SetQueueAttributes is a wrapper for the `sqs.SQS.SetQueueAttributes`.
+func (service *SQSService) SetQueueAttributes(input *sqs.SetQueueAttributesInput) (*sqs.SetQueueAttributesOutput, error) {
+	return service.SetQueueAttributesWithContext(context.Background(), input)
+}
+
+// SetQueueAttributesWithContext is a wrapper for the `sqs.SQS.SetQueueAttributesWithContext`.
+func (service *SQSService) SetQueueAttributesWithContext(ctx context.Context, input *sqs.SetQueueAttributesInput) (*sqs.SetQueueAttributesOutput, error) {
+	input.QueueUrl = service.queueURL(input.QueueUrl)
+	output, err := service.invoke(ctx, MessageMetricMethodSetQueueAttributes, input.QueueUrl, input)
+	out, _ := output.(*sqs.SetQueueAttributesOutput)
+	return out, err
+}
+
+// QueueAttributes reads all the attributes of a queue. A nil queueURL is the
+// queue of the configuration.
+func (service *SQSService) QueueAttributes(ctx context.Context, queueURL *string) (*QueueAttributes, error) {
+	output, err := service.GetQueueAttributesWithContext(ctx, &sqs.GetQueueAttributesInput{
+		QueueUrl:       queueURL,
+		AttributeNames: []*string{aws.String(sqs.QueueAttributeNameAll)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ParseQueueAttributes(output.Attributes)
+}
+
+// UpdateQueueAttributes validates and sets the non nil attributes of a queue.
+// A nil queueURL is the queue of the configuration.
+func (service *SQSService) UpdateQueueAttributes(ctx context.Context, queueURL *string, attributes *QueueAttributes) error {
+	m, err := attributes.Map()
+	if err != nil {
+		return err
+	}
+	_, err = service.SetQueueAttributesWithContext(ctx, &sqs.SetQueueAttributesInput{
+		QueueUrl:   queueURL,
+		Attributes: m,
+	})
+	return err
+}
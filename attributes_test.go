@@ -0,0 +1,196 @@
+package sqssrv
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	rscsrv "github.com/lab259/go-rscsrv"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var _ = Describe("QueueAttributes", func() {
+	seconds := func(n int) *time.Duration {
+		return duration(time.Duration(n) * time.Second)
+	}
+
+	Context("converting", func() {
+		It("should convert the attributes to the map of the SDK", func() {
+			m, err := (&QueueAttributes{
+				VisibilityTimeout:      seconds(30),
+				MessageRetentionPeriod: seconds(3600),
+				Delay:                  seconds(5),
+				MaximumMessageSize:     aws.Int64(2048),
+				ReceiveMessageWaitTime: seconds(20),
+				RedrivePolicy: &RedrivePolicy{
+					DeadLetterTargetArn: "arn:aws:sqs:us-east-1:000000000000:dlq",
+					MaxReceiveCount:     3,
+				},
+			}).Map()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(aws.StringValueMap(m)).To(Equal(map[string]string{
+				sqs.QueueAttributeNameVisibilityTimeout:             "30",
+				sqs.QueueAttributeNameMessageRetentionPeriod:        "3600",
+				sqs.QueueAttributeNameDelaySeconds:                  "5",
+				sqs.QueueAttributeNameMaximumMessageSize:            "2048",
+				sqs.QueueAttributeNameReceiveMessageWaitTimeSeconds: "20",
+				sqs.QueueAttributeNameRedrivePolicy:                 `{"deadLetterTargetArn":"arn:aws:sqs:us-east-1:000000000000:dlq","maxReceiveCount":3}`,
+			}))
+		})
+
+		It("should leave out the attributes not set", func() {
+			m, err := (&QueueAttributes{VisibilityTimeout: seconds(0)}).Map()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(aws.StringValueMap(m)).To(Equal(map[string]string{
+				sqs.QueueAttributeNameVisibilityTimeout: "0",
+			}))
+		})
+
+		It("should parse the map of the SDK", func() {
+			attributes, err := ParseQueueAttributes(aws.StringMap(map[string]string{
+				sqs.QueueAttributeNameVisibilityTimeout:           "30",
+				sqs.QueueAttributeNameMaximumMessageSize:          "2048",
+				sqs.QueueAttributeNameRedrivePolicy:               `{"deadLetterTargetArn":"arn","maxReceiveCount":"5"}`,
+				sqs.QueueAttributeNameQueueArn:                    "arn:aws:sqs:us-east-1:000000000000:queue",
+				sqs.QueueAttributeNameApproximateNumberOfMessages: "7",
+				sqs.QueueAttributeNameCreatedTimestamp:            "1500000000",
+			}))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(*attributes.VisibilityTimeout).To(Equal(30 * time.Second))
+			Expect(*attributes.MaximumMessageSize).To(BeEquivalentTo(2048))
+			Expect(attributes.RedrivePolicy).To(Equal(&RedrivePolicy{DeadLetterTargetArn: "arn", MaxReceiveCount: 5}))
+			Expect(aws.StringValue(attributes.QueueArn)).To(Equal("arn:aws:sqs:us-east-1:000000000000:queue"))
+			Expect(*attributes.ApproximateNumberOfMessages).To(BeEquivalentTo(7))
+			Expect(attributes.Delay).To(BeNil())
+		})
+
+		It("should fail parsing invalid values", func() {
+			_, err := ParseQueueAttributes(aws.StringMap(map[string]string{
+				sqs.QueueAttributeNameDelaySeconds: "five",
+			}))
+			Expect(err).To(HaveOccurred())
+			_, err = ParseQueueAttributes(aws.StringMap(map[string]string{
+				sqs.QueueAttributeNameRedrivePolicy: "{",
+			}))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("validating", func() {
+		It("should accept the limits of the ranges", func() {
+			Expect((&QueueAttributes{
+				VisibilityTimeout:      seconds(43200),
+				MessageRetentionPeriod: seconds(60),
+				Delay:                  seconds(900),
+				MaximumMessageSize:     aws.Int64(262144),
+				ReceiveMessageWaitTime: seconds(0),
+			}).Validate()).To(Succeed())
+		})
+
+		It("should reject the values out of range", func() {
+			invalid := map[string]*QueueAttributes{
+				"VisibilityTimeout":             {VisibilityTimeout: seconds(43201)},
+				"MessageRetentionPeriod":        {MessageRetentionPeriod: seconds(59)},
+				"DelaySeconds":                  {Delay: seconds(901)},
+				"MaximumMessageSize":            {MaximumMessageSize: aws.Int64(1023)},
+				"ReceiveMessageWaitTimeSeconds": {ReceiveMessageWaitTime: seconds(21)},
+				"whole number of seconds":       {VisibilityTimeout: duration(1500 * time.Millisecond)},
+				"deadLetterTargetArn":           {RedrivePolicy: &RedrivePolicy{MaxReceiveCount: 1}},
+				"maxReceiveCount":               {RedrivePolicy: &RedrivePolicy{DeadLetterTargetArn: "arn"}},
+			}
+			for message, attributes := range invalid {
+				err := attributes.Validate()
+				Expect(err).To(HaveOccurred(), message)
+				Expect(err.Error()).To(ContainSubstring(message))
+			}
+		})
+	})
+
+	Context("not running the service", func() {
+		It("should fail getting the attributes", func() {
+			service := &SQSService{}
+			_, err := service.GetQueueAttributes(&sqs.GetQueueAttributesInput{})
+			Expect(err).To(Equal(rscsrv.ErrServiceNotRunning))
+		})
+
+		It("should fail setting the attributes", func() {
+			service := &SQSService{}
+			_, err := service.SetQueueAttributesWithContext(context.Background(), &sqs.SetQueueAttributesInput{})
+			Expect(err).To(Equal(rscsrv.ErrServiceNotRunning))
+		})
+	})
+
+	Context("managing the queue", func() {
+		InitForTesting()
+
+		It("should read the attributes of the queue of the configuration", func() {
+			attributes, err := sqsService.QueueAttributes(context.Background(), nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(*attributes.VisibilityTimeout).To(Equal(time.Second))
+			Expect(aws.StringValue(attributes.QueueArn)).ToNot(BeEmpty())
+
+			var metric dto.Metric
+			Expect(sqsService.Collector.messageCalls.With(prometheus.Labels{
+				"queue":  sqsService.Configuration.QUrl,
+				"method": MessageMetricMethodGetQueueAttributes,
+			}).Write(&metric)).To(Succeed())
+			Expect(metric.GetCounter().GetValue()).To(BeEquivalentTo(1))
+		})
+
+		It("should update the attributes", func() {
+			Expect(sqsService.UpdateQueueAttributes(context.Background(), nil, &QueueAttributes{
+				VisibilityTimeout: seconds(10),
+				Delay:             seconds(2),
+			})).To(Succeed())
+
+			output, err := sqsService.GetQueueAttributes(&sqs.GetQueueAttributesInput{
+				AttributeNames: aws.StringSlice([]string{
+					sqs.QueueAttributeNameVisibilityTimeout,
+					sqs.QueueAttributeNameDelaySeconds,
+				}),
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(aws.StringValueMap(output.Attributes)).To(Equal(map[string]string{
+				sqs.QueueAttributeNameVisibilityTimeout: "10",
+				sqs.QueueAttributeNameDelaySeconds:      "2",
+			}))
+
+			var metric dto.Metric
+			Expect(sqsService.Collector.messageCalls.With(prometheus.Labels{
+				"queue":  sqsService.Configuration.QUrl,
+				"method": MessageMetricMethodSetQueueAttributes,
+			}).Write(&metric)).To(Succeed())
+			Expect(metric.GetCounter().GetValue()).To(BeEquivalentTo(1))
+		})
+
+		It("should not call SQS with invalid attributes", func() {
+			err := sqsService.UpdateQueueAttributes(context.Background(), nil, &QueueAttributes{
+				Delay: seconds(1000),
+			})
+			Expect(err).To(HaveOccurred())
+
+			var metric dto.Metric
+			Expect(sqsService.Collector.messageCalls.With(prometheus.Labels{
+				"queue":  sqsService.Configuration.QUrl,
+				"method": MessageMetricMethodSetQueueAttributes,
+			}).Write(&metric)).To(Succeed())
+			Expect(metric.GetCounter().GetValue()).To(BeEquivalentTo(0))
+		})
+
+		It("should set the attributes with the raw wrapper", func() {
+			_, err := sqsService.SetQueueAttributesWithContext(context.Background(), &sqs.SetQueueAttributesInput{
+				Attributes: aws.StringMap(map[string]string{
+					sqs.QueueAttributeNameMessageRetentionPeriod: "120",
+				}),
+			})
+			Expect(err).ToNot(HaveOccurred())
+			attributes, err := sqsService.QueueAttributes(context.Background(), aws.String(sqsService.Configuration.QUrl))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(*attributes.MessageRetentionPeriod).To(Equal(2 * time.Minute))
+		})
+	})
+})
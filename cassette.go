@@ -0,0 +1,327 @@
+package sqssrv
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// CassetteMode defines if a Cassette records the SQS calls or replays them.
+type CassetteMode string
+
+const (
+	// CassetteModeRecord calls SQS and records every call.
+	CassetteModeRecord CassetteMode = "record"
+	// CassetteModeReplay does not call SQS: the responses come from the
+	// recorded calls, in order, as long as the inputs are the recorded ones.
+	CassetteModeReplay CassetteMode = "replay"
+)
+
+// CassetteRedacted replaces the secrets (the Key and the Secret of the
+// configuration) wherever they show up in a recording.
+const CassetteRedacted = "[REDACTED]"
+
+// Cassette keeps the SQS calls of a SQSService: their inputs, outputs, errors
+// and durations. It is saved to and loaded from a JSON file.
+type Cassette struct {
+	// Mode of the cassette.
+	Mode CassetteMode `json:"-"`
+	// Realtime makes the replay take as long as the recorded calls did.
+	Realtime bool `json:"-"`
+	// Interactions are the calls, in the order they were made.
+	Interactions []*Interaction `json:"interactions"`
+
+	m        sync.Mutex
+	replayed int
+	errs     []error
+}
+
+// Interaction is a recorded SQS call.
+type Interaction struct {
+	Method string `json:"method"`
+	Queue  string `json:"queue"`
+	// Input is the `*sqs.<Method>Input` as JSON. When replaying, the input of
+	// the call must be the same, unless it is empty.
+	Input json.RawMessage `json:"input"`
+	// Output is the `*sqs.<Method>Output` as JSON, if the call succeeded.
+	Output json.RawMessage `json:"output,omitempty"`
+	// Error is the failure of the call, if any.
+	Error *InteractionError `json:"error,omitempty"`
+	// Duration of the call, in nanoseconds.
+	Duration time.Duration `json:"duration"`
+}
+
+// InteractionError is a recorded failure. The errors returned by AWS keep
+// their code, status code and request ID when replayed.
+type InteractionError struct {
+	Code       string `json:"code,omitempty"`
+	Message    string `json:"message"`
+	StatusCode int    `json:"status_code,omitempty"`
+	RequestID  string `json:"request_id,omitempty"`
+}
+
+// UnexpectedCallError is returned when replaying a call that is not the next
+// one of the cassette.
+type UnexpectedCallError struct {
+	Method string
+	Queue  string
+	// Input is the input of the call as JSON, set when it is the only thing
+	// that differs from the Expected interaction.
+	Input json.RawMessage
+	// Expected is the next interaction of the cassette, nil if all of them
+	// were replayed.
+	Expected *Interaction
+}
+
+func (err *UnexpectedCallError) Error() string {
+	if err.Expected == nil {
+		return fmt.Sprintf("unexpected call to %s on %s: all the interactions of the cassette were replayed", err.Method, err.Queue)
+	}
+	if err.Input != nil {
+		return fmt.Sprintf("unexpected call to %s on %s: the input %s differs from the recorded %s", err.Method, err.Queue, err.Input, err.Expected.Input)
+	}
+	return fmt.Sprintf("unexpected call to %s on %s: the cassette expected %s on %s", err.Method, err.Queue, err.Expected.Method, err.Expected.Queue)
+}
+
+// NewCassette creates an empty cassette.
+func NewCassette(mode CassetteMode) *Cassette {
+	return &Cassette{
+		Mode: mode,
+	}
+}
+
+// LoadCassette reads a cassette, to be replayed, from a file.
+func LoadCassette(path string) (*Cassette, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cassette := NewCassette(CassetteModeReplay)
+	if err := json.Unmarshal(data, cassette); err != nil {
+		return nil, fmt.Errorf("could not parse the cassette %s: %s", path, err.Error())
+	}
+	return cassette, nil
+}
+
+// Save writes the cassette to a file.
+func (cassette *Cassette) Save(path string) error {
+	cassette.m.Lock()
+	defer cassette.m.Unlock()
+	data, err := json.MarshalIndent(cassette, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// Remaining returns the interactions not replayed yet.
+func (cassette *Cassette) Remaining() []*Interaction {
+	cassette.m.Lock()
+	defer cassette.m.Unlock()
+	return append([]*Interaction{}, cassette.Interactions[cassette.replayed:]...)
+}
+
+// RecordingErrors returns the errors recording the calls, e.g. an output
+// that could not be encoded. The calls are not failed by them, as they were
+// already made.
+func (cassette *Cassette) RecordingErrors() []error {
+	cassette.m.Lock()
+	defer cassette.m.Unlock()
+	return append([]error{}, cassette.errs...)
+}
+
+// invoker wraps the invoker calling SQS according to the mode of the
+// cassette. The secrets are scrubbed from what is recorded, and from the
+// inputs compared to it.
+func (cassette *Cassette) invoker(next Invoker, secrets ...string) Invoker {
+	if cassette.Mode == CassetteModeReplay {
+		return func(ctx context.Context, op Operation, input interface{}) (interface{}, error) {
+			return cassette.replay(ctx, op, input, secrets)
+		}
+	}
+	return func(ctx context.Context, op Operation, input interface{}) (interface{}, error) {
+		start := time.Now()
+		output, err := next(ctx, op, input)
+		interaction, recordErr := newInteraction(op, input, output, err, time.Since(start), secrets)
+		cassette.m.Lock()
+		if recordErr != nil {
+			cassette.errs = append(cassette.errs, fmt.Errorf("could not record the call to %s on %s: %s", op.Method, op.Queue, recordErr.Error()))
+		} else {
+			cassette.Interactions = append(cassette.Interactions, interaction)
+		}
+		cassette.m.Unlock()
+		return output, err
+	}
+}
+
+// newInteraction records a call.
+func newInteraction(op Operation, input, output interface{}, err error, duration time.Duration, secrets []string) (*Interaction, error) {
+	interaction := &Interaction{
+		Method:   op.Method,
+		Queue:    scrub(op.Queue, secrets),
+		Duration: duration,
+	}
+	data, marshalErr := json.Marshal(input)
+	if marshalErr != nil {
+		return nil, marshalErr
+	}
+	interaction.Input = scrubJSON(data, secrets)
+	if err != nil {
+		interaction.Error = &InteractionError{
+			Message: err.Error(),
+		}
+		if awsErr, ok := err.(awserr.Error); ok {
+			interaction.Error.Code = awsErr.Code()
+			interaction.Error.Message = awsErr.Message()
+		}
+		if requestErr, ok := err.(awserr.RequestFailure); ok {
+			interaction.Error.StatusCode = requestErr.StatusCode()
+			interaction.Error.RequestID = requestErr.RequestID()
+		}
+		interaction.Error.Message = scrub(interaction.Error.Message, secrets)
+		return interaction, nil
+	}
+	data, marshalErr = json.Marshal(output)
+	if marshalErr != nil {
+		return nil, marshalErr
+	}
+	interaction.Output = scrubJSON(data, secrets)
+	return interaction, nil
+}
+
+// replay serves the next interaction of the cassette.
+func (cassette *Cassette) replay(ctx context.Context, op Operation, input interface{}, secrets []string) (interface{}, error) {
+	data, err := json.Marshal(input)
+	if err != nil {
+		return nil, err
+	}
+	data = scrubJSON(data, secrets)
+
+	cassette.m.Lock()
+	if cassette.replayed == len(cassette.Interactions) {
+		cassette.m.Unlock()
+		return nil, &UnexpectedCallError{Method: op.Method, Queue: op.Queue}
+	}
+	interaction := cassette.Interactions[cassette.replayed]
+	if interaction.Method != op.Method || interaction.Queue != op.Queue {
+		cassette.m.Unlock()
+		return nil, &UnexpectedCallError{Method: op.Method, Queue: op.Queue, Expected: interaction}
+	}
+	if len(interaction.Input) > 0 && !sameJSON(interaction.Input, data) {
+		cassette.m.Unlock()
+		return nil, &UnexpectedCallError{Method: op.Method, Queue: op.Queue, Input: data, Expected: interaction}
+	}
+	cassette.replayed++
+	cassette.m.Unlock()
+
+	if cassette.Realtime {
+		select {
+		case <-time.After(interaction.Duration):
+		case <-ctx.Done():
+			return nil, awserr.New("RequestCanceled", "request context canceled", ctx.Err())
+		}
+	}
+
+	if interaction.Error != nil {
+		return nil, interaction.Error.err()
+	}
+	output := newOutput(input)
+	if output == nil {
+		return nil, fmt.Errorf("unsupported operation %s (%T)", op.Method, input)
+	}
+	if err := json.Unmarshal(interaction.Output, output); err != nil {
+		return nil, fmt.Errorf("could not parse the output of %s: %s", op.Method, err.Error())
+	}
+	return output, nil
+}
+
+// sameJSON tells if two JSON documents are the same but for their
+// whitespace, as the cassettes are saved indented.
+func sameJSON(a, b []byte) bool {
+	var compactA, compactB bytes.Buffer
+	if json.Compact(&compactA, a) != nil || json.Compact(&compactB, b) != nil {
+		return bytes.Equal(a, b)
+	}
+	return bytes.Equal(compactA.Bytes(), compactB.Bytes())
+}
+
+// err rebuilds the recorded error.
+func (e *InteractionError) err() error {
+	if e.Code == "" {
+		return errors.New(e.Message)
+	}
+	err := awserr.New(e.Code, e.Message, nil)
+	if e.StatusCode != 0 {
+		return awserr.NewRequestFailure(err, e.StatusCode, e.RequestID)
+	}
+	return err
+}
+
+// newOutput returns an empty output for the input of an operation.
+func newOutput(input interface{}) interface{} {
+	switch input.(type) {
+	case *sqs.SendMessageInput:
+		return &sqs.SendMessageOutput{}
+	case *sqs.SendMessageBatchInput:
+		return &sqs.SendMessageBatchOutput{}
+	case *sqs.ReceiveMessageInput:
+		return &sqs.ReceiveMessageOutput{}
+	case *sqs.DeleteMessageInput:
+		return &sqs.DeleteMessageOutput{}
+	case *sqs.DeleteMessageBatchInput:
+		return &sqs.DeleteMessageBatchOutput{}
+	case *sqs.PurgeQueueInput:
+		return &sqs.PurgeQueueOutput{}
+	case *sqs.ListQueuesInput:
+		return &sqs.ListQueuesOutput{}
+	case *sqs.ChangeMessageVisibilityInput:
+		return &sqs.ChangeMessageVisibilityOutput{}
+	case *sqs.ChangeMessageVisibilityBatchInput:
+		return &sqs.ChangeMessageVisibilityBatchOutput{}
+	case *sqs.GetQueueAttributesInput:
+		return &sqs.GetQueueAttributesOutput{}
+	case *sqs.SetQueueAttributesInput:
+		return &sqs.SetQueueAttributesOutput{}
+	case *sqs.CreateQueueInput:
+		return &sqs.CreateQueueOutput{}
+	case *sqs.DeleteQueueInput:
+		return &sqs.DeleteQueueOutput{}
+	case *sqs.TagQueueInput:
+		return &sqs.TagQueueOutput{}
+	case *sqs.ListQueueTagsInput:
+		return &sqs.ListQueueTagsOutput{}
+	case *sqs.GetQueueUrlInput:
+		return &sqs.GetQueueUrlOutput{}
+	}
+	return nil
+}
+
+// scrub replaces the secrets of a string with CassetteRedacted.
+func scrub(s string, secrets []string) string {
+	return string(scrubJSON([]byte(s), secrets))
+}
+
+// scrubJSON replaces the secrets of a JSON with CassetteRedacted. The secrets
+// are replaced as they are encoded in JSON strings.
+func scrubJSON(data []byte, secrets []string) []byte {
+	for _, secret := range secrets {
+		if secret == "" {
+			continue
+		}
+		encoded, _ := json.Marshal(secret)
+		encoded = encoded[1 : len(encoded)-1]
+		data = bytes.Replace(data, encoded, []byte(CassetteRedacted), -1)
+		if !bytes.Equal(encoded, []byte(secret)) {
+			data = bytes.Replace(data, []byte(secret), []byte(CassetteRedacted), -1)
+		}
+	}
+	return data
+}
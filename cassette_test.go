@@ -0,0 +1,285 @@
+package sqssrv
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Cassette", func() {
+	var (
+		dir          string
+		cassettePath string
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "sqssrv-cassette")
+		Expect(err).ToNot(HaveOccurred())
+		cassettePath = path.Join(dir, "cassette.json")
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	// record runs the calls against a queue of its own, recording them to
+	// the cassettePath. It returns the URL of the queue.
+	record := func(configuration SQSServiceConfiguration, calls func(service *SQSService)) string {
+		configuration.CassetteMode = CassetteModeRecord
+		configuration.CassettePath = cassettePath
+		service := &SQSService{}
+		Expect(service.ApplyConfiguration(configuration)).To(Succeed())
+		queue, err := NewTestQueue(service, nil)
+		Expect(err).ToNot(HaveOccurred())
+		calls(service)
+		Expect(queue.Close()).To(Succeed())
+		return queue.QueueURL
+	}
+
+	// replay starts a service replaying the cassettePath. SQS is out of
+	// reach, so any call that is not replayed fails.
+	replay := func(queueURL string) *SQSService {
+		service := &SQSService{}
+		Expect(service.ApplyConfiguration(SQSServiceConfiguration{
+			Endpoint:     "http://localhost:1",
+			QUrl:         queueURL,
+			CassetteMode: CassetteModeReplay,
+			CassettePath: cassettePath,
+		})).To(Succeed())
+		Expect(service.Start()).To(Succeed())
+		return service
+	}
+
+	sendReceiveDelete := func(service *SQSService) (*sqs.SendMessageOutput, *sqs.ReceiveMessageOutput) {
+		sendOutput, err := service.SendMessage(&sqs.SendMessageInput{
+			MessageBody: aws.String("message"),
+			MessageAttributes: map[string]*sqs.MessageAttributeValue{
+				"type": {DataType: aws.String("String"), StringValue: aws.String("welcome")},
+			},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		receiveOutput, err := service.ReceiveMessage(&sqs.ReceiveMessageInput{
+			MessageAttributeNames: []*string{aws.String("All")},
+			WaitTimeSeconds:       aws.Int64(1),
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(receiveOutput.Messages).To(HaveLen(1))
+		_, err = service.DeleteMessage(&sqs.DeleteMessageInput{
+			ReceiptHandle: receiveOutput.Messages[0].ReceiptHandle,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		return sendOutput, receiveOutput
+	}
+
+	It("should record the calls to the file", func() {
+		record(validConfiguration, func(service *SQSService) {
+			sendReceiveDelete(service)
+		})
+
+		cassette, err := LoadCassette(cassettePath)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(cassette.Mode).To(Equal(CassetteModeReplay))
+		var methods []string
+		for _, interaction := range cassette.Interactions {
+			methods = append(methods, interaction.Method)
+			Expect(interaction.Duration).To(BeNumerically(">", 0))
+			Expect(interaction.Error).To(BeNil())
+		}
+		Expect(methods).To(Equal([]string{
+			MessageMetricMethodListQueues,
+			MessageMetricMethodSendMessage,
+			MessageMetricMethodReceiveMessage,
+			MessageMetricMethodDeleteMessage,
+		}))
+		Expect(string(cassette.Interactions[1].Input)).To(MatchRegexp(`"MessageBody":\s*"message"`))
+		Expect(string(cassette.Interactions[2].Output)).To(MatchRegexp(`"Body":\s*"message"`))
+	})
+
+	It("should replay the calls in order", func() {
+		var (
+			sent     *sqs.SendMessageOutput
+			received *sqs.ReceiveMessageOutput
+		)
+		queueURL := record(validConfiguration, func(service *SQSService) {
+			sent, received = sendReceiveDelete(service)
+		})
+
+		service := replay(queueURL)
+		replayedSent, replayedReceived := sendReceiveDelete(service)
+		Expect(replayedSent).To(Equal(sent))
+		Expect(replayedReceived).To(Equal(received))
+		Expect(aws.StringValue(replayedReceived.Messages[0].MessageAttributes["type"].StringValue)).To(Equal("welcome"))
+		Expect(service.Cassette.Remaining()).To(BeEmpty())
+		Expect(service.Stop()).To(Succeed())
+	})
+
+	It("should replay the errors", func() {
+		queueURL := record(validConfiguration, func(service *SQSService) {
+			_, err := service.SendMessage(&sqs.SendMessageInput{
+				QueueUrl:    aws.String(service.Configuration.QUrl + "-missing"),
+				MessageBody: aws.String("message"),
+			})
+			Expect(err).To(HaveOccurred())
+		})
+
+		service := replay(queueURL)
+		_, err := service.SendMessage(&sqs.SendMessageInput{
+			QueueUrl:    aws.String(queueURL + "-missing"),
+			MessageBody: aws.String("message"),
+		})
+		Expect(err).To(HaveOccurred())
+		requestErr, ok := err.(awserr.RequestFailure)
+		Expect(ok).To(BeTrue())
+		Expect(requestErr.Code()).To(Equal(sqs.ErrCodeQueueDoesNotExist))
+		Expect(requestErr.StatusCode()).To(Equal(400))
+	})
+
+	It("should fail the calls that were not recorded", func() {
+		queueURL := record(validConfiguration, func(service *SQSService) {
+			_, err := service.SendMessage(&sqs.SendMessageInput{
+				MessageBody: aws.String("message"),
+			})
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		service := replay(queueURL)
+		_, err := service.PurgeQueue(&sqs.PurgeQueueInput{})
+		Expect(err).To(HaveOccurred())
+		unexpected, ok := err.(*UnexpectedCallError)
+		Expect(ok).To(BeTrue())
+		Expect(unexpected.Method).To(Equal(MessageMetricMethodPurgeQueue))
+		Expect(unexpected.Expected.Method).To(Equal(MessageMetricMethodSendMessage))
+		Expect(err.Error()).To(ContainSubstring("the cassette expected SendMessage"))
+
+		_, err = service.SendMessage(&sqs.SendMessageInput{
+			MessageBody: aws.String("message"),
+		})
+		Expect(err).ToNot(HaveOccurred())
+		_, err = service.SendMessage(&sqs.SendMessageInput{
+			MessageBody: aws.String("message"),
+		})
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("all the interactions of the cassette were replayed"))
+	})
+
+	It("should fail the calls with another input", func() {
+		queueURL := record(validConfiguration, func(service *SQSService) {
+			_, err := service.SendMessage(&sqs.SendMessageInput{
+				MessageBody: aws.String("message"),
+			})
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		service := replay(queueURL)
+		_, err := service.SendMessage(&sqs.SendMessageInput{
+			MessageBody: aws.String("another message"),
+		})
+		Expect(err).To(HaveOccurred())
+		unexpected, ok := err.(*UnexpectedCallError)
+		Expect(ok).To(BeTrue())
+		Expect(string(unexpected.Input)).To(ContainSubstring(`"MessageBody":"another message"`))
+		Expect(err.Error()).To(ContainSubstring("differs from the recorded"))
+		Expect(service.Cassette.Remaining()).To(HaveLen(1))
+	})
+
+	It("should not fail the calls that cannot be recorded", func() {
+		cassette := NewCassette(CassetteModeRecord)
+		output, err := cassette.invoker(func(ctx context.Context, op Operation, input interface{}) (interface{}, error) {
+			return make(chan int), nil
+		})(context.Background(), Operation{
+			Queue:  "queue",
+			Method: MessageMetricMethodSendMessage,
+		}, &sqs.SendMessageInput{})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(output).ToNot(BeNil())
+		Expect(cassette.Interactions).To(BeEmpty())
+		Expect(cassette.RecordingErrors()).To(HaveLen(1))
+		Expect(cassette.RecordingErrors()[0].Error()).To(HavePrefix("could not record the call to SendMessage on queue: "))
+	})
+
+	It("should scrub the secrets", func() {
+		configuration := validConfiguration
+		configuration.Key = "AKIASECRETKEY"
+		configuration.Secret = "secret/with+symbols"
+		record(configuration, func(service *SQSService) {
+			_, err := service.SendMessage(&sqs.SendMessageInput{
+				MessageBody: aws.String("AKIASECRETKEY:secret/with+symbols"),
+			})
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		data, err := ioutil.ReadFile(cassettePath)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).ToNot(ContainSubstring("AKIASECRETKEY"))
+		Expect(string(data)).ToNot(ContainSubstring("secret/with+symbols"))
+		Expect(string(data)).To(ContainSubstring(CassetteRedacted + ":" + CassetteRedacted))
+	})
+
+	It("should fail starting with an invalid mode", func() {
+		configuration := validConfiguration
+		configuration.CassetteMode = "rewind"
+		service := &SQSService{}
+		Expect(service.ApplyConfiguration(configuration)).To(Succeed())
+		Expect(service.Start()).To(MatchError(ContainSubstring("invalid cassette mode")))
+	})
+
+	It("should fail starting when the cassette cannot be loaded", func() {
+		configuration := validConfiguration
+		configuration.CassetteMode = CassetteModeReplay
+		configuration.CassettePath = path.Join(dir, "missing.json")
+		service := &SQSService{}
+		Expect(service.ApplyConfiguration(configuration)).To(Succeed())
+		Expect(service.Start()).To(HaveOccurred())
+	})
+
+	Context("replaying in real time", func() {
+		var cassette *Cassette
+
+		BeforeEach(func() {
+			output, err := json.Marshal(&sqs.SendMessageOutput{MessageId: aws.String("id")})
+			Expect(err).ToNot(HaveOccurred())
+			cassette = NewCassette(CassetteModeReplay)
+			cassette.Realtime = true
+			cassette.Interactions = []*Interaction{
+				{
+					Method:   MessageMetricMethodSendMessage,
+					Queue:    "queue",
+					Output:   output,
+					Duration: 100 * time.Millisecond,
+				},
+			}
+		})
+
+		It("should take as long as the recorded call", func() {
+			start := time.Now()
+			output, err := cassette.invoker(nil)(context.Background(), Operation{
+				Queue:  "queue",
+				Method: MessageMetricMethodSendMessage,
+			}, &sqs.SendMessageInput{})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(time.Since(start)).To(BeNumerically(">=", 100*time.Millisecond))
+			Expect(aws.StringValue(output.(*sqs.SendMessageOutput).MessageId)).To(Equal("id"))
+		})
+
+		It("should stop waiting when the context is canceled", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			_, err := cassette.invoker(nil)(ctx, Operation{
+				Queue:  "queue",
+				Method: MessageMetricMethodSendMessage,
+			}, &sqs.SendMessageInput{})
+			Expect(err).To(HaveOccurred())
+			Expect(err.(awserr.Error).Code()).To(Equal("RequestCanceled"))
+		})
+	})
+})
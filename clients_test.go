@@ -0,0 +1,99 @@
+package sqssrv
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// mockClient is a sqsiface.SQSAPI that knows a single queue and keeps the
+// messages sent to it. The methods not implemented panic.
+type mockClient struct {
+	sqsiface.SQSAPI
+	queueURL string
+	sent     []string
+}
+
+func (client *mockClient) ListQueuesWithContext(ctx aws.Context, input *sqs.ListQueuesInput, _ ...request.Option) (*sqs.ListQueuesOutput, error) {
+	return &sqs.ListQueuesOutput{
+		QueueUrls: []*string{aws.String(client.queueURL)},
+	}, nil
+}
+
+func (client *mockClient) SendMessageWithContext(ctx aws.Context, input *sqs.SendMessageInput, _ ...request.Option) (*sqs.SendMessageOutput, error) {
+	client.sent = append(client.sent, aws.StringValue(input.MessageBody))
+	return &sqs.SendMessageOutput{
+		MessageId: aws.String("mock"),
+	}, nil
+}
+
+var _ = Describe("Clients", func() {
+	var (
+		client  *mockClient
+		service *SQSService
+	)
+
+	BeforeEach(func() {
+		client = &mockClient{queueURL: "http://mock/queue/mocked"}
+		service = &SQSService{
+			Client: client,
+		}
+		Expect(service.ApplyConfiguration(SQSServiceConfiguration{
+			QUrl: client.queueURL,
+		})).To(Succeed())
+		Expect(service.Start()).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(service.Stop()).To(Succeed())
+	})
+
+	It("should use the client informed before starting", func() {
+		output, err := service.SendMessage(&sqs.SendMessageInput{
+			MessageBody: aws.String("message"),
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(aws.StringValue(output.MessageId)).To(Equal("mock"))
+		Expect(client.sent).To(Equal([]string{"message"}))
+	})
+
+	It("should record the metrics of the client informed", func() {
+		_, err := service.SendMessage(&sqs.SendMessageInput{
+			MessageBody: aws.String("message"),
+		})
+		Expect(err).ToNot(HaveOccurred())
+		var metric dto.Metric
+		Expect(service.Collector.messageCalls.WithLabelValues(client.queueURL, MessageMetricMethodSendMessage).Write(&metric)).To(Succeed())
+		Expect(metric.GetCounter().GetValue()).To(BeEquivalentTo(1))
+	})
+
+	It("should run with the client informed", func() {
+		Expect(service.RunWithClient(func(c sqsiface.SQSAPI) error {
+			Expect(c).To(BeIdenticalTo(client))
+			return nil
+		})).To(Succeed())
+	})
+
+	It("should fail running with the sqs.SQS when another client was informed", func() {
+		Expect(service.RunWithSQS(func(client *sqs.SQS) error {
+			return nil
+		})).To(Equal(ErrClientNotSQS))
+	})
+
+	It("should be used through the Sender interface", func() {
+		send := func(sender Sender) error {
+			_, err := sender.SendMessageWithContext(context.Background(), &sqs.SendMessageInput{
+				MessageBody: aws.String("message"),
+			})
+			return err
+		}
+		Expect(send(service)).To(Succeed())
+		Expect(client.sent).To(HaveLen(1))
+	})
+})
@@ -2,26 +2,96 @@ package sqssrv
 
 import (
 	"fmt"
+	"net/url"
+	"path"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
 
+// SQSServiceCollector is the Prometheus Recorder. It is the one used by the
+// SQSService when no other Recorder is informed.
 type SQSServiceCollector struct {
-	messageCalls         *prometheus.CounterVec
-	messageDuration      *prometheus.CounterVec
-	messageSuccess       *prometheus.CounterVec
-	messageFailures      *prometheus.CounterVec
-	messageTrafficAmount *prometheus.CounterVec
-	messageTrafficSize   *prometheus.CounterVec
+	messageCalls          *prometheus.CounterVec
+	messageDuration       *prometheus.CounterVec
+	messageSuccess        *prometheus.CounterVec
+	messageFailures       *prometheus.CounterVec
+	messageTrafficAmount  *prometheus.CounterVec
+	messageTrafficSize    *prometheus.CounterVec
+	messageEmptyReceives  *prometheus.CounterVec
+	messageRequestUnits   *prometheus.CounterVec
+	messageInjectedFaults *prometheus.CounterVec
+
+	handlerDuration   *prometheus.HistogramVec
+	handlerOutcomes   *prometheus.CounterVec
+	handlerDeadLetter *prometheus.CounterVec
+	handlerInFlight   *prometheus.GaugeVec
+	workers           *prometheus.GaugeVec
+	workerUtilization *prometheus.GaugeVec
+
+	serviceRunning            *prometheus.GaugeVec
+	serviceActions            *prometheus.CounterVec
+	serviceValidationDuration *prometheus.HistogramVec
+	queueAttributeDrift       *prometheus.GaugeVec
+	queueDriftCheckFailures   *prometheus.CounterVec
+
+	queueLabel          QueueLabel
+	maxQueueLabelValues int
+
+	m           sync.RWMutex
+	queues      map[string]string
+	queueLabels map[string]bool
+	overflowed  map[string]bool
+	metrics     map[messageMetricsKey]*messageMetrics
 }
 
+// QueueLabel defines what identifies a queue in the "queue" label of the
+// metrics.
+type QueueLabel string
+
+const (
+	// QueueLabelURL uses the full queue URL as label. It is the default.
+	QueueLabelURL QueueLabel = "url"
+	// QueueLabelName uses only the name of the queue (the last segment of its
+	// URL), leaving the host and account ID out.
+	QueueLabelName QueueLabel = "name"
+)
+
+// QueueLabelOverflow is the "queue" label used when the number of distinct
+// queues reaches SQSServiceCollectorOpts.MaxQueueLabelValues.
+const QueueLabelOverflow = "other"
+
+// maxOverflowedQueues caps how many queue URLs reported as QueueLabelOverflow
+// are remembered, so their lookups only take the read lock. Above it, the
+// ones remembered are forgotten.
+const maxOverflowedQueues = 1024
+
 type SQSServiceCollectorOpts struct {
 	Prefix string
+	// QueueLabel defines if the queues are identified by their URL or name.
+	// Default: QueueLabelURL.
+	QueueLabel QueueLabel
+	// ConstLabels are added to all the metrics. Useful for labels like
+	// "service" or "environment".
+	ConstLabels prometheus.Labels
+	// MaxQueueLabelValues caps how many distinct "queue" label values are
+	// exported. Queues above the cap are reported as QueueLabelOverflow. Zero
+	// means no cap.
+	MaxQueueLabelValues int
+	// HandlerBuckets are the buckets of the handler duration histogram.
+	// Default: prometheus.DefBuckets.
+	HandlerBuckets []float64
+	// Registerer, when set, gets the new collector registered right away. As
+	// the `promauto` package does, NewSQSServiceCollector panics if the
+	// registration fails.
+	Registerer prometheus.Registerer
 }
 
 var (
 	messageMetricVectorLabels = []string{"queue", "method"}
+	handlerMetricVectorLabels = []string{"queue", "type"}
 )
 
 const (
@@ -30,6 +100,18 @@ const (
 	MessageMetricMethodDeleteMessage      string = "DeleteMessage"
 	MessageMetricMethodDeleteMessageBatch string = "DeleteMessageBatch"
 	MessageMetricMethodReceiveMessage     string = "ReceiveMessage"
+	MessageMetricMethodPurgeQueue         string = "PurgeQueue"
+	MessageMetricMethodListQueues         string = "ListQueues"
+
+	MessageMetricMethodChangeMessageVisibility      string = "ChangeMessageVisibility"
+	MessageMetricMethodChangeMessageVisibilityBatch string = "ChangeMessageVisibilityBatch"
+	MessageMetricMethodGetQueueAttributes           string = "GetQueueAttributes"
+	MessageMetricMethodSetQueueAttributes           string = "SetQueueAttributes"
+	MessageMetricMethodCreateQueue                  string = "CreateQueue"
+	MessageMetricMethodDeleteQueue                  string = "DeleteQueue"
+	MessageMetricMethodTagQueue                     string = "TagQueue"
+	MessageMetricMethodListQueueTags                string = "ListQueueTags"
+	MessageMetricMethodGetQueueUrl                  string = "GetQueueUrl"
 )
 
 func NewSQSServiceCollector(opts *SQSServiceCollectorOpts) *SQSServiceCollector {
@@ -37,49 +119,462 @@ func NewSQSServiceCollector(opts *SQSServiceCollectorOpts) *SQSServiceCollector
 	if prefix != "" && !strings.HasSuffix(opts.Prefix, "_") {
 		prefix += "_"
 	}
-	return &SQSServiceCollector{
+	queueLabel := opts.QueueLabel
+	if queueLabel == "" {
+		queueLabel = QueueLabelURL
+	}
+	collector := &SQSServiceCollector{
 		messageCalls: prometheus.NewCounterVec(
 			prometheus.CounterOpts{
-				Name: fmt.Sprintf("sqs_%smessage_calls", prefix),
-				Help: "The total number of method called",
+				Name:        fmt.Sprintf("sqs_%smessage_calls", prefix),
+				Help:        "The total number of method called",
+				ConstLabels: opts.ConstLabels,
 			},
 			messageMetricVectorLabels,
 		),
 		messageDuration: prometheus.NewCounterVec(
 			prometheus.CounterOpts{
-				Name: fmt.Sprintf("sqs_%smessage_duration", prefix),
-				Help: "The total duration (in seconds) of method called",
+				Name:        fmt.Sprintf("sqs_%smessage_duration", prefix),
+				Help:        "The total duration (in seconds) of method called",
+				ConstLabels: opts.ConstLabels,
 			},
 			messageMetricVectorLabels,
 		),
 		messageSuccess: prometheus.NewCounterVec(
 			prometheus.CounterOpts{
-				Name: fmt.Sprintf("sqs_%smessage_success", prefix),
-				Help: "The number of methods executed with success",
+				Name:        fmt.Sprintf("sqs_%smessage_success", prefix),
+				Help:        "The number of methods executed with success",
+				ConstLabels: opts.ConstLabels,
 			},
 			messageMetricVectorLabels,
 		),
 		messageFailures: prometheus.NewCounterVec(
 			prometheus.CounterOpts{
-				Name: fmt.Sprintf("sqs_%smessage_failures", prefix),
-				Help: "The number of methods executed with failures",
+				Name:        fmt.Sprintf("sqs_%smessage_failures", prefix),
+				Help:        "The number of methods executed with failures",
+				ConstLabels: opts.ConstLabels,
 			},
 			messageMetricVectorLabels,
 		),
 		messageTrafficAmount: prometheus.NewCounterVec(
 			prometheus.CounterOpts{
-				Name: fmt.Sprintf("sqs_%smessage_traffic_amount", prefix),
-				Help: "The total number of messages trafficked",
+				Name:        fmt.Sprintf("sqs_%smessage_traffic_amount", prefix),
+				Help:        "The total number of messages trafficked",
+				ConstLabels: opts.ConstLabels,
 			},
 			messageMetricVectorLabels,
 		),
 		messageTrafficSize: prometheus.NewCounterVec(
 			prometheus.CounterOpts{
-				Name: fmt.Sprintf("sqs_%smessage_traffic_size", prefix),
-				Help: "The total size (number of characters) of messages trafficked",
+				Name:        fmt.Sprintf("sqs_%smessage_traffic_size", prefix),
+				Help:        "The total size (number of characters) of messages trafficked",
+				ConstLabels: opts.ConstLabels,
+			},
+			messageMetricVectorLabels,
+		),
+		messageEmptyReceives: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name:        fmt.Sprintf("sqs_%smessage_empty_receives", prefix),
+				Help:        "The number of receives that returned no messages",
+				ConstLabels: opts.ConstLabels,
+			},
+			messageMetricVectorLabels,
+		),
+		messageRequestUnits: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name:        fmt.Sprintf("sqs_%smessage_request_units", prefix),
+				Help:        "The number of billable requests (64 KB chunks of payload) of methods called",
+				ConstLabels: opts.ConstLabels,
 			},
 			messageMetricVectorLabels,
 		),
+		messageInjectedFaults: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name:        fmt.Sprintf("sqs_%smessage_injected_faults", prefix),
+				Help:        "The number of methods called with a fault injected, by fault",
+				ConstLabels: opts.ConstLabels,
+			},
+			[]string{"queue", "method", "fault"},
+		),
+		handlerDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:        fmt.Sprintf("sqs_%sconsumer_handler_duration_seconds", prefix),
+				Help:        "The duration of the handling of messages by consumers",
+				ConstLabels: opts.ConstLabels,
+				Buckets:     opts.HandlerBuckets,
+			},
+			handlerMetricVectorLabels,
+		),
+		handlerOutcomes: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name:        fmt.Sprintf("sqs_%sconsumer_messages_handled", prefix),
+				Help:        "The number of messages handled by consumers, by outcome",
+				ConstLabels: opts.ConstLabels,
+			},
+			[]string{"queue", "type", "outcome"},
+		),
+		handlerDeadLetter: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name:        fmt.Sprintf("sqs_%sconsumer_messages_dead_lettered", prefix),
+				Help:        "The number of messages moved to the dead letter queue by consumers, by reason",
+				ConstLabels: opts.ConstLabels,
+			},
+			[]string{"queue", "type", "reason"},
+		),
+		handlerInFlight: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name:        fmt.Sprintf("sqs_%sconsumer_messages_in_flight", prefix),
+				Help:        "The number of messages being handled by consumers",
+				ConstLabels: opts.ConstLabels,
+			},
+			handlerMetricVectorLabels,
+		),
+		workers: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name:        fmt.Sprintf("sqs_%sconsumer_workers", prefix),
+				Help:        "The number of workers of consumers",
+				ConstLabels: opts.ConstLabels,
+			},
+			[]string{"queue"},
+		),
+		workerUtilization: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name:        fmt.Sprintf("sqs_%sconsumer_worker_utilization", prefix),
+				Help:        "The ratio of busy workers of consumers",
+				ConstLabels: opts.ConstLabels,
+			},
+			[]string{"queue"},
+		),
+		serviceRunning: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name:        fmt.Sprintf("sqs_%sservice_running", prefix),
+				Help:        "If the service is running (1) or not (0)",
+				ConstLabels: opts.ConstLabels,
+			},
+			[]string{"queue"},
+		),
+		serviceActions: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name:        fmt.Sprintf("sqs_%sservice_actions", prefix),
+				Help:        "The number of starts, stops and restarts of the service, by outcome",
+				ConstLabels: opts.ConstLabels,
+			},
+			[]string{"queue", "action", "outcome"},
+		),
+		serviceValidationDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:        fmt.Sprintf("sqs_%sservice_queue_validation_duration_seconds", prefix),
+				Help:        "The duration of the validation of the queue when starting the service",
+				ConstLabels: opts.ConstLabels,
+			},
+			[]string{"queue"},
+		),
+		queueAttributeDrift: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name:        fmt.Sprintf("sqs_%squeue_attribute_drift", prefix),
+				Help:        "If the attribute of the queue differs (1) or not (0) from the configuration",
+				ConstLabels: opts.ConstLabels,
+			},
+			[]string{"queue", "attribute"},
+		),
+		queueDriftCheckFailures: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name:        fmt.Sprintf("sqs_%squeue_drift_check_failures", prefix),
+				Help:        "The number of checks of the attributes of the queue that could not read them",
+				ConstLabels: opts.ConstLabels,
+			},
+			[]string{"queue"},
+		),
+		queueLabel:          queueLabel,
+		maxQueueLabelValues: opts.MaxQueueLabelValues,
+		queues:              make(map[string]string),
+		queueLabels:         make(map[string]bool),
+		overflowed:          make(map[string]bool),
+		metrics:             make(map[messageMetricsKey]*messageMetrics),
+	}
+	if opts.Registerer != nil {
+		opts.Registerer.MustRegister(collector)
+	}
+	return collector
+}
+
+// Register registers the collector into the given registerer. Registering the
+// same collector more than once is not considered an error, so services can
+// call it every time they are started.
+func (collector *SQSServiceCollector) Register(registerer prometheus.Registerer) error {
+	err := registerer.Register(collector)
+	if are, ok := err.(prometheus.AlreadyRegisteredError); ok && are.ExistingCollector == prometheus.Collector(collector) {
+		return nil
+	}
+	return err
+}
+
+type messageMetricsKey struct {
+	queue  string
+	method string
+}
+
+// messageMetrics are the counters of a queue and method, resolved once so the
+// wrappers do not build the labels on every call.
+type messageMetrics struct {
+	calls         prometheus.Counter
+	duration      prometheus.Counter
+	success       prometheus.Counter
+	failures      prometheus.Counter
+	trafficAmount prometheus.Counter
+	trafficSize   prometheus.Counter
+	emptyReceives prometheus.Counter
+	requestUnits  prometheus.Counter
+}
+
+// Value returns the label that identifies the given queue URL.
+func (label QueueLabel) Value(queueURL string) string {
+	if label == QueueLabelName {
+		if u, err := url.Parse(queueURL); err == nil && u.Path != "" {
+			return path.Base(u.Path)
+		}
+	}
+	return queueURL
+}
+
+// queueLabelValue returns the "queue" label of a queue URL, registering it as
+// a known queue. It must be called with the lock held.
+func (collector *SQSServiceCollector) queueLabelValue(queueURL string) string {
+	if label, ok := collector.queues[queueURL]; ok {
+		return label
+	}
+
+	if collector.overflows(queueURL) {
+		if !collector.overflowed[queueURL] {
+			if len(collector.overflowed) >= maxOverflowedQueues {
+				collector.overflowed = make(map[string]bool)
+			}
+			collector.overflowed[queueURL] = true
+		}
+		return QueueLabelOverflow
+	}
+
+	label := collector.queueLabel.Value(queueURL)
+	collector.queues[queueURL] = label
+	collector.queueLabels[label] = true
+	return label
+}
+
+// overflows tells if the queue URL is above the cap of distinct "queue"
+// labels, so it is reported as QueueLabelOverflow. It must be called with the
+// lock, read or write, held.
+func (collector *SQSServiceCollector) overflows(queueURL string) bool {
+	if _, ok := collector.queues[queueURL]; ok || collector.maxQueueLabelValues <= 0 {
+		return false
+	}
+	if collector.overflowed[queueURL] {
+		return true
+	}
+	return len(collector.queueLabels) >= collector.maxQueueLabelValues && !collector.queueLabels[collector.queueLabel.Value(queueURL)]
+}
+
+// queueLabelOf returns the "queue" label of a queue URL.
+func (collector *SQSServiceCollector) queueLabelOf(queueURL string) string {
+	collector.m.RLock()
+	label, ok := collector.queues[queueURL]
+	if !ok && collector.overflowed[queueURL] {
+		label, ok = QueueLabelOverflow, true
+	}
+	collector.m.RUnlock()
+	if ok {
+		return label
+	}
+
+	collector.m.Lock()
+	defer collector.m.Unlock()
+	return collector.queueLabelValue(queueURL)
+}
+
+// messageMetrics returns the counters for the given queue URL and method. It
+// returns nil when the collector is nil.
+func (collector *SQSServiceCollector) messageMetrics(queueURL, method string) *messageMetrics {
+	if collector == nil {
+		return nil
+	}
+
+	// The queues above the cap share the metrics of the QueueLabelOverflow.
+	key := messageMetricsKey{queue: queueURL, method: method}
+	overflowKey := messageMetricsKey{queue: QueueLabelOverflow, method: method}
+	collector.m.RLock()
+	metrics, ok := collector.metrics[key]
+	if !ok && collector.overflows(queueURL) {
+		metrics, ok = collector.metrics[overflowKey]
+	}
+	collector.m.RUnlock()
+	if ok {
+		return metrics
+	}
+
+	collector.m.Lock()
+	defer collector.m.Unlock()
+
+	label := collector.queueLabelValue(queueURL)
+	if label == QueueLabelOverflow {
+		key = overflowKey
+	}
+	if metrics, ok := collector.metrics[key]; ok {
+		return metrics
+	}
+
+	metrics = &messageMetrics{
+		calls:         collector.messageCalls.WithLabelValues(label, method),
+		duration:      collector.messageDuration.WithLabelValues(label, method),
+		success:       collector.messageSuccess.WithLabelValues(label, method),
+		failures:      collector.messageFailures.WithLabelValues(label, method),
+		trafficAmount: collector.messageTrafficAmount.WithLabelValues(label, method),
+		trafficSize:   collector.messageTrafficSize.WithLabelValues(label, method),
+		emptyReceives: collector.messageEmptyReceives.WithLabelValues(label, method),
+		requestUnits:  collector.messageRequestUnits.WithLabelValues(label, method),
+	}
+	collector.metrics[key] = metrics
+	return metrics
+}
+
+// called increases the number of calls of a method. As the other helpers
+// below, it does nothing when the metrics are nil.
+func (metrics *messageMetrics) called() {
+	if metrics == nil {
+		return
+	}
+	metrics.calls.Inc()
+}
+
+// finished records the duration and the outcome of a method call.
+func (metrics *messageMetrics) finished(duration time.Duration, err error) {
+	if metrics == nil {
+		return
+	}
+	metrics.duration.Add(duration.Seconds())
+	if err != nil {
+		metrics.failures.Inc()
+	} else {
+		metrics.success.Inc()
+	}
+}
+
+// trafficked records the amount and the size of the messages trafficked by a
+// method call.
+func (metrics *messageMetrics) trafficked(amount, size int) {
+	if metrics == nil {
+		return
+	}
+	metrics.trafficAmount.Add(float64(amount))
+	if size > 0 {
+		metrics.trafficSize.Add(float64(size))
+	}
+}
+
+// Called implements Recorder.
+func (collector *SQSServiceCollector) Called(op Operation) {
+	collector.messageMetrics(op.Queue, op.Method).called()
+}
+
+// Finished implements Recorder.
+func (collector *SQSServiceCollector) Finished(op Operation, result OperationResult) {
+	metrics := collector.messageMetrics(op.Queue, op.Method)
+	metrics.finished(result.Duration, result.Err)
+	metrics.trafficked(result.Messages, result.Size)
+	metrics.billed(result.RequestUnits)
+	if result.IsEmptyReceive(op) {
+		metrics.receivedEmpty()
+	}
+	if result.Fault != "" && collector != nil {
+		collector.messageInjectedFaults.WithLabelValues(collector.queueLabelOf(op.Queue), op.Method, result.Fault).Inc()
+	}
+}
+
+// billed records the billable requests of a method call.
+func (metrics *messageMetrics) billed(units int) {
+	if metrics == nil || units == 0 {
+		return
+	}
+	metrics.requestUnits.Add(float64(units))
+}
+
+// receivedEmpty counts a receive that returned no messages.
+func (metrics *messageMetrics) receivedEmpty() {
+	if metrics == nil {
+		return
+	}
+	metrics.emptyReceives.Inc()
+}
+
+// HandlerStarted implements Recorder.
+func (collector *SQSServiceCollector) HandlerStarted(handling Handling) {
+	if collector == nil {
+		return
+	}
+	collector.handlerInFlight.WithLabelValues(collector.queueLabelOf(handling.Queue), handling.MessageType).Inc()
+}
+
+// HandlerFinished implements Recorder.
+func (collector *SQSServiceCollector) HandlerFinished(handling Handling, result HandlerResult) {
+	if collector == nil {
+		return
+	}
+	queue := collector.queueLabelOf(handling.Queue)
+	collector.handlerInFlight.WithLabelValues(queue, handling.MessageType).Dec()
+	collector.handlerDuration.WithLabelValues(queue, handling.MessageType).Observe(result.Duration.Seconds())
+	collector.handlerOutcomes.WithLabelValues(queue, handling.MessageType, string(result.Outcome)).Inc()
+	if result.Outcome == HandlerOutcomeDeadLettered {
+		collector.handlerDeadLetter.WithLabelValues(queue, handling.MessageType, string(result.DeadLetterReason)).Inc()
+	}
+}
+
+// WorkersUsed implements Recorder.
+func (collector *SQSServiceCollector) WorkersUsed(queueURL string, busy, workers int) {
+	if collector == nil {
+		return
+	}
+	queue := collector.queueLabelOf(queueURL)
+	collector.workers.WithLabelValues(queue).Set(float64(workers))
+	if workers > 0 {
+		collector.workerUtilization.WithLabelValues(queue).Set(float64(busy) / float64(workers))
+	}
+}
+
+// Lifecycle implements Recorder.
+func (collector *SQSServiceCollector) Lifecycle(event LifecycleEvent) {
+	if collector == nil {
+		return
+	}
+	queue := collector.queueLabelOf(event.Queue)
+	if event.Running {
+		collector.serviceRunning.WithLabelValues(queue).Set(1)
+	} else {
+		collector.serviceRunning.WithLabelValues(queue).Set(0)
+	}
+	outcome := "success"
+	if event.Err != nil {
+		outcome = "failure"
+	}
+	collector.serviceActions.WithLabelValues(queue, string(event.Action), outcome).Inc()
+	if event.ValidationDuration > 0 {
+		collector.serviceValidationDuration.WithLabelValues(queue).Observe(event.ValidationDuration.Seconds())
+	}
+}
+
+// Drift implements Recorder. Every checked attribute gets its gauge, so the
+// ones fixed go back to 0.
+func (collector *SQSServiceCollector) Drift(event DriftEvent) {
+	if collector == nil {
+		return
+	}
+	queue := collector.queueLabelOf(event.Queue)
+	if event.Err != nil {
+		collector.queueDriftCheckFailures.WithLabelValues(queue).Inc()
+		return
+	}
+	for _, name := range event.Checked {
+		collector.queueAttributeDrift.WithLabelValues(queue, name).Set(0)
+	}
+	for _, drift := range event.Drifts {
+		collector.queueAttributeDrift.WithLabelValues(queue, drift.Name).Set(1)
 	}
 }
 
@@ -90,6 +585,20 @@ func (collector *SQSServiceCollector) Describe(descs chan<- *prometheus.Desc) {
 	collector.messageFailures.Describe(descs)
 	collector.messageTrafficAmount.Describe(descs)
 	collector.messageTrafficSize.Describe(descs)
+	collector.messageEmptyReceives.Describe(descs)
+	collector.messageRequestUnits.Describe(descs)
+	collector.messageInjectedFaults.Describe(descs)
+	collector.handlerDuration.Describe(descs)
+	collector.handlerOutcomes.Describe(descs)
+	collector.handlerDeadLetter.Describe(descs)
+	collector.handlerInFlight.Describe(descs)
+	collector.workers.Describe(descs)
+	collector.workerUtilization.Describe(descs)
+	collector.serviceRunning.Describe(descs)
+	collector.serviceActions.Describe(descs)
+	collector.serviceValidationDuration.Describe(descs)
+	collector.queueAttributeDrift.Describe(descs)
+	collector.queueDriftCheckFailures.Describe(descs)
 }
 
 func (collector *SQSServiceCollector) Collect(metrics chan<- prometheus.Metric) {
@@ -99,4 +608,18 @@ func (collector *SQSServiceCollector) Collect(metrics chan<- prometheus.Metric)
 	collector.messageFailures.Collect(metrics)
 	collector.messageTrafficAmount.Collect(metrics)
 	collector.messageTrafficSize.Collect(metrics)
+	collector.messageEmptyReceives.Collect(metrics)
+	collector.messageRequestUnits.Collect(metrics)
+	collector.messageInjectedFaults.Collect(metrics)
+	collector.handlerDuration.Collect(metrics)
+	collector.handlerOutcomes.Collect(metrics)
+	collector.handlerDeadLetter.Collect(metrics)
+	collector.handlerInFlight.Collect(metrics)
+	collector.workers.Collect(metrics)
+	collector.workerUtilization.Collect(metrics)
+	collector.serviceRunning.Collect(metrics)
+	collector.serviceActions.Collect(metrics)
+	collector.serviceValidationDuration.Collect(metrics)
+	collector.queueAttributeDrift.Collect(metrics)
+	collector.queueDriftCheckFailures.Collect(metrics)
 }
@@ -2,10 +2,12 @@ package sqssrv
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"os"
 	"path"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/sqs"
@@ -34,6 +36,265 @@ func TestServiceCollector(t *testing.T) {
 }
 
 var _ = Describe("SQSServiceCollector", func() {
+	It("should record nothing without a collector", func() {
+		var collector *SQSServiceCollector
+		Expect(func() {
+			collector.Called(Operation{Queue: "queue", Method: MessageMetricMethodSendMessage})
+			collector.Finished(Operation{Queue: "queue", Method: MessageMetricMethodSendMessage}, OperationResult{})
+			collector.HandlerStarted(Handling{Queue: "queue"})
+			collector.HandlerFinished(Handling{Queue: "queue"}, HandlerResult{Outcome: HandlerOutcomeAcked})
+			collector.WorkersUsed("queue", 1, 2)
+			collector.Lifecycle(LifecycleEvent{Queue: "queue", Action: LifecycleActionStart, Running: true})
+			collector.Drift(DriftEvent{Queue: "queue"})
+		}).ToNot(Panic())
+	})
+
+	Context("registering", func() {
+		It("should register the collector more than once", func() {
+			registry := prometheus.NewRegistry()
+			collector := NewSQSServiceCollector(&SQSServiceCollectorOpts{})
+			Expect(collector.Register(registry)).To(Succeed())
+			Expect(collector.Register(registry)).To(Succeed())
+		})
+
+		It("should fail registering two collectors with the same prefix", func() {
+			registry := prometheus.NewRegistry()
+			Expect(NewSQSServiceCollector(&SQSServiceCollectorOpts{}).Register(registry)).To(Succeed())
+			Expect(NewSQSServiceCollector(&SQSServiceCollectorOpts{}).Register(registry)).ToNot(Succeed())
+		})
+
+		It("should register the collector automatically", func() {
+			registry := prometheus.NewRegistry()
+			collector := NewSQSServiceCollector(&SQSServiceCollectorOpts{
+				Registerer: registry,
+			})
+			Expect(registry.Unregister(collector)).To(BeTrue())
+		})
+
+		It("should panic when the automatic registration fails", func() {
+			registry := prometheus.NewRegistry()
+			NewSQSServiceCollector(&SQSServiceCollectorOpts{Registerer: registry})
+			Expect(func() {
+				NewSQSServiceCollector(&SQSServiceCollectorOpts{Registerer: registry})
+			}).To(Panic())
+		})
+	})
+
+	Context("labeling queues", func() {
+		queueURL := "http://localhost:9324/queue/queue-test"
+
+		It("should label the queue by its URL by default", func() {
+			collector := NewSQSServiceCollector(&SQSServiceCollectorOpts{})
+			collector.messageMetrics(queueURL, MessageMetricMethodSendMessage).called()
+
+			var metric dto.Metric
+			Expect(collector.messageCalls.With(prometheus.Labels{
+				"queue":  queueURL,
+				"method": MessageMetricMethodSendMessage,
+			}).Write(&metric)).To(Succeed())
+			Expect(metric.GetCounter().GetValue()).To(BeEquivalentTo(1))
+		})
+
+		It("should label the queue by its name", func() {
+			collector := NewSQSServiceCollector(&SQSServiceCollectorOpts{
+				QueueLabel: QueueLabelName,
+			})
+			collector.messageMetrics(queueURL, MessageMetricMethodSendMessage).called()
+			collector.messageMetrics("http://differenthost:9324/queue/queue-test", MessageMetricMethodSendMessage).called()
+
+			var metric dto.Metric
+			Expect(collector.messageCalls.With(prometheus.Labels{
+				"queue":  "queue-test",
+				"method": MessageMetricMethodSendMessage,
+			}).Write(&metric)).To(Succeed())
+			Expect(metric.GetCounter().GetValue()).To(BeEquivalentTo(2))
+		})
+
+		It("should reuse the counters of a queue and method", func() {
+			collector := NewSQSServiceCollector(&SQSServiceCollectorOpts{})
+			Expect(collector.messageMetrics(queueURL, MessageMetricMethodSendMessage)).To(BeIdenticalTo(collector.messageMetrics(queueURL, MessageMetricMethodSendMessage)))
+			Expect(collector.messageMetrics(queueURL, MessageMetricMethodSendMessage)).ToNot(BeIdenticalTo(collector.messageMetrics(queueURL, MessageMetricMethodReceiveMessage)))
+		})
+
+		It("should report the queues above the cap as overflow", func() {
+			collector := NewSQSServiceCollector(&SQSServiceCollectorOpts{
+				QueueLabel:          QueueLabelName,
+				MaxQueueLabelValues: 1,
+			})
+			collector.messageMetrics(queueURL, MessageMetricMethodSendMessage).called()
+			collector.messageMetrics("http://localhost:9324/queue/queue-test-2", MessageMetricMethodSendMessage).called()
+			collector.messageMetrics("http://localhost:9324/queue/queue-test-3", MessageMetricMethodSendMessage).called()
+			collector.messageMetrics(queueURL, MessageMetricMethodReceiveMessage).called()
+
+			var metric dto.Metric
+			Expect(collector.messageCalls.With(prometheus.Labels{
+				"queue":  QueueLabelOverflow,
+				"method": MessageMetricMethodSendMessage,
+			}).Write(&metric)).To(Succeed())
+			Expect(metric.GetCounter().GetValue()).To(BeEquivalentTo(2))
+
+			Expect(collector.messageCalls.With(prometheus.Labels{
+				"queue":  "queue-test",
+				"method": MessageMetricMethodReceiveMessage,
+			}).Write(&metric)).To(Succeed())
+			Expect(metric.GetCounter().GetValue()).To(BeEquivalentTo(1))
+		})
+
+		It("should reuse the counters of the overflow", func() {
+			collector := NewSQSServiceCollector(&SQSServiceCollectorOpts{
+				MaxQueueLabelValues: 1,
+			})
+			collector.messageMetrics(queueURL, MessageMetricMethodSendMessage)
+			overflow := collector.messageMetrics("http://localhost:9324/queue/queue-test-2", MessageMetricMethodSendMessage)
+			Expect(collector.messageMetrics("http://localhost:9324/queue/queue-test-3", MessageMetricMethodSendMessage)).To(BeIdenticalTo(overflow))
+			Expect(collector.metrics).To(HaveKeyWithValue(messageMetricsKey{queue: QueueLabelOverflow, method: MessageMetricMethodSendMessage}, overflow))
+			Expect(collector.metrics).To(HaveLen(2))
+		})
+
+		It("should remember a bounded number of the queues above the cap", func() {
+			collector := NewSQSServiceCollector(&SQSServiceCollectorOpts{
+				MaxQueueLabelValues: 1,
+			})
+			Expect(collector.queueLabelOf(queueURL)).To(Equal(queueURL))
+			Expect(collector.queueLabelOf("http://localhost:9324/queue/queue-test-2")).To(Equal(QueueLabelOverflow))
+			Expect(collector.overflowed).To(HaveKey("http://localhost:9324/queue/queue-test-2"))
+			Expect(collector.queues).To(HaveLen(1))
+			Expect(collector.queueLabelOf("http://localhost:9324/queue/queue-test-2")).To(Equal(QueueLabelOverflow))
+
+			for i := 0; i < 2*maxOverflowedQueues; i++ {
+				Expect(collector.queueLabelOf(fmt.Sprintf("http://localhost:9324/queue/queue-test-%d", i+3))).To(Equal(QueueLabelOverflow))
+				Expect(len(collector.overflowed)).To(BeNumerically("<=", maxOverflowedQueues))
+			}
+		})
+
+		It("should add the constant labels", func() {
+			registry := prometheus.NewRegistry()
+			collector := NewSQSServiceCollector(&SQSServiceCollectorOpts{
+				ConstLabels: prometheus.Labels{"service": "mail", "environment": "test"},
+				Registerer:  registry,
+			})
+			collector.messageMetrics(queueURL, MessageMetricMethodSendMessage).called()
+
+			families, err := registry.Gather()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(families).ToNot(BeEmpty())
+			Expect(families[0].GetName()).To(Equal("sqs_message_calls"))
+			labels := make(map[string]string)
+			for _, pair := range families[0].GetMetric()[0].GetLabel() {
+				labels[pair.GetName()] = pair.GetValue()
+			}
+			Expect(labels).To(Equal(map[string]string{
+				"service":     "mail",
+				"environment": "test",
+				"queue":       queueURL,
+				"method":      MessageMetricMethodSendMessage,
+			}))
+		})
+
+		It("should use the labeling of the configuration", func() {
+			var service SQSService
+			configuration := validConfiguration
+			configuration.CollectorQueueLabel = QueueLabelName
+			configuration.CollectorConstLabels = map[string]string{"service": "mail"}
+			Expect(service.ApplyConfiguration(configuration)).To(Succeed())
+			Expect(service.Start()).To(Succeed())
+			defer service.Stop()
+
+			_, err := service.SendMessage(&sqs.SendMessageInput{
+				MessageBody: aws.String("this is the body of the message"),
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			var metric dto.Metric
+			Expect(service.Collector.messageSuccess.With(prometheus.Labels{
+				"queue":  "queue-test",
+				"method": MessageMetricMethodSendMessage,
+			}).Write(&metric)).To(Succeed())
+			Expect(metric.GetCounter().GetValue()).To(BeEquivalentTo(1))
+		})
+	})
+
+	Context("service lifecycle", func() {
+		var service *SQSService
+
+		BeforeEach(func() {
+			service = &SQSService{}
+			Expect(service.ApplyConfiguration(&validConfiguration)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			Expect(service.Stop()).To(Succeed())
+		})
+
+		running := func() float64 {
+			var metric dto.Metric
+			Expect(service.Collector.serviceRunning.WithLabelValues(service.Configuration.QUrl).Write(&metric)).To(Succeed())
+			return metric.GetGauge().GetValue()
+		}
+
+		actions := func(action LifecycleAction, outcome string) float64 {
+			var metric dto.Metric
+			Expect(service.Collector.serviceActions.WithLabelValues(service.Configuration.QUrl, string(action), outcome).Write(&metric)).To(Succeed())
+			return metric.GetCounter().GetValue()
+		}
+
+		It("should report the service running after starting", func() {
+			Expect(service.Start()).To(Succeed())
+			Expect(running()).To(BeEquivalentTo(1))
+			Expect(actions(LifecycleActionStart, "success")).To(BeEquivalentTo(1))
+
+			var metric dto.Metric
+			Expect(service.Collector.serviceValidationDuration.WithLabelValues(service.Configuration.QUrl).(prometheus.Histogram).Write(&metric)).To(Succeed())
+			Expect(metric.GetHistogram().GetSampleCount()).To(BeEquivalentTo(1))
+			Expect(metric.GetHistogram().GetSampleSum()).To(BeNumerically(">", 0))
+		})
+
+		It("should time only the validation of the queue", func() {
+			service.Configuration.Drift = &DriftConfiguration{
+				Attributes: QueueAttributes{VisibilityTimeout: duration(30 * time.Second)},
+				Logger:     log.New(GinkgoWriter, "", 0),
+			}
+			service.Configuration.Interceptors = []Interceptor{
+				func(ctx context.Context, op Operation, input interface{}, next Invoker) (interface{}, error) {
+					if op.Method == MessageMetricMethodGetQueueAttributes {
+						time.Sleep(200 * time.Millisecond)
+					}
+					return next(ctx, op, input)
+				},
+			}
+			Expect(service.Start()).To(Succeed())
+
+			var metric dto.Metric
+			Expect(service.Collector.serviceValidationDuration.WithLabelValues(service.Configuration.QUrl).(prometheus.Histogram).Write(&metric)).To(Succeed())
+			Expect(metric.GetHistogram().GetSampleCount()).To(BeEquivalentTo(1))
+			Expect(metric.GetHistogram().GetSampleSum()).To(BeNumerically("<", 0.2))
+		})
+
+		It("should report the service stopped", func() {
+			Expect(service.Start()).To(Succeed())
+			Expect(service.Stop()).To(Succeed())
+			Expect(running()).To(BeEquivalentTo(0))
+			Expect(actions(LifecycleActionStop, "success")).To(BeEquivalentTo(1))
+		})
+
+		It("should count the restarts", func() {
+			Expect(service.Start()).To(Succeed())
+			Expect(service.Restart()).To(Succeed())
+			Expect(service.Restart()).To(Succeed())
+			Expect(running()).To(BeEquivalentTo(1))
+			Expect(actions(LifecycleActionRestart, "success")).To(BeEquivalentTo(2))
+			Expect(actions(LifecycleActionStart, "success")).To(BeEquivalentTo(3))
+		})
+
+		It("should count the failed starts", func() {
+			service.Configuration.QUrl = "http://localhost:9324/queue/queue-that-does-not-exist"
+			Expect(service.Start()).ToNot(Succeed())
+			Expect(running()).To(BeEquivalentTo(0))
+			Expect(actions(LifecycleActionStart, "failure")).To(BeEquivalentTo(1))
+			Expect(actions(LifecycleActionStart, "success")).To(BeEquivalentTo(0))
+		})
+	})
+
 	Context("testing prometheus metrics", func() {
 		InitForTesting()
 
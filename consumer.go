@@ -0,0 +1,342 @@
+package sqssrv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	rscsrv "github.com/lab259/go-rscsrv"
+)
+
+// Handler processes the messages of a Consumer. Returning nil acks the
+// message, which is deleted. Returning an error nacks it, leaving it to be
+// received again once its visibility timeout expires.
+type Handler interface {
+	HandleMessage(ctx context.Context, message *sqs.Message) error
+}
+
+// HandlerFunc is a function used as Handler.
+type HandlerFunc func(ctx context.Context, message *sqs.Message) error
+
+// HandleMessage implements Handler.
+func (f HandlerFunc) HandleMessage(ctx context.Context, message *sqs.Message) error {
+	return f(ctx, message)
+}
+
+// ErrNoHandler is returned by Run when the ConsumerOpts has no Handler.
+var ErrNoHandler = errors.New("the consumer has no handler")
+
+// PanicError is the error passed to the ErrorHandler of the Poller of a
+// Consumer when its handler panics.
+type PanicError struct {
+	// Value is the value the handler panicked with.
+	Value interface{}
+	// Stack is the stack trace of the panic.
+	Stack []byte
+}
+
+func (err *PanicError) Error() string {
+	return fmt.Sprintf("the handler panicked: %v", err.Value)
+}
+
+// Unwrap returns the value the handler panicked with, if it is an error.
+func (err *PanicError) Unwrap() error {
+	if cause, ok := err.Value.(error); ok {
+		return cause
+	}
+	return nil
+}
+
+// MessageAttributeType returns a ConsumerOpts.MessageType that uses the
+// string message attribute with the given name as the type of the messages.
+func MessageAttributeType(name string) func(message *sqs.Message) string {
+	return func(message *sqs.Message) string {
+		if attribute, ok := message.MessageAttributes[name]; ok {
+			return aws.StringValue(attribute.StringValue)
+		}
+		return ""
+	}
+}
+
+// ConsumerOpts configures a Consumer.
+type ConsumerOpts struct {
+	// Poller configures how the messages are received. Its Handler is set by
+	// the consumer, and its ErrorHandler also receives the errors handling
+	// the messages, e.g. a PanicError.
+	Poller PollerOpts
+	// Workers is the number of messages handled concurrently. Default: 1.
+	Workers int
+	// Timeout, when set, is the time a handler has to process a message. Its
+	// context is canceled after that and the message is not deleted.
+	Timeout time.Duration
+	// MessageType, when set, classifies the messages for the "type" label of
+	// the metrics. Keep the number of types low.
+	MessageType func(message *sqs.Message) string
+	// Handler processes the messages. Required.
+	Handler Handler
+	// Retry, when set, re-sends the messages whose handling failed (nacked,
+	// panicked or timed out) with escalating delays. The retry queues, if
+	// any, are consumed too. Default: the Retry of the configuration of the
+	// service.
+	Retry *RetryPolicy
+	// DeadLetter, when set, moves the messages received too many times, or
+	// whose handler returned a PermanentError, to a dead letter queue,
+	// annotated with why they failed. Default: the DeadLetter of the
+	// configuration of the service.
+	DeadLetter *DeadLetterPolicy
+	// Name identifies the handler in the DeadLetterAttributeHandler of the
+	// dead-lettered messages. Default: the name of the function of a
+	// HandlerFunc, or the type of the Handler.
+	Name string
+}
+
+// Consumer receives the messages of a queue, using a Poller, and hands them
+// to a pool of workers running the Handler. The handling is reported to the
+// Recorder of the service: its duration, outcome, the messages in flight and
+// the utilization of the workers.
+//
+// With a RetryPolicy, the failed messages that were re-sent are reported as
+// HandlerOutcomeRetried or HandlerOutcomeParked instead. With a
+// DeadLetterPolicy, the poison messages are reported as
+// HandlerOutcomeDeadLettered, with their DeadLetterReason.
+type Consumer struct {
+	service  *SQSService
+	opts     ConsumerOpts
+	queueURL string
+
+	m    sync.Mutex
+	busy int
+}
+
+// NewConsumer creates a Consumer for the service.
+func NewConsumer(service *SQSService, opts *ConsumerOpts) *Consumer {
+	consumer := &Consumer{
+		service: service,
+		opts:    *opts,
+	}
+	if consumer.opts.Workers < 1 {
+		consumer.opts.Workers = 1
+	}
+	consumer.queueURL = consumer.opts.Poller.QueueURL
+	if consumer.queueURL == "" {
+		consumer.queueURL = service.Configuration.QUrl
+	}
+	if consumer.opts.Retry == nil {
+		consumer.opts.Retry = service.Configuration.Retry
+	}
+	if consumer.opts.DeadLetter == nil {
+		consumer.opts.DeadLetter = service.Configuration.DeadLetter
+	}
+	if consumer.opts.Name == "" && consumer.opts.Handler != nil {
+		consumer.opts.Name = handlerName(consumer.opts.Handler)
+	}
+	return consumer
+}
+
+// receivedMessage is a message and the queue it was received from.
+type receivedMessage struct {
+	queueURL string
+	message  *sqs.Message
+}
+
+// Run consumes the queue, and the retry queues, until the context is done,
+// waiting for the messages being handled. It fails with
+// `rscsrv.ErrServiceNotRunning` if the service was not started, and with
+// ErrNoHandler without a Handler.
+func (consumer *Consumer) Run(ctx context.Context) error {
+	if !consumer.service.isRunning() {
+		return rscsrv.ErrServiceNotRunning
+	}
+	if consumer.opts.Handler == nil {
+		return ErrNoHandler
+	}
+	queueURLs := []string{consumer.queueURL}
+	if consumer.opts.Retry != nil {
+		if err := consumer.opts.Retry.Validate(); err != nil {
+			return err
+		}
+		if err := consumer.opts.Retry.validateQueue(consumer.queueURL); err != nil {
+			return err
+		}
+		queueURLs = append(queueURLs, consumer.opts.Retry.Queues...)
+	}
+	if consumer.opts.DeadLetter != nil {
+		if err := consumer.opts.DeadLetter.Validate(); err != nil {
+			return err
+		}
+	}
+
+	messages := make(chan receivedMessage)
+	var wg sync.WaitGroup
+	wg.Add(consumer.opts.Workers)
+	for i := 0; i < consumer.opts.Workers; i++ {
+		go func() {
+			defer wg.Done()
+			for received := range messages {
+				consumer.handle(ctx, received.queueURL, received.message)
+			}
+		}()
+	}
+	consumer.service.getRecorder().WorkersUsed(consumer.queueURL, 0, consumer.opts.Workers)
+
+	errs := make(chan error, len(queueURLs))
+	for _, queueURL := range queueURLs {
+		pollerOpts := consumer.opts.Poller
+		pollerOpts.QueueURL = queueURL
+		pollerOpts.Handler = func(ctx context.Context, received []*sqs.Message) {
+			for _, message := range received {
+				select {
+				case messages <- receivedMessage{queueURL: pollerOpts.QueueURL, message: message}:
+				case <-ctx.Done():
+					// The message is received again once its visibility
+					// timeout expires.
+					return
+				}
+			}
+		}
+		go func(poller *Poller) {
+			errs <- poller.Run(ctx)
+		}(NewPoller(consumer.service, &pollerOpts))
+	}
+	var err error
+	for range queueURLs {
+		if pollerErr := <-errs; pollerErr != nil && err == nil {
+			err = pollerErr
+		}
+	}
+
+	close(messages)
+	wg.Wait()
+	return err
+}
+
+// working updates the number of busy workers.
+func (consumer *Consumer) working(delta int) {
+	consumer.m.Lock()
+	consumer.busy += delta
+	busy := consumer.busy
+	consumer.m.Unlock()
+
+	consumer.service.getRecorder().WorkersUsed(consumer.queueURL, busy, consumer.opts.Workers)
+}
+
+func (consumer *Consumer) handle(ctx context.Context, queueURL string, message *sqs.Message) {
+	consumer.working(1)
+	defer consumer.working(-1)
+
+	handling := Handling{Queue: queueURL}
+	if consumer.opts.MessageType != nil {
+		handling.MessageType = consumer.opts.MessageType(message)
+	}
+	recorder := consumer.service.getRecorder()
+	recorder.HandlerStarted(handling)
+
+	start := time.Now()
+	result := consumer.run(ctx, queueURL, message)
+	result.Duration = time.Since(start)
+	recorder.HandlerFinished(handling, result)
+}
+
+// run runs the handler, deleting the message if it succeeds, or retrying it
+// if it fails. The poison messages are dead-lettered instead.
+func (consumer *Consumer) run(ctx context.Context, queueURL string, message *sqs.Message) HandlerResult {
+	if policy := consumer.opts.DeadLetter; policy != nil && policy.exceeded(message) {
+		err := fmt.Errorf("the message was received %d times, more than the %d allowed", receiveCount(message), policy.MaxReceiveCount)
+		if result, ok := consumer.deadLetter(queueURL, message, DeadLetterReasonMaxReceiveCount, err); ok {
+			return result
+		}
+		return HandlerResult{Outcome: HandlerOutcomeNacked}
+	}
+
+	handlerCtx := ctx
+	if consumer.opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		handlerCtx, cancel = context.WithTimeout(ctx, consumer.opts.Timeout)
+		defer cancel()
+	}
+
+	var panicErr *PanicError
+	panicked := true
+	err := func() error {
+		defer func() {
+			if panicked {
+				panicErr = &PanicError{Value: recover(), Stack: debug.Stack()}
+			}
+		}()
+		err := consumer.opts.Handler.HandleMessage(handlerCtx, message)
+		panicked = false
+		return err
+	}()
+	if panicked {
+		consumer.error(panicErr)
+		return consumer.retry(queueURL, message, HandlerOutcomePanicked)
+	}
+	if handlerCtx.Err() == context.DeadlineExceeded {
+		return consumer.retry(queueURL, message, HandlerOutcomeTimedOut)
+	}
+	if permanent := permanentError(err); permanent != nil && consumer.opts.DeadLetter != nil {
+		if result, ok := consumer.deadLetter(queueURL, message, permanent.Reason, permanent.Err); ok {
+			return result
+		}
+	}
+	if err != nil {
+		return consumer.retry(queueURL, message, HandlerOutcomeNacked)
+	}
+
+	// The message is deleted even if the consumer is being stopped, as it was
+	// already processed.
+	_, err = consumer.service.DeleteMessage(&sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(queueURL),
+		ReceiptHandle: message.ReceiptHandle,
+	})
+	if err != nil {
+		consumer.error(err)
+		return HandlerResult{Outcome: HandlerOutcomeNacked}
+	}
+	return HandlerResult{Outcome: HandlerOutcomeAcked}
+}
+
+// deadLetter moves the message to the queue of the DeadLetterPolicy, telling
+// if it was moved. As the deletion, it is done even if the consumer is being
+// stopped.
+func (consumer *Consumer) deadLetter(queueURL string, message *sqs.Message, reason DeadLetterReason, cause error) (HandlerResult, bool) {
+	err := consumer.service.deadLetter(context.Background(), consumer.opts.DeadLetter, &deadLetterAnnotation{
+		Reason:  reason,
+		Err:     cause,
+		Handler: consumer.opts.Name,
+		Queue:   queueURL,
+	}, message)
+	if err != nil {
+		consumer.error(err)
+		return HandlerResult{}, false
+	}
+	return HandlerResult{Outcome: HandlerOutcomeDeadLettered, DeadLetterReason: reason}, true
+}
+
+// retry re-sends the failed message according to the RetryPolicy, returning
+// the outcome of the handler when it was not re-sent. As the deletion, the
+// retry is done even if the consumer is being stopped.
+func (consumer *Consumer) retry(queueURL string, message *sqs.Message, outcome HandlerOutcome) HandlerResult {
+	if consumer.opts.Retry == nil {
+		return HandlerResult{Outcome: outcome}
+	}
+	retried, err := consumer.service.retryMessage(context.Background(), consumer.opts.Retry, queueURL, message)
+	if err != nil {
+		consumer.error(err)
+	}
+	if retried == HandlerOutcomeNacked {
+		return HandlerResult{Outcome: outcome}
+	}
+	return HandlerResult{Outcome: retried}
+}
+
+func (consumer *Consumer) error(err error) {
+	if consumer.opts.Poller.ErrorHandler != nil {
+		consumer.opts.Poller.ErrorHandler(err)
+	}
+}
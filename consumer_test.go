@@ -0,0 +1,223 @@
+package sqssrv
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	rscsrv "github.com/lab259/go-rscsrv"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var _ = Describe("Consumer", func() {
+	It("should fail when the service is not running", func() {
+		consumer := NewConsumer(&SQSService{}, &ConsumerOpts{})
+		Expect(consumer.Run(context.Background())).To(Equal(rscsrv.ErrServiceNotRunning))
+	})
+
+	It("should fail without a handler", func() {
+		service := &SQSService{}
+		Expect(service.ApplyConfiguration(&validConfiguration)).To(Succeed())
+		queue, err := NewTestQueue(service, nil)
+		Expect(err).ToNot(HaveOccurred())
+		defer func() {
+			Expect(queue.Close()).To(Succeed())
+		}()
+
+		consumer := NewConsumer(service, &ConsumerOpts{})
+		Expect(consumer.Run(context.Background())).To(Equal(ErrNoHandler))
+	})
+
+	Context("consuming", func() {
+		var (
+			cancel context.CancelFunc
+			done   chan struct{}
+		)
+
+		run := func(opts *ConsumerOpts) {
+			opts.Poller.WaitTimeSeconds = 1
+			opts.Poller.MinBackoff = 10 * time.Millisecond
+			consumer := NewConsumer(sqsService, opts)
+
+			var ctx context.Context
+			ctx, cancel = context.WithCancel(context.Background())
+			done = make(chan struct{})
+			go func() {
+				defer GinkgoRecover()
+				defer close(done)
+				Expect(consumer.Run(ctx)).To(Succeed())
+			}()
+		}
+
+		send := func(body string, attributes map[string]*sqs.MessageAttributeValue) {
+			_, err := sqsService.SendMessage(&sqs.SendMessageInput{
+				MessageBody:       aws.String(body),
+				MessageAttributes: attributes,
+			})
+			Expect(err).ToNot(HaveOccurred())
+		}
+
+		handled := func(messageType string, outcome HandlerOutcome) func() float64 {
+			return func() float64 {
+				var metric dto.Metric
+				Expect(sqsService.Collector.handlerOutcomes.WithLabelValues(sqsService.Configuration.QUrl, messageType, string(outcome)).Write(&metric)).To(Succeed())
+				return metric.GetCounter().GetValue()
+			}
+		}
+
+		gauge := func(vector *prometheus.GaugeVec, labels ...string) func() float64 {
+			return func() float64 {
+				var metric dto.Metric
+				Expect(vector.WithLabelValues(labels...).Write(&metric)).To(Succeed())
+				return metric.GetGauge().GetValue()
+			}
+		}
+
+		// Declared before InitForTesting, so the consumer is stopped before
+		// the service.
+		AfterEach(func() {
+			cancel()
+			Eventually(done, 5*time.Second).Should(BeClosed())
+		})
+
+		InitForTesting()
+
+		It("should delete the messages handled with success", func() {
+			bodies := make(chan string, 10)
+			run(&ConsumerOpts{
+				Workers: 2,
+				Handler: HandlerFunc(func(ctx context.Context, message *sqs.Message) error {
+					bodies <- aws.StringValue(message.Body)
+					return nil
+				}),
+			})
+			send("message 1", nil)
+			send("message 2", nil)
+
+			Eventually(handled("", HandlerOutcomeAcked), 5*time.Second).Should(BeEquivalentTo(2))
+			Expect(bodies).To(HaveLen(2))
+			Eventually(gauge(sqsService.Collector.handlerInFlight, sqsService.Configuration.QUrl, "")).Should(BeEquivalentTo(0))
+
+			var metric dto.Metric
+			Expect(sqsService.Collector.handlerDuration.WithLabelValues(sqsService.Configuration.QUrl, "").(prometheus.Histogram).Write(&metric)).To(Succeed())
+			Expect(metric.GetHistogram().GetSampleCount()).To(BeEquivalentTo(2))
+
+			output, err := sqsService.ReceiveMessage(&sqs.ReceiveMessageInput{
+				WaitTimeSeconds: aws.Int64(0),
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(output.Messages).To(BeEmpty())
+		})
+
+		It("should nack the messages when the handler fails", func() {
+			run(&ConsumerOpts{
+				Handler: HandlerFunc(func(ctx context.Context, message *sqs.Message) error {
+					return errors.New("failed")
+				}),
+			})
+			send("message 1", nil)
+
+			Eventually(handled("", HandlerOutcomeNacked), 5*time.Second).Should(BeEquivalentTo(1))
+			Expect(handled("", HandlerOutcomeAcked)()).To(BeEquivalentTo(0))
+		})
+
+		It("should recover the handlers that panic", func() {
+			errs := make(chan error, 1)
+			run(&ConsumerOpts{
+				Handler: HandlerFunc(func(ctx context.Context, message *sqs.Message) error {
+					panic("failed")
+				}),
+				Poller: PollerOpts{
+					ErrorHandler: func(err error) {
+						errs <- err
+					},
+				},
+			})
+			send("message 1", nil)
+
+			Eventually(handled("", HandlerOutcomePanicked), 5*time.Second).Should(BeEquivalentTo(1))
+			var err error
+			Eventually(errs).Should(Receive(&err))
+			Expect(err).To(MatchError("the handler panicked: failed"))
+			Expect(err.(*PanicError).Value).To(Equal("failed"))
+			Expect(string(err.(*PanicError).Stack)).To(ContainSubstring("consumer_test.go"))
+		})
+
+		It("should time the handlers out", func() {
+			run(&ConsumerOpts{
+				Timeout: 10 * time.Millisecond,
+				Handler: HandlerFunc(func(ctx context.Context, message *sqs.Message) error {
+					<-ctx.Done()
+					return ctx.Err()
+				}),
+			})
+			send("message 1", nil)
+
+			Eventually(handled("", HandlerOutcomeTimedOut), 5*time.Second).Should(BeEquivalentTo(1))
+		})
+
+		It("should label the metrics with the type of the messages", func() {
+			run(&ConsumerOpts{
+				MessageType: MessageAttributeType("type"),
+				Handler: HandlerFunc(func(ctx context.Context, message *sqs.Message) error {
+					return nil
+				}),
+			})
+			send("message 1", map[string]*sqs.MessageAttributeValue{
+				"type": {DataType: aws.String("String"), StringValue: aws.String("welcome")},
+			})
+
+			Eventually(handled("welcome", HandlerOutcomeAcked), 5*time.Second).Should(BeEquivalentTo(1))
+		})
+
+		It("should report the messages in flight and the utilization of the workers", func() {
+			release := make(chan struct{})
+			run(&ConsumerOpts{
+				Workers: 4,
+				Handler: HandlerFunc(func(ctx context.Context, message *sqs.Message) error {
+					<-release
+					return nil
+				}),
+			})
+			send("message 1", nil)
+			send("message 2", nil)
+
+			Eventually(gauge(sqsService.Collector.handlerInFlight, sqsService.Configuration.QUrl, ""), 5*time.Second).Should(BeEquivalentTo(2))
+			Expect(gauge(sqsService.Collector.workers, sqsService.Configuration.QUrl)()).To(BeEquivalentTo(4))
+			Expect(gauge(sqsService.Collector.workerUtilization, sqsService.Configuration.QUrl)()).To(BeEquivalentTo(0.5))
+
+			close(release)
+			Eventually(gauge(sqsService.Collector.handlerInFlight, sqsService.Configuration.QUrl, ""), 5*time.Second).Should(BeEquivalentTo(0))
+			Eventually(gauge(sqsService.Collector.workerUtilization, sqsService.Configuration.QUrl)).Should(BeEquivalentTo(0))
+		})
+
+		It("should expose the consumer metrics through the collector registration", func() {
+			registry := prometheus.NewRegistry()
+			Expect(sqsService.Collector.Register(registry)).To(Succeed())
+			run(&ConsumerOpts{
+				Handler: HandlerFunc(func(ctx context.Context, message *sqs.Message) error {
+					return nil
+				}),
+			})
+			send("message 1", nil)
+			Eventually(handled("", HandlerOutcomeAcked), 5*time.Second).Should(BeEquivalentTo(1))
+
+			families, err := registry.Gather()
+			Expect(err).ToNot(HaveOccurred())
+			var names []string
+			for _, family := range families {
+				names = append(names, family.GetName())
+			}
+			Expect(names).To(ContainElement("sqs_consumer_handler_duration_seconds"))
+			Expect(names).To(ContainElement("sqs_consumer_messages_handled"))
+			Expect(names).To(ContainElement("sqs_consumer_messages_in_flight"))
+			Expect(names).To(ContainElement("sqs_consumer_workers"))
+			Expect(names).To(ContainElement("sqs_consumer_worker_utilization"))
+		})
+	})
+})
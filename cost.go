@@ -0,0 +1,33 @@
+package sqssrv
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// RequestUnitSize is the size of the payload chunks SQS bills as one request
+// each.
+const RequestUnitSize = 64 * 1024
+
+// RequestUnits returns how many requests SQS bills for a call carrying the
+// given payload size, in bytes. Every call is billed at least once, even when
+// it carries nothing, like an empty receive.
+func RequestUnits(payload int) int {
+	if payload <= RequestUnitSize {
+		return 1
+	}
+	return (payload + RequestUnitSize - 1) / RequestUnitSize
+}
+
+// messageAttributesSize returns the size of the message attributes as
+// counted by SQS: the name, type and value of each one.
+func messageAttributesSize(attributes map[string]*sqs.MessageAttributeValue) int {
+	size := 0
+	for name, attribute := range attributes {
+		if attribute == nil {
+			continue
+		}
+		size += len(name) + len(aws.StringValue(attribute.DataType)) + len(aws.StringValue(attribute.StringValue)) + len(attribute.BinaryValue)
+	}
+	return size
+}
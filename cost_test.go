@@ -0,0 +1,81 @@
+package sqssrv
+
+import (
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var _ = Describe("Request units", func() {
+	It("should bill every 64 KB chunk of payload", func() {
+		Expect(RequestUnits(0)).To(Equal(1))
+		Expect(RequestUnits(1)).To(Equal(1))
+		Expect(RequestUnits(RequestUnitSize)).To(Equal(1))
+		Expect(RequestUnits(RequestUnitSize + 1)).To(Equal(2))
+		Expect(RequestUnits(4 * RequestUnitSize)).To(Equal(4))
+	})
+
+	It("should count the name, type and value of the message attributes", func() {
+		Expect(messageAttributesSize(map[string]*sqs.MessageAttributeValue{
+			"type":  {DataType: aws.String("String"), StringValue: aws.String("welcome")},
+			"image": {DataType: aws.String("Binary"), BinaryValue: []byte{1, 2, 3}},
+		})).To(Equal(4 + 6 + 7 + 5 + 6 + 3))
+	})
+
+	Context("recording", func() {
+		InitForTesting()
+
+		requestUnits := func(method string) float64 {
+			var metric dto.Metric
+			Expect(sqsService.Collector.messageRequestUnits.With(prometheus.Labels{
+				"queue":  sqsService.Configuration.QUrl,
+				"method": method,
+			}).Write(&metric)).To(Succeed())
+			return metric.GetCounter().GetValue()
+		}
+
+		It("should bill a large message more than once", func() {
+			_, err := sqsService.SendMessage(&sqs.SendMessageInput{
+				MessageBody: aws.String(strings.Repeat("a", RequestUnitSize+1)),
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(requestUnits(MessageMetricMethodSendMessage)).To(BeEquivalentTo(2))
+		})
+
+		It("should bill a batch of small messages once", func() {
+			var entries []*sqs.SendMessageBatchRequestEntry
+			for _, id := range []string{"1", "2", "3", "4", "5"} {
+				entries = append(entries, &sqs.SendMessageBatchRequestEntry{
+					Id:          aws.String(id),
+					MessageBody: aws.String("testing this body " + id),
+				})
+			}
+			_, err := sqsService.SendMessageBatch(&sqs.SendMessageBatchInput{
+				Entries: entries,
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(requestUnits(MessageMetricMethodSendMessageBatch)).To(BeEquivalentTo(1))
+		})
+
+		It("should bill the empty receives", func() {
+			_, err := sqsService.ReceiveMessage(&sqs.ReceiveMessageInput{
+				WaitTimeSeconds: aws.Int64(0),
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(requestUnits(MessageMetricMethodReceiveMessage)).To(BeEquivalentTo(1))
+		})
+
+		It("should bill the queue management operations", func() {
+			// Start lists the queues.
+			Expect(requestUnits(MessageMetricMethodListQueues)).To(BeEquivalentTo(1))
+			_, err := sqsService.PurgeQueue(&sqs.PurgeQueueInput{})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(requestUnits(MessageMetricMethodPurgeQueue)).To(BeEquivalentTo(1))
+		})
+	})
+})
@@ -0,0 +1,269 @@
+package sqssrv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// DeadLetterReason is why a message was dead-lettered by a Consumer.
+type DeadLetterReason string
+
+const (
+	// DeadLetterReasonMaxReceiveCount means the message was received more than
+	// the DeadLetterPolicy.MaxReceiveCount, so it was not handled again.
+	DeadLetterReasonMaxReceiveCount DeadLetterReason = "max_receive_count"
+	// DeadLetterReasonPermanentError means the handler returned a
+	// PermanentError.
+	DeadLetterReasonPermanentError DeadLetterReason = "permanent_error"
+	// DeadLetterReasonDecodeError means the handler could not decode the
+	// message, returning a DecodeError.
+	DeadLetterReasonDecodeError DeadLetterReason = "decode_error"
+)
+
+// The message attributes added to the dead-lettered messages. SQS allows 10
+// message attributes per message: the original ones are kept, and these take
+// the slots left, in this order. The DeadLetterAttributeReason is always
+// added: when the message has no slot left, it takes the one of the original
+// attribute whose name sorts last.
+const (
+	// DeadLetterAttributeReason is the DeadLetterReason.
+	DeadLetterAttributeReason = "dead_letter_reason"
+	// DeadLetterAttributeError is the error returned by the handler.
+	DeadLetterAttributeError = "dead_letter_error"
+	// DeadLetterAttributeHandler is the ConsumerOpts.Name.
+	DeadLetterAttributeHandler = "dead_letter_handler"
+	// DeadLetterAttributeQueue is the URL of the queue the message was
+	// received from.
+	DeadLetterAttributeQueue = "dead_letter_queue"
+	// DeadLetterAttributeReceiveCount is how many times the message was
+	// received.
+	DeadLetterAttributeReceiveCount = "dead_letter_receive_count"
+	// DeadLetterAttributeSentAt is when the message was sent to the queue, in
+	// RFC 3339.
+	DeadLetterAttributeSentAt = "dead_letter_sent_at"
+	// DeadLetterAttributeDeadLetteredAt is when the message was
+	// dead-lettered, in RFC 3339.
+	DeadLetterAttributeDeadLetteredAt = "dead_lettered_at"
+)
+
+var deadLetterAttributes = []string{
+	DeadLetterAttributeReason,
+	DeadLetterAttributeError,
+	DeadLetterAttributeHandler,
+	DeadLetterAttributeQueue,
+	DeadLetterAttributeReceiveCount,
+	DeadLetterAttributeSentAt,
+	DeadLetterAttributeDeadLetteredAt,
+}
+
+// maxMessageAttributes is the maximum number of message attributes of a
+// message.
+const maxMessageAttributes = 10
+
+// maxErrorAttributeLength caps the DeadLetterAttributeError.
+const maxErrorAttributeLength = 1024
+
+// PermanentError is an error of a handler that retrying does not fix, like a
+// message that is not valid. With a DeadLetterPolicy, the message is
+// dead-lettered right away. Without one, it is nacked as any other error.
+type PermanentError struct {
+	// Err is the error of the handler.
+	Err error
+	// Reason is DeadLetterReasonPermanentError or
+	// DeadLetterReasonDecodeError.
+	Reason DeadLetterReason
+}
+
+func (err *PermanentError) Error() string {
+	return err.Err.Error()
+}
+
+// Unwrap returns the error of the handler.
+func (err *PermanentError) Unwrap() error {
+	return err.Err
+}
+
+// Permanent marks the error of a handler as permanent.
+func Permanent(err error) error {
+	return &PermanentError{Err: err, Reason: DeadLetterReasonPermanentError}
+}
+
+// DecodeError marks the error of a handler decoding a message as permanent.
+func DecodeError(err error) error {
+	return &PermanentError{Err: err, Reason: DeadLetterReasonDecodeError}
+}
+
+// permanentError returns the PermanentError in the chain of the error, nil
+// if there is none.
+func permanentError(err error) *PermanentError {
+	for err != nil {
+		if permanent, ok := err.(*PermanentError); ok {
+			return permanent
+		}
+		wrapper, ok := err.(interface{ Unwrap() error })
+		if !ok {
+			return nil
+		}
+		err = wrapper.Unwrap()
+	}
+	return nil
+}
+
+// IsPermanent tells if the error, or any error it wraps, is a
+// PermanentError.
+func IsPermanent(err error) bool {
+	return permanentError(err) != nil
+}
+
+// DeadLetterPolicy makes the consumers move the poison messages to a dead
+// letter queue, annotated with why they failed, instead of leaving them to the
+// redrive policy of the queue, which moves them silently:
+//
+//	dead_letter:
+//	  queue: https://sqs.sa-east-1.amazonaws.com/000000000000/mail-dlq
+//	  max_receive_count: 5
+type DeadLetterPolicy struct {
+	// Queue is the URL of the dead letter queue.
+	Queue string `yaml:"queue"`
+	// MaxReceiveCount, when set, dead-letters the messages received more
+	// than it, by their ApproximateReceiveCount, without handling them again.
+	// Keep it below the maxReceiveCount of the redrive policy of the queue.
+	MaxReceiveCount int `yaml:"max_receive_count"`
+}
+
+// Validate checks the policy has a queue.
+func (policy *DeadLetterPolicy) Validate() error {
+	if policy.Queue == "" {
+		return errors.New("the dead letter policy has no queue")
+	}
+	if policy.MaxReceiveCount < 0 {
+		return fmt.Errorf("the max receive count %d of the dead letter policy is negative", policy.MaxReceiveCount)
+	}
+	return nil
+}
+
+// exceeded tells if the message was received more than the MaxReceiveCount.
+func (policy *DeadLetterPolicy) exceeded(message *sqs.Message) bool {
+	return policy.MaxReceiveCount > 0 && receiveCount(message) > policy.MaxReceiveCount
+}
+
+// receiveCount returns the ApproximateReceiveCount of the message, zero if it
+// was not received with it.
+func receiveCount(message *sqs.Message) int {
+	count, _ := strconv.Atoi(aws.StringValue(message.Attributes[sqs.MessageSystemAttributeNameApproximateReceiveCount]))
+	return count
+}
+
+// deadLetterAnnotation describes why a message is dead-lettered.
+type deadLetterAnnotation struct {
+	// Reason is why the message is dead-lettered.
+	Reason DeadLetterReason
+	// Err is the error of the handler, if any.
+	Err error
+	// Handler identifies the handler of the message.
+	Handler string
+	// Queue is the URL of the queue the message was received from.
+	Queue string
+}
+
+// attributes returns the message attributes of the annotation for the
+// message.
+func (annotation *deadLetterAnnotation) attributes(message *sqs.Message, now time.Time) []messageAttribute {
+	attributes := []messageAttribute{
+		{DeadLetterAttributeReason, "String", string(annotation.Reason)},
+	}
+	if annotation.Err != nil {
+		errorMessage := annotation.Err.Error()
+		if len(errorMessage) > maxErrorAttributeLength {
+			errorMessage = errorMessage[:maxErrorAttributeLength]
+		}
+		attributes = append(attributes, messageAttribute{DeadLetterAttributeError, "String", errorMessage})
+	}
+	if annotation.Handler != "" {
+		attributes = append(attributes, messageAttribute{DeadLetterAttributeHandler, "String", annotation.Handler})
+	}
+	attributes = append(attributes, messageAttribute{DeadLetterAttributeQueue, "String", annotation.Queue})
+	if count := receiveCount(message); count > 0 {
+		attributes = append(attributes, messageAttribute{DeadLetterAttributeReceiveCount, "Number", strconv.Itoa(count)})
+	}
+	if sent, err := strconv.ParseInt(aws.StringValue(message.Attributes[sqs.MessageSystemAttributeNameSentTimestamp]), 10, 64); err == nil {
+		attributes = append(attributes, messageAttribute{DeadLetterAttributeSentAt, "String", time.Unix(0, sent*int64(time.Millisecond)).UTC().Format(time.RFC3339)})
+	}
+	return append(attributes, messageAttribute{DeadLetterAttributeDeadLetteredAt, "String", now.UTC().Format(time.RFC3339)})
+}
+
+type messageAttribute struct {
+	name, dataType, value string
+}
+
+// deadLetter moves the message to the dead letter queue of the policy,
+// annotated, deleting it from the queue it was received from only after it
+// was sent. A FIFO dead letter queue gets the message group of the message
+// and a new deduplication ID, its MessageId with a dead-letter suffix, as SQS
+// would drop a copy with the ID of a message sent to it before.
+func (service *SQSService) deadLetter(ctx context.Context, policy *DeadLetterPolicy, annotation *deadLetterAnnotation, message *sqs.Message) error {
+	annotations := annotation.attributes(message, time.Now())
+	attributes := make(map[string]*sqs.MessageAttributeValue, maxMessageAttributes)
+	for name, attribute := range message.MessageAttributes {
+		attributes[name] = attribute
+	}
+	// The annotations of a message dead-lettered before are replaced.
+	for _, name := range deadLetterAttributes {
+		delete(attributes, name)
+	}
+	if len(attributes) >= maxMessageAttributes {
+		names := make([]string, 0, len(attributes))
+		for name := range attributes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		delete(attributes, names[len(names)-1])
+	}
+	for _, attribute := range annotations {
+		if len(attributes) >= maxMessageAttributes {
+			break
+		}
+		attributes[attribute.name] = &sqs.MessageAttributeValue{
+			DataType:    aws.String(attribute.dataType),
+			StringValue: aws.String(attribute.value),
+		}
+	}
+	input := &sqs.SendMessageInput{
+		QueueUrl:          aws.String(policy.Queue),
+		MessageBody:       message.Body,
+		MessageAttributes: attributes,
+	}
+	if isFIFO(policy.Queue) {
+		input.MessageGroupId = message.Attributes[sqs.MessageSystemAttributeNameMessageGroupId]
+		input.MessageDeduplicationId = aws.String(aws.StringValue(message.MessageId) + "-dead-letter")
+	}
+	_, err := service.SendMessageWithContext(ctx, input)
+	if err != nil {
+		return err
+	}
+	_, err = service.DeleteMessageWithContext(ctx, &sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(annotation.Queue),
+		ReceiptHandle: message.ReceiptHandle,
+	})
+	return err
+}
+
+// handlerName returns the name of the function of a HandlerFunc, or the type
+// of other handlers.
+func handlerName(handler Handler) string {
+	if f, ok := handler.(HandlerFunc); ok {
+		if fn := runtime.FuncForPC(reflect.ValueOf(f).Pointer()); fn != nil {
+			return fn.Name()
+		}
+	}
+	return fmt.Sprintf("%T", handler)
+}
@@ -0,0 +1,339 @@
+package sqssrv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// failWelcome is a named handler, for the DeadLetterAttributeHandler.
+func failWelcome(ctx context.Context, message *sqs.Message) error {
+	return Permanent(errors.New("unknown user"))
+}
+
+// wrappedError wraps an error with a message, as fmt.Errorf with %w, which
+// Go 1.12 does not have.
+type wrappedError struct {
+	message string
+	err     error
+}
+
+func (err *wrappedError) Error() string {
+	return err.message + ": " + err.err.Error()
+}
+
+func (err *wrappedError) Unwrap() error {
+	return err.err
+}
+
+var _ = Describe("DeadLetter", func() {
+	It("should tell the permanent errors", func() {
+		err := &wrappedError{"handling", DecodeError(errors.New("invalid character"))}
+		Expect(IsPermanent(err)).To(BeTrue())
+		Expect(permanentError(err).Reason).To(Equal(DeadLetterReasonDecodeError))
+		Expect(err.Error()).To(Equal("handling: invalid character"))
+
+		Expect(IsPermanent(Permanent(errors.New("unknown user")))).To(BeTrue())
+		Expect(IsPermanent(errors.New("timeout"))).To(BeFalse())
+		Expect(IsPermanent(nil)).To(BeFalse())
+	})
+
+	It("should validate the policy", func() {
+		Expect((&DeadLetterPolicy{}).Validate()).To(MatchError("the dead letter policy has no queue"))
+		Expect((&DeadLetterPolicy{Queue: "dlq", MaxReceiveCount: -1}).Validate()).To(MatchError("the max receive count -1 of the dead letter policy is negative"))
+		Expect((&DeadLetterPolicy{Queue: "dlq"}).Validate()).To(Succeed())
+	})
+
+	It("should name the handlers", func() {
+		Expect(handlerName(HandlerFunc(failWelcome))).To(Equal("github.com/lab259/go-rscsrv-sqs.failWelcome"))
+		Expect(handlerName(&struct{ Handler }{})).To(Equal("*struct { sqssrv.Handler }"))
+	})
+
+	It("should dead-letter to a FIFO queue with a new deduplication ID", func() {
+		service := &SQSService{}
+		Expect(service.ApplyConfiguration(validConfiguration)).To(Succeed())
+		testQueue, err := NewTestQueue(service, &TestQueueOpts{
+			Prefix:          "sqssrv-poison",
+			FIFO:            true,
+			DeadLetterQueue: true,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		defer func() {
+			Expect(testQueue.Close()).To(Succeed())
+		}()
+		_, err = service.SendMessage(&sqs.SendMessageInput{
+			MessageBody:            aws.String("message"),
+			MessageGroupId:         aws.String("group"),
+			MessageDeduplicationId: aws.String("welcome"),
+		})
+		Expect(err).ToNot(HaveOccurred())
+		output, err := service.ReceiveMessage(&sqs.ReceiveMessageInput{
+			AttributeNames: []*string{aws.String(sqs.QueueAttributeNameAll)},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(output.Messages).To(HaveLen(1))
+		message := output.Messages[0]
+
+		policy := &DeadLetterPolicy{Queue: testQueue.DeadLetterQueueURL}
+		Expect(service.deadLetter(context.Background(), policy, &deadLetterAnnotation{
+			Reason: DeadLetterReasonPermanentError,
+			Queue:  service.Configuration.QUrl,
+		}, message)).To(Succeed())
+
+		output, err = service.ReceiveMessage(&sqs.ReceiveMessageInput{
+			QueueUrl:       aws.String(testQueue.DeadLetterQueueURL),
+			AttributeNames: []*string{aws.String(sqs.QueueAttributeNameAll)},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(output.Messages).To(HaveLen(1))
+		attributes := output.Messages[0].Attributes
+		Expect(aws.StringValue(attributes[sqs.MessageSystemAttributeNameMessageGroupId])).To(Equal("group"))
+		Expect(aws.StringValue(attributes[sqs.MessageSystemAttributeNameMessageDeduplicationId])).To(Equal(aws.StringValue(message.MessageId) + "-dead-letter"))
+	})
+
+	Context("consuming", func() {
+		var (
+			service   *SQSService
+			testQueue *TestQueue
+			dlq       string
+			cancel    context.CancelFunc
+			done      chan struct{}
+		)
+
+		BeforeEach(func() {
+			service = &SQSService{}
+			Expect(service.ApplyConfiguration(validConfiguration)).To(Succeed())
+			var err error
+			testQueue, err = NewTestQueue(service, &TestQueueOpts{
+				Prefix: "sqssrv-poison",
+				Attributes: map[string]string{
+					sqs.QueueAttributeNameVisibilityTimeout: "1",
+				},
+				DeadLetterQueue: true,
+				// Above the receives of the specs, so only the consumer
+				// dead-letters the messages.
+				MaxReceiveCount: 10,
+			})
+			Expect(err).ToNot(HaveOccurred())
+			dlq = testQueue.DeadLetterQueueURL
+		})
+
+		AfterEach(func() {
+			if cancel != nil {
+				cancel()
+				Eventually(done, 5*time.Second).Should(BeClosed())
+				cancel = nil
+			}
+			Expect(testQueue.Close()).To(Succeed())
+		})
+
+		run := func(opts *ConsumerOpts) {
+			opts.Poller.WaitTimeSeconds = 1
+			opts.Poller.MinBackoff = 10 * time.Millisecond
+			consumer := NewConsumer(service, opts)
+
+			var ctx context.Context
+			ctx, cancel = context.WithCancel(context.Background())
+			done = make(chan struct{})
+			go func() {
+				defer GinkgoRecover()
+				defer close(done)
+				Expect(consumer.Run(ctx)).To(Succeed())
+			}()
+		}
+
+		send := func(attributes map[string]*sqs.MessageAttributeValue) {
+			_, err := service.SendMessage(&sqs.SendMessageInput{
+				MessageBody:       aws.String("message"),
+				MessageAttributes: attributes,
+			})
+			Expect(err).ToNot(HaveOccurred())
+		}
+
+		deadLettered := func() []*sqs.Message {
+			output, err := service.ReceiveMessage(&sqs.ReceiveMessageInput{
+				QueueUrl:              aws.String(dlq),
+				MessageAttributeNames: []*string{aws.String(sqs.QueueAttributeNameAll)},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			return output.Messages
+		}
+
+		attribute := func(message *sqs.Message, name string) string {
+			if attribute, ok := message.MessageAttributes[name]; ok {
+				return aws.StringValue(attribute.StringValue)
+			}
+			return ""
+		}
+
+		count := func(reason DeadLetterReason) float64 {
+			var metric dto.Metric
+			Expect(service.Collector.handlerDeadLetter.WithLabelValues(service.Configuration.QUrl, "", string(reason)).Write(&metric)).To(Succeed())
+			return metric.GetCounter().GetValue()
+		}
+
+		It("should dead-letter the messages with a permanent error", func() {
+			begin := time.Now().UTC().Truncate(time.Second)
+			run(&ConsumerOpts{
+				DeadLetter: &DeadLetterPolicy{Queue: dlq},
+				Handler:    HandlerFunc(failWelcome),
+			})
+			send(map[string]*sqs.MessageAttributeValue{
+				"type": {DataType: aws.String("String"), StringValue: aws.String("welcome")},
+			})
+
+			var messages []*sqs.Message
+			Eventually(func() []*sqs.Message {
+				messages = deadLettered()
+				return messages
+			}, 5*time.Second).Should(HaveLen(1))
+			message := messages[0]
+			Expect(aws.StringValue(message.Body)).To(Equal("message"))
+			Expect(attribute(message, "type")).To(Equal("welcome"))
+			Expect(attribute(message, DeadLetterAttributeReason)).To(Equal("permanent_error"))
+			Expect(attribute(message, DeadLetterAttributeError)).To(Equal("unknown user"))
+			Expect(attribute(message, DeadLetterAttributeHandler)).To(Equal("github.com/lab259/go-rscsrv-sqs.failWelcome"))
+			Expect(attribute(message, DeadLetterAttributeQueue)).To(Equal(service.Configuration.QUrl))
+			Expect(attribute(message, DeadLetterAttributeReceiveCount)).To(Equal("1"))
+			for _, name := range []string{DeadLetterAttributeSentAt, DeadLetterAttributeDeadLetteredAt} {
+				at, err := time.Parse(time.RFC3339, attribute(message, name))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(at).To(BeTemporally(">=", begin), name)
+			}
+
+			Eventually(func() float64 { return count(DeadLetterReasonPermanentError) }).Should(BeEquivalentTo(1))
+			var metric dto.Metric
+			Expect(service.Collector.handlerOutcomes.WithLabelValues(service.Configuration.QUrl, "", string(HandlerOutcomeDeadLettered)).Write(&metric)).To(Succeed())
+			Expect(metric.GetCounter().GetValue()).To(BeEquivalentTo(1))
+
+			// The original was deleted.
+			time.Sleep(1500 * time.Millisecond)
+			output, err := service.ReceiveMessage(&sqs.ReceiveMessageInput{})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(output.Messages).To(BeEmpty())
+		})
+
+		It("should dead-letter the messages that failed decoding", func() {
+			run(&ConsumerOpts{
+				DeadLetter: &DeadLetterPolicy{Queue: dlq},
+				Name:       "welcome",
+				Handler: HandlerFunc(func(ctx context.Context, message *sqs.Message) error {
+					return &wrappedError{"decoding", DecodeError(errors.New("invalid character"))}
+				}),
+			})
+			send(nil)
+
+			var messages []*sqs.Message
+			Eventually(func() []*sqs.Message {
+				messages = deadLettered()
+				return messages
+			}, 5*time.Second).Should(HaveLen(1))
+			Expect(attribute(messages[0], DeadLetterAttributeReason)).To(Equal("decode_error"))
+			Expect(attribute(messages[0], DeadLetterAttributeError)).To(Equal("invalid character"))
+			Expect(attribute(messages[0], DeadLetterAttributeHandler)).To(Equal("welcome"))
+			Eventually(func() float64 { return count(DeadLetterReasonDecodeError) }).Should(BeEquivalentTo(1))
+		})
+
+		It("should dead-letter the messages received too many times, without handling them", func() {
+			var attempts int32
+			run(&ConsumerOpts{
+				DeadLetter: &DeadLetterPolicy{Queue: dlq, MaxReceiveCount: 2},
+				Handler: HandlerFunc(func(ctx context.Context, message *sqs.Message) error {
+					atomic.AddInt32(&attempts, 1)
+					return errors.New("timeout")
+				}),
+			})
+			send(nil)
+
+			var messages []*sqs.Message
+			Eventually(func() []*sqs.Message {
+				messages = deadLettered()
+				return messages
+			}, 10*time.Second).Should(HaveLen(1))
+			Expect(atomic.LoadInt32(&attempts)).To(BeEquivalentTo(2))
+			Expect(attribute(messages[0], DeadLetterAttributeReason)).To(Equal("max_receive_count"))
+			Expect(attribute(messages[0], DeadLetterAttributeError)).To(Equal("the message was received 3 times, more than the 2 allowed"))
+			Expect(attribute(messages[0], DeadLetterAttributeReceiveCount)).To(Equal("3"))
+			Eventually(func() float64 { return count(DeadLetterReasonMaxReceiveCount) }).Should(BeEquivalentTo(1))
+		})
+
+		It("should keep the original attributes when there is no room for all the annotations", func() {
+			attributes := make(map[string]*sqs.MessageAttributeValue)
+			for i := 0; i < 7; i++ {
+				attributes[fmt.Sprintf("attribute%d", i)] = &sqs.MessageAttributeValue{
+					DataType:    aws.String("String"),
+					StringValue: aws.String("value"),
+				}
+			}
+			// Of a message dead-lettered before.
+			attributes[DeadLetterAttributeReason] = &sqs.MessageAttributeValue{
+				DataType:    aws.String("String"),
+				StringValue: aws.String("max_receive_count"),
+			}
+			run(&ConsumerOpts{
+				DeadLetter: &DeadLetterPolicy{Queue: dlq},
+				Handler:    HandlerFunc(failWelcome),
+			})
+			send(attributes)
+
+			var messages []*sqs.Message
+			Eventually(func() []*sqs.Message {
+				messages = deadLettered()
+				return messages
+			}, 5*time.Second).Should(HaveLen(1))
+			Expect(messages[0].MessageAttributes).To(HaveLen(10))
+			Expect(attribute(messages[0], "attribute6")).To(Equal("value"))
+			Expect(attribute(messages[0], DeadLetterAttributeReason)).To(Equal("permanent_error"))
+			Expect(attribute(messages[0], DeadLetterAttributeError)).To(Equal("unknown user"))
+			Expect(attribute(messages[0], DeadLetterAttributeHandler)).ToNot(BeEmpty())
+			Expect(messages[0].MessageAttributes).ToNot(HaveKey(DeadLetterAttributeQueue))
+		})
+
+		It("should keep the reason when the message has no room for any annotation", func() {
+			attributes := make(map[string]*sqs.MessageAttributeValue)
+			for i := 0; i < maxMessageAttributes; i++ {
+				attributes[fmt.Sprintf("attribute%d", i)] = &sqs.MessageAttributeValue{
+					DataType:    aws.String("String"),
+					StringValue: aws.String("value"),
+				}
+			}
+			run(&ConsumerOpts{
+				DeadLetter: &DeadLetterPolicy{Queue: dlq},
+				Handler:    HandlerFunc(failWelcome),
+			})
+			send(attributes)
+
+			var messages []*sqs.Message
+			Eventually(func() []*sqs.Message {
+				messages = deadLettered()
+				return messages
+			}, 5*time.Second).Should(HaveLen(1))
+			Expect(messages[0].MessageAttributes).To(HaveLen(10))
+			Expect(attribute(messages[0], DeadLetterAttributeReason)).To(Equal("permanent_error"))
+			Expect(attribute(messages[0], "attribute8")).To(Equal("value"))
+			Expect(messages[0].MessageAttributes).ToNot(HaveKey("attribute9"))
+		})
+
+		It("should nack the permanent errors without a policy", func() {
+			run(&ConsumerOpts{
+				Handler: HandlerFunc(failWelcome),
+			})
+			send(nil)
+
+			Eventually(func() float64 {
+				var metric dto.Metric
+				Expect(service.Collector.handlerOutcomes.WithLabelValues(service.Configuration.QUrl, "", string(HandlerOutcomeNacked)).Write(&metric)).To(Succeed())
+				return metric.GetCounter().GetValue()
+			}, 5*time.Second).Should(BeNumerically(">=", 1))
+			Expect(deadLettered()).To(BeEmpty())
+		})
+	})
+})
@@ -0,0 +1,201 @@
+package sqssrv
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// DriftConfiguration makes the SQSService compare the attributes of its queue
+// with the expected ones, catching the changes made outside of the
+// application (e.g. in the console):
+//
+//	drift:
+//	  interval: 5m
+//	  critical:
+//	    - RedrivePolicy
+//	  attributes:
+//	    visibility_timeout: 30s
+//	    redrive_policy:
+//	      dead_letter_target_arn: arn:aws:sqs:sa-east-1:000000000000:mail-dlq
+//	      max_receive_count: 5
+//
+// The drifted attributes are logged and reported to the Recorder.
+type DriftConfiguration struct {
+	// Attributes are the expected values. Only the attributes set are
+	// compared.
+	Attributes QueueAttributes `yaml:"attributes"`
+	// Interval between the checks done after Start. Zero checks only on
+	// Start.
+	Interval time.Duration `yaml:"interval"`
+	// Critical are the SQS names of the attributes (e.g. "VisibilityTimeout")
+	// that make Start fail with a DriftError when drifted. The checks done on
+	// the Interval only report them.
+	Critical []string `yaml:"critical"`
+	// FailOnError makes Start fail when the attributes cannot be read, e.g.
+	// without the permission to GetQueueAttributes. By default, the error is
+	// only logged and reported, as the checks on the Interval do.
+	FailOnError bool `yaml:"fail_on_error"`
+	// Logger receives a line for every drifted attribute. Default: the
+	// standard logger of the `log` package.
+	Logger *log.Logger `yaml:"-"`
+}
+
+// Validate checks the expected attributes and that the critical ones are among
+// them.
+func (configuration *DriftConfiguration) Validate() error {
+	_, err := configuration.expected()
+	return err
+}
+
+// expected returns the expected attributes, as SQS represents them.
+func (configuration *DriftConfiguration) expected() (map[string]string, error) {
+	attributes, err := configuration.Attributes.Map()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range configuration.Critical {
+		if _, ok := attributes[name]; !ok {
+			return nil, fmt.Errorf("the critical attribute %s is not among the expected attributes", name)
+		}
+	}
+	return aws.StringValueMap(attributes), nil
+}
+
+func (configuration *DriftConfiguration) isCritical(name string) bool {
+	for _, critical := range configuration.Critical {
+		if critical == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (configuration *DriftConfiguration) logf(format string, v ...interface{}) {
+	if configuration.Logger != nil {
+		configuration.Logger.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
+
+// DriftError is returned by Start when critical attributes of the queue
+// drifted.
+type DriftError struct {
+	// Queue is the URL of the queue.
+	Queue string
+	// Drifts are the critical attributes that drifted.
+	Drifts []AttributeDrift
+}
+
+func (err *DriftError) Error() string {
+	names := make([]string, len(err.Drifts))
+	for i, drift := range err.Drifts {
+		names[i] = drift.Name
+	}
+	return fmt.Sprintf("the critical attributes of the queue %s drifted: %s", err.Queue, strings.Join(names, ", "))
+}
+
+// CheckDrift compares the attributes of the queue with the Drift of the
+// configuration, logging and reporting the drifted ones as Start does. It
+// returns nothing when drift detection is not configured.
+func (service *SQSService) CheckDrift(ctx context.Context) ([]AttributeDrift, error) {
+	configuration := service.Configuration.Drift
+	if configuration == nil {
+		return nil, nil
+	}
+	event := configuration.check(managementCall(ctx), service.getInvoker(), service.Configuration.QUrl)
+	configuration.report(service.getRecorder(), event)
+	return event.Drifts, event.Err
+}
+
+// check reads the expected attributes of the queue and compares them.
+func (configuration *DriftConfiguration) check(ctx context.Context, invoker Invoker, queueURL string) DriftEvent {
+	event := DriftEvent{Queue: queueURL}
+	expected, err := configuration.expected()
+	if err != nil {
+		event.Err = err
+		return event
+	}
+	names := sortedKeys(expected)
+	op := Operation{
+		Queue:  queueURL,
+		Method: MessageMetricMethodGetQueueAttributes,
+	}
+	output, err := invoker(ctx, op, &sqs.GetQueueAttributesInput{
+		QueueUrl:       aws.String(queueURL),
+		AttributeNames: aws.StringSlice(names),
+	})
+	if err != nil {
+		event.Err = err
+		return event
+	}
+	out, ok := output.(*sqs.GetQueueAttributesOutput)
+	if !ok || out == nil {
+		event.Err = unexpectedOutputError(op, output)
+		return event
+	}
+	current := aws.StringValueMap(out.Attributes)
+	event.Checked = names
+	for _, name := range names {
+		if !sameAttribute(name, current[name], expected[name]) {
+			event.Drifts = append(event.Drifts, AttributeDrift{
+				Name:     name,
+				Current:  current[name],
+				Expected: expected[name],
+				Critical: configuration.isCritical(name),
+			})
+		}
+	}
+	return event
+}
+
+// report logs the drifted attributes and sends the event to the recorder.
+func (configuration *DriftConfiguration) report(recorder Recorder, event DriftEvent) {
+	if event.Err != nil {
+		configuration.logf("sqssrv: could not check the attributes of the queue %s: %s", event.Queue, event.Err)
+	}
+	for _, drift := range event.Drifts {
+		configuration.logf("sqssrv: the %s of the queue %s drifted: %q, expected %q", drift.Name, event.Queue, drift.Current, drift.Expected)
+	}
+	recorder.Drift(event)
+}
+
+// criticalError returns the DriftError of the critical attributes drifted, if
+// any.
+func (event DriftEvent) criticalError() error {
+	var critical []AttributeDrift
+	for _, drift := range event.Drifts {
+		if drift.Critical {
+			critical = append(critical, drift)
+		}
+	}
+	if len(critical) == 0 {
+		return nil
+	}
+	return &DriftError{Queue: event.Queue, Drifts: critical}
+}
+
+// watchDrift checks the attributes of the queue on the Interval until the
+// context is done.
+func (service *SQSService) watchDrift(ctx context.Context, configuration *DriftConfiguration, invoker Invoker, queueURL string) {
+	ticker := time.NewTicker(configuration.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			event := configuration.check(ctx, invoker, queueURL)
+			if ctx.Err() != nil {
+				return
+			}
+			configuration.report(service.getRecorder(), event)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package sqssrv
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/sqs"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var _ = Describe("Drift", func() {
+	var (
+		service   *SQSService
+		testQueue *TestQueue
+		logs      *bytes.Buffer
+	)
+
+	BeforeEach(func() {
+		logs = &bytes.Buffer{}
+	})
+
+	AfterEach(func() {
+		if testQueue != nil {
+			Expect(testQueue.Close()).To(Succeed())
+		}
+		testQueue = nil
+	})
+
+	// start starts the service, with the drift detection, for a queue created
+	// with a visibility timeout of 45s.
+	start := func(drift *DriftConfiguration, faults ...FaultRule) error {
+		if drift != nil {
+			drift.Logger = log.New(logs, "", 0)
+		}
+		configuration := validConfiguration
+		configuration.Drift = drift
+		configuration.Faults = faults
+		service = &SQSService{}
+		Expect(service.ApplyConfiguration(configuration)).To(Succeed())
+		var err error
+		testQueue, err = NewTestQueue(service, &TestQueueOpts{
+			Prefix: "sqssrv-drift",
+			Attributes: map[string]string{
+				sqs.QueueAttributeNameVisibilityTimeout: "45",
+			},
+		})
+		return err
+	}
+
+	drifted := func(attribute string) float64 {
+		var metric dto.Metric
+		Expect(service.Collector.queueAttributeDrift.With(prometheus.Labels{
+			"queue":     service.Configuration.QUrl,
+			"attribute": attribute,
+		}).Write(&metric)).To(Succeed())
+		return metric.GetGauge().GetValue()
+	}
+
+	It("should start when the attributes match", func() {
+		Expect(start(&DriftConfiguration{
+			Attributes: QueueAttributes{VisibilityTimeout: duration(45 * time.Second)},
+			Critical:   []string{sqs.QueueAttributeNameVisibilityTimeout},
+		})).To(Succeed())
+		Expect(drifted(sqs.QueueAttributeNameVisibilityTimeout)).To(BeEquivalentTo(0))
+		Expect(logs.String()).To(BeEmpty())
+
+		drifts, err := service.CheckDrift(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(drifts).To(BeEmpty())
+	})
+
+	It("should log and report the drifted attributes", func() {
+		Expect(start(&DriftConfiguration{
+			Attributes: QueueAttributes{
+				VisibilityTimeout: duration(30 * time.Second),
+				Delay:             duration(0),
+			},
+		})).To(Succeed())
+		Expect(drifted(sqs.QueueAttributeNameVisibilityTimeout)).To(BeEquivalentTo(1))
+		Expect(drifted(sqs.QueueAttributeNameDelaySeconds)).To(BeEquivalentTo(0))
+		Expect(logs.String()).To(Equal("sqssrv: the VisibilityTimeout of the queue " + service.Configuration.QUrl + " drifted: \"45\", expected \"30\"\n"))
+
+		drifts, err := service.CheckDrift(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(drifts).To(Equal([]AttributeDrift{{
+			Name:     sqs.QueueAttributeNameVisibilityTimeout,
+			Current:  "45",
+			Expected: "30",
+		}}))
+	})
+
+	It("should report a redrive policy missing", func() {
+		Expect(start(&DriftConfiguration{
+			Attributes: QueueAttributes{
+				RedrivePolicy: &RedrivePolicy{
+					DeadLetterTargetArn: "arn:aws:sqs:elasticmq:000000000000:sqssrv-drift-dlq",
+					MaxReceiveCount:     5,
+				},
+			},
+		})).To(Succeed())
+		Expect(drifted(sqs.QueueAttributeNameRedrivePolicy)).To(BeEquivalentTo(1))
+	})
+
+	It("should fail to start when critical attributes drifted", func() {
+		err := start(&DriftConfiguration{
+			Attributes: QueueAttributes{
+				VisibilityTimeout: duration(30 * time.Second),
+				Delay:             duration(5 * time.Second),
+			},
+			Critical: []string{sqs.QueueAttributeNameVisibilityTimeout},
+		})
+		Expect(err).To(Equal(&DriftError{
+			Queue: service.Configuration.QUrl,
+			Drifts: []AttributeDrift{{
+				Name:     sqs.QueueAttributeNameVisibilityTimeout,
+				Current:  "45",
+				Expected: "30",
+				Critical: true,
+			}},
+		}))
+		Expect(err.Error()).To(HaveSuffix("drifted: VisibilityTimeout"))
+		Expect(service.isRunning()).To(BeFalse())
+		Expect(drifted(sqs.QueueAttributeNameDelaySeconds)).To(BeEquivalentTo(1))
+	})
+
+	It("should fail to start with a critical attribute not expected", func() {
+		err := start(&DriftConfiguration{
+			Attributes: QueueAttributes{VisibilityTimeout: duration(45 * time.Second)},
+			Critical:   []string{sqs.QueueAttributeNameRedrivePolicy},
+		})
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("RedrivePolicy is not among the expected attributes"))
+	})
+
+	It("should check the attributes on the interval", func() {
+		Expect(start(&DriftConfiguration{
+			Attributes: QueueAttributes{VisibilityTimeout: duration(45 * time.Second)},
+			Critical:   []string{sqs.QueueAttributeNameVisibilityTimeout},
+			Interval:   20 * time.Millisecond,
+		})).To(Succeed())
+		Expect(drifted(sqs.QueueAttributeNameVisibilityTimeout)).To(BeEquivalentTo(0))
+
+		// Someone changes it in the console.
+		Expect(service.UpdateQueueAttributes(context.Background(), nil, &QueueAttributes{
+			VisibilityTimeout: duration(10 * time.Second),
+		})).To(Succeed())
+		Eventually(func() float64 {
+			return drifted(sqs.QueueAttributeNameVisibilityTimeout)
+		}).Should(BeEquivalentTo(1))
+		// The interval only reports, even the critical ones.
+		Expect(service.isRunning()).To(BeTrue())
+
+		// Stop ends the checks.
+		Expect(service.Stop()).To(Succeed())
+		Expect(service.stopDrift).To(BeNil())
+	})
+
+	It("should start when the attributes cannot be read", func() {
+		Expect(start(&DriftConfiguration{
+			Attributes: QueueAttributes{VisibilityTimeout: duration(45 * time.Second)},
+			Critical:   []string{sqs.QueueAttributeNameVisibilityTimeout},
+		}, FaultRule{
+			Method:    MessageMetricMethodGetQueueAttributes,
+			ErrorCode: "AccessDenied",
+		})).To(Succeed())
+		Expect(logs.String()).To(HavePrefix("sqssrv: could not check the attributes of the queue " + service.Configuration.QUrl + ": AccessDenied"))
+
+		var metric dto.Metric
+		Expect(service.Collector.queueDriftCheckFailures.WithLabelValues(service.Configuration.QUrl).Write(&metric)).To(Succeed())
+		Expect(metric.GetCounter().GetValue()).To(BeEquivalentTo(1))
+	})
+
+	It("should fail to start when the attributes cannot be read, with FailOnError", func() {
+		err := start(&DriftConfiguration{
+			Attributes:  QueueAttributes{VisibilityTimeout: duration(45 * time.Second)},
+			FailOnError: true,
+		}, FaultRule{
+			Method:    MessageMetricMethodGetQueueAttributes,
+			ErrorCode: "AccessDenied",
+		})
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(HavePrefix("AccessDenied"))
+		Expect(service.isRunning()).To(BeFalse())
+	})
+
+	It("should fail the check without an output", func() {
+		event := (&DriftConfiguration{
+			Attributes: QueueAttributes{VisibilityTimeout: duration(45 * time.Second)},
+		}).check(context.Background(), func(ctx context.Context, op Operation, input interface{}) (interface{}, error) {
+			return nil, nil
+		}, "queue")
+		Expect(event.Err).To(MatchError("unexpected output <nil> of GetQueueAttributes on queue"))
+		Expect(event.Drifts).To(BeEmpty())
+	})
+
+	It("should do nothing without the configuration", func() {
+		Expect(start(nil)).To(Succeed())
+
+		drifts, err := service.CheckDrift(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(drifts).To(BeNil())
+	})
+})
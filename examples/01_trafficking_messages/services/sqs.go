@@ -35,9 +35,6 @@ func (service *MessageSQSService) LoadConfiguration() (interface{}, error) {
 // Start starts the service. If successful nil will be returned, otherwise
 // the error.
 func (service *MessageSQSService) Start() error {
-	err := service.SQSService.Start()
-	if err != nil {
-		return err
-	}
-	return DefaultPromService.Register(service.Collector)
+	service.Registerer = &DefaultPromService
+	return service.SQSService.Start()
 }
@@ -0,0 +1,311 @@
+package sqssrv
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"net/url"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+const (
+	// FaultLatency is the OperationResult.Fault of an operation that was only
+	// delayed.
+	FaultLatency = "latency"
+	// FaultPartialBatch is the OperationResult.Fault of a batch operation with
+	// some of its entries failed.
+	FaultPartialBatch = "partial_batch"
+	// FaultTimeout is the OperationResult.Fault of an operation whose context
+	// was done during the injected latency.
+	FaultTimeout = "timeout"
+)
+
+// FaultDefaultErrorCode is the code of the injected errors when the
+// FaultRule does not inform one.
+const FaultDefaultErrorCode = "InternalError"
+
+// FaultRule injects failures in the SQS calls that match it, for chaos
+// testing. A rule can delay the call (Latency), fail it (ErrorCode) or, for
+// the batch operations, fail some of its entries (BatchFailureRatio). A rule
+// with neither an ErrorCode nor any of the others fails the call with
+// FaultDefaultErrorCode.
+type FaultRule struct {
+	// Method is one of the `MessageMetricMethod*` constants. Empty matches all
+	// the methods, but not the calls the service makes on its own to manage
+	// the queue: the validation, creation, FIFO lookup and drift check.
+	Method string `yaml:"method"`
+	// Queue is the URL or the name of the queue. Empty matches all the
+	// queues.
+	Queue string `yaml:"queue"`
+	// Probability of a matching call getting the fault, from 0 to 1. Zero
+	// means never, which turns the rule off. Unset (nil) means always.
+	Probability *float64 `yaml:"probability"`
+	// ErrorCode fails the call with an `awserr.RequestFailure` of this code,
+	// e.g. "ThrottlingException".
+	ErrorCode string `yaml:"error_code"`
+	// StatusCode of the injected error. Default: 400.
+	StatusCode int `yaml:"status_code"`
+	// Latency is added before the call. If the context is done meanwhile, the
+	// call fails as canceled, as a timeout would.
+	Latency time.Duration `yaml:"latency"`
+	// BatchFailureRatio is the ratio, from 0 to 1, of the entries of a batch
+	// that fail with the ErrorCode, while the others are sent to SQS. A rule
+	// with a BatchFailureRatio only matches the batch operations.
+	BatchFailureRatio float64 `yaml:"batch_failure_ratio"`
+}
+
+// matches tells if the rule applies to an operation, which is a management
+// call of the service or not.
+func (rule *FaultRule) matches(op Operation, management bool) bool {
+	if rule.Method == "" && management {
+		return false
+	}
+	if rule.Method != "" && rule.Method != op.Method {
+		return false
+	}
+	if rule.BatchFailureRatio > 0 && !isBatch(op.Method) {
+		return false
+	}
+	if rule.Queue != "" && rule.Queue != op.Queue {
+		u, err := url.Parse(op.Queue)
+		if err != nil || path.Base(u.Path) != rule.Queue {
+			return false
+		}
+	}
+	return true
+}
+
+func (rule *FaultRule) errorCode() string {
+	if rule.ErrorCode == "" {
+		return FaultDefaultErrorCode
+	}
+	return rule.ErrorCode
+}
+
+func (rule *FaultRule) err() error {
+	statusCode := rule.StatusCode
+	if statusCode == 0 {
+		statusCode = 400
+	}
+	return awserr.NewRequestFailure(awserr.New(rule.errorCode(), "injected fault", nil), statusCode, "")
+}
+
+// faultKey is the context key of where the fault injected in an operation is
+// reported to the RecorderInterceptor.
+type faultKey struct{}
+
+// reportFault tells the RecorderInterceptor, if any, the fault injected in
+// the operation.
+func reportFault(ctx context.Context, fault string) {
+	if f, ok := ctx.Value(faultKey{}).(*string); ok {
+		*f = fault
+	}
+}
+
+// managementKey is the context key that marks the calls the service makes on
+// its own to manage the queue.
+type managementKey struct{}
+
+// managementCall marks the calls made with the context as management calls,
+// so the FaultRule without a Method skips them.
+func managementCall(ctx context.Context) context.Context {
+	return context.WithValue(ctx, managementKey{}, true)
+}
+
+func isManagementCall(ctx context.Context) bool {
+	management, _ := ctx.Value(managementKey{}).(bool)
+	return management
+}
+
+// faultInjector applies the FaultRule of the configuration.
+type faultInjector struct {
+	rules []FaultRule
+
+	m    sync.Mutex
+	rand *rand.Rand
+}
+
+func newFaultInjector(rules []FaultRule) *faultInjector {
+	return &faultInjector{
+		rules: rules,
+		rand:  rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// float64 is a random number in [0, 1).
+func (injector *faultInjector) float64() float64 {
+	injector.m.Lock()
+	defer injector.m.Unlock()
+	return injector.rand.Float64()
+}
+
+// perm is a random permutation of [0, n).
+func (injector *faultInjector) perm(n int) []int {
+	injector.m.Lock()
+	defer injector.m.Unlock()
+	return injector.rand.Perm(n)
+}
+
+// rule returns the first rule matching the operation that is drawn, nil if
+// none.
+func (injector *faultInjector) rule(op Operation, management bool) *FaultRule {
+	for i := range injector.rules {
+		rule := &injector.rules[i]
+		if !rule.matches(op, management) {
+			continue
+		}
+		if rule.Probability != nil && injector.float64() >= *rule.Probability {
+			continue
+		}
+		return rule
+	}
+	return nil
+}
+
+// invoker wraps the invoker calling SQS with the faults.
+func (injector *faultInjector) invoker(next Invoker) Invoker {
+	return func(ctx context.Context, op Operation, input interface{}) (interface{}, error) {
+		rule := injector.rule(op, isManagementCall(ctx))
+		if rule == nil {
+			return next(ctx, op, input)
+		}
+
+		if rule.Latency > 0 {
+			reportFault(ctx, FaultLatency)
+			timer := time.NewTimer(rule.Latency)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				reportFault(ctx, FaultTimeout)
+				return nil, awserr.New(request.CanceledErrorCode, "request context canceled", ctx.Err())
+			}
+		}
+
+		if rule.BatchFailureRatio > 0 {
+			reportFault(ctx, FaultPartialBatch)
+			return injector.partialBatch(ctx, rule, op, input, next)
+		}
+		if rule.ErrorCode != "" || rule.Latency == 0 {
+			reportFault(ctx, rule.errorCode())
+			return nil, rule.err()
+		}
+		return next(ctx, op, input)
+	}
+}
+
+func isBatch(method string) bool {
+	return method == MessageMetricMethodSendMessageBatch || method == MessageMetricMethodDeleteMessageBatch || method == MessageMetricMethodChangeMessageVisibilityBatch
+}
+
+// splitBatch picks the entries of a batch, by their ids, to be failed. It
+// returns the indexes of the entries left to be sent to SQS, in order, and the
+// failures of the picked ones.
+func (injector *faultInjector) splitBatch(rule *FaultRule, ids []*string) ([]int, []*sqs.BatchResultErrorEntry) {
+	n := int(math.Ceil(rule.BatchFailureRatio * float64(len(ids))))
+	picked := make(map[int]bool, n)
+	for _, i := range injector.perm(len(ids))[:n] {
+		picked[i] = true
+	}
+	kept := make([]int, 0, len(ids)-n)
+	failed := make([]*sqs.BatchResultErrorEntry, 0, n)
+	for i, id := range ids {
+		if !picked[i] {
+			kept = append(kept, i)
+			continue
+		}
+		failed = append(failed, &sqs.BatchResultErrorEntry{
+			Id:          id,
+			Code:        aws.String(rule.errorCode()),
+			Message:     aws.String("injected fault"),
+			SenderFault: aws.Bool(false),
+		})
+	}
+	return kept, failed
+}
+
+// partialBatch sends to SQS only the entries of the batch not picked to fail,
+// adding the others to the Failed of the output.
+func (injector *faultInjector) partialBatch(ctx context.Context, rule *FaultRule, op Operation, input interface{}, next Invoker) (interface{}, error) {
+	// forward sends the entries kept, if any.
+	forward := func(kept []int, input interface{}) (interface{}, error) {
+		if len(kept) == 0 {
+			return nil, nil
+		}
+		return next(ctx, op, input)
+	}
+
+	switch in := input.(type) {
+	case *sqs.SendMessageBatchInput:
+		ids := make([]*string, len(in.Entries))
+		for i, entry := range in.Entries {
+			ids[i] = entry.Id
+		}
+		kept, failed := injector.splitBatch(rule, ids)
+		sent := *in
+		sent.Entries = make([]*sqs.SendMessageBatchRequestEntry, len(kept))
+		for i, k := range kept {
+			sent.Entries[i] = in.Entries[k]
+		}
+		out, err := forward(kept, &sent)
+		if err != nil {
+			return out, err
+		}
+		output, _ := out.(*sqs.SendMessageBatchOutput)
+		if output == nil {
+			output = &sqs.SendMessageBatchOutput{}
+		}
+		output.Failed = append(output.Failed, failed...)
+		return output, nil
+	case *sqs.DeleteMessageBatchInput:
+		ids := make([]*string, len(in.Entries))
+		for i, entry := range in.Entries {
+			ids[i] = entry.Id
+		}
+		kept, failed := injector.splitBatch(rule, ids)
+		deleted := *in
+		deleted.Entries = make([]*sqs.DeleteMessageBatchRequestEntry, len(kept))
+		for i, k := range kept {
+			deleted.Entries[i] = in.Entries[k]
+		}
+		out, err := forward(kept, &deleted)
+		if err != nil {
+			return out, err
+		}
+		output, _ := out.(*sqs.DeleteMessageBatchOutput)
+		if output == nil {
+			output = &sqs.DeleteMessageBatchOutput{}
+		}
+		output.Failed = append(output.Failed, failed...)
+		return output, nil
+	case *sqs.ChangeMessageVisibilityBatchInput:
+		ids := make([]*string, len(in.Entries))
+		for i, entry := range in.Entries {
+			ids[i] = entry.Id
+		}
+		kept, failed := injector.splitBatch(rule, ids)
+		changed := *in
+		changed.Entries = make([]*sqs.ChangeMessageVisibilityBatchRequestEntry, len(kept))
+		for i, k := range kept {
+			changed.Entries[i] = in.Entries[k]
+		}
+		out, err := forward(kept, &changed)
+		if err != nil {
+			return out, err
+		}
+		output, _ := out.(*sqs.ChangeMessageVisibilityBatchOutput)
+		if output == nil {
+			output = &sqs.ChangeMessageVisibilityBatchOutput{}
+		}
+		output.Failed = append(output.Failed, failed...)
+		return output, nil
+	}
+	return next(ctx, op, input)
+}
@@ -0,0 +1,282 @@
+package sqssrv
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/lab259/go-rscsrv-sqs/sqstest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var _ = Describe("Faults", func() {
+	var (
+		service   *SQSService
+		testQueue *TestQueue
+	)
+
+	start := func(rules ...FaultRule) {
+		configuration := validConfiguration
+		configuration.Faults = rules
+		service = &SQSService{}
+		Expect(service.ApplyConfiguration(configuration)).To(Succeed())
+		var err error
+		testQueue, err = NewTestQueue(service, nil)
+		Expect(err).ToNot(HaveOccurred())
+	}
+
+	AfterEach(func() {
+		if testQueue != nil {
+			Expect(testQueue.Close()).To(Succeed())
+		}
+		testQueue = nil
+	})
+
+	faults := func(method, fault string) float64 {
+		var metric dto.Metric
+		Expect(service.Collector.messageInjectedFaults.WithLabelValues(service.Configuration.QUrl, method, fault).Write(&metric)).To(Succeed())
+		return metric.GetCounter().GetValue()
+	}
+
+	send := func() error {
+		_, err := service.SendMessage(&sqs.SendMessageInput{
+			MessageBody: aws.String("message"),
+		})
+		return err
+	}
+
+	sendBatch := func(n int) *sqs.SendMessageBatchOutput {
+		var entries []*sqs.SendMessageBatchRequestEntry
+		for i := 0; i < n; i++ {
+			entries = append(entries, &sqs.SendMessageBatchRequestEntry{
+				Id:          aws.String(fmt.Sprint(i)),
+				MessageBody: aws.String("message"),
+			})
+		}
+		output, err := service.SendMessageBatch(&sqs.SendMessageBatchInput{
+			Entries: entries,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		return output
+	}
+
+	It("should fail the calls with the error code", func() {
+		start(FaultRule{
+			Method:     MessageMetricMethodSendMessage,
+			ErrorCode:  "ThrottlingException",
+			StatusCode: 429,
+		})
+
+		err := send()
+		Expect(err).To(HaveOccurred())
+		requestErr, ok := err.(awserr.RequestFailure)
+		Expect(ok).To(BeTrue())
+		Expect(requestErr.Code()).To(Equal("ThrottlingException"))
+		Expect(requestErr.StatusCode()).To(Equal(429))
+		Expect(faults(MessageMetricMethodSendMessage, "ThrottlingException")).To(BeEquivalentTo(1))
+
+		Expect(service).To(sqstest.HaveMessagesInQueue(0))
+	})
+
+	It("should fail with an internal error by default", func() {
+		start(FaultRule{Method: MessageMetricMethodSendMessage})
+
+		err := send()
+		Expect(err).To(HaveOccurred())
+		Expect(err.(awserr.Error).Code()).To(Equal(FaultDefaultErrorCode))
+		Expect(err.(awserr.RequestFailure).StatusCode()).To(Equal(400))
+	})
+
+	It("should only fail the calls to the queue of the rule", func() {
+		start(FaultRule{Queue: "other-queue"})
+
+		Expect(send()).To(Succeed())
+		Expect(faults(MessageMetricMethodSendMessage, FaultDefaultErrorCode)).To(BeEquivalentTo(0))
+	})
+
+	It("should not fail the management calls without a method", func() {
+		start(FaultRule{ErrorCode: "ThrottlingException"})
+
+		err := send()
+		Expect(err).To(HaveOccurred())
+		Expect(err.(awserr.Error).Code()).To(Equal("ThrottlingException"))
+
+		rule := FaultRule{}
+		Expect(rule.matches(Operation{Method: MessageMetricMethodListQueues}, true)).To(BeFalse())
+		rule = FaultRule{Method: MessageMetricMethodListQueues}
+		Expect(rule.matches(Operation{Method: MessageMetricMethodListQueues}, true)).To(BeTrue())
+	})
+
+	It("should match the queue by URL or name", func() {
+		rule := FaultRule{Queue: "name"}
+		Expect(rule.matches(Operation{Queue: "http://localhost:9324/queue/name"}, false)).To(BeTrue())
+		Expect(rule.matches(Operation{Queue: "http://localhost:9324/queue/other"}, false)).To(BeFalse())
+
+		rule = FaultRule{Queue: "http://localhost:9324/queue/name"}
+		Expect(rule.matches(Operation{Queue: "http://localhost:9324/queue/name"}, false)).To(BeTrue())
+		Expect(rule.matches(Operation{Queue: "http://localhost:9324/queue/other"}, false)).To(BeFalse())
+	})
+
+	It("should inject the faults with the probability", func() {
+		injector := newFaultInjector([]FaultRule{{Probability: aws.Float64(0.5)}})
+		hits := 0
+		for i := 0; i < 1000; i++ {
+			if injector.rule(Operation{Method: MessageMetricMethodSendMessage}, false) != nil {
+				hits++
+			}
+		}
+		Expect(hits).To(BeNumerically("~", 500, 100))
+	})
+
+	It("should inject the faults always without a probability, and never with zero", func() {
+		injector := newFaultInjector([]FaultRule{{}})
+		Expect(injector.rule(Operation{Method: MessageMetricMethodSendMessage}, false)).ToNot(BeNil())
+
+		injector = newFaultInjector([]FaultRule{{Probability: aws.Float64(0)}})
+		for i := 0; i < 1000; i++ {
+			Expect(injector.rule(Operation{Method: MessageMetricMethodSendMessage}, false)).To(BeNil())
+		}
+	})
+
+	It("should use the first rule drawn", func() {
+		injector := newFaultInjector([]FaultRule{
+			{Method: MessageMetricMethodReceiveMessage, ErrorCode: "first"},
+			{ErrorCode: "second"},
+		})
+		Expect(injector.rule(Operation{Method: MessageMetricMethodReceiveMessage}, false).ErrorCode).To(Equal("first"))
+		Expect(injector.rule(Operation{Method: MessageMetricMethodSendMessage}, false).ErrorCode).To(Equal("second"))
+	})
+
+	It("should delay the calls", func() {
+		start(FaultRule{
+			Method:  MessageMetricMethodSendMessage,
+			Latency: 100 * time.Millisecond,
+		})
+
+		begin := time.Now()
+		Expect(send()).To(Succeed())
+		Expect(time.Since(begin)).To(BeNumerically(">=", 100*time.Millisecond))
+		Expect(faults(MessageMetricMethodSendMessage, FaultLatency)).To(BeEquivalentTo(1))
+	})
+
+	It("should time out the delayed calls", func() {
+		start(FaultRule{
+			Method:  MessageMetricMethodSendMessage,
+			Latency: time.Minute,
+		})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, err := service.SendMessageWithContext(ctx, &sqs.SendMessageInput{
+			MessageBody: aws.String("message"),
+		})
+		Expect(err).To(HaveOccurred())
+		Expect(err.(awserr.Error).Code()).To(Equal(request.CanceledErrorCode))
+		Expect(faults(MessageMetricMethodSendMessage, FaultTimeout)).To(BeEquivalentTo(1))
+	})
+
+	It("should fail part of the batches", func() {
+		start(FaultRule{
+			ErrorCode:         "ThrottlingException",
+			BatchFailureRatio: 0.3,
+		})
+
+		output := sendBatch(10)
+		Expect(output.Successful).To(HaveLen(7))
+		Expect(output.Failed).To(HaveLen(3))
+		for _, failed := range output.Failed {
+			Expect(aws.StringValue(failed.Code)).To(Equal("ThrottlingException"))
+			Expect(aws.BoolValue(failed.SenderFault)).To(BeFalse())
+		}
+		Expect(faults(MessageMetricMethodSendMessageBatch, FaultPartialBatch)).To(BeEquivalentTo(1))
+		Expect(service).To(sqstest.HaveMessagesInQueue(7))
+
+		// The rule does not apply to the other operations.
+		Expect(send()).To(Succeed())
+	})
+
+	It("should fail whole batches", func() {
+		start(FaultRule{BatchFailureRatio: 1})
+
+		output := sendBatch(3)
+		Expect(output.Successful).To(BeEmpty())
+		Expect(output.Failed).To(HaveLen(3))
+		Expect(service).To(sqstest.HaveMessagesInQueue(0))
+	})
+
+	It("should keep the failed entries when the next invoker has no output", func() {
+		injector := newFaultInjector([]FaultRule{{BatchFailureRatio: 0.5}})
+		invoker := injector.invoker(func(ctx context.Context, op Operation, input interface{}) (interface{}, error) {
+			return nil, nil
+		})
+		entries := func(n int) []*string {
+			ids := make([]*string, n)
+			for i := range ids {
+				ids[i] = aws.String(fmt.Sprint(i))
+			}
+			return ids
+		}
+
+		sendInput := &sqs.SendMessageBatchInput{}
+		for _, id := range entries(2) {
+			sendInput.Entries = append(sendInput.Entries, &sqs.SendMessageBatchRequestEntry{Id: id, MessageBody: aws.String("message")})
+		}
+		output, err := invoker(context.Background(), Operation{Method: MessageMetricMethodSendMessageBatch}, sendInput)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(output.(*sqs.SendMessageBatchOutput).Failed).To(HaveLen(1))
+
+		deleteInput := &sqs.DeleteMessageBatchInput{}
+		for _, id := range entries(2) {
+			deleteInput.Entries = append(deleteInput.Entries, &sqs.DeleteMessageBatchRequestEntry{Id: id, ReceiptHandle: id})
+		}
+		output, err = invoker(context.Background(), Operation{Method: MessageMetricMethodDeleteMessageBatch}, deleteInput)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(output.(*sqs.DeleteMessageBatchOutput).Failed).To(HaveLen(1))
+
+		changeInput := &sqs.ChangeMessageVisibilityBatchInput{}
+		for _, id := range entries(2) {
+			changeInput.Entries = append(changeInput.Entries, &sqs.ChangeMessageVisibilityBatchRequestEntry{Id: id, ReceiptHandle: id})
+		}
+		output, err = invoker(context.Background(), Operation{Method: MessageMetricMethodChangeMessageVisibilityBatch}, changeInput)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(output.(*sqs.ChangeMessageVisibilityBatchOutput).Failed).To(HaveLen(1))
+	})
+
+	It("should fail part of the batches of deletes", func() {
+		start(FaultRule{
+			Method:            MessageMetricMethodDeleteMessageBatch,
+			BatchFailureRatio: 0.5,
+		})
+
+		sendBatch(4)
+		var messages []*sqs.Message
+		for len(messages) < 4 {
+			output, err := service.ReceiveMessage(&sqs.ReceiveMessageInput{
+				MaxNumberOfMessages: aws.Int64(10),
+				WaitTimeSeconds:     aws.Int64(1),
+			})
+			Expect(err).ToNot(HaveOccurred())
+			messages = append(messages, output.Messages...)
+		}
+		var entries []*sqs.DeleteMessageBatchRequestEntry
+		for i, message := range messages {
+			entries = append(entries, &sqs.DeleteMessageBatchRequestEntry{
+				Id:            aws.String(fmt.Sprint(i)),
+				ReceiptHandle: message.ReceiptHandle,
+			})
+		}
+		output, err := service.DeleteMessageBatch(&sqs.DeleteMessageBatchInput{
+			Entries: entries,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(output.Successful).To(HaveLen(2))
+		Expect(output.Failed).To(HaveLen(2))
+		Expect(aws.StringValue(output.Failed[0].Code)).To(Equal(FaultDefaultErrorCode))
+	})
+})
@@ -0,0 +1,185 @@
+package sqssrv
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// ErrCodeMessageGroupBlocked is the Code of the Failed entries of a
+// SendMessageBatch to a FIFO queue that were not sent, as an earlier entry of
+// their message group failed.
+const ErrCodeMessageGroupBlocked = "MessageGroupBlocked"
+
+// FIFOConfiguration fills in the MessageGroupId and MessageDeduplicationId of
+// the messages sent to FIFO queues, when the inputs do not inform them:
+//
+//	fifo:
+//	  group_id_attribute: customer_id
+//	  content_deduplication: true
+type FIFOConfiguration struct {
+	// GroupID returns the MessageGroupId of a message. It takes precedence
+	// over the GroupIDAttribute.
+	GroupID func(body string, attributes map[string]*sqs.MessageAttributeValue) string `yaml:"-"`
+	// GroupIDAttribute is the message attribute whose value is the
+	// MessageGroupId.
+	GroupIDAttribute string `yaml:"group_id_attribute"`
+	// ContentDeduplication makes the MessageDeduplicationId the
+	// ContentDeduplicationID of the body, so it does not depend on the
+	// ContentBasedDeduplication of the queue.
+	ContentDeduplication bool `yaml:"content_deduplication"`
+}
+
+// groupID returns the MessageGroupId of the message, empty if there is none.
+func (configuration *FIFOConfiguration) groupID(body *string, attributes map[string]*sqs.MessageAttributeValue) string {
+	if configuration == nil {
+		return ""
+	}
+	if configuration.GroupID != nil {
+		return configuration.GroupID(aws.StringValue(body), attributes)
+	}
+	if attribute, ok := attributes[configuration.GroupIDAttribute]; ok && configuration.GroupIDAttribute != "" {
+		return aws.StringValue(attribute.StringValue)
+	}
+	return ""
+}
+
+// FIFOError is returned by the send wrappers when a message to a FIFO queue
+// misses its MessageGroupId, or its MessageDeduplicationId when the queue has
+// no ContentBasedDeduplication. Nothing is sent.
+type FIFOError struct {
+	// Queue is the URL of the FIFO queue.
+	Queue string
+	// Entry is the Id of the entry of the batch, empty for SendMessage.
+	Entry string
+	// Parameter is "MessageGroupId" or "MessageDeduplicationId".
+	Parameter string
+}
+
+func (err *FIFOError) Error() string {
+	if err.Entry != "" {
+		return fmt.Sprintf("the entry %s of the batch to the FIFO queue %s has no %s", err.Entry, err.Queue, err.Parameter)
+	}
+	return fmt.Sprintf("the message to the FIFO queue %s has no %s", err.Queue, err.Parameter)
+}
+
+// ContentDeduplicationID returns the SHA-256 of the body, in hex, as SQS
+// does for the ContentBasedDeduplication.
+func ContentDeduplicationID(body string) string {
+	sum := sha256.Sum256([]byte(body))
+	return hex.EncodeToString(sum[:])
+}
+
+// isFIFO tells if the queue is a FIFO queue, by its ".fifo" suffix.
+func isFIFO(queueURL string) bool {
+	return strings.HasSuffix(queueURL, ".fifo")
+}
+
+// fifoQueue is what the service knows of a FIFO queue.
+type fifoQueue struct {
+	contentBasedDeduplication bool
+}
+
+// lookupFIFO gets the attributes of the FIFO queue, failing if it is not one.
+func lookupFIFO(ctx context.Context, invoker Invoker, queueURL string) (*fifoQueue, error) {
+	op := Operation{
+		Queue:  queueURL,
+		Method: MessageMetricMethodGetQueueAttributes,
+	}
+	output, err := invoker(ctx, op, &sqs.GetQueueAttributesInput{
+		QueueUrl: aws.String(queueURL),
+		AttributeNames: aws.StringSlice([]string{
+			sqs.QueueAttributeNameFifoQueue,
+			sqs.QueueAttributeNameContentBasedDeduplication,
+		}),
+	})
+	if err != nil {
+		return nil, err
+	}
+	out, ok := output.(*sqs.GetQueueAttributesOutput)
+	if !ok || out == nil {
+		return nil, unexpectedOutputError(op, output)
+	}
+	attributes := aws.StringValueMap(out.Attributes)
+	if attributes[sqs.QueueAttributeNameFifoQueue] != "true" {
+		return nil, fmt.Errorf("the queue %s is not a FIFO queue", queueURL)
+	}
+	return &fifoQueue{
+		contentBasedDeduplication: attributes[sqs.QueueAttributeNameContentBasedDeduplication] == "true",
+	}, nil
+}
+
+// getFIFOQueue returns what the service knows of the FIFO queue, getting its
+// attributes the first time.
+func (service *SQSService) getFIFOQueue(ctx context.Context, queueURL string) (*fifoQueue, error) {
+	if queue, ok := service.fifoQueues.Load(queueURL); ok {
+		return queue.(*fifoQueue), nil
+	}
+	queue, err := lookupFIFO(managementCall(ctx), service.getInvoker(), queueURL)
+	if err != nil {
+		return nil, err
+	}
+	service.fifoQueues.Store(queueURL, queue)
+	return queue, nil
+}
+
+// fifoMessage fills in the MessageGroupId and MessageDeduplicationId of a
+// message to a FIFO queue, according to the FIFO of the configuration, and
+// checks they are set. The attributes of the queue are only needed when the
+// MessageDeduplicationId is missing.
+func (service *SQSService) fifoMessage(ctx context.Context, queueURL, entry string, body *string, attributes map[string]*sqs.MessageAttributeValue, groupID, deduplicationID *string) (*string, *string, error) {
+	configuration := service.Configuration.FIFO
+	if aws.StringValue(groupID) == "" {
+		groupID = nil
+		if id := configuration.groupID(body, attributes); id != "" {
+			groupID = aws.String(id)
+		}
+	}
+	if groupID == nil {
+		return nil, nil, &FIFOError{Queue: queueURL, Entry: entry, Parameter: "MessageGroupId"}
+	}
+
+	if aws.StringValue(deduplicationID) != "" {
+		return groupID, deduplicationID, nil
+	}
+	if configuration != nil && configuration.ContentDeduplication {
+		return groupID, aws.String(ContentDeduplicationID(aws.StringValue(body))), nil
+	}
+	queue, err := service.getFIFOQueue(ctx, queueURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !queue.contentBasedDeduplication {
+		return nil, nil, &FIFOError{Queue: queueURL, Entry: entry, Parameter: "MessageDeduplicationId"}
+	}
+	return groupID, nil, nil
+}
+
+// sendBatchChunks splits the entries of a SendMessageBatch in order, so each
+// chunk has up to MaxBatchEntries and its payload fits maxBatchPayload.
+func sendBatchChunks(entries []*sqs.SendMessageBatchRequestEntry) [][]*sqs.SendMessageBatchRequestEntry {
+	var chunks [][]*sqs.SendMessageBatchRequestEntry
+	var chunk []*sqs.SendMessageBatchRequestEntry
+	size := 0
+	for _, entry := range entries {
+		entrySize := 0
+		if entry != nil {
+			entrySize = len(aws.StringValue(entry.MessageBody)) + messageAttributesSize(entry.MessageAttributes)
+		}
+		if len(chunk) == MaxBatchEntries || (len(chunk) > 0 && size+entrySize > maxBatchPayload) {
+			chunks = append(chunks, chunk)
+			chunk, size = nil, 0
+		}
+		chunk = append(chunk, entry)
+		size += entrySize
+	}
+	if len(chunk) > 0 {
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
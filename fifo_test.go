@@ -0,0 +1,348 @@
+package sqssrv
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("FIFO", func() {
+	It("should hash the content as the deduplication ID", func() {
+		Expect(ContentDeduplicationID("message")).To(Equal("ab530a13e45914982b79f9b7e3fba994cfd1f3fb22f71cea1afbf02b460c6d1d"))
+	})
+
+	It("should describe the missing parameters", func() {
+		Expect((&FIFOError{Queue: "orders.fifo", Parameter: "MessageGroupId"}).Error()).To(Equal("the message to the FIFO queue orders.fifo has no MessageGroupId"))
+		Expect((&FIFOError{Queue: "orders.fifo", Entry: "3", Parameter: "MessageDeduplicationId"}).Error()).To(Equal("the entry 3 of the batch to the FIFO queue orders.fifo has no MessageDeduplicationId"))
+	})
+
+	It("should fail the lookup without an output", func() {
+		_, err := lookupFIFO(context.Background(), func(ctx context.Context, op Operation, input interface{}) (interface{}, error) {
+			return (*sqs.GetQueueAttributesOutput)(nil), nil
+		}, "orders.fifo")
+		Expect(err).To(MatchError("unexpected output *sqs.GetQueueAttributesOutput of GetQueueAttributes on orders.fifo"))
+	})
+
+	Context("sending", func() {
+		var (
+			service   *SQSService
+			testQueue *TestQueue
+		)
+
+		// contentBased are the attributes of a queue with content based
+		// deduplication.
+		contentBased := map[string]string{
+			sqs.QueueAttributeNameContentBasedDeduplication: "true",
+		}
+
+		// start starts the service on a new queue.
+		start := func(opts *TestQueueOpts, configure func(configuration *SQSServiceConfiguration)) {
+			configuration := validConfiguration
+			if configure != nil {
+				configure(&configuration)
+			}
+			service = &SQSService{}
+			Expect(service.ApplyConfiguration(configuration)).To(Succeed())
+			opts.Prefix = "sqssrv-fifo"
+			var err error
+			testQueue, err = NewTestQueue(service, opts)
+			Expect(err).ToNot(HaveOccurred())
+		}
+
+		AfterEach(func() {
+			if testQueue != nil {
+				Expect(testQueue.Close()).To(Succeed())
+			}
+			testQueue = nil
+		})
+
+		// messages returns the number of visible messages of the queue.
+		messages := func() int64 {
+			attributes, err := service.QueueAttributes(context.Background(), nil)
+			Expect(err).ToNot(HaveOccurred())
+			return aws.Int64Value(attributes.ApproximateNumberOfMessages)
+		}
+
+		// receiveAll receives, and deletes, all the messages of the queue.
+		receiveAll := func() []*sqs.Message {
+			var received []*sqs.Message
+			for {
+				output, err := service.ReceiveMessage(&sqs.ReceiveMessageInput{
+					MaxNumberOfMessages:   aws.Int64(MaxBatchEntries),
+					AttributeNames:        []*string{aws.String(sqs.QueueAttributeNameAll)},
+					MessageAttributeNames: []*string{aws.String(sqs.QueueAttributeNameAll)},
+				})
+				Expect(err).ToNot(HaveOccurred())
+				if len(output.Messages) == 0 {
+					return received
+				}
+				for _, message := range output.Messages {
+					_, err := service.DeleteMessage(&sqs.DeleteMessageInput{ReceiptHandle: message.ReceiptHandle})
+					Expect(err).ToNot(HaveOccurred())
+				}
+				received = append(received, output.Messages...)
+			}
+		}
+
+		It("should look the FIFO queue up on Start", func() {
+			start(&TestQueueOpts{FIFO: true, Attributes: contentBased}, nil)
+			queue, ok := service.fifoQueues.Load(service.Configuration.QUrl)
+			Expect(ok).To(BeTrue())
+			Expect(queue).To(Equal(&fifoQueue{contentBasedDeduplication: true}))
+		})
+
+		It("should fail without the group ID", func() {
+			start(&TestQueueOpts{FIFO: true}, nil)
+			_, err := service.SendMessage(&sqs.SendMessageInput{
+				MessageBody:            aws.String("message"),
+				MessageDeduplicationId: aws.String("1"),
+			})
+			Expect(err).To(Equal(&FIFOError{Queue: service.Configuration.QUrl, Parameter: "MessageGroupId"}))
+			Expect(messages()).To(BeEquivalentTo(0))
+		})
+
+		It("should fail without the deduplication ID when the queue has no content based deduplication", func() {
+			start(&TestQueueOpts{FIFO: true}, nil)
+			_, err := service.SendMessageBatch(&sqs.SendMessageBatchInput{
+				Entries: []*sqs.SendMessageBatchRequestEntry{
+					{Id: aws.String("0"), MessageBody: aws.String("message 0"), MessageGroupId: aws.String("a"), MessageDeduplicationId: aws.String("0")},
+					{Id: aws.String("1"), MessageBody: aws.String("message 1"), MessageGroupId: aws.String("a")},
+				},
+			})
+			Expect(err).To(Equal(&FIFOError{Queue: service.Configuration.QUrl, Entry: "1", Parameter: "MessageDeduplicationId"}))
+			Expect(messages()).To(BeEquivalentTo(0))
+		})
+
+		It("should rely on the content based deduplication of the queues", func() {
+			start(&TestQueueOpts{FIFO: true, Attributes: contentBased}, nil)
+			output, err := service.SendMessage(&sqs.SendMessageInput{
+				MessageBody:    aws.String("message"),
+				MessageGroupId: aws.String("a"),
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(aws.StringValue(output.SequenceNumber)).ToNot(BeEmpty())
+
+			// Other queues are looked up on the first message without a
+			// deduplication ID.
+			other, err := testQueue.AddQueue("-other.fifo", map[string]string{
+				sqs.QueueAttributeNameFifoQueue: "true",
+			})
+			Expect(err).ToNot(HaveOccurred())
+			_, err = service.SendMessage(&sqs.SendMessageInput{
+				QueueUrl:       aws.String(other),
+				MessageBody:    aws.String("message"),
+				MessageGroupId: aws.String("a"),
+			})
+			Expect(err).To(Equal(&FIFOError{Queue: other, Parameter: "MessageDeduplicationId"}))
+			queue, ok := service.fifoQueues.Load(other)
+			Expect(ok).To(BeTrue())
+			Expect(queue).To(Equal(&fifoQueue{contentBasedDeduplication: false}))
+		})
+
+		It("should fill in the group ID from the attribute and the deduplication ID from the content", func() {
+			start(&TestQueueOpts{FIFO: true}, func(configuration *SQSServiceConfiguration) {
+				configuration.FIFO = &FIFOConfiguration{
+					GroupIDAttribute:     "customer_id",
+					ContentDeduplication: true,
+				}
+			})
+			send := func() *sqs.SendMessageOutput {
+				output, err := service.SendMessage(&sqs.SendMessageInput{
+					MessageBody: aws.String("message"),
+					MessageAttributes: map[string]*sqs.MessageAttributeValue{
+						"customer_id": {DataType: aws.String("String"), StringValue: aws.String("42")},
+					},
+				})
+				Expect(err).ToNot(HaveOccurred())
+				return output
+			}
+			first, second := send(), send()
+			Expect(aws.StringValue(first.SequenceNumber)).ToNot(BeEmpty())
+			// Deduplicated.
+			Expect(second.MessageId).To(Equal(first.MessageId))
+
+			received := receiveAll()
+			Expect(received).To(HaveLen(1))
+			Expect(aws.StringValue(received[0].Attributes[sqs.MessageSystemAttributeNameMessageGroupId])).To(Equal("42"))
+			Expect(aws.StringValue(received[0].Attributes[sqs.MessageSystemAttributeNameMessageDeduplicationId])).To(Equal(ContentDeduplicationID("message")))
+			Expect(received[0].Attributes[sqs.MessageSystemAttributeNameSequenceNumber]).To(Equal(first.SequenceNumber))
+		})
+
+		It("should prefer the group ID informed, then the one of the function", func() {
+			start(&TestQueueOpts{FIFO: true}, func(configuration *SQSServiceConfiguration) {
+				configuration.FIFO = &FIFOConfiguration{
+					GroupID: func(body string, attributes map[string]*sqs.MessageAttributeValue) string {
+						return strings.Fields(body)[0]
+					},
+					GroupIDAttribute:     "customer_id",
+					ContentDeduplication: true,
+				}
+			})
+			attributes := map[string]*sqs.MessageAttributeValue{
+				"customer_id": {DataType: aws.String("String"), StringValue: aws.String("42")},
+			}
+			_, err := service.SendMessage(&sqs.SendMessageInput{
+				MessageBody:       aws.String("welcome 1"),
+				MessageAttributes: attributes,
+			})
+			Expect(err).ToNot(HaveOccurred())
+			_, err = service.SendMessage(&sqs.SendMessageInput{
+				MessageBody:       aws.String("welcome 2"),
+				MessageAttributes: attributes,
+				MessageGroupId:    aws.String("informed"),
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			groups := make(map[string]string)
+			for _, message := range receiveAll() {
+				groups[aws.StringValue(message.Body)] = aws.StringValue(message.Attributes[sqs.MessageSystemAttributeNameMessageGroupId])
+			}
+			Expect(groups).To(Equal(map[string]string{
+				"welcome 1": "welcome",
+				"welcome 2": "informed",
+			}))
+		})
+
+		It("should split the batches preserving the order of the groups", func() {
+			var calls []int
+			start(&TestQueueOpts{FIFO: true}, func(configuration *SQSServiceConfiguration) {
+				configuration.FIFO = &FIFOConfiguration{ContentDeduplication: true}
+				// Fails the entry "1" of the first call.
+				configuration.Interceptors = []Interceptor{
+					func(ctx context.Context, op Operation, input interface{}, next Invoker) (interface{}, error) {
+						in, ok := input.(*sqs.SendMessageBatchInput)
+						if !ok {
+							return next(ctx, op, input)
+						}
+						calls = append(calls, len(in.Entries))
+						if len(calls) > 1 {
+							return next(ctx, op, input)
+						}
+						chunk := *in
+						chunk.Entries = append([]*sqs.SendMessageBatchRequestEntry{in.Entries[0]}, in.Entries[2:]...)
+						output, err := next(ctx, op, &chunk)
+						if err != nil {
+							return nil, err
+						}
+						out := output.(*sqs.SendMessageBatchOutput)
+						out.Failed = append(out.Failed, &sqs.BatchResultErrorEntry{
+							Id:          aws.String("1"),
+							Code:        aws.String("InternalError"),
+							SenderFault: aws.Bool(false),
+						})
+						return out, nil
+					},
+				}
+			})
+
+			entries := make([]*sqs.SendMessageBatchRequestEntry, 15)
+			for i := range entries {
+				entries[i] = &sqs.SendMessageBatchRequestEntry{
+					Id:             aws.String(strconv.Itoa(i)),
+					MessageBody:    aws.String(fmt.Sprintf("message %d", i)),
+					MessageGroupId: aws.String(fmt.Sprintf("group %d", i%3)),
+				}
+			}
+			output, err := service.SendMessageBatch(&sqs.SendMessageBatchInput{Entries: entries})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(calls).To(Equal([]int{10, 3}))
+
+			Expect(output.Successful).To(HaveLen(12))
+			for _, entry := range output.Successful {
+				Expect(aws.StringValue(entry.SequenceNumber)).ToNot(BeEmpty())
+			}
+			failed := make(map[string]string)
+			for _, entry := range output.Failed {
+				failed[aws.StringValue(entry.Id)] = aws.StringValue(entry.Code)
+			}
+			// The group 1 of the entry failed is blocked in the later call.
+			Expect(failed).To(Equal(map[string]string{
+				"1":  "InternalError",
+				"10": ErrCodeMessageGroupBlocked,
+				"13": ErrCodeMessageGroupBlocked,
+			}))
+
+			// Each group is received in the order it was sent.
+			groups := make(map[string][]string)
+			for _, message := range receiveAll() {
+				group := aws.StringValue(message.Attributes[sqs.MessageSystemAttributeNameMessageGroupId])
+				groups[group] = append(groups[group], aws.StringValue(message.Body))
+			}
+			Expect(groups).To(Equal(map[string][]string{
+				"group 0": {"message 0", "message 3", "message 6", "message 9", "message 12"},
+				"group 1": {"message 4", "message 7"},
+				"group 2": {"message 2", "message 5", "message 8", "message 11", "message 14"},
+			}))
+		})
+
+		It("should split the FIFO batches by payload", func() {
+			var calls []int
+			start(&TestQueueOpts{
+				FIFO: true,
+				Attributes: map[string]string{
+					sqs.QueueAttributeNameMaximumMessageSize: strconv.Itoa(256 * 1024),
+				},
+			}, func(configuration *SQSServiceConfiguration) {
+				configuration.FIFO = &FIFOConfiguration{ContentDeduplication: true}
+				configuration.Interceptors = []Interceptor{
+					func(ctx context.Context, op Operation, input interface{}, next Invoker) (interface{}, error) {
+						if in, ok := input.(*sqs.SendMessageBatchInput); ok {
+							calls = append(calls, len(in.Entries))
+						}
+						return next(ctx, op, input)
+					},
+				}
+			})
+
+			big := strings.Repeat("x", 100*1024)
+			entries := make([]*sqs.SendMessageBatchRequestEntry, 3)
+			for i := range entries {
+				entries[i] = &sqs.SendMessageBatchRequestEntry{
+					Id:             aws.String(strconv.Itoa(i)),
+					MessageBody:    aws.String(big + strconv.Itoa(i)),
+					MessageGroupId: aws.String("a"),
+				}
+			}
+			output, err := service.SendMessageBatch(&sqs.SendMessageBatchInput{Entries: entries})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(output.Successful).To(HaveLen(3))
+			Expect(output.Failed).To(BeEmpty())
+			Expect(calls).To(Equal([]int{2, 1}))
+			Expect(messages()).To(BeEquivalentTo(3))
+		})
+
+		It("should send the batches of the standard queues in a single call", func() {
+			var calls []int
+			start(&TestQueueOpts{}, func(configuration *SQSServiceConfiguration) {
+				configuration.Interceptors = []Interceptor{
+					func(ctx context.Context, op Operation, input interface{}, next Invoker) (interface{}, error) {
+						if in, ok := input.(*sqs.SendMessageBatchInput); ok {
+							calls = append(calls, len(in.Entries))
+						}
+						return next(ctx, op, input)
+					},
+				}
+			})
+
+			entries := make([]*sqs.SendMessageBatchRequestEntry, 25)
+			for i := range entries {
+				entries[i] = &sqs.SendMessageBatchRequestEntry{
+					Id:          aws.String(strconv.Itoa(i)),
+					MessageBody: aws.String("message"),
+				}
+			}
+			_, err := service.SendMessageBatch(&sqs.SendMessageBatchInput{Entries: entries})
+			Expect(err).To(HaveOccurred())
+			Expect(err.(awserr.Error).Code()).To(Equal(sqs.ErrCodeTooManyEntriesInBatchRequest))
+			Expect(calls).To(Equal([]int{25}))
+			Expect(messages()).To(BeEquivalentTo(0))
+		})
+	})
+})
@@ -0,0 +1,169 @@
+package sqssrv
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	rscsrv "github.com/lab259/go-rscsrv"
+)
+
+// Invoker executes an operation. The input is the `*sqs.<Method>Input` of the
+// operation and the output is the respective `*sqs.<Method>Output`.
+type Invoker func(ctx context.Context, op Operation, input interface{}) (interface{}, error)
+
+// Interceptor wraps every SQS call made by the SQSService. It must call next
+// to proceed with the operation, and can inspect or change the input and the
+// output, or skip the call altogether.
+//
+// The interceptors of the configuration are called in order, before the
+// built-in one that records the metrics. When the service is not running, next
+// fails with `rscsrv.ErrServiceNotRunning`.
+type Interceptor func(ctx context.Context, op Operation, input interface{}, next Invoker) (interface{}, error)
+
+// unexpectedOutputError is the error of an operation whose invoker returned
+// no output, or an output of another type, e.g. from an interceptor.
+func unexpectedOutputError(op Operation, output interface{}) error {
+	return fmt.Errorf("unexpected output %T of %s on %s", output, op.Method, op.Queue)
+}
+
+// isOutputOf tells if the output is a non-nil `*sqs.<Method>Output` of the
+// `*sqs.<Method>Input`. The outputs of unknown inputs are not checked.
+func isOutputOf(input, output interface{}) bool {
+	expected := newOutput(input)
+	if expected == nil {
+		return true
+	}
+	value := reflect.ValueOf(output)
+	return value.IsValid() && value.Type() == reflect.TypeOf(expected) && !value.IsNil()
+}
+
+// chain builds the invoker of the operations: the interceptors of the
+// configuration, then the one recording the metrics and, finally, the invoker
+// calling the client.
+func (service *SQSService) chain(invoker Invoker, recorder Recorder) Invoker {
+	interceptors := append(append([]Interceptor{}, service.Configuration.Interceptors...), RecorderInterceptor(recorder))
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], invoker
+		invoker = func(ctx context.Context, op Operation, input interface{}) (interface{}, error) {
+			return interceptor(ctx, op, input, next)
+		}
+	}
+	return invoker
+}
+
+// clientInvoker returns the Invoker that actually calls SQS. A nil client
+// fails all the operations with `rscsrv.ErrServiceNotRunning`.
+func clientInvoker(client sqsiface.SQSAPI) Invoker {
+	return func(ctx context.Context, op Operation, input interface{}) (interface{}, error) {
+		if client == nil {
+			return nil, rscsrv.ErrServiceNotRunning
+		}
+		switch input := input.(type) {
+		case *sqs.SendMessageInput:
+			return client.SendMessageWithContext(ctx, input)
+		case *sqs.SendMessageBatchInput:
+			return client.SendMessageBatchWithContext(ctx, input)
+		case *sqs.ReceiveMessageInput:
+			return client.ReceiveMessageWithContext(ctx, input)
+		case *sqs.DeleteMessageInput:
+			return client.DeleteMessageWithContext(ctx, input)
+		case *sqs.DeleteMessageBatchInput:
+			return client.DeleteMessageBatchWithContext(ctx, input)
+		case *sqs.PurgeQueueInput:
+			return client.PurgeQueueWithContext(ctx, input)
+		case *sqs.ListQueuesInput:
+			return client.ListQueuesWithContext(ctx, input)
+		case *sqs.ChangeMessageVisibilityInput:
+			return client.ChangeMessageVisibilityWithContext(ctx, input)
+		case *sqs.ChangeMessageVisibilityBatchInput:
+			return client.ChangeMessageVisibilityBatchWithContext(ctx, input)
+		case *sqs.GetQueueAttributesInput:
+			return client.GetQueueAttributesWithContext(ctx, input)
+		case *sqs.SetQueueAttributesInput:
+			return client.SetQueueAttributesWithContext(ctx, input)
+		case *sqs.CreateQueueInput:
+			return client.CreateQueueWithContext(ctx, input)
+		case *sqs.DeleteQueueInput:
+			return client.DeleteQueueWithContext(ctx, input)
+		case *sqs.TagQueueInput:
+			return client.TagQueueWithContext(ctx, input)
+		case *sqs.ListQueueTagsInput:
+			return client.ListQueueTagsWithContext(ctx, input)
+		case *sqs.GetQueueUrlInput:
+			return client.GetQueueUrlWithContext(ctx, input)
+		}
+		return nil, fmt.Errorf("unsupported operation %s (%T)", op.Method, input)
+	}
+}
+
+// RecorderInterceptor returns the Interceptor that reports the operations to
+// the recorder. The SQSService always adds it to the end of the chain, with
+// its Recorder (or Collector), so the faults injected by the configuration
+// are reported too.
+func RecorderInterceptor(recorder Recorder) Interceptor {
+	return func(ctx context.Context, op Operation, input interface{}, next Invoker) (interface{}, error) {
+		recorder.Called(op)
+		start := time.Now()
+		var fault string
+		output, err := next(context.WithValue(ctx, faultKey{}, &fault), op, input)
+		if err == rscsrv.ErrServiceNotRunning {
+			return output, err
+		}
+		result := operationResult(input, output)
+		result.Duration = time.Since(start)
+		result.Err = err
+		result.Fault = fault
+		recorder.Finished(op, result)
+		return output, err
+	}
+}
+
+// operationResult computes the traffic and the request units of an
+// operation. The nil entries and messages are not counted.
+func operationResult(input, output interface{}) OperationResult {
+	result := OperationResult{RequestUnits: 1}
+	switch input := input.(type) {
+	case *sqs.SendMessageInput:
+		result.Messages = 1
+		result.Size = len(aws.StringValue(input.MessageBody))
+		result.RequestUnits = RequestUnits(result.Size + messageAttributesSize(input.MessageAttributes))
+	case *sqs.SendMessageBatchInput:
+		payload := 0
+		for _, msg := range input.Entries {
+			if msg == nil {
+				continue
+			}
+			result.Messages++
+			result.Size += len(aws.StringValue(msg.MessageBody))
+			payload += len(aws.StringValue(msg.MessageBody)) + messageAttributesSize(msg.MessageAttributes)
+		}
+		result.RequestUnits = RequestUnits(payload)
+	case *sqs.ReceiveMessageInput:
+		if output, ok := output.(*sqs.ReceiveMessageOutput); ok && output != nil {
+			payload := 0
+			for _, msg := range output.Messages {
+				if msg == nil {
+					continue
+				}
+				result.Messages++
+				result.Size += len(aws.StringValue(msg.Body))
+				payload += len(aws.StringValue(msg.Body)) + messageAttributesSize(msg.MessageAttributes)
+			}
+			result.RequestUnits = RequestUnits(payload)
+		}
+	case *sqs.DeleteMessageInput:
+		result.Messages = 1
+	case *sqs.DeleteMessageBatchInput:
+		result.Messages = len(input.Entries)
+	case *sqs.ChangeMessageVisibilityInput:
+		result.Messages = 1
+	case *sqs.ChangeMessageVisibilityBatchInput:
+		result.Messages = len(input.Entries)
+	}
+	return result
+}
@@ -0,0 +1,265 @@
+package sqssrv
+
+import (
+	"context"
+	"errors"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	rscsrv "github.com/lab259/go-rscsrv"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var _ = Describe("Interceptors", func() {
+	var (
+		service   *SQSService
+		testQueue *TestQueue
+	)
+
+	start := func(interceptors ...Interceptor) {
+		configuration := validConfiguration
+		configuration.Interceptors = interceptors
+		service = &SQSService{}
+		Expect(service.ApplyConfiguration(configuration)).To(Succeed())
+		var err error
+		testQueue, err = NewTestQueue(service, nil)
+		Expect(err).ToNot(HaveOccurred())
+	}
+
+	AfterEach(func() {
+		if testQueue != nil {
+			Expect(testQueue.Close()).To(Succeed())
+		}
+		testQueue = nil
+	})
+
+	// trace returns an interceptor that appends its name to the calls.
+	trace := func(name string, calls *[]string) Interceptor {
+		return func(ctx context.Context, op Operation, input interface{}, next Invoker) (interface{}, error) {
+			*calls = append(*calls, name+":"+op.Method)
+			return next(ctx, op, input)
+		}
+	}
+
+	counter := func(method string) float64 {
+		var metric dto.Metric
+		Expect(service.Collector.messageCalls.WithLabelValues(service.Configuration.QUrl, method).Write(&metric)).To(Succeed())
+		return metric.GetCounter().GetValue()
+	}
+
+	It("should call the interceptors in order", func() {
+		var calls []string
+		start(trace("first", &calls), trace("second", &calls))
+
+		_, err := service.SendMessage(&sqs.SendMessageInput{
+			MessageBody: aws.String("message"),
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(calls).To(Equal([]string{
+			"first:" + MessageMetricMethodListQueues,
+			"second:" + MessageMetricMethodListQueues,
+			"first:" + MessageMetricMethodSendMessage,
+			"second:" + MessageMetricMethodSendMessage,
+		}))
+	})
+
+	It("should wrap all the operations", func() {
+		var calls []string
+		start(trace("trace", &calls))
+		calls = nil
+
+		_, err := service.SendMessageBatch(&sqs.SendMessageBatchInput{
+			Entries: []*sqs.SendMessageBatchRequestEntry{
+				{Id: aws.String("1"), MessageBody: aws.String("message")},
+			},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		output, err := service.ReceiveMessage(&sqs.ReceiveMessageInput{})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(output.Messages).To(HaveLen(1))
+		_, err = service.DeleteMessage(&sqs.DeleteMessageInput{
+			ReceiptHandle: output.Messages[0].ReceiptHandle,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		_, err = service.DeleteMessageBatch(&sqs.DeleteMessageBatchInput{
+			Entries: []*sqs.DeleteMessageBatchRequestEntry{
+				{Id: aws.String("1"), ReceiptHandle: output.Messages[0].ReceiptHandle},
+			},
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(calls).To(Equal([]string{
+			"trace:" + MessageMetricMethodSendMessageBatch,
+			"trace:" + MessageMetricMethodReceiveMessage,
+			"trace:" + MessageMetricMethodDeleteMessage,
+			"trace:" + MessageMetricMethodDeleteMessageBatch,
+		}))
+	})
+
+	It("should let the interceptors change the input", func() {
+		start(func(ctx context.Context, op Operation, input interface{}, next Invoker) (interface{}, error) {
+			if input, ok := input.(*sqs.SendMessageInput); ok {
+				input.MessageAttributes = map[string]*sqs.MessageAttributeValue{
+					"tenant": {DataType: aws.String("String"), StringValue: aws.String("lab259")},
+				}
+			}
+			return next(ctx, op, input)
+		})
+
+		_, err := service.SendMessage(&sqs.SendMessageInput{
+			MessageBody: aws.String("message"),
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		output, err := service.ReceiveMessage(&sqs.ReceiveMessageInput{
+			MessageAttributeNames: []*string{aws.String("All")},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(output.Messages).To(HaveLen(1))
+		Expect(output.Messages[0].MessageAttributes).To(HaveKey("tenant"))
+		Expect(aws.StringValue(output.Messages[0].MessageAttributes["tenant"].StringValue)).To(Equal("lab259"))
+	})
+
+	It("should let the interceptors skip the call", func() {
+		errDenied := errors.New("denied")
+		start(func(ctx context.Context, op Operation, input interface{}, next Invoker) (interface{}, error) {
+			if op.Method == MessageMetricMethodSendMessage {
+				return nil, errDenied
+			}
+			return next(ctx, op, input)
+		})
+
+		output, err := service.SendMessage(&sqs.SendMessageInput{
+			MessageBody: aws.String("message"),
+		})
+		Expect(err).To(Equal(errDenied))
+		Expect(output).To(BeNil())
+		Expect(counter(MessageMetricMethodSendMessage)).To(BeEquivalentTo(0))
+	})
+
+	It("should fail the calls an interceptor returns no output for", func() {
+		start(func(ctx context.Context, op Operation, input interface{}, next Invoker) (interface{}, error) {
+			switch op.Method {
+			case MessageMetricMethodReceiveMessage:
+				return nil, nil
+			case MessageMetricMethodSendMessage:
+				return &sqs.DeleteMessageOutput{}, nil
+			case MessageMetricMethodGetQueueAttributes:
+				return (*sqs.GetQueueAttributesOutput)(nil), nil
+			}
+			return next(ctx, op, input)
+		})
+
+		output, err := service.ReceiveMessage(&sqs.ReceiveMessageInput{})
+		Expect(err).To(MatchError("unexpected output <nil> of ReceiveMessage on " + service.Configuration.QUrl))
+		Expect(output).To(BeNil())
+		_, err = service.SendMessage(&sqs.SendMessageInput{
+			MessageBody: aws.String("message"),
+		})
+		Expect(err).To(MatchError("unexpected output *sqs.DeleteMessageOutput of SendMessage on " + service.Configuration.QUrl))
+		_, err = service.QueueAttributes(context.Background(), nil)
+		Expect(err).To(MatchError("unexpected output *sqs.GetQueueAttributesOutput of GetQueueAttributes on " + service.Configuration.QUrl))
+	})
+
+	It("should fail the start when an interceptor fails the validation of the queue", func() {
+		errDenied := errors.New("denied")
+		configuration := validConfiguration
+		configuration.Interceptors = []Interceptor{
+			func(ctx context.Context, op Operation, input interface{}, next Invoker) (interface{}, error) {
+				return nil, errDenied
+			},
+		}
+		var s SQSService
+		Expect(s.ApplyConfiguration(configuration)).To(Succeed())
+		Expect(s.Start()).To(Equal(errDenied))
+		Expect(s.isRunning()).To(BeFalse())
+	})
+
+	It("should still record the metrics", func() {
+		var calls []string
+		start(trace("trace", &calls))
+
+		_, err := service.SendMessage(&sqs.SendMessageInput{
+			MessageBody: aws.String("message"),
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(counter(MessageMetricMethodSendMessage)).To(BeEquivalentTo(1))
+		Expect(counter(MessageMetricMethodListQueues)).To(BeEquivalentTo(1))
+	})
+
+	It("should call the interceptors when the service is not running", func() {
+		var calls []string
+		configuration := validConfiguration
+		configuration.Interceptors = []Interceptor{trace("trace", &calls)}
+		var s SQSService
+		Expect(s.ApplyConfiguration(configuration)).To(Succeed())
+
+		_, err := s.SendMessage(&sqs.SendMessageInput{
+			MessageBody: aws.String("message"),
+		})
+		Expect(err).To(Equal(rscsrv.ErrServiceNotRunning))
+		Expect(calls).To(Equal([]string{"trace:" + MessageMetricMethodSendMessage}))
+	})
+
+	It("should report the operations to the recorder", func() {
+		recorder := &recordingRecorder{}
+		interceptor := RecorderInterceptor(recorder)
+		op := Operation{Queue: "queue", Method: MessageMetricMethodSendMessage}
+
+		_, err := interceptor(context.Background(), op, &sqs.SendMessageInput{
+			MessageBody: aws.String("message"),
+		}, func(ctx context.Context, op Operation, input interface{}) (interface{}, error) {
+			return &sqs.SendMessageOutput{}, nil
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(recorder.called).To(Equal([]Operation{op}))
+		Expect(recorder.finished).To(HaveLen(1))
+		Expect(recorder.finished[0].Messages).To(Equal(1))
+		Expect(recorder.finished[0].Size).To(Equal(len("message")))
+		Expect(recorder.finished[0].RequestUnits).To(Equal(1))
+	})
+
+	It("should skip the nil entries reporting the operations", func() {
+		recorder := &recordingRecorder{}
+		interceptor := RecorderInterceptor(recorder)
+
+		_, err := interceptor(context.Background(), Operation{Method: MessageMetricMethodSendMessageBatch}, &sqs.SendMessageBatchInput{
+			Entries: []*sqs.SendMessageBatchRequestEntry{
+				{Id: aws.String("1"), MessageBody: aws.String("message")},
+				nil,
+			},
+		}, func(ctx context.Context, op Operation, input interface{}) (interface{}, error) {
+			return &sqs.SendMessageBatchOutput{}, nil
+		})
+		Expect(err).ToNot(HaveOccurred())
+		_, err = interceptor(context.Background(), Operation{Method: MessageMetricMethodReceiveMessage}, &sqs.ReceiveMessageInput{}, func(ctx context.Context, op Operation, input interface{}) (interface{}, error) {
+			return &sqs.ReceiveMessageOutput{Messages: []*sqs.Message{nil, {Body: aws.String("message")}}}, nil
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(recorder.finished).To(HaveLen(2))
+		for _, result := range recorder.finished {
+			Expect(result.Messages).To(Equal(1))
+			Expect(result.Size).To(Equal(len("message")))
+			Expect(result.RequestUnits).To(Equal(1))
+		}
+	})
+})
+
+// recordingRecorder keeps the operations reported to it.
+type recordingRecorder struct {
+	NopRecorder
+	called   []Operation
+	finished []OperationResult
+}
+
+func (recorder *recordingRecorder) Called(op Operation) {
+	recorder.called = append(recorder.called, op)
+}
+
+func (recorder *recordingRecorder) Finished(op Operation, result OperationResult) {
+	recorder.finished = append(recorder.finished, result)
+}
@@ -0,0 +1,210 @@
+package sqssrv
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	rscsrv "github.com/lab259/go-rscsrv"
+)
+
+// PollerOpts configures a Poller.
+type PollerOpts struct {
+	// QueueURL is the queue polled. Default: the QUrl of the configuration.
+	QueueURL string
+	// Pollers is the maximum number of concurrent ReceiveMessage calls.
+	// Default: 1.
+	Pollers int
+	// MaxNumberOfMessages of each ReceiveMessage. Default: 10.
+	MaxNumberOfMessages int64
+	// WaitTimeSeconds of each ReceiveMessage. Default: MaxWaitTimeSeconds.
+	WaitTimeSeconds int64
+	// VisibilityTimeout, in seconds, of the messages received. Default: the
+	// one of the queue.
+	VisibilityTimeout int64
+	// MinBackoff is how long the additional pollers wait after an empty
+	// receive. Default: 1 second.
+	MinBackoff time.Duration
+	// MaxBackoff caps the wait, which doubles on every consecutive empty
+	// receive. Default: 1 minute.
+	MaxBackoff time.Duration
+	// Handler receives the messages of every receive that returned any.
+	Handler func(ctx context.Context, messages []*sqs.Message)
+	// ErrorHandler, when set, receives the errors of ReceiveMessage.
+	ErrorHandler func(err error)
+}
+
+// Poller keeps receiving messages from a queue, with up to `Pollers`
+// concurrent long polls.
+//
+// The first poller never stops. The additional ones back off, exponentially,
+// while the receives come back empty, so idle queues are not hammered. As soon
+// as a receive returns messages, all of them are woken up again.
+type Poller struct {
+	service *SQSService
+	opts    PollerOpts
+	active  int32
+
+	m           sync.Mutex
+	emptyStreak int
+	wake        chan struct{}
+}
+
+// NewPoller creates a Poller for the service.
+func NewPoller(service *SQSService, opts *PollerOpts) *Poller {
+	poller := &Poller{
+		service: service,
+		opts:    *opts,
+		wake:    make(chan struct{}),
+	}
+	if poller.opts.Pollers < 1 {
+		poller.opts.Pollers = 1
+	}
+	if poller.opts.MaxNumberOfMessages == 0 {
+		poller.opts.MaxNumberOfMessages = 10
+	}
+	if poller.opts.WaitTimeSeconds == 0 {
+		poller.opts.WaitTimeSeconds = MaxWaitTimeSeconds
+	}
+	if poller.opts.MinBackoff == 0 {
+		poller.opts.MinBackoff = time.Second
+	}
+	if poller.opts.MaxBackoff == 0 {
+		poller.opts.MaxBackoff = time.Minute
+	}
+	if poller.opts.MaxBackoff < poller.opts.MinBackoff {
+		poller.opts.MaxBackoff = poller.opts.MinBackoff
+	}
+	return poller
+}
+
+// Run polls the queue until the context is done. It fails with
+// `rscsrv.ErrServiceNotRunning` if the service was not started.
+func (poller *Poller) Run(ctx context.Context) error {
+	if !poller.service.isRunning() {
+		return rscsrv.ErrServiceNotRunning
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(poller.opts.Pollers)
+	for i := 0; i < poller.opts.Pollers; i++ {
+		go func(primary bool) {
+			defer wg.Done()
+			poller.poll(ctx, primary)
+		}(i == 0)
+	}
+	wg.Wait()
+	return nil
+}
+
+// Active returns how many pollers are not backing off.
+func (poller *Poller) Active() int {
+	return int(atomic.LoadInt32(&poller.active))
+}
+
+func (poller *Poller) poll(ctx context.Context, primary bool) {
+	atomic.AddInt32(&poller.active, 1)
+	defer atomic.AddInt32(&poller.active, -1)
+
+	input := &sqs.ReceiveMessageInput{
+		AttributeNames:        []*string{aws.String(sqs.QueueAttributeNameAll)},
+		MessageAttributeNames: []*string{aws.String(sqs.QueueAttributeNameAll)},
+		MaxNumberOfMessages:   aws.Int64(poller.opts.MaxNumberOfMessages),
+		WaitTimeSeconds:       aws.Int64(poller.opts.WaitTimeSeconds),
+	}
+	if poller.opts.QueueURL != "" {
+		input.QueueUrl = aws.String(poller.opts.QueueURL)
+	}
+	if poller.opts.VisibilityTimeout > 0 {
+		input.VisibilityTimeout = aws.Int64(poller.opts.VisibilityTimeout)
+	}
+
+	for ctx.Err() == nil {
+		if !primary && !poller.backoff(ctx) {
+			return
+		}
+
+		output, err := poller.service.ReceiveMessageWithContext(ctx, input)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			if poller.opts.ErrorHandler != nil {
+				poller.opts.ErrorHandler(err)
+			}
+			// Even the primary poller waits before retrying a failure.
+			if primary {
+				poller.sleep(ctx, poller.opts.MinBackoff)
+			}
+			poller.received(0)
+			continue
+		}
+
+		poller.received(len(output.Messages))
+		if len(output.Messages) > 0 && poller.opts.Handler != nil {
+			poller.opts.Handler(ctx, output.Messages)
+		}
+	}
+}
+
+// received updates the streak of empty receives, waking the pollers up when
+// the messages are back.
+func (poller *Poller) received(messages int) {
+	poller.m.Lock()
+	defer poller.m.Unlock()
+
+	if messages == 0 {
+		poller.emptyStreak++
+		return
+	}
+	if poller.emptyStreak > 0 {
+		poller.emptyStreak = 0
+		close(poller.wake)
+		poller.wake = make(chan struct{})
+	}
+}
+
+// backoff waits while the receives are coming back empty. It returns false if
+// the context is done.
+func (poller *Poller) backoff(ctx context.Context) bool {
+	poller.m.Lock()
+	streak, wake := poller.emptyStreak, poller.wake
+	poller.m.Unlock()
+
+	if streak == 0 {
+		return true
+	}
+
+	wait := poller.opts.MinBackoff
+	for i := 1; i < streak && wait < poller.opts.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > poller.opts.MaxBackoff {
+		wait = poller.opts.MaxBackoff
+	}
+
+	atomic.AddInt32(&poller.active, -1)
+	defer atomic.AddInt32(&poller.active, 1)
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-wake:
+	case <-timer.C:
+	}
+	return true
+}
+
+func (poller *Poller) sleep(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
@@ -0,0 +1,134 @@
+package sqssrv
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	rscsrv "github.com/lab259/go-rscsrv"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var _ = Describe("Poller", func() {
+	It("should fail when the service is not running", func() {
+		poller := NewPoller(&SQSService{}, &PollerOpts{})
+		Expect(poller.Run(context.Background())).To(Equal(rscsrv.ErrServiceNotRunning))
+	})
+
+	Context("polling", func() {
+		var (
+			m        sync.Mutex
+			received []string
+			cancel   context.CancelFunc
+			done     chan struct{}
+		)
+
+		bodies := func() []string {
+			m.Lock()
+			defer m.Unlock()
+			return append([]string{}, received...)
+		}
+
+		run := func(opts *PollerOpts) *Poller {
+			received = nil
+			opts.Handler = func(ctx context.Context, messages []*sqs.Message) {
+				m.Lock()
+				for _, message := range messages {
+					received = append(received, aws.StringValue(message.Body))
+				}
+				m.Unlock()
+				for _, message := range messages {
+					// It fails when the poller is stopped meanwhile, so the
+					// error is not checked.
+					sqsService.DeleteMessageWithContext(ctx, &sqs.DeleteMessageInput{
+						ReceiptHandle: message.ReceiptHandle,
+					})
+				}
+			}
+			poller := NewPoller(sqsService, opts)
+
+			var ctx context.Context
+			ctx, cancel = context.WithCancel(context.Background())
+			done = make(chan struct{})
+			go func() {
+				defer GinkgoRecover()
+				defer close(done)
+				Expect(poller.Run(ctx)).To(Succeed())
+			}()
+			return poller
+		}
+
+		// Declared before InitForTesting, so the poller is stopped before the
+		// service.
+		AfterEach(func() {
+			cancel()
+			Eventually(done, 5*time.Second).Should(BeClosed())
+		})
+
+		InitForTesting()
+
+		It("should hand the messages received", func() {
+			run(&PollerOpts{
+				Pollers:         2,
+				WaitTimeSeconds: 1,
+			})
+
+			for i := 0; i < 5; i++ {
+				_, err := sqsService.SendMessage(&sqs.SendMessageInput{
+					MessageBody: aws.String(fmt.Sprintf("message %d", i)),
+				})
+				Expect(err).ToNot(HaveOccurred())
+			}
+
+			Eventually(bodies, 5*time.Second).Should(ConsistOf("message 0", "message 1", "message 2", "message 3", "message 4"))
+		})
+
+		It("should back the additional pollers off while the queue is empty", func() {
+			poller := run(&PollerOpts{
+				Pollers:         4,
+				WaitTimeSeconds: 1,
+				MinBackoff:      50 * time.Millisecond,
+				MaxBackoff:      5 * time.Second,
+			})
+
+			Eventually(poller.Active, 5*time.Second, time.Millisecond).Should(Equal(1))
+
+			var metric dto.Metric
+			Expect(sqsService.Collector.messageEmptyReceives.With(prometheus.Labels{
+				"queue":  sqsService.Configuration.QUrl,
+				"method": MessageMetricMethodReceiveMessage,
+			}).Write(&metric)).To(Succeed())
+			Expect(metric.GetCounter().GetValue()).To(BeNumerically(">", 0))
+		})
+
+		It("should wake the pollers up when the messages are back", func() {
+			poller := run(&PollerOpts{
+				Pollers:             4,
+				MaxNumberOfMessages: 1,
+				WaitTimeSeconds:     1,
+				MinBackoff:          time.Minute,
+				MaxBackoff:          time.Minute,
+			})
+
+			Eventually(poller.Active, 5*time.Second, time.Millisecond).Should(Equal(1))
+
+			for i := 0; i < 10; i++ {
+				_, err := sqsService.SendMessage(&sqs.SendMessageInput{
+					MessageBody: aws.String(fmt.Sprintf("message %d", i)),
+				})
+				Expect(err).ToNot(HaveOccurred())
+			}
+
+			// The backoff is a minute, so only being woken up would let the
+			// additional pollers run.
+			Eventually(poller.Active, 5*time.Second, time.Millisecond).Should(BeNumerically(">", 1))
+			Eventually(bodies, 5*time.Second).Should(HaveLen(10))
+		})
+	})
+})
@@ -0,0 +1,179 @@
+package sqssrv
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// ErrMissingQueueURL is returned by DeleteQueue when the input has no
+// QueueUrl. Unlike the other wrappers, it does not default to the QUrl of the
+// configuration.
+var ErrMissingQueueURL = errors.New("the queue URL to delete is missing")
+
+// CreateQueueConfiguration makes Start create the queue of the configuration
+// when it does not exist. A queue whose name ends with ".fifo" is created as
+// a FIFO queue.
+type CreateQueueConfiguration struct {
+	// Attributes of the queue.
+	Attributes QueueAttributes `yaml:"attributes"`
+	// ContentBasedDeduplication of a FIFO queue.
+	ContentBasedDeduplication bool `yaml:"content_based_deduplication"`
+	// Tags of the queue, and of its dead letter queue.
+	Tags map[string]string `yaml:"tags"`
+	// DeadLetterQueue is created too, if informed, and set as the target of
+	// the redrive policy of the queue.
+	DeadLetterQueue *DeadLetterQueueConfiguration `yaml:"dead_letter_queue"`
+}
+
+// DeadLetterQueueConfiguration is the dead letter queue created along with a
+// queue.
+type DeadLetterQueueConfiguration struct {
+	// Name of the dead letter queue. Default: the name of the queue with the
+	// "-dlq" suffix (before the ".fifo").
+	Name string `yaml:"name"`
+	// MaxReceiveCount of the redrive policy. Default: 3.
+	MaxReceiveCount int `yaml:"max_receive_count"`
+	// Attributes of the dead letter queue, e.g. a longer retention.
+	Attributes QueueAttributes `yaml:"attributes"`
+}
+
+// name returns the name of the dead letter queue of a queue.
+func (configuration *DeadLetterQueueConfiguration) name(queue string) string {
+	if configuration.Name != "" {
+		return configuration.Name
+	}
+	if strings.HasSuffix(queue, ".fifo") {
+		return strings.TrimSuffix(queue, ".fifo") + "-dlq.fifo"
+	}
+	return queue + "-dlq"
+}
+
+// createQueue creates the queue, and its dead letter queue, according to the
+// configuration. It is called by Start, with the lock held, so it calls SQS
+// through the invoker being built.
+func (configuration *CreateQueueConfiguration) createQueue(ctx context.Context, invoker Invoker, name string) error {
+	attributes, err := configuration.Attributes.Map()
+	if err != nil {
+		return err
+	}
+	fifo := strings.HasSuffix(name, ".fifo")
+	if dlq := configuration.DeadLetterQueue; dlq != nil {
+		dlqAttributes, err := dlq.Attributes.Map()
+		if err != nil {
+			return err
+		}
+		if fifo {
+			dlqAttributes[sqs.QueueAttributeNameFifoQueue] = aws.String("true")
+		}
+		dlqURL, err := configuration.create(ctx, invoker, dlq.name(name), dlqAttributes)
+		if err != nil {
+			return err
+		}
+		op := Operation{
+			Queue:  dlqURL,
+			Method: MessageMetricMethodGetQueueAttributes,
+		}
+		output, err := invoker(ctx, op, &sqs.GetQueueAttributesInput{
+			QueueUrl:       aws.String(dlqURL),
+			AttributeNames: []*string{aws.String(sqs.QueueAttributeNameQueueArn)},
+		})
+		if err != nil {
+			return err
+		}
+		out, ok := output.(*sqs.GetQueueAttributesOutput)
+		if !ok || out == nil {
+			return unexpectedOutputError(op, output)
+		}
+		maxReceiveCount := dlq.MaxReceiveCount
+		if maxReceiveCount == 0 {
+			maxReceiveCount = 3
+		}
+		redrive, err := (&QueueAttributes{
+			RedrivePolicy: &RedrivePolicy{
+				DeadLetterTargetArn: aws.StringValue(out.Attributes[sqs.QueueAttributeNameQueueArn]),
+				MaxReceiveCount:     maxReceiveCount,
+			},
+		}).Map()
+		if err != nil {
+			return err
+		}
+		attributes[sqs.QueueAttributeNameRedrivePolicy] = redrive[sqs.QueueAttributeNameRedrivePolicy]
+	}
+	if fifo {
+		attributes[sqs.QueueAttributeNameFifoQueue] = aws.String("true")
+		if configuration.ContentBasedDeduplication {
+			attributes[sqs.QueueAttributeNameContentBasedDeduplication] = aws.String("true")
+		}
+	}
+	_, err = configuration.create(ctx, invoker, name, attributes)
+	return err
+}
+
+// create creates a queue, and tags it, returning its URL. Creating a queue
+// that already exists with the same attributes just returns its URL.
+func (configuration *CreateQueueConfiguration) create(ctx context.Context, invoker Invoker, name string, attributes map[string]*string) (string, error) {
+	op := Operation{
+		Queue:  name,
+		Method: MessageMetricMethodCreateQueue,
+	}
+	output, err := invoker(ctx, op, &sqs.CreateQueueInput{
+		QueueName:  aws.String(name),
+		Attributes: attributes,
+	})
+	if err != nil {
+		return "", err
+	}
+	out, ok := output.(*sqs.CreateQueueOutput)
+	if !ok || out == nil {
+		return "", unexpectedOutputError(op, output)
+	}
+	queueURL := aws.StringValue(out.QueueUrl)
+	if len(configuration.Tags) > 0 {
+		_, err = invoker(ctx, Operation{
+			Queue:  queueURL,
+			Method: MessageMetricMethodTagQueue,
+		}, &sqs.TagQueueInput{
+			QueueUrl: aws.String(queueURL),
+			Tags:     aws.StringMap(configuration.Tags),
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	return queueURL, nil
+}
+
+// CreateQueue is a wrapper for the `sqs.SQS.CreateQueue`.
+func (service *SQSService) CreateQueue(input *sqs.CreateQueueInput) (*sqs.CreateQueueOutput, error) {
+	return service.CreateQueueWithContext(context.Background(), input)
+}
+
+// CreateQueueWithContext is a wrapper for the `sqs.SQS.CreateQueueWithContext`.
+// As the queue has no URL yet, the call is reported with its name.
+func (service *SQSService) CreateQueueWithContext(ctx context.Context, input *sqs.CreateQueueInput) (*sqs.CreateQueueOutput, error) {
+	output, err := service.invoke(ctx, MessageMetricMethodCreateQueue, input.QueueName, input)
+	out, _ := output.(*sqs.CreateQueueOutput)
+	return out, err
+}
+
+// DeleteQueue is a wrapper for the `sqs.SQS.DeleteQueue`.
+func (service *SQSService) DeleteQueue(input *sqs.DeleteQueueInput) (*sqs.DeleteQueueOutput, error) {
+	return service.DeleteQueueWithContext(context.Background(), input)
+}
+
+// DeleteQueueWithContext is a wrapper for the `sqs.SQS.DeleteQueueWithContext`.
+//
+// As deleting is destructive, the QueueUrl must be informed: it fails with
+// ErrMissingQueueURL otherwise.
+func (service *SQSService) DeleteQueueWithContext(ctx context.Context, input *sqs.DeleteQueueInput) (*sqs.DeleteQueueOutput, error) {
+	if aws.StringValue(input.QueueUrl) == "" {
+		return nil, ErrMissingQueueURL
+	}
+	output, err := service.invoke(ctx, MessageMetricMethodDeleteQueue, input.QueueUrl, input)
+	out, _ := output.(*sqs.DeleteQueueOutput)
+	return out, err
+}
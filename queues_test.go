@@ -0,0 +1,250 @@
+package sqssrv
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	rscsrv "github.com/lab259/go-rscsrv"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var _ = Describe("Queues", func() {
+	var (
+		service *SQSService
+		name    string
+	)
+
+	BeforeEach(func() {
+		var err error
+		name, err = testQueueName("sqssrv-create")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		if service == nil {
+			return
+		}
+		Expect(deleteTestQueues(service, name)).To(Succeed())
+		Expect(service.Stop()).To(Succeed())
+		service = nil
+	})
+
+	start := func(queue string, createQueue *CreateQueueConfiguration) error {
+		configuration := validConfiguration
+		configuration.QUrl = validConfiguration.Endpoint + "/queue/" + queue
+		configuration.CreateQueue = createQueue
+		service = &SQSService{}
+		Expect(service.ApplyConfiguration(configuration)).To(Succeed())
+		return service.Start()
+	}
+
+	// attributes reads the attributes of a queue, by name, straight from SQS.
+	attributes := func(queue string) map[string]string {
+		var attributes map[string]string
+		Expect(service.RunWithClient(func(client sqsiface.SQSAPI) error {
+			urlOutput, err := client.GetQueueUrl(&sqs.GetQueueUrlInput{QueueName: aws.String(queue)})
+			if err != nil {
+				return err
+			}
+			output, err := client.GetQueueAttributes(&sqs.GetQueueAttributesInput{
+				QueueUrl:       urlOutput.QueueUrl,
+				AttributeNames: []*string{aws.String(sqs.QueueAttributeNameAll)},
+			})
+			if err != nil {
+				return err
+			}
+			attributes = aws.StringValueMap(output.Attributes)
+			return nil
+		})).To(Succeed())
+		return attributes
+	}
+
+	tags := func(queue string) map[string]string {
+		var tags map[string]string
+		Expect(service.RunWithClient(func(client sqsiface.SQSAPI) error {
+			urlOutput, err := client.GetQueueUrl(&sqs.GetQueueUrlInput{QueueName: aws.String(queue)})
+			if err != nil {
+				return err
+			}
+			output, err := client.ListQueueTags(&sqs.ListQueueTagsInput{QueueUrl: urlOutput.QueueUrl})
+			if err != nil {
+				return err
+			}
+			tags = aws.StringValueMap(output.Tags)
+			return nil
+		})).To(Succeed())
+		return tags
+	}
+
+	calls := func(queue, method string) float64 {
+		var metric dto.Metric
+		Expect(service.Collector.messageCalls.With(prometheus.Labels{
+			"queue":  queue,
+			"method": method,
+		}).Write(&metric)).To(Succeed())
+		return metric.GetCounter().GetValue()
+	}
+
+	Context("creating the missing queue on Start", func() {
+		It("should create the queue with the attributes and tags", func() {
+			Expect(start(name, &CreateQueueConfiguration{
+				Attributes: QueueAttributes{
+					VisibilityTimeout: duration(45 * time.Second),
+					Delay:             duration(2 * time.Second),
+				},
+				Tags: map[string]string{"team": "mail"},
+			})).To(Succeed())
+
+			Expect(attributes(name)).To(And(
+				HaveKeyWithValue(sqs.QueueAttributeNameVisibilityTimeout, "45"),
+				HaveKeyWithValue(sqs.QueueAttributeNameDelaySeconds, "2"),
+			))
+			Expect(tags(name)).To(Equal(map[string]string{"team": "mail"}))
+			Expect(calls(name, MessageMetricMethodCreateQueue)).To(BeEquivalentTo(1))
+
+			_, err := service.SendMessage(&sqs.SendMessageInput{
+				MessageBody: aws.String("message"),
+			})
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("should not create a queue that exists", func() {
+			Expect(start(name, &CreateQueueConfiguration{
+				Attributes: QueueAttributes{VisibilityTimeout: duration(45 * time.Second)},
+			})).To(Succeed())
+			Expect(service.Stop()).To(Succeed())
+
+			// Even with different attributes.
+			service.Configuration.CreateQueue.Attributes.VisibilityTimeout = duration(10 * time.Second)
+			Expect(service.Start()).To(Succeed())
+			Expect(calls(name, MessageMetricMethodCreateQueue)).To(BeEquivalentTo(1))
+			Expect(attributes(name)).To(HaveKeyWithValue(sqs.QueueAttributeNameVisibilityTimeout, "45"))
+		})
+
+		It("should create the dead letter queue with the redrive policy", func() {
+			Expect(start(name, &CreateQueueConfiguration{
+				Tags: map[string]string{"team": "mail"},
+				DeadLetterQueue: &DeadLetterQueueConfiguration{
+					MaxReceiveCount: 5,
+					Attributes: QueueAttributes{
+						MessageRetentionPeriod: duration(14 * 24 * time.Hour),
+					},
+				},
+			})).To(Succeed())
+
+			dlq := attributes(name + "-dlq")
+			Expect(dlq).To(HaveKeyWithValue(sqs.QueueAttributeNameMessageRetentionPeriod, "1209600"))
+			Expect(tags(name + "-dlq")).To(Equal(map[string]string{"team": "mail"}))
+
+			queue, err := ParseQueueAttributes(aws.StringMap(attributes(name)))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(queue.RedrivePolicy).To(Equal(&RedrivePolicy{
+				DeadLetterTargetArn: dlq[sqs.QueueAttributeNameQueueArn],
+				MaxReceiveCount:     5,
+			}))
+		})
+
+		It("should reuse a dead letter queue that exists", func() {
+			Expect(start(name+"-dlq", &CreateQueueConfiguration{})).To(Succeed())
+			Expect(service.Stop()).To(Succeed())
+
+			Expect(start(name, &CreateQueueConfiguration{
+				DeadLetterQueue: &DeadLetterQueueConfiguration{},
+			})).To(Succeed())
+			queue, err := ParseQueueAttributes(aws.StringMap(attributes(name)))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(queue.RedrivePolicy.MaxReceiveCount).To(Equal(3))
+		})
+
+		It("should create a FIFO queue", func() {
+			Expect(start(name+".fifo", &CreateQueueConfiguration{
+				ContentBasedDeduplication: true,
+				DeadLetterQueue:           &DeadLetterQueueConfiguration{},
+			})).To(Succeed())
+
+			Expect(attributes(name + ".fifo")).To(And(
+				HaveKeyWithValue(sqs.QueueAttributeNameFifoQueue, "true"),
+				HaveKeyWithValue(sqs.QueueAttributeNameContentBasedDeduplication, "true"),
+			))
+			Expect(attributes(name + "-dlq.fifo")).To(HaveKeyWithValue(sqs.QueueAttributeNameFifoQueue, "true"))
+		})
+
+		It("should fail when the creation has no output", func() {
+			configuration := validConfiguration
+			configuration.QUrl = validConfiguration.Endpoint + "/queue/" + name
+			configuration.CreateQueue = &CreateQueueConfiguration{}
+			configuration.Interceptors = []Interceptor{
+				func(ctx context.Context, op Operation, input interface{}, next Invoker) (interface{}, error) {
+					if op.Method == MessageMetricMethodCreateQueue {
+						return nil, nil
+					}
+					return next(ctx, op, input)
+				},
+			}
+			service = &SQSService{}
+			Expect(service.ApplyConfiguration(configuration)).To(Succeed())
+			Expect(service.Start()).To(MatchError("unexpected output <nil> of CreateQueue on " + name))
+			service = nil
+		})
+
+		It("should not create anything with invalid attributes", func() {
+			err := start(name, &CreateQueueConfiguration{
+				Attributes:      QueueAttributes{Delay: duration(time.Hour)},
+				DeadLetterQueue: &DeadLetterQueueConfiguration{},
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("DelaySeconds"))
+			Expect(calls(name, MessageMetricMethodCreateQueue)).To(BeEquivalentTo(0))
+			Expect(calls(name+"-dlq", MessageMetricMethodCreateQueue)).To(BeEquivalentTo(0))
+			service = nil
+		})
+	})
+
+	Context("not running the service", func() {
+		It("should fail creating a queue", func() {
+			_, err := (&SQSService{}).CreateQueue(&sqs.CreateQueueInput{
+				QueueName: aws.String("queue"),
+			})
+			Expect(err).To(Equal(rscsrv.ErrServiceNotRunning))
+		})
+
+		It("should fail deleting a queue", func() {
+			_, err := (&SQSService{}).DeleteQueueWithContext(context.Background(), &sqs.DeleteQueueInput{
+				QueueUrl: aws.String(validConfiguration.QUrl),
+			})
+			Expect(err).To(Equal(rscsrv.ErrServiceNotRunning))
+		})
+	})
+
+	Context("the wrappers", func() {
+		It("should create and delete queues", func() {
+			Expect(start(name, &CreateQueueConfiguration{})).To(Succeed())
+
+			output, err := service.CreateQueueWithContext(context.Background(), &sqs.CreateQueueInput{
+				QueueName: aws.String(name + "-other"),
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(aws.StringValue(output.QueueUrl)).To(HaveSuffix("/" + name + "-other"))
+			Expect(calls(name+"-other", MessageMetricMethodCreateQueue)).To(BeEquivalentTo(1))
+
+			_, err = service.DeleteQueue(&sqs.DeleteQueueInput{
+				QueueUrl: output.QueueUrl,
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(calls(aws.StringValue(output.QueueUrl), MessageMetricMethodDeleteQueue)).To(BeEquivalentTo(1))
+
+			// Not the queue of the configuration, by default.
+			_, err = service.DeleteQueue(&sqs.DeleteQueueInput{})
+			Expect(err).To(Equal(ErrMissingQueueURL))
+			Expect(calls(service.Configuration.QUrl, MessageMetricMethodDeleteQueue)).To(BeEquivalentTo(0))
+			_, err = service.QueueAttributes(context.Background(), nil)
+			Expect(err).ToNot(HaveOccurred())
+		})
+	})
+})
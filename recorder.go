@@ -0,0 +1,246 @@
+package sqssrv
+
+import (
+	"time"
+)
+
+// Operation identifies an operation executed by the SQSService.
+type Operation struct {
+	// Queue is the URL of the queue.
+	Queue string
+	// Method is one of the `MessageMetricMethod*` constants.
+	Method string
+}
+
+// OperationResult describes how an operation went.
+type OperationResult struct {
+	// Duration is how long the call to SQS took.
+	Duration time.Duration
+	// Err is the error returned by SQS, if any.
+	Err error
+	// Messages is the number of messages trafficked.
+	Messages int
+	// Size is the total size (number of characters) of the bodies of the
+	// messages trafficked.
+	Size int
+	// RequestUnits is the number of requests billed by SQS for the call: one
+	// for every RequestUnitSize of payload, at least one.
+	RequestUnits int
+	// Fault is the fault injected in the operation by a FaultRule: the
+	// ErrorCode, FaultLatency, FaultTimeout or FaultPartialBatch. It is empty
+	// for the real operations.
+	Fault string
+}
+
+// IsEmptyReceive tells if the result is of a ReceiveMessage that succeeded
+// without returning any message.
+func (result OperationResult) IsEmptyReceive(op Operation) bool {
+	return op.Method == MessageMetricMethodReceiveMessage && result.Err == nil && result.Messages == 0
+}
+
+// Handling identifies a message being handled by a Consumer.
+type Handling struct {
+	// Queue is the URL of the queue.
+	Queue string
+	// MessageType is the type of the message, as given by
+	// ConsumerOpts.MessageType. It is empty when the consumer does not
+	// classify the messages.
+	MessageType string
+}
+
+// HandlerOutcome is how the handling of a message ended.
+type HandlerOutcome string
+
+const (
+	// HandlerOutcomeAcked means the handler succeeded and the message was
+	// deleted.
+	HandlerOutcomeAcked HandlerOutcome = "acked"
+	// HandlerOutcomeNacked means the handler failed, so the message is left
+	// to be received again.
+	HandlerOutcomeNacked HandlerOutcome = "nacked"
+	// HandlerOutcomePanicked means the handler panicked.
+	HandlerOutcomePanicked HandlerOutcome = "panicked"
+	// HandlerOutcomeTimedOut means the handler took longer than
+	// ConsumerOpts.Timeout.
+	HandlerOutcomeTimedOut HandlerOutcome = "timed_out"
+	// HandlerOutcomeRetried means the handling failed and the message was
+	// re-sent by the RetryPolicy, to be handled again after a delay.
+	HandlerOutcomeRetried HandlerOutcome = "retried"
+	// HandlerOutcomeParked means the handling failed after the last retry of
+	// the RetryPolicy and the message was sent to its ParkingQueue.
+	HandlerOutcomeParked HandlerOutcome = "parked"
+	// HandlerOutcomeDeadLettered means the message was moved to the queue of
+	// the DeadLetterPolicy, for the HandlerResult.DeadLetterReason.
+	HandlerOutcomeDeadLettered HandlerOutcome = "dead_lettered"
+)
+
+// HandlerResult describes how the handling of a message went.
+type HandlerResult struct {
+	// Duration is how long the handler took.
+	Duration time.Duration
+	// Outcome is how the handling ended.
+	Outcome HandlerOutcome
+	// DeadLetterReason is why the message was dead-lettered, when the Outcome
+	// is HandlerOutcomeDeadLettered.
+	DeadLetterReason DeadLetterReason
+}
+
+// LifecycleAction is an action changing the state of the SQSService.
+type LifecycleAction string
+
+const (
+	// LifecycleActionStart is a call to SQSService.Start.
+	LifecycleActionStart LifecycleAction = "start"
+	// LifecycleActionStop is a call to SQSService.Stop.
+	LifecycleActionStop LifecycleAction = "stop"
+	// LifecycleActionRestart is a call to SQSService.Restart, which also
+	// reports its stop and start.
+	LifecycleActionRestart LifecycleAction = "restart"
+)
+
+// LifecycleEvent describes how a Start, Stop or Restart went.
+type LifecycleEvent struct {
+	// Queue is the URL of the queue of the service.
+	Queue string
+	// Action is what was called.
+	Action LifecycleAction
+	// Err is the error returned, if any.
+	Err error
+	// Running tells if the service is running after the action.
+	Running bool
+	// ValidationDuration is how long Start took checking that the queue
+	// exists. It is zero when the validation did not happen.
+	ValidationDuration time.Duration
+}
+
+// AttributeDrift is a queue attribute whose live value differs from the
+// expected one.
+type AttributeDrift struct {
+	// Name is the SQS name of the attribute, e.g. "VisibilityTimeout".
+	Name string
+	// Current is the value of the attribute on SQS, empty when it is not set.
+	Current string
+	// Expected is the value of the attribute in the configuration.
+	Expected string
+	// Critical tells if the attribute is one of DriftConfiguration.Critical.
+	Critical bool
+}
+
+// DriftEvent describes a check of the attributes of a queue against the
+// DriftConfiguration.
+type DriftEvent struct {
+	// Queue is the URL of the queue.
+	Queue string
+	// Checked are the names of all the attributes compared, drifted or not.
+	Checked []string
+	// Drifts are the attributes that differ from the expected values.
+	Drifts []AttributeDrift
+	// Err is the error reading the attributes, if any. Nothing was checked
+	// when it is set.
+	Err error
+}
+
+// Recorder receives the metrics of every operation executed by the
+// SQSService, and of the messages handled by its consumers. It allows
+// exporting metrics to backends other than Prometheus.
+//
+// Implementations must be safe for concurrent use.
+type Recorder interface {
+	// Called is called before every operation, even if the service is not
+	// running.
+	Called(op Operation)
+
+	// Finished is called after the operation reached SQS.
+	Finished(op Operation, result OperationResult)
+
+	// HandlerStarted is called when a consumer starts handling a message. The
+	// message is in flight until HandlerFinished is called.
+	HandlerStarted(handling Handling)
+
+	// HandlerFinished is called when a consumer finishes handling a message.
+	HandlerFinished(handling Handling, result HandlerResult)
+
+	// WorkersUsed is called whenever the number of busy workers of a consumer
+	// changes.
+	WorkersUsed(queue string, busy, workers int)
+
+	// Lifecycle is called after every Start, Stop and Restart of the service.
+	Lifecycle(event LifecycleEvent)
+
+	// Drift is called after every check of the attributes of the queue.
+	Drift(event DriftEvent)
+}
+
+// NopRecorder is a Recorder that discards everything.
+type NopRecorder struct{}
+
+// Called implements Recorder.
+func (NopRecorder) Called(Operation) {}
+
+// Finished implements Recorder.
+func (NopRecorder) Finished(Operation, OperationResult) {}
+
+// HandlerStarted implements Recorder.
+func (NopRecorder) HandlerStarted(Handling) {}
+
+// HandlerFinished implements Recorder.
+func (NopRecorder) HandlerFinished(Handling, HandlerResult) {}
+
+// WorkersUsed implements Recorder.
+func (NopRecorder) WorkersUsed(string, int, int) {}
+
+// Lifecycle implements Recorder.
+func (NopRecorder) Lifecycle(LifecycleEvent) {}
+
+// Drift implements Recorder.
+func (NopRecorder) Drift(DriftEvent) {}
+
+type multiRecorder []Recorder
+
+// MultiRecorder returns a Recorder that forwards everything to all the given
+// recorders.
+func MultiRecorder(recorders ...Recorder) Recorder {
+	return multiRecorder(recorders)
+}
+
+func (recorders multiRecorder) Called(op Operation) {
+	for _, recorder := range recorders {
+		recorder.Called(op)
+	}
+}
+
+func (recorders multiRecorder) Finished(op Operation, result OperationResult) {
+	for _, recorder := range recorders {
+		recorder.Finished(op, result)
+	}
+}
+
+func (recorders multiRecorder) HandlerStarted(handling Handling) {
+	for _, recorder := range recorders {
+		recorder.HandlerStarted(handling)
+	}
+}
+
+func (recorders multiRecorder) HandlerFinished(handling Handling, result HandlerResult) {
+	for _, recorder := range recorders {
+		recorder.HandlerFinished(handling, result)
+	}
+}
+
+func (recorders multiRecorder) WorkersUsed(queue string, busy, workers int) {
+	for _, recorder := range recorders {
+		recorder.WorkersUsed(queue, busy, workers)
+	}
+}
+
+func (recorders multiRecorder) Lifecycle(event LifecycleEvent) {
+	for _, recorder := range recorders {
+		recorder.Lifecycle(event)
+	}
+}
+
+func (recorders multiRecorder) Drift(event DriftEvent) {
+	for _, recorder := range recorders {
+		recorder.Drift(event)
+	}
+}
@@ -0,0 +1,494 @@
+package sqssrv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// recorderReader reads the value of a metric ("calls", "duration", "success",
+// "failures", "traffic_amount", "traffic_size", "empty_receives",
+// "request_units" or "injected_faults") of a queue and method.
+type recorderReader func(metric, queue, method string) float64
+
+// statsDBuffer is an io.Writer that aggregates the StatsD packets written on
+// it.
+type statsDBuffer struct {
+	m       sync.Mutex
+	packets []string
+}
+
+func (buf *statsDBuffer) Write(p []byte) (int, error) {
+	buf.m.Lock()
+	defer buf.m.Unlock()
+	buf.packets = append(buf.packets, string(p))
+	return len(p), nil
+}
+
+// sum adds the values of the metrics with the given name. When tags are
+// informed, only the metrics with all of them are considered.
+func (buf *statsDBuffer) sum(name string, tags ...string) float64 {
+	buf.m.Lock()
+	defer buf.m.Unlock()
+
+	var total float64
+	for _, packet := range buf.packets {
+		for _, line := range strings.Split(packet, "\n") {
+			parts := strings.Split(line, "|")
+			nameValue := strings.SplitN(parts[0], ":", 2)
+			if nameValue[0] != name {
+				continue
+			}
+			matches := true
+			for _, tag := range tags {
+				if len(parts) < 3 || !strings.Contains(","+strings.TrimPrefix(parts[2], "#")+",", ","+tag+",") {
+					matches = false
+				}
+			}
+			if !matches {
+				continue
+			}
+			value, err := strconv.ParseFloat(nameValue[1], 64)
+			Expect(err).ToNot(HaveOccurred())
+			total += value
+		}
+	}
+	return total
+}
+
+// recorderBackends are the recorders the Recorder specs run for. The
+// OpenTelemetry recorder lives in its own module, so its sqsotel specs repeat
+// these, one for one, and check they are all there.
+var recorderBackends = []struct {
+	name string
+	new  func() (Recorder, recorderReader)
+}{
+	{
+		name: "Prometheus",
+		new: func() (Recorder, recorderReader) {
+			collector := NewSQSServiceCollector(&SQSServiceCollectorOpts{})
+			vectors := map[string]*prometheus.CounterVec{
+				"calls":          collector.messageCalls,
+				"duration":       collector.messageDuration,
+				"success":        collector.messageSuccess,
+				"failures":       collector.messageFailures,
+				"traffic_amount": collector.messageTrafficAmount,
+				"traffic_size":   collector.messageTrafficSize,
+				"empty_receives": collector.messageEmptyReceives,
+				"request_units":  collector.messageRequestUnits,
+			}
+			return collector, func(metric, queue, method string) float64 {
+				if metric == "injected_faults" {
+					// Sums up all the faults.
+					ch := make(chan prometheus.Metric, 100)
+					collector.messageInjectedFaults.Collect(ch)
+					close(ch)
+					var total float64
+					for metric := range ch {
+						var m dto.Metric
+						Expect(metric.Write(&m)).To(Succeed())
+						labels := make(map[string]string)
+						for _, label := range m.GetLabel() {
+							labels[label.GetName()] = label.GetValue()
+						}
+						if labels["queue"] == queue && labels["method"] == method {
+							total += m.GetCounter().GetValue()
+						}
+					}
+					return total
+				}
+				var m dto.Metric
+				Expect(vectors[metric].With(prometheus.Labels{
+					"queue":  queue,
+					"method": method,
+				}).Write(&m)).To(Succeed())
+				return m.GetCounter().GetValue()
+			}
+		},
+	},
+	{
+		name: "StatsD",
+		new: func() (Recorder, recorderReader) {
+			var buf statsDBuffer
+			recorder, err := NewStatsDRecorder(&StatsDRecorderOpts{
+				Writer: &buf,
+				Tags:   true,
+			})
+			Expect(err).ToNot(HaveOccurred())
+			return recorder, func(metric, queue, method string) float64 {
+				value := buf.sum("sqs.message."+metric, "queue:"+queue, "method:"+method)
+				if metric == "duration" {
+					// Timers are sent in milliseconds.
+					value /= 1000
+				}
+				return value
+			}
+		},
+	},
+}
+
+var _ = Describe("Recorder", func() {
+	for _, backend := range recorderBackends {
+		backend := backend
+
+		Context("using the "+backend.name+" recorder", func() {
+			var (
+				service   *SQSService
+				testQueue *TestQueue
+				read      recorderReader
+			)
+
+			BeforeEach(func() {
+				var recorder Recorder
+				recorder, read = backend.new()
+				service = &SQSService{Recorder: recorder}
+				Expect(service.ApplyConfiguration(&validConfiguration)).To(Succeed())
+				var err error
+				testQueue, err = NewTestQueue(service, nil)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			AfterEach(func() {
+				Expect(testQueue.Close()).To(Succeed())
+			})
+
+			It("should not create a collector", func() {
+				Expect(service.Collector).To(BeNil())
+			})
+
+			It("should record SendMessage", func() {
+				_, err := service.SendMessageWithContext(context.Background(), &sqs.SendMessageInput{
+					MessageBody: aws.String("testing message size 1"),
+				})
+				Expect(err).ToNot(HaveOccurred())
+
+				queue := service.Configuration.QUrl
+				Expect(read("calls", queue, MessageMetricMethodSendMessage)).To(BeEquivalentTo(1))
+				Expect(read("duration", queue, MessageMetricMethodSendMessage)).To(BeNumerically(">", 0))
+				Expect(read("success", queue, MessageMetricMethodSendMessage)).To(BeEquivalentTo(1))
+				Expect(read("failures", queue, MessageMetricMethodSendMessage)).To(BeEquivalentTo(0))
+				Expect(read("traffic_amount", queue, MessageMetricMethodSendMessage)).To(BeEquivalentTo(1))
+				Expect(read("traffic_size", queue, MessageMetricMethodSendMessage)).To(BeEquivalentTo(22))
+				Expect(read("request_units", queue, MessageMetricMethodSendMessage)).To(BeEquivalentTo(1))
+			})
+
+			It("should record SendMessageBatch", func() {
+				_, err := service.SendMessageBatch(&sqs.SendMessageBatchInput{
+					Entries: []*sqs.SendMessageBatchRequestEntry{
+						{Id: aws.String("message1"), MessageBody: aws.String("testing this body 1")},
+						{Id: aws.String("message2"), MessageBody: aws.String("testing this body 2")},
+					},
+				})
+				Expect(err).ToNot(HaveOccurred())
+
+				queue := service.Configuration.QUrl
+				Expect(read("calls", queue, MessageMetricMethodSendMessageBatch)).To(BeEquivalentTo(1))
+				Expect(read("duration", queue, MessageMetricMethodSendMessageBatch)).To(BeNumerically(">", 0))
+				Expect(read("success", queue, MessageMetricMethodSendMessageBatch)).To(BeEquivalentTo(1))
+				Expect(read("traffic_amount", queue, MessageMetricMethodSendMessageBatch)).To(BeEquivalentTo(2))
+				Expect(read("traffic_size", queue, MessageMetricMethodSendMessageBatch)).To(BeEquivalentTo(38))
+			})
+
+			It("should record ReceiveMessage, DeleteMessage and DeleteMessageBatch", func() {
+				_, err := service.SendMessageBatch(&sqs.SendMessageBatchInput{
+					Entries: []*sqs.SendMessageBatchRequestEntry{
+						{Id: aws.String("message1"), MessageBody: aws.String("testing this body 1")},
+						{Id: aws.String("message2"), MessageBody: aws.String("testing this body 2")},
+						{Id: aws.String("message3"), MessageBody: aws.String("testing this body 3")},
+					},
+				})
+				Expect(err).ToNot(HaveOccurred())
+
+				var messages []*sqs.Message
+				for len(messages) < 3 {
+					output, err := service.ReceiveMessage(&sqs.ReceiveMessageInput{
+						MaxNumberOfMessages: aws.Int64(10),
+						WaitTimeSeconds:     aws.Int64(1),
+					})
+					Expect(err).ToNot(HaveOccurred())
+					messages = append(messages, output.Messages...)
+				}
+
+				_, err = service.DeleteMessage(&sqs.DeleteMessageInput{
+					ReceiptHandle: messages[0].ReceiptHandle,
+				})
+				Expect(err).ToNot(HaveOccurred())
+				_, err = service.DeleteMessageBatch(&sqs.DeleteMessageBatchInput{
+					Entries: []*sqs.DeleteMessageBatchRequestEntry{
+						{Id: aws.String("message2"), ReceiptHandle: messages[1].ReceiptHandle},
+						{Id: aws.String("message3"), ReceiptHandle: messages[2].ReceiptHandle},
+					},
+				})
+				Expect(err).ToNot(HaveOccurred())
+
+				queue := service.Configuration.QUrl
+				Expect(read("calls", queue, MessageMetricMethodReceiveMessage)).To(BeNumerically(">=", 1))
+				Expect(read("duration", queue, MessageMetricMethodReceiveMessage)).To(BeNumerically(">", 0))
+				Expect(read("traffic_amount", queue, MessageMetricMethodReceiveMessage)).To(BeEquivalentTo(3))
+				Expect(read("traffic_size", queue, MessageMetricMethodReceiveMessage)).To(BeEquivalentTo(57))
+
+				Expect(read("calls", queue, MessageMetricMethodDeleteMessage)).To(BeEquivalentTo(1))
+				Expect(read("success", queue, MessageMetricMethodDeleteMessage)).To(BeEquivalentTo(1))
+				Expect(read("traffic_amount", queue, MessageMetricMethodDeleteMessage)).To(BeEquivalentTo(1))
+
+				Expect(read("calls", queue, MessageMetricMethodDeleteMessageBatch)).To(BeEquivalentTo(1))
+				Expect(read("success", queue, MessageMetricMethodDeleteMessageBatch)).To(BeEquivalentTo(1))
+				Expect(read("traffic_amount", queue, MessageMetricMethodDeleteMessageBatch)).To(BeEquivalentTo(2))
+			})
+
+			It("should record the empty receives", func() {
+				_, err := service.ReceiveMessage(&sqs.ReceiveMessageInput{
+					WaitTimeSeconds: aws.Int64(0),
+				})
+				Expect(err).ToNot(HaveOccurred())
+
+				queue := service.Configuration.QUrl
+				Expect(read("empty_receives", queue, MessageMetricMethodReceiveMessage)).To(BeEquivalentTo(1))
+				Expect(read("success", queue, MessageMetricMethodReceiveMessage)).To(BeEquivalentTo(1))
+				Expect(read("traffic_amount", queue, MessageMetricMethodReceiveMessage)).To(BeEquivalentTo(0))
+				Expect(read("request_units", queue, MessageMetricMethodReceiveMessage)).To(BeEquivalentTo(1))
+			})
+
+			It("should record failures", func() {
+				service.Configuration.QUrl = "fake-url-to-return-error"
+				_, err := service.SendMessage(&sqs.SendMessageInput{
+					MessageBody: aws.String("this is the body of the message"),
+				})
+				Expect(err).To(HaveOccurred())
+
+				queue := service.Configuration.QUrl
+				Expect(read("calls", queue, MessageMetricMethodSendMessage)).To(BeEquivalentTo(1))
+				Expect(read("success", queue, MessageMetricMethodSendMessage)).To(BeEquivalentTo(0))
+				Expect(read("failures", queue, MessageMetricMethodSendMessage)).To(BeEquivalentTo(1))
+			})
+
+			It("should record the injected faults", func() {
+				Expect(service.Stop()).To(Succeed())
+				service.Configuration.Faults = []FaultRule{
+					{Method: MessageMetricMethodSendMessage, ErrorCode: "ThrottlingException"},
+				}
+				Expect(service.Start()).To(Succeed())
+
+				_, err := service.SendMessage(&sqs.SendMessageInput{
+					MessageBody: aws.String("this is the body of the message"),
+				})
+				Expect(err).To(HaveOccurred())
+				_, err = service.ReceiveMessage(&sqs.ReceiveMessageInput{
+					WaitTimeSeconds: aws.Int64(0),
+				})
+				Expect(err).ToNot(HaveOccurred())
+
+				queue := service.Configuration.QUrl
+				Expect(read("failures", queue, MessageMetricMethodSendMessage)).To(BeEquivalentTo(1))
+				Expect(read("injected_faults", queue, MessageMetricMethodSendMessage)).To(BeEquivalentTo(1))
+				Expect(read("injected_faults", queue, MessageMetricMethodReceiveMessage)).To(BeEquivalentTo(0))
+			})
+
+			It("should record the calls when the service is not running", func() {
+				Expect(service.Stop()).To(Succeed())
+				_, err := service.SendMessage(&sqs.SendMessageInput{
+					MessageBody: aws.String("this is the body of the message"),
+				})
+				Expect(err).To(HaveOccurred())
+
+				queue := service.Configuration.QUrl
+				Expect(read("calls", queue, MessageMetricMethodSendMessage)).To(BeEquivalentTo(1))
+				Expect(read("success", queue, MessageMetricMethodSendMessage)).To(BeEquivalentTo(0))
+				Expect(read("failures", queue, MessageMetricMethodSendMessage)).To(BeEquivalentTo(0))
+			})
+		})
+	}
+
+	It("should not fail using the NopRecorder", func() {
+		service := &SQSService{Recorder: NopRecorder{}}
+		Expect(service.ApplyConfiguration(&validConfiguration)).To(Succeed())
+		Expect(service.Start()).To(Succeed())
+		defer service.Stop()
+
+		_, err := service.SendMessage(&sqs.SendMessageInput{
+			MessageBody: aws.String("this is the body of the message"),
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(service.Collector).To(BeNil())
+	})
+
+	It("should forward to all the recorders of a MultiRecorder", func() {
+		collector := NewSQSServiceCollector(&SQSServiceCollectorOpts{})
+		var buf statsDBuffer
+		statsd, err := NewStatsDRecorder(&StatsDRecorderOpts{Writer: &buf})
+		Expect(err).ToNot(HaveOccurred())
+
+		op := Operation{Queue: "http://localhost:9324/queue/queue-test", Method: MessageMetricMethodSendMessage}
+		recorder := MultiRecorder(collector, statsd)
+		recorder.Called(op)
+		recorder.Finished(op, OperationResult{Duration: time.Second, Err: errors.New("failed"), Messages: 1})
+
+		var metric dto.Metric
+		Expect(collector.messageFailures.With(prometheus.Labels{
+			"queue":  op.Queue,
+			"method": op.Method,
+		}).Write(&metric)).To(Succeed())
+		Expect(metric.GetCounter().GetValue()).To(BeEquivalentTo(1))
+		Expect(buf.sum("sqs.message.failures.http___localhost_9324_queue_queue-test.SendMessage")).To(BeEquivalentTo(1))
+	})
+
+	Context("StatsDRecorder", func() {
+		It("should name the metrics with the prefix, queue name and method", func() {
+			var buf bytes.Buffer
+			recorder, err := NewStatsDRecorder(&StatsDRecorderOpts{
+				Writer:     &buf,
+				Prefix:     "myapp",
+				QueueLabel: QueueLabelName,
+			})
+			Expect(err).ToNot(HaveOccurred())
+			recorder.Called(Operation{Queue: "http://localhost:9324/queue/queue-test", Method: MessageMetricMethodSendMessage})
+			Expect(buf.String()).To(Equal("myapp.sqs.message.calls.queue-test.SendMessage:1|c"))
+		})
+
+		It("should send the queue, method and constant tags", func() {
+			var buf bytes.Buffer
+			recorder, err := NewStatsDRecorder(&StatsDRecorderOpts{
+				Writer:     &buf,
+				QueueLabel: QueueLabelName,
+				Tags:       true,
+				ConstTags:  map[string]string{"service": "mail", "environment": "test"},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			recorder.Finished(Operation{Queue: "http://localhost:9324/queue/queue-test", Method: MessageMetricMethodDeleteMessage}, OperationResult{
+				Duration: 1500 * time.Microsecond,
+				Messages: 1,
+			})
+			Expect(strings.Split(buf.String(), "\n")).To(Equal([]string{
+				"sqs.message.duration:1.5|ms|#queue:queue-test,method:DeleteMessage,environment:test,service:mail",
+				"sqs.message.success:1|c|#queue:queue-test,method:DeleteMessage,environment:test,service:mail",
+				"sqs.message.traffic_amount:1|c|#queue:queue-test,method:DeleteMessage,environment:test,service:mail",
+			}))
+		})
+
+		It("should send the consumer metrics", func() {
+			var buf statsDBuffer
+			recorder, err := NewStatsDRecorder(&StatsDRecorderOpts{
+				Writer:     &buf,
+				QueueLabel: QueueLabelName,
+			})
+			Expect(err).ToNot(HaveOccurred())
+			handling := Handling{Queue: "http://localhost:9324/queue/queue-test", MessageType: "welcome"}
+			recorder.HandlerStarted(handling)
+			recorder.HandlerFinished(handling, HandlerResult{Duration: 2 * time.Millisecond, Outcome: HandlerOutcomeAcked})
+			recorder.WorkersUsed(handling.Queue, 1, 4)
+			Expect(strings.Split(strings.Join(buf.packets, "\n"), "\n")).To(Equal([]string{
+				"sqs.consumer.messages_in_flight.queue-test.welcome:+1|g",
+				"sqs.consumer.messages_in_flight.queue-test.welcome:-1|g",
+				"sqs.consumer.handler_duration.queue-test.welcome:2|ms",
+				"sqs.consumer.messages_handled.queue-test.welcome.acked:1|c",
+				"sqs.consumer.workers.queue-test:4|g",
+				"sqs.consumer.worker_utilization.queue-test:0.25|g",
+			}))
+		})
+
+		It("should send the dead-lettered messages by reason", func() {
+			var buf statsDBuffer
+			recorder, err := NewStatsDRecorder(&StatsDRecorderOpts{
+				Writer:     &buf,
+				QueueLabel: QueueLabelName,
+				Tags:       true,
+			})
+			Expect(err).ToNot(HaveOccurred())
+			handling := Handling{Queue: "http://localhost:9324/queue/queue-test", MessageType: "welcome"}
+			recorder.HandlerFinished(handling, HandlerResult{
+				Duration:         2 * time.Millisecond,
+				Outcome:          HandlerOutcomeDeadLettered,
+				DeadLetterReason: DeadLetterReasonDecodeError,
+			})
+			Expect(strings.Split(strings.Join(buf.packets, "\n"), "\n")).To(Equal([]string{
+				"sqs.consumer.messages_in_flight:-1|g|#queue:queue-test,type:welcome",
+				"sqs.consumer.handler_duration:2|ms|#queue:queue-test,type:welcome",
+				"sqs.consumer.messages_handled:1|c|#queue:queue-test,type:welcome,outcome:dead_lettered",
+				"sqs.consumer.messages_dead_lettered:1|c|#queue:queue-test,type:welcome,reason:decode_error",
+			}))
+		})
+
+		It("should send the lifecycle metrics", func() {
+			var buf statsDBuffer
+			recorder, err := NewStatsDRecorder(&StatsDRecorderOpts{
+				Writer:     &buf,
+				QueueLabel: QueueLabelName,
+				Tags:       true,
+			})
+			Expect(err).ToNot(HaveOccurred())
+			recorder.Lifecycle(LifecycleEvent{
+				Queue:              "http://localhost:9324/queue/queue-test",
+				Action:             LifecycleActionStart,
+				Running:            true,
+				ValidationDuration: 3 * time.Millisecond,
+			})
+			recorder.Lifecycle(LifecycleEvent{
+				Queue:  "http://localhost:9324/queue/queue-test",
+				Action: LifecycleActionRestart,
+				Err:    errors.New("failed"),
+			})
+			Expect(strings.Split(strings.Join(buf.packets, "\n"), "\n")).To(Equal([]string{
+				"sqs.service.running:1|g|#queue:queue-test",
+				"sqs.service.actions:1|c|#queue:queue-test,action:start,outcome:success",
+				"sqs.service.queue_validation_duration:3|ms|#queue:queue-test",
+				"sqs.service.running:0|g|#queue:queue-test",
+				"sqs.service.actions:1|c|#queue:queue-test,action:restart,outcome:failure",
+			}))
+		})
+
+		It("should send the drift metrics", func() {
+			var buf statsDBuffer
+			recorder, err := NewStatsDRecorder(&StatsDRecorderOpts{
+				Writer:     &buf,
+				QueueLabel: QueueLabelName,
+				Tags:       true,
+			})
+			Expect(err).ToNot(HaveOccurred())
+			recorder.Drift(DriftEvent{
+				Queue:   "http://localhost:9324/queue/queue-test",
+				Checked: []string{"DelaySeconds", "VisibilityTimeout"},
+				Drifts:  []AttributeDrift{{Name: "VisibilityTimeout", Current: "45", Expected: "30"}},
+			})
+			recorder.Drift(DriftEvent{
+				Queue: "http://localhost:9324/queue/queue-test",
+				Err:   errors.New("failed"),
+			})
+			Expect(strings.Split(strings.Join(buf.packets, "\n"), "\n")).To(Equal([]string{
+				"sqs.queue.attribute_drift:0|g|#queue:queue-test,attribute:DelaySeconds",
+				"sqs.queue.attribute_drift:1|g|#queue:queue-test,attribute:VisibilityTimeout",
+				"sqs.queue.drift_check_failures:1|c|#queue:queue-test",
+			}))
+		})
+
+		It("should send the metrics over UDP", func() {
+			conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+			Expect(err).ToNot(HaveOccurred())
+			defer conn.Close()
+
+			recorder, err := NewStatsDRecorder(&StatsDRecorderOpts{
+				Address: conn.LocalAddr().String(),
+			})
+			Expect(err).ToNot(HaveOccurred())
+			defer recorder.Close()
+			recorder.Called(Operation{Queue: "queue", Method: MessageMetricMethodSendMessage})
+
+			packet := make([]byte, 1024)
+			Expect(conn.SetReadDeadline(time.Now().Add(time.Second))).To(Succeed())
+			n, _, err := conn.ReadFrom(packet)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(packet[:n])).To(Equal("sqs.message.calls.queue.SendMessage:1|c"))
+		})
+	})
+})
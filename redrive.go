@@ -0,0 +1,330 @@
+package sqssrv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// maxBatchPayload is the maximum total size, in bytes, of the messages of a
+// SendMessageBatch.
+const maxBatchPayload = 256 * 1024
+
+// RedriveOpts configures a Redrive.
+type RedriveOpts struct {
+	// Source is the URL of the queue the messages are moved from, usually a
+	// dead letter queue.
+	Source string
+	// Target is the URL of the queue the messages are moved to. Default: the
+	// QUrl of the configuration.
+	Target string
+	// MaxMessages caps how many messages are moved. Zero moves all of them.
+	MaxMessages int
+	// Rate limits how many messages are moved per second. Zero does not
+	// limit.
+	Rate float64
+	// Filter, when set, selects the messages moved, e.g. by their body or
+	// attributes. The others are left in the Source.
+	Filter func(message *sqs.Message) bool
+	// DryRun receives and filters the messages, counting the ones that would
+	// be moved, without sending nor deleting any.
+	DryRun bool
+	// VisibilityTimeout, in seconds, of the messages received. The messages
+	// not moved are kept invisible until the redrive ends, so they are not
+	// received twice, so it must be longer than the whole redrive.
+	// Default: 300.
+	VisibilityTimeout int64
+	// WaitTimeSeconds of each ReceiveMessage. The redrive ends at the first
+	// receive that returns nothing. Default: 1.
+	WaitTimeSeconds int64
+	// Progress, when set, receives the progress after every batch.
+	Progress func(progress RedriveProgress)
+	// KeepDeduplicationID sends the messages to a FIFO Target with their
+	// original deduplication ID, instead of a new one. SQS drops, as
+	// duplicates, the messages whose ID it saw in the last 5 minutes, so the
+	// ones that reached the Source within that window are lost: they are
+	// counted as Moved, but never delivered.
+	KeepDeduplicationID bool
+}
+
+// RedriveProgress counts the messages of a Redrive.
+type RedriveProgress struct {
+	// Received is the number of messages received from the Source.
+	Received int
+	// Moved is the number of messages sent to the Target and deleted from the
+	// Source. In a dry run, the number of messages that would be.
+	Moved int
+	// Skipped is the number of messages left out by the Filter.
+	Skipped int
+	// Failed is the number of messages that could not be sent to the Target.
+	// They are left in the Source.
+	Failed int
+	// Unreleased is the number of messages, skipped or failed, that could not
+	// be made visible again in the Source when the redrive ended. They stay
+	// hidden until their VisibilityTimeout.
+	Unreleased int
+}
+
+// Redrive moves the messages of a queue, usually a dead letter queue, to
+// another one, e.g. back to the source queue once the bug that sent them
+// there is fixed. The body and the message attributes are kept, as the group
+// ID of FIFO queues. A FIFO Target gets each message with a new deduplication
+// ID, its MessageId with a marker of the redrive, unless KeepDeduplicationID.
+//
+// A message is only deleted from the Source after it was sent to the Target.
+// The messages skipped, or that failed to be sent, even when the batch they
+// were sent in succeeded for the others, are made visible again in the Source
+// when the redrive ends. The ones that could not be are counted as
+// Unreleased, and failed the redrive.
+func (service *SQSService) Redrive(ctx context.Context, opts *RedriveOpts) (progress RedriveProgress, err error) {
+	if opts.Source == "" {
+		return progress, errors.New("the source queue of the redrive is missing")
+	}
+	target := opts.Target
+	if target == "" {
+		target = service.Configuration.QUrl
+	}
+	if opts.Source == target {
+		return progress, errors.New("the source and target queues of the redrive are the same")
+	}
+	visibilityTimeout := opts.VisibilityTimeout
+	if visibilityTimeout == 0 {
+		visibilityTimeout = 300
+	}
+	waitTimeSeconds := opts.WaitTimeSeconds
+	if waitTimeSeconds == 0 {
+		waitTimeSeconds = 1
+	}
+
+	// marker tells the messages of this redrive from the ones sent before
+	// with the same MessageId, e.g. by a previous redrive.
+	var marker string
+	if isFIFO(target) && !opts.KeepDeduplicationID {
+		marker = "-redrive-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+
+	// held are the messages received, but not moved, to be released at the
+	// end.
+	var held []*sqs.Message
+	defer func() {
+		// Released even when the context is done, as they would be hidden
+		// until their visibility timeout otherwise.
+		unreleased, releaseErr := service.releaseMessages(context.Background(), opts.Source, held)
+		progress.Unreleased = unreleased
+		if releaseErr != nil && err == nil {
+			err = fmt.Errorf("could not release %d messages not moved: %s", unreleased, releaseErr.Error())
+		}
+	}()
+
+	var next time.Time
+	for opts.MaxMessages == 0 || progress.Moved < opts.MaxMessages {
+		maxNumberOfMessages := MaxBatchEntries
+		if opts.Rate > 0 && opts.Rate < MaxBatchEntries {
+			maxNumberOfMessages = int(opts.Rate)
+			if maxNumberOfMessages < 1 {
+				maxNumberOfMessages = 1
+			}
+		}
+		if opts.MaxMessages > 0 && opts.MaxMessages-progress.Moved < maxNumberOfMessages {
+			maxNumberOfMessages = opts.MaxMessages - progress.Moved
+		}
+		output, err := service.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:              aws.String(opts.Source),
+			AttributeNames:        []*string{aws.String(sqs.QueueAttributeNameAll)},
+			MessageAttributeNames: []*string{aws.String(sqs.QueueAttributeNameAll)},
+			MaxNumberOfMessages:   aws.Int64(int64(maxNumberOfMessages)),
+			VisibilityTimeout:     aws.Int64(visibilityTimeout),
+			WaitTimeSeconds:       aws.Int64(waitTimeSeconds),
+		})
+		if err != nil {
+			return progress, err
+		}
+		if len(output.Messages) == 0 {
+			break
+		}
+		progress.Received += len(output.Messages)
+
+		batch := make([]*sqs.Message, 0, len(output.Messages))
+		for _, message := range output.Messages {
+			if opts.Filter != nil && !opts.Filter(message) {
+				progress.Skipped++
+				held = append(held, message)
+				continue
+			}
+			batch = append(batch, message)
+		}
+
+		if opts.DryRun {
+			progress.Moved += len(batch)
+			held = append(held, batch...)
+		} else if len(batch) > 0 {
+			if opts.Rate > 0 {
+				if err := sleepUntil(ctx, next); err != nil {
+					held = append(held, batch...)
+					return progress, err
+				}
+				if now := time.Now(); next.Before(now) {
+					next = now
+				}
+				next = next.Add(time.Duration(float64(len(batch)) / opts.Rate * float64(time.Second)))
+			}
+			failed, err := service.moveMessages(ctx, opts.Source, target, marker, batch)
+			progress.Failed += len(failed)
+			progress.Moved += len(batch) - len(failed)
+			held = append(held, failed...)
+			if err != nil {
+				return progress, err
+			}
+		}
+
+		if opts.Progress != nil {
+			opts.Progress(progress)
+		}
+	}
+	return progress, nil
+}
+
+// moveMessages sends the messages to the target, deleting the ones sent from
+// the source. It returns the messages that could not be sent, including the
+// failed entries of the batches, for the caller to release. With a marker,
+// the deduplication ID of a message is its MessageId with the marker.
+//
+// The messages are sent in as many batches as their payload requires. When a
+// call fails, the messages not sent yet are returned with the error. The
+// messages sent but not deleted are not, as they were moved, even though they
+// will be received from the source again.
+func (service *SQSService) moveMessages(ctx context.Context, source, target, marker string, messages []*sqs.Message) ([]*sqs.Message, error) {
+	var failed []*sqs.Message
+	chunks := payloadChunks(messages)
+	// unsent are the messages of the chunks after the given one.
+	unsent := func(c int) []*sqs.Message {
+		var messages []*sqs.Message
+		for _, chunk := range chunks[c+1:] {
+			messages = append(messages, chunk...)
+		}
+		return messages
+	}
+	for c, chunk := range chunks {
+		entries := make([]*sqs.SendMessageBatchRequestEntry, len(chunk))
+		for i, message := range chunk {
+			deduplicationID := message.Attributes[sqs.MessageSystemAttributeNameMessageDeduplicationId]
+			if marker != "" {
+				deduplicationID = aws.String(aws.StringValue(message.MessageId) + marker)
+			}
+			entries[i] = &sqs.SendMessageBatchRequestEntry{
+				Id:                     aws.String(strconv.Itoa(i)),
+				MessageBody:            message.Body,
+				MessageAttributes:      message.MessageAttributes,
+				MessageGroupId:         message.Attributes[sqs.MessageSystemAttributeNameMessageGroupId],
+				MessageDeduplicationId: deduplicationID,
+			}
+		}
+		output, err := service.SendMessageBatchWithContext(ctx, &sqs.SendMessageBatchInput{
+			QueueUrl: aws.String(target),
+			Entries:  entries,
+		})
+		if err != nil {
+			return append(append(failed, chunk...), unsent(c)...), err
+		}
+		for _, entry := range output.Failed {
+			i, _ := strconv.Atoi(aws.StringValue(entry.Id))
+			failed = append(failed, chunk[i])
+		}
+
+		deletes := make([]*sqs.DeleteMessageBatchRequestEntry, len(output.Successful))
+		for j, entry := range output.Successful {
+			i, _ := strconv.Atoi(aws.StringValue(entry.Id))
+			deletes[j] = &sqs.DeleteMessageBatchRequestEntry{
+				Id:            entry.Id,
+				ReceiptHandle: chunk[i].ReceiptHandle,
+			}
+		}
+		if len(deletes) == 0 {
+			continue
+		}
+		deleteOutput, err := service.DeleteMessageBatchWithContext(ctx, &sqs.DeleteMessageBatchInput{
+			QueueUrl: aws.String(source),
+			Entries:  deletes,
+		})
+		if err != nil {
+			return append(failed, unsent(c)...), fmt.Errorf("could not delete the messages moved from %s: %s", source, err.Error())
+		}
+		if len(deleteOutput.Failed) > 0 {
+			return append(failed, unsent(c)...), fmt.Errorf("could not delete %d messages moved from %s: %s", len(deleteOutput.Failed), source, aws.StringValue(deleteOutput.Failed[0].Message))
+		}
+	}
+	return failed, nil
+}
+
+// payloadChunks splits the messages so the payload of each SendMessageBatch
+// fits maxBatchPayload.
+func payloadChunks(messages []*sqs.Message) [][]*sqs.Message {
+	var chunks [][]*sqs.Message
+	var chunk []*sqs.Message
+	size := 0
+	for _, message := range messages {
+		messageSize := len(aws.StringValue(message.Body)) + messageAttributesSize(message.MessageAttributes)
+		if len(chunk) > 0 && size+messageSize > maxBatchPayload {
+			chunks = append(chunks, chunk)
+			chunk, size = nil, 0
+		}
+		chunk = append(chunk, message)
+		size += messageSize
+	}
+	if len(chunk) > 0 {
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+// releaseMessages makes the messages visible again. It returns how many could
+// not be, either failed entries or the ones of a call that failed.
+func (service *SQSService) releaseMessages(ctx context.Context, queueURL string, messages []*sqs.Message) (int, error) {
+	if len(messages) == 0 {
+		return 0, nil
+	}
+	entries := make([]*sqs.ChangeMessageVisibilityBatchRequestEntry, len(messages))
+	for i, message := range messages {
+		entries[i] = &sqs.ChangeMessageVisibilityBatchRequestEntry{
+			Id:                aws.String(strconv.Itoa(i)),
+			ReceiptHandle:     message.ReceiptHandle,
+			VisibilityTimeout: aws.Int64(0),
+		}
+	}
+	output, err := service.ChangeMessageVisibilityBatchWithContext(ctx, &sqs.ChangeMessageVisibilityBatchInput{
+		QueueUrl: aws.String(queueURL),
+		Entries:  entries,
+	})
+	if err != nil {
+		released := 0
+		if output != nil {
+			released = len(output.Successful)
+		}
+		return len(messages) - released, err
+	}
+	if len(output.Failed) > 0 {
+		return len(output.Failed), errors.New(aws.StringValue(output.Failed[0].Message))
+	}
+	return 0, nil
+}
+
+// sleepUntil waits until the given time, or the context is done.
+func sleepUntil(ctx context.Context, t time.Time) error {
+	d := time.Until(t)
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
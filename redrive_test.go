@@ -0,0 +1,295 @@
+package sqssrv
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Redrive", func() {
+	var (
+		service   *SQSService
+		testQueue *TestQueue
+		source    string
+		target    string
+	)
+
+	// startQueues starts the service for the target queue, whose dead letter
+	// queue is the source of the redrives.
+	startQueues := func(opts *TestQueueOpts, faults []FaultRule) {
+		configuration := validConfiguration
+		configuration.Faults = faults
+		service = &SQSService{}
+		Expect(service.ApplyConfiguration(configuration)).To(Succeed())
+		opts.Prefix = "sqssrv-redrive"
+		opts.DeadLetterQueue = true
+		var err error
+		testQueue, err = NewTestQueue(service, opts)
+		Expect(err).ToNot(HaveOccurred())
+		target = testQueue.QueueURL
+		source = testQueue.DeadLetterQueueURL
+	}
+
+	start := func(faults ...FaultRule) {
+		startQueues(&TestQueueOpts{}, faults)
+	}
+
+	startFIFO := func() {
+		startQueues(&TestQueueOpts{FIFO: true}, nil)
+	}
+
+	AfterEach(func() {
+		if testQueue != nil {
+			Expect(testQueue.Close()).To(Succeed())
+		}
+		testQueue = nil
+	})
+
+	// send sends the messages to the dead letter queue, with their index as
+	// the "index" attribute.
+	send := func(n int) {
+		for i := 0; i < n; i++ {
+			_, err := service.SendMessage(&sqs.SendMessageInput{
+				QueueUrl:    aws.String(source),
+				MessageBody: aws.String(fmt.Sprintf("message %d", i)),
+				MessageAttributes: map[string]*sqs.MessageAttributeValue{
+					"index": {DataType: aws.String("Number"), StringValue: aws.String(fmt.Sprint(i))},
+				},
+			})
+			Expect(err).ToNot(HaveOccurred())
+		}
+	}
+
+	// messages returns the number of visible messages of the queue.
+	messages := func(queueURL string) int64 {
+		attributes, err := service.QueueAttributes(context.Background(), aws.String(queueURL))
+		Expect(err).ToNot(HaveOccurred())
+		return aws.Int64Value(attributes.ApproximateNumberOfMessages)
+	}
+
+	receive := func(queueURL string) []*sqs.Message {
+		output, err := service.ReceiveMessage(&sqs.ReceiveMessageInput{
+			QueueUrl:              aws.String(queueURL),
+			MaxNumberOfMessages:   aws.Int64(10),
+			MessageAttributeNames: []*string{aws.String(sqs.QueueAttributeNameAll)},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		return output.Messages
+	}
+
+	It("should move all the messages, keeping their attributes", func() {
+		start()
+		send(12)
+
+		var progresses []RedriveProgress
+		progress, err := service.Redrive(context.Background(), &RedriveOpts{
+			Source: source,
+			Progress: func(progress RedriveProgress) {
+				progresses = append(progresses, progress)
+			},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(progress).To(Equal(RedriveProgress{Received: 12, Moved: 12}))
+		Expect(progresses).To(Equal([]RedriveProgress{
+			{Received: 10, Moved: 10},
+			{Received: 12, Moved: 12},
+		}))
+
+		Expect(messages(source)).To(BeEquivalentTo(0))
+		Expect(messages(target)).To(BeEquivalentTo(12))
+		moved := receive(target)
+		Expect(moved).ToNot(BeEmpty())
+		for _, message := range moved {
+			Expect(aws.StringValue(message.Body)).To(Equal("message " + aws.StringValue(message.MessageAttributes["index"].StringValue)))
+			Expect(aws.StringValue(message.MessageAttributes["index"].DataType)).To(Equal("Number"))
+		}
+	})
+
+	It("should move up to the maximum", func() {
+		start()
+		send(5)
+
+		progress, err := service.Redrive(context.Background(), &RedriveOpts{
+			Source:      source,
+			MaxMessages: 3,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(progress).To(Equal(RedriveProgress{Received: 3, Moved: 3}))
+		Expect(messages(source)).To(BeEquivalentTo(2))
+		Expect(messages(target)).To(BeEquivalentTo(3))
+	})
+
+	It("should move only the messages filtered", func() {
+		start()
+		send(6)
+
+		progress, err := service.Redrive(context.Background(), &RedriveOpts{
+			Source: source,
+			Filter: func(message *sqs.Message) bool {
+				return !strings.HasSuffix(aws.StringValue(message.Body), "3")
+			},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(progress).To(Equal(RedriveProgress{Received: 6, Moved: 5, Skipped: 1}))
+
+		// The message skipped is visible again right away.
+		left := receive(source)
+		Expect(left).To(HaveLen(1))
+		Expect(aws.StringValue(left[0].Body)).To(Equal("message 3"))
+		Expect(messages(target)).To(BeEquivalentTo(5))
+	})
+
+	It("should not move anything in a dry run", func() {
+		start()
+		send(4)
+
+		progress, err := service.Redrive(context.Background(), &RedriveOpts{
+			Source: source,
+			DryRun: true,
+			Filter: func(message *sqs.Message) bool {
+				return aws.StringValue(message.MessageAttributes["index"].StringValue) != "0"
+			},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(progress).To(Equal(RedriveProgress{Received: 4, Moved: 3, Skipped: 1}))
+		Expect(messages(source)).To(BeEquivalentTo(4))
+		Expect(messages(target)).To(BeEquivalentTo(0))
+	})
+
+	It("should limit the rate", func() {
+		start()
+		send(4)
+
+		begin := time.Now()
+		progress, err := service.Redrive(context.Background(), &RedriveOpts{
+			Source: source,
+			Rate:   4,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(progress.Moved).To(Equal(4))
+		Expect(time.Since(begin)).To(BeNumerically(">=", time.Second))
+	})
+
+	It("should not delete the messages that failed to be sent", func() {
+		start(FaultRule{
+			Method:            MessageMetricMethodSendMessageBatch,
+			BatchFailureRatio: 0.5,
+		})
+		send(10)
+
+		progress, err := service.Redrive(context.Background(), &RedriveOpts{
+			Source: source,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(progress.Failed).To(BeNumerically(">", 0))
+		Expect(progress.Moved + progress.Failed).To(Equal(10))
+		Expect(messages(source)).To(BeEquivalentTo(progress.Failed))
+		Expect(messages(target)).To(BeEquivalentTo(progress.Moved))
+	})
+
+	It("should count the messages that could not be released", func() {
+		start(FaultRule{
+			Method:            MessageMetricMethodChangeMessageVisibilityBatch,
+			BatchFailureRatio: 0.5,
+		})
+		send(4)
+
+		progress, err := service.Redrive(context.Background(), &RedriveOpts{
+			Source: source,
+			Filter: func(message *sqs.Message) bool {
+				return false
+			},
+		})
+		Expect(err).To(MatchError("could not release 2 messages not moved: injected fault"))
+		Expect(progress).To(Equal(RedriveProgress{Received: 4, Skipped: 4, Unreleased: 2}))
+		Expect(messages(source)).To(BeEquivalentTo(2))
+	})
+
+	It("should keep all the messages when the send fails", func() {
+		start(FaultRule{
+			Method:    MessageMetricMethodSendMessageBatch,
+			ErrorCode: "ThrottlingException",
+		})
+		send(3)
+
+		progress, err := service.Redrive(context.Background(), &RedriveOpts{
+			Source: source,
+		})
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("ThrottlingException"))
+		Expect(progress).To(Equal(RedriveProgress{Received: 3, Failed: 3}))
+		Expect(messages(source)).To(BeEquivalentTo(3))
+	})
+
+	// deadLetteredFIFO sends a message to the FIFO target, that handles it,
+	// and then to the source, as it would be dead-lettered with the same
+	// deduplication ID, within the deduplication interval.
+	deadLetteredFIFO := func() {
+		input := &sqs.SendMessageInput{
+			MessageBody:            aws.String("message"),
+			MessageGroupId:         aws.String("user-1"),
+			MessageDeduplicationId: aws.String("welcome-1"),
+		}
+		_, err := service.SendMessage(input)
+		Expect(err).ToNot(HaveOccurred())
+		handled := receive(target)
+		Expect(handled).To(HaveLen(1))
+		_, err = service.DeleteMessage(&sqs.DeleteMessageInput{ReceiptHandle: handled[0].ReceiptHandle})
+		Expect(err).ToNot(HaveOccurred())
+
+		input.QueueUrl = aws.String(source)
+		_, err = service.SendMessage(input)
+		Expect(err).ToNot(HaveOccurred())
+	}
+
+	It("should move the FIFO messages with a new deduplication ID", func() {
+		startFIFO()
+		deadLetteredFIFO()
+
+		progress, err := service.Redrive(context.Background(), &RedriveOpts{
+			Source: source,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(progress).To(Equal(RedriveProgress{Received: 1, Moved: 1}))
+		Expect(messages(source)).To(BeEquivalentTo(0))
+
+		output, err := service.ReceiveMessage(&sqs.ReceiveMessageInput{
+			AttributeNames: []*string{aws.String(sqs.QueueAttributeNameAll)},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(output.Messages).To(HaveLen(1))
+		message := output.Messages[0]
+		Expect(aws.StringValue(message.Body)).To(Equal("message"))
+		Expect(aws.StringValue(message.Attributes[sqs.MessageSystemAttributeNameMessageGroupId])).To(Equal("user-1"))
+		Expect(aws.StringValue(message.Attributes[sqs.MessageSystemAttributeNameMessageDeduplicationId])).To(ContainSubstring("-redrive-"))
+	})
+
+	It("should keep the deduplication ID when asked, even if SQS drops the messages", func() {
+		startFIFO()
+		deadLetteredFIFO()
+
+		progress, err := service.Redrive(context.Background(), &RedriveOpts{
+			Source:              source,
+			KeepDeduplicationID: true,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(progress).To(Equal(RedriveProgress{Received: 1, Moved: 1}))
+		Expect(messages(source)).To(BeEquivalentTo(0))
+		Expect(messages(target)).To(BeEquivalentTo(0))
+	})
+
+	It("should fail without the source", func() {
+		start()
+		_, err := service.Redrive(context.Background(), &RedriveOpts{})
+		Expect(err).To(MatchError("the source queue of the redrive is missing"))
+
+		_, err = service.Redrive(context.Background(), &RedriveOpts{Source: target})
+		Expect(err).To(MatchError("the source and target queues of the redrive are the same"))
+	})
+})
@@ -0,0 +1,189 @@
+package sqssrv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// DefaultRetryCountAttribute is the message attribute with the number of
+// retries of a message, when the RetryPolicy does not inform one.
+const DefaultRetryCountAttribute = "retry_count"
+
+// maxDelay is the longest DelaySeconds of a message.
+const maxDelay = 15 * time.Minute
+
+// ErrNoRetryPolicy is returned by RetryMessage when the configuration has no
+// Retry.
+var ErrNoRetryPolicy = errors.New("no retry policy configured")
+
+// RetryPolicy re-sends the messages whose handling failed, with escalating
+// delays, instead of leaving them to be received again as soon as their
+// visibility timeout expires:
+//
+//	retry:
+//	  delays: [10s, 1m, 5m]
+//	  queues:                 # optional, one for each delay
+//	    - https://sqs.sa-east-1.amazonaws.com/000000000000/mail-retry-1
+//	    - https://sqs.sa-east-1.amazonaws.com/000000000000/mail-retry-2
+//	    - https://sqs.sa-east-1.amazonaws.com/000000000000/mail-retry-3
+//	  parking_queue: https://sqs.sa-east-1.amazonaws.com/000000000000/mail-parking
+//
+// The number of retries is kept in the CountAttribute of the message, also
+// in the ones parked. The original message is only deleted after the retry
+// was sent.
+//
+// FIFO queues only take the delay of the queue, not the one of each message,
+// so the retries to a FIFO queue must have no delay: their backoff is the
+// DelaySeconds of the FIFO retry queues.
+type RetryPolicy struct {
+	// Delays of the retries, in order: the first failure is retried after the
+	// first delay, and so on. Up to 15m each.
+	Delays []time.Duration `yaml:"delays"`
+	// Queues are the URLs of the retry queues, one for each delay. When
+	// empty, the messages are re-sent to the queue they were received from.
+	Queues []string `yaml:"queues"`
+	// ParkingQueue is the URL of the queue that receives the messages that
+	// failed after the last retry. When empty, they are left in the queue to
+	// be received again, or moved by its redrive policy.
+	ParkingQueue string `yaml:"parking_queue"`
+	// CountAttribute is the message attribute with the number of retries.
+	// Default: DefaultRetryCountAttribute.
+	CountAttribute string `yaml:"count_attribute"`
+}
+
+// Validate checks the delays and that there is a queue for each of them.
+func (policy *RetryPolicy) Validate() error {
+	if len(policy.Delays) == 0 {
+		return errors.New("the retry policy has no delays")
+	}
+	for _, delay := range policy.Delays {
+		if delay < 0 || delay > maxDelay {
+			return fmt.Errorf("the retry delay %s is out of the range 0s-%s", delay, maxDelay)
+		}
+		if delay%time.Second != 0 {
+			return fmt.Errorf("the retry delay %s is not a whole number of seconds", delay)
+		}
+	}
+	if len(policy.Queues) > 0 && len(policy.Queues) != len(policy.Delays) {
+		return fmt.Errorf("the retry policy has %d delays but %d queues", len(policy.Delays), len(policy.Queues))
+	}
+	return nil
+}
+
+// validateQueue checks the delays can be applied to the retries of the
+// messages received from the queue, as the ones to a FIFO queue would be
+// received again right away.
+func (policy *RetryPolicy) validateQueue(queueURL string) error {
+	for i, delay := range policy.Delays {
+		retryQueue := queueURL
+		if len(policy.Queues) > 0 {
+			retryQueue = policy.Queues[i]
+		}
+		if delay > 0 && isFIFO(retryQueue) {
+			return fmt.Errorf("the retry delay %s cannot be applied to the FIFO queue %s", delay, retryQueue)
+		}
+	}
+	return nil
+}
+
+func (policy *RetryPolicy) countAttribute() string {
+	if policy.CountAttribute != "" {
+		return policy.CountAttribute
+	}
+	return DefaultRetryCountAttribute
+}
+
+// RetryCount returns how many times the message was retried, from its
+// CountAttribute. The message must be received with its message attributes.
+func (policy *RetryPolicy) RetryCount(message *sqs.Message) int {
+	attribute, ok := message.MessageAttributes[policy.countAttribute()]
+	if !ok {
+		return 0
+	}
+	count, _ := strconv.Atoi(aws.StringValue(attribute.StringValue))
+	return count
+}
+
+// RetryMessage re-sends a message received from the queue, whose handling
+// failed, according to the Retry of the configuration. It returns
+// HandlerOutcomeRetried when the message was sent to be retried,
+// HandlerOutcomeParked when it was sent to the ParkingQueue, or
+// HandlerOutcomeNacked when it was left in the queue, as it has no
+// ParkingQueue.
+func (service *SQSService) RetryMessage(ctx context.Context, queueURL string, message *sqs.Message) (HandlerOutcome, error) {
+	policy := service.Configuration.Retry
+	if policy == nil {
+		return HandlerOutcomeNacked, ErrNoRetryPolicy
+	}
+	if err := policy.Validate(); err != nil {
+		return HandlerOutcomeNacked, err
+	}
+	if err := policy.validateQueue(queueURL); err != nil {
+		return HandlerOutcomeNacked, err
+	}
+	return service.retryMessage(ctx, policy, queueURL, message)
+}
+
+// retryMessage is the RetryMessage of the given policy, already validated.
+// A FIFO queue gets the message group of the message and a new deduplication
+// ID, its MessageId with the retry count.
+func (service *SQSService) retryMessage(ctx context.Context, policy *RetryPolicy, queueURL string, message *sqs.Message) (HandlerOutcome, error) {
+	count := policy.RetryCount(message)
+
+	input := &sqs.SendMessageInput{
+		MessageBody: message.Body,
+	}
+	outcome := HandlerOutcomeRetried
+	if count >= len(policy.Delays) {
+		if policy.ParkingQueue == "" {
+			return HandlerOutcomeNacked, nil
+		}
+		outcome = HandlerOutcomeParked
+		input.QueueUrl = aws.String(policy.ParkingQueue)
+	} else {
+		input.QueueUrl = aws.String(queueURL)
+		if len(policy.Queues) > 0 {
+			input.QueueUrl = aws.String(policy.Queues[count])
+		}
+		if !isFIFO(aws.StringValue(input.QueueUrl)) {
+			input.DelaySeconds = aws.Int64(int64(policy.Delays[count] / time.Second))
+		}
+		count++
+	}
+	if isFIFO(aws.StringValue(input.QueueUrl)) {
+		input.MessageGroupId = message.Attributes[sqs.MessageSystemAttributeNameMessageGroupId]
+		// A new ID, as a retry to the same queue with content-based
+		// deduplication would be dropped as a duplicate of the message.
+		input.MessageDeduplicationId = aws.String(aws.StringValue(message.MessageId) + "-retry-" + strconv.Itoa(count))
+	}
+
+	name := policy.countAttribute()
+	input.MessageAttributes = make(map[string]*sqs.MessageAttributeValue, len(message.MessageAttributes)+1)
+	for attributeName, attribute := range message.MessageAttributes {
+		input.MessageAttributes[attributeName] = attribute
+	}
+	input.MessageAttributes[name] = &sqs.MessageAttributeValue{
+		DataType:    aws.String("Number"),
+		StringValue: aws.String(strconv.Itoa(count)),
+	}
+	if len(input.MessageAttributes) > maxMessageAttributes {
+		return HandlerOutcomeNacked, fmt.Errorf("the message has no room for the %s attribute: it has %d message attributes, of the %d allowed", name, len(message.MessageAttributes), maxMessageAttributes)
+	}
+	if _, err := service.SendMessageWithContext(ctx, input); err != nil {
+		return HandlerOutcomeNacked, err
+	}
+
+	// The retry was sent, so the message is handled again even if it cannot
+	// be deleted.
+	_, err := service.DeleteMessageWithContext(ctx, &sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(queueURL),
+		ReceiptHandle: message.ReceiptHandle,
+	})
+	return outcome, err
+}
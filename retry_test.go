@@ -0,0 +1,330 @@
+package sqssrv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var _ = Describe("Retry", func() {
+	It("should validate the policy", func() {
+		invalid := map[string]RetryPolicy{
+			"the retry policy has no delays":                        {},
+			"the retry delay 16m0s is out of the range 0s-15m0s":    {Delays: []time.Duration{16 * time.Minute}},
+			"the retry delay -1s is out of the range 0s-15m0s":      {Delays: []time.Duration{-time.Second}},
+			"the retry delay 1.5s is not a whole number of seconds": {Delays: []time.Duration{1500 * time.Millisecond}},
+			"the retry policy has 2 delays but 1 queues":            {Delays: []time.Duration{time.Second, time.Minute}, Queues: []string{"retry"}},
+		}
+		for message, policy := range invalid {
+			Expect(policy.Validate()).To(MatchError(message))
+		}
+
+		Expect((&RetryPolicy{
+			Delays: []time.Duration{0, time.Second, 15 * time.Minute},
+			Queues: []string{"retry-1", "retry-2", "retry-3"},
+		}).Validate()).To(Succeed())
+	})
+
+	It("should reject the delays to FIFO queues", func() {
+		policy := &RetryPolicy{Delays: []time.Duration{time.Minute}}
+		Expect(policy.validateQueue("http://localhost:9324/queue/mail.fifo")).To(MatchError("the retry delay 1m0s cannot be applied to the FIFO queue http://localhost:9324/queue/mail.fifo"))
+		Expect(policy.validateQueue("http://localhost:9324/queue/mail")).To(Succeed())
+
+		policy = &RetryPolicy{
+			Delays: []time.Duration{0, time.Minute},
+			Queues: []string{"http://localhost:9324/queue/mail-retry-1.fifo", "http://localhost:9324/queue/mail-retry-2"},
+		}
+		Expect(policy.validateQueue("http://localhost:9324/queue/mail.fifo")).To(Succeed())
+		policy.Queues[1] += ".fifo"
+		Expect(policy.validateQueue("http://localhost:9324/queue/mail.fifo")).To(MatchError("the retry delay 1m0s cannot be applied to the FIFO queue http://localhost:9324/queue/mail-retry-2.fifo"))
+
+		configuration := validConfiguration
+		configuration.QUrl += ".fifo"
+		configuration.Retry = &RetryPolicy{Delays: []time.Duration{time.Minute}}
+		var service SQSService
+		Expect(service.ApplyConfiguration(configuration)).To(Succeed())
+		Expect(service.Start()).To(MatchError("invalid retry configuration: the retry delay 1m0s cannot be applied to the FIFO queue " + configuration.QUrl))
+		Expect(service.isRunning()).To(BeFalse())
+
+		service.Configuration.Retry = nil
+		_, err := service.RetryMessage(context.Background(), configuration.QUrl, &sqs.Message{})
+		Expect(err).To(Equal(ErrNoRetryPolicy))
+		service.Configuration.Retry = policy
+		_, err = service.RetryMessage(context.Background(), "http://localhost:9324/queue/mail.fifo", &sqs.Message{})
+		Expect(err).To(MatchError("the retry delay 1m0s cannot be applied to the FIFO queue http://localhost:9324/queue/mail-retry-2.fifo"))
+	})
+
+	It("should read the retry count", func() {
+		policy := &RetryPolicy{CountAttribute: "attempts"}
+		Expect(policy.RetryCount(&sqs.Message{})).To(Equal(0))
+		Expect(policy.RetryCount(&sqs.Message{
+			MessageAttributes: map[string]*sqs.MessageAttributeValue{
+				"attempts": {DataType: aws.String("Number"), StringValue: aws.String("2")},
+			},
+		})).To(Equal(2))
+	})
+
+	It("should fail without a policy", func() {
+		_, err := (&SQSService{}).RetryMessage(context.Background(), "queue", &sqs.Message{})
+		Expect(err).To(Equal(ErrNoRetryPolicy))
+	})
+
+	Context("re-sending the messages", func() {
+		var (
+			service   *SQSService
+			testQueue *TestQueue
+		)
+
+		start := func(policy *RetryPolicy, faults ...FaultRule) {
+			configuration := validConfiguration
+			configuration.Retry = policy
+			configuration.Faults = faults
+			service = &SQSService{}
+			Expect(service.ApplyConfiguration(configuration)).To(Succeed())
+			var err error
+			testQueue, err = NewTestQueue(service, &TestQueueOpts{Prefix: "sqssrv-retry"})
+			Expect(err).ToNot(HaveOccurred())
+		}
+
+		// queue creates a queue named after the one of the service.
+		queue := func(suffix string) string {
+			queueURL, err := testQueue.AddQueue(suffix, nil)
+			Expect(err).ToNot(HaveOccurred())
+			return queueURL
+		}
+
+		AfterEach(func() {
+			if testQueue != nil {
+				Expect(testQueue.Close()).To(Succeed())
+			}
+			testQueue = nil
+		})
+
+		send := func(attributes map[string]*sqs.MessageAttributeValue) {
+			_, err := service.SendMessage(&sqs.SendMessageInput{
+				MessageBody:       aws.String("message"),
+				MessageAttributes: attributes,
+			})
+			Expect(err).ToNot(HaveOccurred())
+		}
+
+		receive := func(queueURL string, waitTimeSeconds int64) []*sqs.Message {
+			output, err := service.ReceiveMessage(&sqs.ReceiveMessageInput{
+				QueueUrl:              aws.String(queueURL),
+				MessageAttributeNames: []*string{aws.String(sqs.QueueAttributeNameAll)},
+				WaitTimeSeconds:       aws.Int64(waitTimeSeconds),
+				VisibilityTimeout:     aws.Int64(1),
+			})
+			Expect(err).ToNot(HaveOccurred())
+			return output.Messages
+		}
+
+		count := func(message *sqs.Message) string {
+			return aws.StringValue(message.MessageAttributes[DefaultRetryCountAttribute].StringValue)
+		}
+
+		It("should re-send the message to the same queue with the delay", func() {
+			start(&RetryPolicy{Delays: []time.Duration{time.Second, time.Minute}})
+			send(map[string]*sqs.MessageAttributeValue{
+				"type": {DataType: aws.String("String"), StringValue: aws.String("welcome")},
+			})
+
+			messages := receive(service.Configuration.QUrl, 0)
+			Expect(messages).To(HaveLen(1))
+			outcome, err := service.RetryMessage(context.Background(), service.Configuration.QUrl, messages[0])
+			Expect(err).ToNot(HaveOccurred())
+			Expect(outcome).To(Equal(HandlerOutcomeRetried))
+
+			// Delayed.
+			Expect(receive(service.Configuration.QUrl, 0)).To(BeEmpty())
+			messages = receive(service.Configuration.QUrl, 2)
+			Expect(messages).To(HaveLen(1))
+			Expect(count(messages[0])).To(Equal("1"))
+			Expect(aws.StringValue(messages[0].MessageAttributes["type"].StringValue)).To(Equal("welcome"))
+
+			// The original was deleted.
+			time.Sleep(time.Second)
+			Expect(receive(service.Configuration.QUrl, 0)).To(HaveLen(1))
+		})
+
+		It("should park the message after the last retry", func() {
+			start(nil)
+			parking := queue("-parking")
+			service.Configuration.Retry = &RetryPolicy{
+				Delays:       []time.Duration{0, 0},
+				ParkingQueue: parking,
+			}
+			send(map[string]*sqs.MessageAttributeValue{
+				DefaultRetryCountAttribute: {DataType: aws.String("Number"), StringValue: aws.String("2")},
+			})
+
+			messages := receive(service.Configuration.QUrl, 0)
+			Expect(messages).To(HaveLen(1))
+			outcome, err := service.RetryMessage(context.Background(), service.Configuration.QUrl, messages[0])
+			Expect(err).ToNot(HaveOccurred())
+			Expect(outcome).To(Equal(HandlerOutcomeParked))
+
+			parked := receive(parking, 0)
+			Expect(parked).To(HaveLen(1))
+			Expect(count(parked[0])).To(Equal("2"))
+		})
+
+		It("should leave the message after the last retry without a parking queue", func() {
+			start(&RetryPolicy{Delays: []time.Duration{0}})
+			send(map[string]*sqs.MessageAttributeValue{
+				DefaultRetryCountAttribute: {DataType: aws.String("Number"), StringValue: aws.String("1")},
+			})
+
+			messages := receive(service.Configuration.QUrl, 0)
+			outcome, err := service.RetryMessage(context.Background(), service.Configuration.QUrl, messages[0])
+			Expect(err).ToNot(HaveOccurred())
+			Expect(outcome).To(Equal(HandlerOutcomeNacked))
+
+			Expect(receive(service.Configuration.QUrl, 2)).To(HaveLen(1))
+		})
+
+		It("should not delete the message when the retry fails", func() {
+			start(&RetryPolicy{Delays: []time.Duration{0}}, FaultRule{
+				Method:    MessageMetricMethodSendMessage,
+				ErrorCode: "ThrottlingException",
+			})
+			// Sent straight to the client, as SendMessage fails.
+			Expect(service.RunWithClient(func(client sqsiface.SQSAPI) error {
+				_, err := client.SendMessage(&sqs.SendMessageInput{
+					QueueUrl:    aws.String(service.Configuration.QUrl),
+					MessageBody: aws.String("message"),
+				})
+				return err
+			})).To(Succeed())
+
+			messages := receive(service.Configuration.QUrl, 0)
+			outcome, err := service.RetryMessage(context.Background(), service.Configuration.QUrl, messages[0])
+			Expect(err).To(HaveOccurred())
+			Expect(outcome).To(Equal(HandlerOutcomeNacked))
+
+			Expect(receive(service.Configuration.QUrl, 2)).To(HaveLen(1))
+		})
+
+		It("should re-send the message to the same FIFO queue", func() {
+			configuration := validConfiguration
+			configuration.Retry = &RetryPolicy{Delays: []time.Duration{0}}
+			service = &SQSService{}
+			Expect(service.ApplyConfiguration(configuration)).To(Succeed())
+			var err error
+			testQueue, err = NewTestQueue(service, &TestQueueOpts{
+				Prefix: "sqssrv-retry",
+				FIFO:   true,
+				Attributes: map[string]string{
+					sqs.QueueAttributeNameContentBasedDeduplication: "true",
+				},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			_, err = service.SendMessage(&sqs.SendMessageInput{
+				MessageBody:    aws.String("message"),
+				MessageGroupId: aws.String("group"),
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			output, err := service.ReceiveMessage(&sqs.ReceiveMessageInput{
+				AttributeNames:        []*string{aws.String(sqs.QueueAttributeNameAll)},
+				MessageAttributeNames: []*string{aws.String(sqs.QueueAttributeNameAll)},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(output.Messages).To(HaveLen(1))
+			outcome, err := service.RetryMessage(context.Background(), service.Configuration.QUrl, output.Messages[0])
+			Expect(err).ToNot(HaveOccurred())
+			Expect(outcome).To(Equal(HandlerOutcomeRetried))
+
+			// Not dropped as a duplicate of the original, which was deleted.
+			output, err = service.ReceiveMessage(&sqs.ReceiveMessageInput{
+				AttributeNames:        []*string{aws.String(sqs.QueueAttributeNameAll)},
+				MessageAttributeNames: []*string{aws.String(sqs.QueueAttributeNameAll)},
+				WaitTimeSeconds:       aws.Int64(1),
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(output.Messages).To(HaveLen(1))
+			Expect(count(output.Messages[0])).To(Equal("1"))
+			Expect(aws.StringValue(output.Messages[0].Attributes[sqs.MessageSystemAttributeNameMessageGroupId])).To(Equal("group"))
+		})
+
+		It("should not re-send a message without room for the retry count", func() {
+			start(&RetryPolicy{Delays: []time.Duration{0}})
+			attributes := make(map[string]*sqs.MessageAttributeValue, maxMessageAttributes)
+			for i := 0; i < maxMessageAttributes; i++ {
+				attributes[fmt.Sprintf("attribute-%d", i)] = &sqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String("value")}
+			}
+			send(attributes)
+
+			messages := receive(service.Configuration.QUrl, 0)
+			Expect(messages).To(HaveLen(1))
+			outcome, err := service.RetryMessage(context.Background(), service.Configuration.QUrl, messages[0])
+			Expect(err).To(MatchError("the message has no room for the retry_count attribute: it has 10 message attributes, of the 10 allowed"))
+			Expect(outcome).To(Equal(HandlerOutcomeNacked))
+
+			Expect(receive(service.Configuration.QUrl, 2)).To(HaveLen(1))
+		})
+
+		It("should make the consumer retry through the retry queues", func() {
+			start(nil)
+			policy := &RetryPolicy{
+				Delays:       []time.Duration{0, time.Second},
+				Queues:       []string{queue("-retry-1"), queue("-retry-2")},
+				ParkingQueue: queue("-parking"),
+			}
+			send(nil)
+
+			var attempts int32
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			go func() {
+				defer GinkgoRecover()
+				defer close(done)
+				Expect(NewConsumer(service, &ConsumerOpts{
+					Poller: PollerOpts{WaitTimeSeconds: 1, MinBackoff: 10 * time.Millisecond},
+					Retry:  policy,
+					Handler: HandlerFunc(func(ctx context.Context, message *sqs.Message) error {
+						atomic.AddInt32(&attempts, 1)
+						return errors.New("failed")
+					}),
+				}).Run(ctx)).To(Succeed())
+			}()
+			defer func() {
+				cancel()
+				Eventually(done, 5*time.Second).Should(BeClosed())
+			}()
+
+			var parked []*sqs.Message
+			Eventually(func() []*sqs.Message {
+				parked = receive(policy.ParkingQueue, 0)
+				return parked
+			}, 10*time.Second).Should(HaveLen(1))
+			Expect(count(parked[0])).To(Equal("2"))
+			Expect(atomic.LoadInt32(&attempts)).To(BeEquivalentTo(3))
+
+			outcomes := func(queueURL string, outcome HandlerOutcome) float64 {
+				var metric dto.Metric
+				Expect(service.Collector.handlerOutcomes.WithLabelValues(queueURL, "", string(outcome)).Write(&metric)).To(Succeed())
+				return metric.GetCounter().GetValue()
+			}
+			// The message can be parked before the consumer records the outcome.
+			Eventually(func() float64 {
+				return outcomes(service.Configuration.QUrl, HandlerOutcomeRetried)
+			}).Should(BeEquivalentTo(1))
+			Eventually(func() float64 {
+				return outcomes(policy.Queues[0], HandlerOutcomeRetried)
+			}).Should(BeEquivalentTo(1))
+			Eventually(func() float64 {
+				return outcomes(policy.Queues[1], HandlerOutcomeParked)
+			}).Should(BeEquivalentTo(1))
+		})
+	})
+})
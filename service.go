@@ -13,6 +13,7 @@ import (
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
 	rscsrv "github.com/lab259/go-rscsrv"
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -25,8 +26,49 @@ type SQSServiceConfiguration struct {
 	Key             string `yaml:"key"`
 	Secret          string `yaml:"secret"`
 	CollectorPrefix string `yaml:"collector_prefix"`
+	// CollectorQueueLabel is the SQSServiceCollectorOpts.QueueLabel: "url"
+	// (default) or "name".
+	CollectorQueueLabel QueueLabel `yaml:"collector_queue_label"`
+	// CollectorConstLabels are labels added to all the metrics.
+	CollectorConstLabels map[string]string `yaml:"collector_const_labels"`
+	// CollectorMaxQueues caps the distinct "queue" labels of the metrics.
+	CollectorMaxQueues int `yaml:"collector_max_queues"`
+	// LongPolling makes ReceiveMessage wait MaxWaitTimeSeconds for messages
+	// when the input does not set WaitTimeSeconds.
+	LongPolling bool `yaml:"long_polling"`
+	// Interceptors wrap all the SQS calls of the service, in order. They are
+	// applied by Start.
+	Interceptors []Interceptor `yaml:"-"`
+	// CassetteMode records the SQS calls to, or replays them from, the
+	// CassettePath. Empty disables both.
+	CassetteMode CassetteMode `yaml:"cassette_mode"`
+	// CassettePath is the file of the cassette: loaded by Start, when
+	// replaying, and written by Stop, when recording.
+	CassettePath string `yaml:"cassette_path"`
+	// Faults are injected in the SQS calls, for chaos testing. The calls that
+	// got a fault are reported with its OperationResult.Fault.
+	Faults []FaultRule `yaml:"faults"`
+	// CreateQueue makes Start create the queue, instead of failing, when it
+	// does not exist.
+	CreateQueue *CreateQueueConfiguration `yaml:"create_queue"`
+	// Drift makes Start, and then a routine on its interval, compare the
+	// attributes of the queue with the expected ones.
+	Drift *DriftConfiguration `yaml:"drift"`
+	// Retry makes the consumers re-send the messages whose handling failed,
+	// with escalating delays.
+	Retry *RetryPolicy `yaml:"retry"`
+	// DeadLetter makes the consumers move the poison messages to a dead letter
+	// queue, annotated with why they failed.
+	DeadLetter *DeadLetterPolicy `yaml:"dead_letter"`
+	// FIFO fills in the MessageGroupId and MessageDeduplicationId of the
+	// messages sent to FIFO queues.
+	FIFO *FIFOConfiguration `yaml:"fifo"`
 }
 
+// MaxWaitTimeSeconds is the longest time a ReceiveMessage can wait for
+// messages.
+const MaxWaitTimeSeconds = 20
+
 // CredentialsFromStruct define credentials from sqs configuration
 type CredentialsFromStruct struct {
 	credentials *SQSServiceConfiguration
@@ -52,12 +94,44 @@ func (*CredentialsFromStruct) IsExpired() bool {
 	return false
 }
 
+// ErrClientNotSQS is returned by RunWithSQS when the client of the service is
+// not a `*sqs.SQS`.
+var ErrClientNotSQS = errors.New("the client is not a *sqs.SQS")
+
 // SQSService is the service which manages a service queue on the AWS.
+//
+// The Client can be set before calling Start, e.g. with a mock. Otherwise,
+// Start creates a `*sqs.SQS` from the configuration.
+//
+// The Collector can be set before calling Start. Otherwise, Start creates one
+// using the `CollectorPrefix` of the configuration. Either way, the collector
+// is kept for the whole life of the service, so its metrics survive Restart.
+// If a Registerer is informed, Start registers the Collector on it.
+//
+// When a Recorder is informed, the metrics are sent to it instead and no
+// Collector is created.
+//
+// All the SQS calls go through the Interceptors of the configuration and then
+// through the RecorderInterceptor, which reports them to the Recorder.
+//
+// The Cassette can be set before calling Start. Otherwise, Start creates one
+// according to the CassetteMode of the configuration. A recording Cassette
+// keeps every call made to the client, with the Key and the Secret of the
+// configuration scrubbed. A replaying one answers the calls instead of the
+// client, failing with an UnexpectedCallError when they diverge from the
+// recording.
 type SQSService struct {
 	m             sync.RWMutex
-	awsSQS        *sqs.SQS
+	awsSQS        sqsiface.SQSAPI
+	invoker       Invoker
+	stopDrift     context.CancelFunc
+	fifoQueues    sync.Map
 	Configuration SQSServiceConfiguration
+	Client        sqsiface.SQSAPI
 	Collector     *SQSServiceCollector
+	Registerer    prometheus.Registerer
+	Recorder      Recorder
+	Cassette      *Cassette
 }
 
 // LoadConfiguration returns
@@ -80,6 +154,17 @@ func (service *SQSService) ApplyConfiguration(configuration interface{}) error {
 
 // Restart stops and then starts the service again.
 func (service *SQSService) Restart() error {
+	err := service.restart()
+	service.getRecorder().Lifecycle(LifecycleEvent{
+		Queue:   service.Configuration.QUrl,
+		Action:  LifecycleActionRestart,
+		Err:     err,
+		Running: service.isRunning(),
+	})
+	return err
+}
+
+func (service *SQSService) restart() error {
 	if err := service.Stop(); err != nil {
 		if err != nil {
 			return err
@@ -90,463 +175,530 @@ func (service *SQSService) Restart() error {
 
 // Start starts the service pool.
 func (service *SQSService) Start() error {
+	event := LifecycleEvent{
+		Queue:  service.Configuration.QUrl,
+		Action: LifecycleActionStart,
+	}
+	event.Err = service.start(&event)
+	event.Running = service.isRunning()
+	service.getRecorder().Lifecycle(event)
+	return event.Err
+}
+
+// start starts the service, filling how long the validation of the queue
+// took.
+func (service *SQSService) start(event *LifecycleEvent) error {
 	if !service.isRunning() {
 		service.m.Lock()
 		defer service.m.Unlock()
 
-		conf := aws.Config{
-			Credentials: credentials.NewCredentials(NewCredentialsFromStruct(&service.Configuration)),
+		if service.Recorder == nil && service.Collector == nil {
+			service.Collector = NewSQSServiceCollector(&SQSServiceCollectorOpts{
+				Prefix:              service.Configuration.CollectorPrefix,
+				QueueLabel:          service.Configuration.CollectorQueueLabel,
+				ConstLabels:         service.Configuration.CollectorConstLabels,
+				MaxQueueLabelValues: service.Configuration.CollectorMaxQueues,
+			})
+		}
+		if service.Collector != nil && service.Registerer != nil {
+			if err := service.Collector.Register(service.Registerer); err != nil {
+				return err
+			}
 		}
 
-		if service.Configuration.Endpoint != "" {
-			conf.Endpoint = aws.String(service.Configuration.Endpoint)
+		awsSQS := service.Client
+		if awsSQS == nil {
+			client, err := service.newClient()
+			if err != nil {
+				return err
+			}
+			awsSQS = client
 		}
-
-		if service.Configuration.Region == "" {
-			conf.Region = aws.String("sa-east-1")
-		} else {
-			conf.Region = aws.String(service.Configuration.Region)
+		if service.Cassette == nil {
+			cassette, err := service.newCassette()
+			if err != nil {
+				return err
+			}
+			service.Cassette = cassette
 		}
-
-		sess, err := session.NewSessionWithOptions(session.Options{
-			Config: conf,
-		})
-		if err != nil {
-			return err
+		invoker := clientInvoker(awsSQS)
+		if service.Cassette != nil {
+			invoker = service.Cassette.invoker(invoker, service.Configuration.Key, service.Configuration.Secret)
 		}
-
-		awsSQS := sqs.New(sess)
+		if len(service.Configuration.Faults) > 0 {
+			invoker = newFaultInjector(service.Configuration.Faults).invoker(invoker)
+		}
+		invoker = service.chain(invoker, service.recorder())
 
 		confQURLParsed, err := url.Parse(service.Configuration.QUrl)
 		if err != nil {
 			return fmt.Errorf("could not parse the qurl: %s (%s)", service.Configuration.QUrl, err.Error())
 		}
+		drift := service.Configuration.Drift
+		if drift != nil {
+			if err := drift.Validate(); err != nil {
+				return fmt.Errorf("invalid drift configuration: %s", err.Error())
+			}
+		}
+		retry := service.Configuration.Retry
+		if retry != nil {
+			if err := retry.Validate(); err != nil {
+				return fmt.Errorf("invalid retry configuration: %s", err.Error())
+			}
+			if err := retry.validateQueue(service.Configuration.QUrl); err != nil {
+				return fmt.Errorf("invalid retry configuration: %s", err.Error())
+			}
+		}
 
-		listQueuesOutput, err := awsSQS.ListQueues(&sqs.ListQueuesInput{
+		start := time.Now()
+		ctx := managementCall(context.Background())
+		output, err := invoker(ctx, Operation{
+			Queue:  service.Configuration.QUrl,
+			Method: MessageMetricMethodListQueues,
+		}, &sqs.ListQueuesInput{
 			QueueNamePrefix: aws.String(path.Base(confQURLParsed.Path)),
 		})
+		// Only the validation: the creation of the queue, the FIFO lookup and
+		// the drift check are not timed.
+		event.ValidationDuration = time.Since(start)
 		if err != nil {
 			return err
 		}
+		listQueuesOutput, _ := output.(*sqs.ListQueuesOutput)
 		err = func() error {
-			for _, q := range listQueuesOutput.QueueUrls {
-				qURLParsed, err := url.Parse(aws.StringValue(q))
-				if err != nil {
-					return fmt.Errorf("could not parse the qurl: %s (%s)", aws.StringValue(q), err.Error())
-				}
-				if path.Base(qURLParsed.Path) == path.Base(confQURLParsed.Path) {
-					return nil
+			if listQueuesOutput != nil {
+				for _, q := range listQueuesOutput.QueueUrls {
+					qURLParsed, err := url.Parse(aws.StringValue(q))
+					if err != nil {
+						return fmt.Errorf("could not parse the qurl: %s (%s)", aws.StringValue(q), err.Error())
+					}
+					if path.Base(qURLParsed.Path) == path.Base(confQURLParsed.Path) {
+						return nil
+					}
 				}
 			}
+			if service.Configuration.CreateQueue != nil {
+				return service.Configuration.CreateQueue.createQueue(ctx, invoker, path.Base(confQURLParsed.Path))
+			}
 			return fmt.Errorf("queue %s not found", service.Configuration.QUrl)
 		}()
 		if err != nil {
 			return err
 		}
 
+		if isFIFO(service.Configuration.QUrl) {
+			queue, err := lookupFIFO(ctx, invoker, service.Configuration.QUrl)
+			if err != nil {
+				return err
+			}
+			service.fifoQueues.Store(service.Configuration.QUrl, queue)
+		}
+
+		if drift != nil {
+			driftEvent := drift.check(ctx, invoker, service.Configuration.QUrl)
+			drift.report(service.recorder(), driftEvent)
+			if driftEvent.Err != nil && drift.FailOnError {
+				return driftEvent.Err
+			}
+			if err := driftEvent.criticalError(); err != nil {
+				return err
+			}
+			if drift.Interval > 0 {
+				ctx, cancel := context.WithCancel(ctx)
+				service.stopDrift = cancel
+				go service.watchDrift(ctx, drift, invoker, service.Configuration.QUrl)
+			}
+		}
+
 		service.awsSQS = awsSQS
-		service.Collector = NewSQSServiceCollector(&SQSServiceCollectorOpts{
-			Prefix: service.Configuration.CollectorPrefix,
-		})
+		service.invoker = invoker
 	}
 
 	return nil
 }
 
+// newClient creates the `*sqs.SQS` client from the configuration.
+func (service *SQSService) newClient() (*sqs.SQS, error) {
+	conf := aws.Config{
+		Credentials: credentials.NewCredentials(NewCredentialsFromStruct(&service.Configuration)),
+	}
+
+	if service.Configuration.Endpoint != "" {
+		conf.Endpoint = aws.String(service.Configuration.Endpoint)
+	}
+
+	if service.Configuration.Region == "" {
+		conf.Region = aws.String("sa-east-1")
+	} else {
+		conf.Region = aws.String(service.Configuration.Region)
+	}
+
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config: conf,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sqs.New(sess), nil
+}
+
+// newCassette creates the cassette of the CassetteMode of the configuration,
+// nil if there is none.
+func (service *SQSService) newCassette() (*Cassette, error) {
+	switch service.Configuration.CassetteMode {
+	case "":
+		return nil, nil
+	case CassetteModeRecord:
+		return NewCassette(CassetteModeRecord), nil
+	case CassetteModeReplay:
+		return LoadCassette(service.Configuration.CassettePath)
+	}
+	return nil, fmt.Errorf("invalid cassette mode: %s", service.Configuration.CassetteMode)
+}
+
 func (service *SQSService) isRunning() bool {
 	service.m.RLock()
 	defer service.m.RUnlock()
 	return service.awsSQS != nil
 }
 
-func (service *SQSService) getSQS() *sqs.SQS {
+// getRecorder returns the Recorder of the service, falling back to the
+// Collector and then to a NopRecorder.
+func (service *SQSService) getRecorder() Recorder {
+	service.m.RLock()
+	defer service.m.RUnlock()
+	return service.recorder()
+}
+
+// recorder is the getRecorder to be called with the lock held.
+func (service *SQSService) recorder() Recorder {
+	if service.Recorder != nil {
+		return service.Recorder
+	}
+	if service.Collector != nil {
+		return service.Collector
+	}
+	return NopRecorder{}
+}
+
+func (service *SQSService) getSQS() sqsiface.SQSAPI {
 	service.m.RLock()
 	defer service.m.RUnlock()
 	return service.awsSQS
 }
 
-// Stop erases the aws client reference.
+// getInvoker returns the chain built by Start. While the service is not
+// running, the interceptors are still called, but the operations fail with
+// `rscsrv.ErrServiceNotRunning`.
+func (service *SQSService) getInvoker() Invoker {
+	service.m.RLock()
+	defer service.m.RUnlock()
+	if service.invoker != nil {
+		return service.invoker
+	}
+	return service.chain(clientInvoker(nil), service.recorder())
+}
+
+// Stop erases the aws client reference, stopping the drift checks. When
+// recording, it also writes the Cassette to the CassettePath of the
+// configuration.
 func (service *SQSService) Stop() error {
+	var err error
 	if service.isRunning() {
 		service.m.Lock()
 		service.awsSQS = nil
+		service.invoker = nil
+		if service.stopDrift != nil {
+			service.stopDrift()
+			service.stopDrift = nil
+		}
+		cassette := service.Cassette
 		service.m.Unlock()
+		if cassette != nil && cassette.Mode == CassetteModeRecord && service.Configuration.CassettePath != "" {
+			err = cassette.Save(service.Configuration.CassettePath)
+		}
 	}
-	return nil
+	service.getRecorder().Lifecycle(LifecycleEvent{
+		Queue:  service.Configuration.QUrl,
+		Action: LifecycleActionStop,
+		Err:    err,
+	})
+	return err
 }
 
-// RunWithSQS runs a handler passing the reference of a `sqs.SQS` client.
+// RunWithSQS runs a handler passing the reference of a `sqs.SQS` client. It
+// fails with ErrClientNotSQS if another Client was injected; use RunWithClient
+// instead.
+//
+// The calls made directly on the client do not go through the interceptors.
 func (service *SQSService) RunWithSQS(handler func(client *sqs.SQS) error) error {
+	return service.RunWithClient(func(client sqsiface.SQSAPI) error {
+		awsSQS, ok := client.(*sqs.SQS)
+		if !ok {
+			return ErrClientNotSQS
+		}
+		return handler(awsSQS)
+	})
+}
+
+// RunWithClient runs a handler passing the client of the service.
+//
+// The calls made directly on the client do not go through the interceptors.
+func (service *SQSService) RunWithClient(handler func(client sqsiface.SQSAPI) error) error {
 	if service.isRunning() {
 		return handler(service.getSQS())
 	}
 	return rscsrv.ErrServiceNotRunning
 }
 
-// SendMessage is a wrapper for the `sqs.SQS.SendMessage`.
-func (service *SQSService) SendMessage(input *sqs.SendMessageInput) (*sqs.SendMessageOutput, error) {
-	if input.QueueUrl == nil {
-		qURL := aws.String(service.Configuration.QUrl)
-		if qURL == nil {
-			*qURL = ""
-		}
-		input.QueueUrl = qURL
+// queueURL defaults the queue of an input to the QUrl of the configuration.
+func (service *SQSService) queueURL(queueURL *string) *string {
+	if queueURL == nil {
+		return aws.String(service.Configuration.QUrl)
 	}
+	return queueURL
+}
 
-	metricLabels := prometheus.Labels{"queue": *input.QueueUrl, "method": MessageMetricMethodSendMessage}
-
-	service.Collector.messageCalls.With(metricLabels).Inc()
-
-	if service.isRunning() {
-
-		start := time.Now()
-		output, err := service.getSQS().SendMessage(input)
-		service.Collector.messageDuration.With(metricLabels).Add(time.Since(start).Seconds())
-
-		if err != nil {
-			service.Collector.messageFailures.With(metricLabels).Inc()
-		} else {
-			service.Collector.messageSuccess.With(metricLabels).Inc()
-		}
-
-		service.Collector.messageTrafficAmount.With(metricLabels).Inc()
-		if input.MessageBody != nil {
-			service.Collector.messageTrafficSize.With(metricLabels).Add(float64(len(*input.MessageBody)))
-		}
-
-		return output, err
+// invoke calls the operation through the interceptors. When it succeeds,
+// the output is always the one of the input, so the wrappers never return
+// nil, nil.
+func (service *SQSService) invoke(ctx context.Context, method string, queueURL *string, input interface{}) (interface{}, error) {
+	op := Operation{
+		Queue:  aws.StringValue(queueURL),
+		Method: method,
+	}
+	output, err := service.getInvoker()(ctx, op, input)
+	// An interceptor, a fault or a cassette could return no output, or one of
+	// another type, without an error: the wrappers would return nil, nil.
+	if err == nil && !isOutputOf(input, output) {
+		return nil, unexpectedOutputError(op, output)
 	}
-	return nil, rscsrv.ErrServiceNotRunning
+	return output, err
+}
+
+// SendMessage is a wrapper for the `sqs.SQS.SendMessage`.
+func (service *SQSService) SendMessage(input *sqs.SendMessageInput) (*sqs.SendMessageOutput, error) {
+	return service.SendMessageWithContext(context.Background(), input)
 }
 
 // SendMessageWithContext is a wrapper for the `sqs.SQS.SendMessage`.
+//
+// When the queue is a FIFO queue, the MessageGroupId and
+// MessageDeduplicationId missing are filled in according to the FIFO of the
+// configuration, failing with a FIFOError when they cannot be. The output has
+// the SequenceNumber of the message.
 func (service *SQSService) SendMessageWithContext(ctx context.Context, input *sqs.SendMessageInput) (*sqs.SendMessageOutput, error) {
-	if input.QueueUrl == nil {
-		qURL := aws.String(service.Configuration.QUrl)
-		if qURL == nil {
-			*qURL = ""
-		}
-		input.QueueUrl = qURL
-	}
-
-	metricLabels := prometheus.Labels{"queue": *input.QueueUrl, "method": MessageMetricMethodSendMessage}
-
-	service.Collector.messageCalls.With(metricLabels).Inc()
-
-	if service.isRunning() {
-
-		start := time.Now()
-		output, err := service.getSQS().SendMessageWithContext(ctx, input)
-		service.Collector.messageDuration.With(metricLabels).Add(time.Since(start).Seconds())
-
+	input.QueueUrl = service.queueURL(input.QueueUrl)
+	if queueURL := aws.StringValue(input.QueueUrl); isFIFO(queueURL) {
+		groupID, deduplicationID, err := service.fifoMessage(ctx, queueURL, "", input.MessageBody, input.MessageAttributes, input.MessageGroupId, input.MessageDeduplicationId)
 		if err != nil {
-			service.Collector.messageFailures.With(metricLabels).Inc()
-		} else {
-			service.Collector.messageSuccess.With(metricLabels).Inc()
-		}
-
-		service.Collector.messageTrafficAmount.With(metricLabels).Inc()
-		if input.MessageBody != nil {
-			service.Collector.messageTrafficSize.With(metricLabels).Add(float64(len(*input.MessageBody)))
+			return nil, err
 		}
-
-		return output, err
+		input.MessageGroupId, input.MessageDeduplicationId = groupID, deduplicationID
 	}
-	return nil, rscsrv.ErrServiceNotRunning
+	output, err := service.invoke(ctx, MessageMetricMethodSendMessage, input.QueueUrl, input)
+	out, _ := output.(*sqs.SendMessageOutput)
+	return out, err
 }
 
 // SendMessageBatch is a wrapper for the `sqs.SQS.SendMessageBatch`.
 func (service *SQSService) SendMessageBatch(input *sqs.SendMessageBatchInput) (*sqs.SendMessageBatchOutput, error) {
-	if input.QueueUrl == nil {
-		qURL := aws.String(service.Configuration.QUrl)
-		if qURL == nil {
-			*qURL = ""
-		}
-		input.QueueUrl = qURL
-	}
-
-	metricLabels := prometheus.Labels{"queue": *input.QueueUrl, "method": MessageMetricMethodSendMessageBatch}
-
-	service.Collector.messageCalls.With(metricLabels).Inc()
-
-	if service.isRunning() {
-
-		trafficSize := 0
-		for _, msg := range input.Entries {
-			if msg.MessageBody != nil {
-				trafficSize += len(*msg.MessageBody)
-			}
-		}
-
-		service.Collector.messageTrafficAmount.With(metricLabels).Add(float64(len(input.Entries)))
-		service.Collector.messageTrafficSize.With(metricLabels).Add(float64(trafficSize))
-
-		start := time.Now()
-		out, err := service.getSQS().SendMessageBatch(input)
-		service.Collector.messageDuration.With(metricLabels).Add(time.Since(start).Seconds())
-
-		if err != nil {
-			service.Collector.messageFailures.With(metricLabels).Inc()
-		} else {
-			service.Collector.messageSuccess.With(metricLabels).Inc()
-		}
-
-		return out, err
-	}
-	return nil, rscsrv.ErrServiceNotRunning
+	return service.SendMessageBatchWithContext(context.Background(), input)
 }
 
 // SendMessageBatchWithContext is a wrapper for the `sqs.SQS.SendMessageBatchWithContext`.
+//
+// When the queue is a FIFO queue, the entries are filled in and checked as in
+// SendMessageWithContext. Batches above MaxBatchEntries, or whose payload is
+// above 256KB, are split in as many calls as needed, in order, with their
+// results merged. If a call fails, the results of the previous ones are
+// returned along with the error. The order of each message group is
+// preserved: once an entry fails, the entries of its group in the later calls
+// are not sent, but reported as Failed with ErrCodeMessageGroupBlocked.
+//
+// The batches to standard queues are sent as they are, in a single call.
 func (service *SQSService) SendMessageBatchWithContext(ctx context.Context, input *sqs.SendMessageBatchInput) (*sqs.SendMessageBatchOutput, error) {
-	if input.QueueUrl == nil {
-		qURL := aws.String(service.Configuration.QUrl)
-		if qURL == nil {
-			*qURL = ""
-		}
-		input.QueueUrl = qURL
+	input.QueueUrl = service.queueURL(input.QueueUrl)
+	queueURL := aws.StringValue(input.QueueUrl)
+	if !isFIFO(queueURL) {
+		output, err := service.invoke(ctx, MessageMetricMethodSendMessageBatch, input.QueueUrl, input)
+		out, _ := output.(*sqs.SendMessageBatchOutput)
+		return out, err
 	}
-
-	metricLabels := prometheus.Labels{"queue": *input.QueueUrl, "method": MessageMetricMethodSendMessageBatch}
-
-	service.Collector.messageCalls.With(metricLabels).Inc()
-
-	if service.isRunning() {
-
-		trafficSize := 0
-		for _, msg := range input.Entries {
-			if msg.MessageBody != nil {
-				trafficSize += len(*msg.MessageBody)
-			}
+	for _, entry := range input.Entries {
+		if entry == nil {
+			continue
 		}
-
-		service.Collector.messageTrafficAmount.With(metricLabels).Add(float64(len(input.Entries)))
-		service.Collector.messageTrafficSize.With(metricLabels).Add(float64(trafficSize))
-
-		start := time.Now()
-		out, err := service.getSQS().SendMessageBatchWithContext(ctx, input)
-		service.Collector.messageDuration.With(metricLabels).Add(time.Since(start).Seconds())
-
+		groupID, deduplicationID, err := service.fifoMessage(ctx, queueURL, aws.StringValue(entry.Id), entry.MessageBody, entry.MessageAttributes, entry.MessageGroupId, entry.MessageDeduplicationId)
 		if err != nil {
-			service.Collector.messageFailures.With(metricLabels).Inc()
-		} else {
-			service.Collector.messageSuccess.With(metricLabels).Inc()
+			return nil, err
 		}
+		entry.MessageGroupId, entry.MessageDeduplicationId = groupID, deduplicationID
+	}
 
+	chunks := sendBatchChunks(input.Entries)
+	if len(chunks) <= 1 {
+		output, err := service.invoke(ctx, MessageMetricMethodSendMessageBatch, input.QueueUrl, input)
+		out, _ := output.(*sqs.SendMessageBatchOutput)
 		return out, err
 	}
-	return nil, rscsrv.ErrServiceNotRunning
-}
 
-// ReceiveMessage is a wrapper for the `sqs.SQS.ReceiveMessage`.
-func (service *SQSService) ReceiveMessage(input *sqs.ReceiveMessageInput) (*sqs.ReceiveMessageOutput, error) {
-	if input.QueueUrl == nil {
-		qURL := aws.String(service.Configuration.QUrl)
-		if qURL == nil {
-			*qURL = ""
-		}
-		input.QueueUrl = qURL
+	result := &sqs.SendMessageBatchOutput{
+		Successful: []*sqs.SendMessageBatchResultEntry{},
+		Failed:     []*sqs.BatchResultErrorEntry{},
 	}
-	metricLabels := prometheus.Labels{"queue": *input.QueueUrl, "method": MessageMetricMethodReceiveMessage}
-	service.Collector.messageCalls.With(metricLabels).Inc()
-
-	if service.isRunning() {
-		start := time.Now()
-		output, err := service.getSQS().ReceiveMessage(input)
-		service.Collector.messageDuration.With(metricLabels).Add(time.Since(start).Seconds())
-
+	// groups are the message groups of the entries, by their Id, and blocked
+	// the ones with an entry failed.
+	groups := make(map[string]string)
+	blocked := make(map[string]bool)
+	for _, entries := range chunks {
+		chunk := *input
+		chunk.Entries = nil
+		for _, entry := range entries {
+			if entry == nil {
+				chunk.Entries = append(chunk.Entries, entry)
+				continue
+			}
+			groupID := aws.StringValue(entry.MessageGroupId)
+			groups[aws.StringValue(entry.Id)] = groupID
+			if blocked[groupID] {
+				result.Failed = append(result.Failed, &sqs.BatchResultErrorEntry{
+					Id:          entry.Id,
+					Code:        aws.String(ErrCodeMessageGroupBlocked),
+					Message:     aws.String(fmt.Sprintf("not sent, as an earlier message of the group %s failed", groupID)),
+					SenderFault: aws.Bool(false),
+				})
+				continue
+			}
+			chunk.Entries = append(chunk.Entries, entry)
+		}
+		if len(chunk.Entries) == 0 {
+			continue
+		}
+		output, err := service.invoke(ctx, MessageMetricMethodSendMessageBatch, input.QueueUrl, &chunk)
 		if err != nil {
-			service.Collector.messageFailures.With(metricLabels).Inc()
-		} else {
-			service.Collector.messageSuccess.With(metricLabels).Inc()
+			return result, err
 		}
-
-		service.Collector.messageTrafficAmount.With(metricLabels).Add(float64(len(output.Messages)))
-
-		trafficSize := 0
-
-		for _, msg := range output.Messages {
-			if msg.Body != nil {
-				trafficSize += len(*msg.Body)
+		if out, ok := output.(*sqs.SendMessageBatchOutput); ok && out != nil {
+			result.Successful = append(result.Successful, out.Successful...)
+			result.Failed = append(result.Failed, out.Failed...)
+			for _, entry := range out.Failed {
+				blocked[groups[aws.StringValue(entry.Id)]] = true
 			}
 		}
-		service.Collector.messageTrafficSize.With(metricLabels).Add(float64(trafficSize))
-
-		return output, err
 	}
-	return nil, rscsrv.ErrServiceNotRunning
+	return result, nil
+}
+
+// ReceiveMessage is a wrapper for the `sqs.SQS.ReceiveMessage`.
+func (service *SQSService) ReceiveMessage(input *sqs.ReceiveMessageInput) (*sqs.ReceiveMessageOutput, error) {
+	return service.ReceiveMessageWithContext(context.Background(), input)
 }
 
 // ReceiveMessageWithContext is a wrapper for the `sqs.SQS.ReceiveMessageWithContext`.
 func (service *SQSService) ReceiveMessageWithContext(ctx context.Context, input *sqs.ReceiveMessageInput) (*sqs.ReceiveMessageOutput, error) {
-	if input.QueueUrl == nil {
-		qURL := aws.String(service.Configuration.QUrl)
-		if qURL == nil {
-			*qURL = ""
-		}
-		input.QueueUrl = qURL
+	input.QueueUrl = service.queueURL(input.QueueUrl)
+	if input.WaitTimeSeconds == nil && service.Configuration.LongPolling {
+		input.WaitTimeSeconds = aws.Int64(MaxWaitTimeSeconds)
 	}
-	metricLabels := prometheus.Labels{"queue": *input.QueueUrl, "method": MessageMetricMethodReceiveMessage}
-	service.Collector.messageCalls.With(metricLabels).Inc()
-
-	if service.isRunning() {
-		start := time.Now()
-		output, err := service.getSQS().ReceiveMessageWithContext(ctx, input)
-		service.Collector.messageDuration.With(metricLabels).Add(time.Since(start).Seconds())
-
-		if err != nil {
-			service.Collector.messageFailures.With(metricLabels).Inc()
-		} else {
-			service.Collector.messageSuccess.With(metricLabels).Inc()
-		}
-
-		service.Collector.messageTrafficAmount.With(metricLabels).Add(float64(len(output.Messages)))
-
-		trafficSize := 0
-
-		for _, msg := range output.Messages {
-			if msg.Body != nil {
-				trafficSize += len(*msg.Body)
-			}
-		}
-		service.Collector.messageTrafficSize.With(metricLabels).Add(float64(trafficSize))
-
-		return output, err
-	}
-	return nil, rscsrv.ErrServiceNotRunning
+	output, err := service.invoke(ctx, MessageMetricMethodReceiveMessage, input.QueueUrl, input)
+	out, _ := output.(*sqs.ReceiveMessageOutput)
+	return out, err
 }
 
 // DeleteMessage is a wrapper for the `sqs.SQS.DeleteMessage`.
 func (service *SQSService) DeleteMessage(input *sqs.DeleteMessageInput) (*sqs.DeleteMessageOutput, error) {
-	if input.QueueUrl == nil {
-		qURL := aws.String(service.Configuration.QUrl)
-		if qURL == nil {
-			*qURL = ""
-		}
-		input.QueueUrl = qURL
-	}
-	metricLabels := prometheus.Labels{"queue": *input.QueueUrl, "method": MessageMetricMethodDeleteMessage}
-	service.Collector.messageCalls.With(metricLabels).Inc()
-
-	if service.isRunning() {
-		start := time.Now()
-		output, err := service.getSQS().DeleteMessage(input)
-		service.Collector.messageDuration.With(metricLabels).Add(time.Since(start).Seconds())
-
-		if err != nil {
-			service.Collector.messageFailures.With(metricLabels).Inc()
-		} else {
-			service.Collector.messageSuccess.With(metricLabels).Inc()
-		}
-		service.Collector.messageTrafficAmount.With(metricLabels).Inc()
-		return output, err
-	}
-	return nil, rscsrv.ErrServiceNotRunning
+	return service.DeleteMessageWithContext(context.Background(), input)
 }
 
 // DeleteMessageWithContext is a wrapper for the `sqs.SQS.DeleteMessageWithContext`.
 func (service *SQSService) DeleteMessageWithContext(ctx context.Context, input *sqs.DeleteMessageInput) (*sqs.DeleteMessageOutput, error) {
-	if input.QueueUrl == nil {
-		qURL := aws.String(service.Configuration.QUrl)
-		if qURL == nil {
-			*qURL = ""
-		}
-		input.QueueUrl = qURL
-	}
-	metricLabels := prometheus.Labels{"queue": *input.QueueUrl, "method": MessageMetricMethodDeleteMessage}
-	service.Collector.messageCalls.With(metricLabels).Inc()
-
-	if service.isRunning() {
-		start := time.Now()
-		output, err := service.getSQS().DeleteMessageWithContext(ctx, input)
-		service.Collector.messageDuration.With(metricLabels).Add(time.Since(start).Seconds())
-
-		if err != nil {
-			service.Collector.messageFailures.With(metricLabels).Inc()
-		} else {
-			service.Collector.messageSuccess.With(metricLabels).Inc()
-		}
-		service.Collector.messageTrafficAmount.With(metricLabels).Inc()
-		return output, err
-	}
-	return nil, rscsrv.ErrServiceNotRunning
+	input.QueueUrl = service.queueURL(input.QueueUrl)
+	output, err := service.invoke(ctx, MessageMetricMethodDeleteMessage, input.QueueUrl, input)
+	out, _ := output.(*sqs.DeleteMessageOutput)
+	return out, err
 }
 
 // DeleteMessageBatch is a wrapper for the `sqs.SQS.DeleteMessageBatch`.
 func (service *SQSService) DeleteMessageBatch(input *sqs.DeleteMessageBatchInput) (*sqs.DeleteMessageBatchOutput, error) {
-	if input.QueueUrl == nil {
-		qURL := aws.String(service.Configuration.QUrl)
-		if qURL == nil {
-			*qURL = ""
-		}
-		input.QueueUrl = qURL
-	}
-
-	metricLabels := prometheus.Labels{"queue": *input.QueueUrl, "method": MessageMetricMethodDeleteMessageBatch}
-
-	service.Collector.messageCalls.With(metricLabels).Inc()
-
-	if service.isRunning() {
-		service.Collector.messageTrafficAmount.With(metricLabels).Add(float64(len(input.Entries)))
-
-		start := time.Now()
-		out, err := service.getSQS().DeleteMessageBatch(input)
-		service.Collector.messageDuration.With(metricLabels).Add(time.Since(start).Seconds())
-
-		if err != nil {
-			service.Collector.messageFailures.With(metricLabels).Inc()
-		} else {
-			service.Collector.messageSuccess.With(metricLabels).Inc()
-		}
-
-		return out, err
-	}
-	return nil, rscsrv.ErrServiceNotRunning
+	return service.DeleteMessageBatchWithContext(context.Background(), input)
 }
 
 // DeleteMessageBatchWithContext is a wrapper for the `sqs.SQS.DeleteMessageBatchWithContext`.
 func (service *SQSService) DeleteMessageBatchWithContext(ctx context.Context, input *sqs.DeleteMessageBatchInput) (*sqs.DeleteMessageBatchOutput, error) {
-	if input.QueueUrl == nil {
-		qURL := aws.String(service.Configuration.QUrl)
-		if qURL == nil {
-			*qURL = ""
-		}
-		input.QueueUrl = qURL
-	}
+	input.QueueUrl = service.queueURL(input.QueueUrl)
+	output, err := service.invoke(ctx, MessageMetricMethodDeleteMessageBatch, input.QueueUrl, input)
+	out, _ := output.(*sqs.DeleteMessageBatchOutput)
+	return out, err
+}
 
-	metricLabels := prometheus.Labels{"queue": *input.QueueUrl, "method": MessageMetricMethodDeleteMessageBatch}
+// PurgeQueue is a wrapper for the `sqs.SQS.PurgeQueue`.
+func (service *SQSService) PurgeQueue(input *sqs.PurgeQueueInput) (*sqs.PurgeQueueOutput, error) {
+	return service.PurgeQueueWithContext(context.Background(), input)
+}
 
-	service.Collector.messageCalls.With(metricLabels).Inc()
+// PurgeQueueWithContext is a wrapper for the `sqs.SQS.PurgeQueueWithContext`.
+func (service *SQSService) PurgeQueueWithContext(ctx context.Context, input *sqs.PurgeQueueInput) (*sqs.PurgeQueueOutput, error) {
+	input.QueueUrl = service.queueURL(input.QueueUrl)
+	output, err := service.invoke(ctx, MessageMetricMethodPurgeQueue, input.QueueUrl, input)
+	out, _ := output.(*sqs.PurgeQueueOutput)
+	return out, err
+}
 
-	if service.isRunning() {
-		service.Collector.messageTrafficAmount.With(metricLabels).Add(float64(len(input.Entries)))
+// MaxBatchEntries is the maximum number of entries of a batch request to SQS.
+const MaxBatchEntries = 10
 
-		start := time.Now()
-		out, err := service.getSQS().DeleteMessageBatchWithContext(ctx, input)
-		service.Collector.messageDuration.With(metricLabels).Add(time.Since(start).Seconds())
+// ChangeMessageVisibility is a wrapper for the `sqs.SQS.ChangeMessageVisibility`.
+func (service *SQSService) ChangeMessageVisibility(input *sqs.ChangeMessageVisibilityInput) (*sqs.ChangeMessageVisibilityOutput, error) {
+	return service.ChangeMessageVisibilityWithContext(context.Background(), input)
+}
 
-		if err != nil {
-			service.Collector.messageFailures.With(metricLabels).Inc()
-		} else {
-			service.Collector.messageSuccess.With(metricLabels).Inc()
-		}
+// ChangeMessageVisibilityWithContext is a wrapper for the `sqs.SQS.ChangeMessageVisibilityWithContext`.
+func (service *SQSService) ChangeMessageVisibilityWithContext(ctx context.Context, input *sqs.ChangeMessageVisibilityInput) (*sqs.ChangeMessageVisibilityOutput, error) {
+	input.QueueUrl = service.queueURL(input.QueueUrl)
+	output, err := service.invoke(ctx, MessageMetricMethodChangeMessageVisibility, input.QueueUrl, input)
+	out, _ := output.(*sqs.ChangeMessageVisibilityOutput)
+	return out, err
+}
 
-		return out, err
-	}
-	return nil, rscsrv.ErrServiceNotRunning
+// ChangeMessageVisibilityBatch is a wrapper for the `sqs.SQS.ChangeMessageVisibilityBatch`.
+func (service *SQSService) ChangeMessageVisibilityBatch(input *sqs.ChangeMessageVisibilityBatchInput) (*sqs.ChangeMessageVisibilityBatchOutput, error) {
+	return service.ChangeMessageVisibilityBatchWithContext(context.Background(), input)
 }
 
-// PurgeQueue is a wrapper for the `sqs.SQS.PurgeQueue`.
-func (service *SQSService) PurgeQueue(input *sqs.PurgeQueueInput) (*sqs.PurgeQueueOutput, error) {
-	if input.QueueUrl == nil {
-		qURL := aws.String(service.Configuration.QUrl)
-		if qURL == nil {
-			*qURL = ""
-		}
-		input.QueueUrl = qURL
+// ChangeMessageVisibilityBatchWithContext is a wrapper for the
+// `sqs.SQS.ChangeMessageVisibilityBatchWithContext`.
+//
+// Batches above MaxBatchEntries are split in as many calls as needed, with
+// their results merged. If a call fails, the results of the previous ones are
+// returned along with the error.
+func (service *SQSService) ChangeMessageVisibilityBatchWithContext(ctx context.Context, input *sqs.ChangeMessageVisibilityBatchInput) (*sqs.ChangeMessageVisibilityBatchOutput, error) {
+	input.QueueUrl = service.queueURL(input.QueueUrl)
+	if len(input.Entries) <= MaxBatchEntries {
+		output, err := service.invoke(ctx, MessageMetricMethodChangeMessageVisibilityBatch, input.QueueUrl, input)
+		out, _ := output.(*sqs.ChangeMessageVisibilityBatchOutput)
+		return out, err
 	}
 
-	if service.isRunning() {
-		return service.getSQS().PurgeQueue(input)
+	result := &sqs.ChangeMessageVisibilityBatchOutput{
+		Successful: []*sqs.ChangeMessageVisibilityBatchResultEntry{},
+		Failed:     []*sqs.BatchResultErrorEntry{},
+	}
+	for start := 0; start < len(input.Entries); start += MaxBatchEntries {
+		end := start + MaxBatchEntries
+		if end > len(input.Entries) {
+			end = len(input.Entries)
+		}
+		chunk := *input
+		chunk.Entries = input.Entries[start:end]
+		output, err := service.invoke(ctx, MessageMetricMethodChangeMessageVisibilityBatch, input.QueueUrl, &chunk)
+		if err != nil {
+			return result, err
+		}
+		if out, ok := output.(*sqs.ChangeMessageVisibilityBatchOutput); ok && out != nil {
+			result.Successful = append(result.Successful, out.Successful...)
+			result.Failed = append(result.Failed, out.Failed...)
+		}
 	}
-	return nil, rscsrv.ErrServiceNotRunning
+	return result, nil
 }
@@ -2,18 +2,24 @@ package sqssrv
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"os"
 	"path"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/jamillosantos/macchiato"
 	rscsrv "github.com/lab259/go-rscsrv"
+	"github.com/lab259/go-rscsrv-sqs/sqsmem"
+	"github.com/lab259/go-rscsrv-sqs/sqstest"
 	. "github.com/onsi/ginkgo"
 	"github.com/onsi/ginkgo/reporters"
 	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 )
 
 func TestService(t *testing.T) {
@@ -38,19 +44,54 @@ var (
 		Endpoint: "http://localhost:9324",
 		QUrl:     "http://localhost:9324/queue/queue-test",
 	}
+	sqsServer *sqstest.Server
 )
 
+// The specs run against the SQS of the SQS_ENDPOINT environment variable (e.g.
+// the ElasticMQ of the docker-compose.yml). Without it, they run against a
+// sqstest.Server.
+var _ = BeforeSuite(func() {
+	if endpoint := os.Getenv("SQS_ENDPOINT"); endpoint != "" {
+		validConfiguration.Endpoint = endpoint
+		validConfiguration.QUrl = endpoint + "/queue/queue-test"
+		return
+	}
+	sqsServer = sqstest.NewServer(nil)
+	// Same as the .docker/elasticmq/custom.conf.
+	queueURL, err := sqsServer.CreateQueue("queue-test", map[string]string{
+		sqs.QueueAttributeNameVisibilityTimeout: "1",
+	})
+	Expect(err).ToNot(HaveOccurred())
+	validConfiguration.Endpoint = sqsServer.URL
+	validConfiguration.QUrl = queueURL
+})
+
+var _ = AfterSuite(func() {
+	if sqsServer != nil {
+		sqsServer.Close()
+	}
+})
+
+// InitForTesting starts the sqsService for a queue of its own, deleted after
+// each spec.
 func InitForTesting() {
+	var queue *TestQueue
+
 	BeforeEach(func() {
 		sqsService = &SQSService{}
 		Expect(sqsService.ApplyConfiguration(&validConfiguration)).To(Succeed())
-		Expect(sqsService.Start()).To(Succeed())
-		_, err := sqsService.PurgeQueue(&sqs.PurgeQueueInput{})
+		var err error
+		queue, err = NewTestQueue(sqsService, &TestQueueOpts{
+			Attributes: map[string]string{
+				// Same as the .docker/elasticmq/custom.conf.
+				sqs.QueueAttributeNameVisibilityTimeout: "1",
+			},
+		})
 		Expect(err).ToNot(HaveOccurred())
 	})
 
 	AfterEach(func() {
-		Expect(sqsService.Stop()).To(Succeed())
+		Expect(queue.Close()).To(Succeed())
 	})
 }
 
@@ -168,6 +209,32 @@ var _ = Describe("SQSService", func() {
 		})).To(Equal(rscsrv.ErrServiceNotRunning))
 	})
 
+	It("should run in process with the in-memory backend", func() {
+		backend := sqsmem.New(nil)
+		_, err := backend.CreateQueue(&sqs.CreateQueueInput{
+			QueueName: aws.String("queue-test"),
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		service := SQSService{
+			Client: backend,
+		}
+		Expect(service.ApplyConfiguration(&SQSServiceConfiguration{
+			QUrl: backend.QueueURL("queue-test"),
+		})).To(Succeed())
+		Expect(service.Start()).To(Succeed())
+		defer service.Stop()
+
+		_, err = service.SendMessage(&sqs.SendMessageInput{
+			MessageBody: aws.String("this is the body of the message"),
+		})
+		Expect(err).ToNot(HaveOccurred())
+		output, err := service.ReceiveMessage(&sqs.ReceiveMessageInput{})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(output.Messages).To(HaveLen(1))
+		Expect(aws.StringValue(output.Messages[0].Body)).To(Equal("this is the body of the message"))
+	})
+
 	It("should restart the service", func() {
 		var service SQSService
 		Expect(service.ApplyConfiguration(&validConfiguration)).To(Succeed())
@@ -180,6 +247,63 @@ var _ = Describe("SQSService", func() {
 		Expect(aws.StringValue(output.MessageId)).NotTo(BeEmpty())
 	})
 
+	It("should keep the collector when restarting", func() {
+		var service SQSService
+		Expect(service.ApplyConfiguration(&validConfiguration)).To(Succeed())
+		Expect(service.Start()).To(Succeed())
+		defer service.Stop()
+		collector := service.Collector
+		Expect(collector).ToNot(BeNil())
+		Expect(service.Restart()).To(Succeed())
+		Expect(service.Collector).To(BeIdenticalTo(collector))
+	})
+
+	It("should use the collector informed before starting", func() {
+		collector := NewSQSServiceCollector(&SQSServiceCollectorOpts{})
+		service := SQSService{
+			Collector: collector,
+		}
+		Expect(service.ApplyConfiguration(&validConfiguration)).To(Succeed())
+		Expect(service.Start()).To(Succeed())
+		defer service.Stop()
+		Expect(service.Collector).To(BeIdenticalTo(collector))
+	})
+
+	It("should register the collector when starting and restarting", func() {
+		registry := prometheus.NewRegistry()
+		service := SQSService{
+			Registerer: registry,
+		}
+		Expect(service.ApplyConfiguration(&validConfiguration)).To(Succeed())
+		Expect(service.Start()).To(Succeed())
+		defer service.Stop()
+		Expect(service.Restart()).To(Succeed())
+		Expect(registry.Unregister(service.Collector)).To(BeTrue())
+	})
+
+	When("the service was never started", func() {
+		var service SQSService
+
+		It("should fail sending a message", func() {
+			_, err := service.SendMessage(&sqs.SendMessageInput{
+				MessageBody: aws.String("testing data"),
+			})
+			Expect(err).To(Equal(rscsrv.ErrServiceNotRunning))
+		})
+
+		It("should fail receiving a message", func() {
+			_, err := service.ReceiveMessage(&sqs.ReceiveMessageInput{
+				WaitTimeSeconds: aws.Int64(1),
+			})
+			Expect(err).To(Equal(rscsrv.ErrServiceNotRunning))
+		})
+
+		It("should fail deleting a message batch", func() {
+			_, err := service.DeleteMessageBatch(&sqs.DeleteMessageBatchInput{})
+			Expect(err).To(Equal(rscsrv.ErrServiceNotRunning))
+		})
+	})
+
 	When("not running the service", func() {
 		sqsService := &SQSService{
 			Collector: NewSQSServiceCollector(&SQSServiceCollectorOpts{}),
@@ -282,6 +406,46 @@ var _ = Describe("SQSService", func() {
 			})
 			Expect(err).To(Equal(rscsrv.ErrServiceNotRunning))
 		})
+
+		It("should fail changing the visibility of a message", func() {
+			_, err := sqsService.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
+				ReceiptHandle:     aws.String("fake message"),
+				VisibilityTimeout: aws.Int64(0),
+			})
+			Expect(err).To(Equal(rscsrv.ErrServiceNotRunning))
+		})
+
+		It("should fail changing the visibility of a message with context", func() {
+			_, err := sqsService.ChangeMessageVisibilityWithContext(context.Background(), &sqs.ChangeMessageVisibilityInput{
+				ReceiptHandle:     aws.String("fake message"),
+				VisibilityTimeout: aws.Int64(0),
+			})
+			Expect(err).To(Equal(rscsrv.ErrServiceNotRunning))
+		})
+
+		It("should fail changing the visibility of a message batch", func() {
+			_, err := sqsService.ChangeMessageVisibilityBatch(&sqs.ChangeMessageVisibilityBatchInput{
+				Entries: []*sqs.ChangeMessageVisibilityBatchRequestEntry{
+					{
+						Id:            aws.String("message1"),
+						ReceiptHandle: aws.String("fake message 1"),
+					},
+				},
+			})
+			Expect(err).To(Equal(rscsrv.ErrServiceNotRunning))
+		})
+
+		It("should fail changing the visibility of a message batch with context", func() {
+			_, err := sqsService.ChangeMessageVisibilityBatchWithContext(context.Background(), &sqs.ChangeMessageVisibilityBatchInput{
+				Entries: []*sqs.ChangeMessageVisibilityBatchRequestEntry{
+					{
+						Id:            aws.String("message1"),
+						ReceiptHandle: aws.String("fake message 1"),
+					},
+				},
+			})
+			Expect(err).To(Equal(rscsrv.ErrServiceNotRunning))
+		})
 	})
 
 	Context("sending and receiving messages", func() {
@@ -320,41 +484,46 @@ var _ = Describe("SQSService", func() {
 				MessageBody: aws.String("testing this body"),
 			})
 			Expect(err).ToNot(HaveOccurred())
-			rcvOut, err := sqsService.ReceiveMessage(&sqs.ReceiveMessageInput{
-				WaitTimeSeconds: aws.Int64(1),
-			})
-			Expect(err).ToNot(HaveOccurred())
-			Expect(rcvOut.Messages).To(HaveLen(1))
+			var message *sqs.Message
+			Expect(sqsService).To(sqstest.ReceiveMessageWithBody("testing this body", &message))
 			_, err = sqsService.DeleteMessage(&sqs.DeleteMessageInput{
-				ReceiptHandle: rcvOut.Messages[0].ReceiptHandle,
-			})
-			Expect(err).ToNot(HaveOccurred())
-			rcvOut, err = sqsService.ReceiveMessage(&sqs.ReceiveMessageInput{
-				WaitTimeSeconds: aws.Int64(0),
+				ReceiptHandle: message.ReceiptHandle,
 			})
 			Expect(err).ToNot(HaveOccurred())
-			Expect(rcvOut.Messages).To(BeEmpty())
+			Expect(sqsService).To(sqstest.HaveMessagesInQueue(0))
 		})
 
-		It("should delete a message with context", func() {
+		It("should use the maximum wait time when long polling", func() {
+			sqsService.Configuration.LongPolling = true
 			_, err := sqsService.SendMessage(&sqs.SendMessageInput{
 				MessageBody: aws.String("testing this body"),
 			})
 			Expect(err).ToNot(HaveOccurred())
-			rcvOut, err := sqsService.ReceiveMessage(&sqs.ReceiveMessageInput{
-				WaitTimeSeconds: aws.Int64(1),
-			})
+
+			input := &sqs.ReceiveMessageInput{}
+			rcvOut, err := sqsService.ReceiveMessage(input)
 			Expect(err).ToNot(HaveOccurred())
 			Expect(rcvOut.Messages).To(HaveLen(1))
-			_, err = sqsService.DeleteMessageWithContext(context.Background(), &sqs.DeleteMessageInput{
-				ReceiptHandle: rcvOut.Messages[0].ReceiptHandle,
+			Expect(aws.Int64Value(input.WaitTimeSeconds)).To(BeEquivalentTo(MaxWaitTimeSeconds))
+
+			input = &sqs.ReceiveMessageInput{WaitTimeSeconds: aws.Int64(0)}
+			_, err = sqsService.ReceiveMessage(input)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(aws.Int64Value(input.WaitTimeSeconds)).To(BeEquivalentTo(0))
+		})
+
+		It("should delete a message with context", func() {
+			_, err := sqsService.SendMessage(&sqs.SendMessageInput{
+				MessageBody: aws.String("testing this body"),
 			})
 			Expect(err).ToNot(HaveOccurred())
-			rcvOut, err = sqsService.ReceiveMessage(&sqs.ReceiveMessageInput{
-				WaitTimeSeconds: aws.Int64(0),
+			var message *sqs.Message
+			Expect(sqsService).To(sqstest.ReceiveMessageWithBody("testing this body", &message))
+			_, err = sqsService.DeleteMessageWithContext(context.Background(), &sqs.DeleteMessageInput{
+				ReceiptHandle: message.ReceiptHandle,
 			})
 			Expect(err).ToNot(HaveOccurred())
-			Expect(rcvOut.Messages).To(BeEmpty())
+			Expect(sqsService).To(sqstest.HaveMessagesInQueue(0))
 		})
 
 		It("should send a message batch", func() {
@@ -441,13 +610,7 @@ var _ = Describe("SQSService", func() {
 				},
 			})
 			Expect(err).ToNot(HaveOccurred())
-
-			rcvOut, err = sqsService.ReceiveMessage(&sqs.ReceiveMessageInput{
-				WaitTimeSeconds:     aws.Int64(2),
-				MaxNumberOfMessages: aws.Int64(2),
-			})
-			Expect(err).ToNot(HaveOccurred())
-			Expect(rcvOut.Messages).To(BeEmpty())
+			Expect(sqsService).To(sqstest.HaveMessagesInQueue(0))
 		})
 
 		It("should delete a message in batch with context", func() {
@@ -486,13 +649,132 @@ var _ = Describe("SQSService", func() {
 				},
 			})
 			Expect(err).ToNot(HaveOccurred())
+			Expect(sqsService).To(sqstest.HaveMessagesInQueue(0))
+		})
 
-			rcvOut, err = sqsService.ReceiveMessage(&sqs.ReceiveMessageInput{
-				WaitTimeSeconds:     aws.Int64(1),
-				MaxNumberOfMessages: aws.Int64(2),
+		// receive receives n messages, failing if they do not arrive.
+		receive := func(n int) []*sqs.Message {
+			var messages []*sqs.Message
+			seen := map[string]bool{}
+			Eventually(func() int {
+				rcvOut, err := sqsService.ReceiveMessage(&sqs.ReceiveMessageInput{
+					MaxNumberOfMessages: aws.Int64(10),
+				})
+				Expect(err).ToNot(HaveOccurred())
+				for _, message := range rcvOut.Messages {
+					if !seen[aws.StringValue(message.MessageId)] {
+						seen[aws.StringValue(message.MessageId)] = true
+						messages = append(messages, message)
+					}
+				}
+				return len(messages)
+			}).Should(Equal(n))
+			return messages
+		}
+
+		sendN := func(n int) {
+			for i := 0; i < n; i++ {
+				_, err := sqsService.SendMessage(&sqs.SendMessageInput{
+					MessageBody: aws.String(fmt.Sprintf("testing this body %d", i)),
+				})
+				Expect(err).ToNot(HaveOccurred())
+			}
+		}
+
+		It("should change the visibility of a message", func() {
+			sendN(1)
+			message := receive(1)[0]
+			_, err := sqsService.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
+				ReceiptHandle:     message.ReceiptHandle,
+				VisibilityTimeout: aws.Int64(0),
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(sqsService).To(sqstest.ReceiveMessageWithBody("testing this body 0"))
+		})
+
+		It("should change the visibility of a message with context", func() {
+			sendN(1)
+			message := receive(1)[0]
+			_, err := sqsService.ChangeMessageVisibilityWithContext(context.Background(), &sqs.ChangeMessageVisibilityInput{
+				ReceiptHandle:     message.ReceiptHandle,
+				VisibilityTimeout: aws.Int64(0),
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(sqsService).To(sqstest.ReceiveMessageWithBody("testing this body 0"))
+		})
+
+		It("should change the visibility of a message batch", func() {
+			sendN(2)
+			messages := receive(2)
+			output, err := sqsService.ChangeMessageVisibilityBatch(&sqs.ChangeMessageVisibilityBatchInput{
+				Entries: []*sqs.ChangeMessageVisibilityBatchRequestEntry{
+					{
+						Id:                messages[0].MessageId,
+						ReceiptHandle:     messages[0].ReceiptHandle,
+						VisibilityTimeout: aws.Int64(0),
+					},
+					{
+						Id:                messages[1].MessageId,
+						ReceiptHandle:     messages[1].ReceiptHandle,
+						VisibilityTimeout: aws.Int64(0),
+					},
+				},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(output.Successful).To(HaveLen(2))
+			Expect(output.Failed).To(BeEmpty())
+			Expect(receive(2)).To(HaveLen(2))
+		})
+
+		It("should split the batches above the maximum number of entries", func() {
+			sendN(12)
+			messages := receive(12)
+			var entries []*sqs.ChangeMessageVisibilityBatchRequestEntry
+			for i, message := range messages {
+				entries = append(entries, &sqs.ChangeMessageVisibilityBatchRequestEntry{
+					Id:                aws.String(fmt.Sprint(i)),
+					ReceiptHandle:     message.ReceiptHandle,
+					VisibilityTimeout: aws.Int64(60),
+				})
+			}
+			output, err := sqsService.ChangeMessageVisibilityBatchWithContext(context.Background(), &sqs.ChangeMessageVisibilityBatchInput{
+				Entries: entries,
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(output.Successful).To(HaveLen(12))
+			Expect(output.Failed).To(BeEmpty())
+
+			var metric dto.Metric
+			Expect(sqsService.Collector.messageCalls.With(prometheus.Labels{
+				"queue":  sqsService.Configuration.QUrl,
+				"method": MessageMetricMethodChangeMessageVisibilityBatch,
+			}).Write(&metric)).To(Succeed())
+			Expect(metric.GetCounter().GetValue()).To(BeEquivalentTo(2))
+			Expect(sqsService.Collector.messageTrafficAmount.With(prometheus.Labels{
+				"queue":  sqsService.Configuration.QUrl,
+				"method": MessageMetricMethodChangeMessageVisibilityBatch,
+			}).Write(&metric)).To(Succeed())
+			Expect(metric.GetCounter().GetValue()).To(BeEquivalentTo(12))
+
+			// The messages are hidden for a minute, past the visibility
+			// timeout of the queue.
+			time.Sleep(1100 * time.Millisecond)
+			Expect(sqsService).To(sqstest.HaveMessagesInQueue(0))
+		})
+
+		It("should report the failed entries of the batches", func() {
+			output, err := sqsService.ChangeMessageVisibilityBatch(&sqs.ChangeMessageVisibilityBatchInput{
+				Entries: []*sqs.ChangeMessageVisibilityBatchRequestEntry{
+					{
+						Id:                aws.String("message1"),
+						ReceiptHandle:     aws.String("fake message 1"),
+						VisibilityTimeout: aws.Int64(0),
+					},
+				},
 			})
 			Expect(err).ToNot(HaveOccurred())
-			Expect(rcvOut.Messages).To(BeEmpty())
+			Expect(output.Successful).To(BeEmpty())
+			Expect(output.Failed).To(HaveLen(1))
 		})
 	})
 })
@@ -0,0 +1,451 @@
+// Package sqscontract is a conformance suite for SQS backends: any
+// `sqsiface.SQSAPI` (the AWS SDK client pointed at AWS or at the ElasticMQ, a
+// `sqsmem.Backend`, a `sqstest.Server`, a mock...) can be checked to behave
+// like SQS on the operations used by the `sqssrv.SQSService`.
+//
+// The suite is made of Ginkgo specs, declared by Describe in the test suite of
+// the backend:
+//
+//	var _ = sqscontract.Describe("in-memory backend", func() (*sqscontract.Backend, error) {
+//		return &sqscontract.Backend{Client: sqsmem.New(nil)}, nil
+//	})
+//
+// Every spec creates a uniquely named queue, deleted afterwards, so the
+// backend can be shared by the specs and by parallel Ginkgo nodes.
+package sqscontract
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+// VisibilityTimeout is the visibility timeout, in seconds, of the queues
+// created by the suite.
+const VisibilityTimeout = 1
+
+// ReceiveTimeout is how long the suite keeps receiving while waiting for
+// messages. SQS may return fewer messages than available on each receive.
+var ReceiveTimeout = 10 * time.Second
+
+// Backend is the SQS checked by the suite.
+type Backend struct {
+	// Client is the SQS. It must support CreateQueue and DeleteQueue, besides
+	// the operations checked.
+	Client sqsiface.SQSAPI
+	// Prefix of the name of the queues. Default: "sqscontract".
+	Prefix string
+	// Close, when set, is called after every spec.
+	Close func()
+}
+
+// Factory creates the backend of a spec. It is called before every spec.
+type Factory func() (*Backend, error)
+
+// Describe declares the specs of the suite, in a Ginkgo container of the
+// given name.
+func Describe(name string, factory Factory) bool {
+	return ginkgo.Describe(name, func() {
+		var (
+			backend  *Backend
+			client   sqsiface.SQSAPI
+			queueURL string
+		)
+
+		ginkgo.BeforeEach(func() {
+			var err error
+			backend, err = factory()
+			gomega.Expect(err).ToNot(gomega.HaveOccurred())
+			client = backend.Client
+
+			prefix := backend.Prefix
+			if prefix == "" {
+				prefix = "sqscontract"
+			}
+			output, err := client.CreateQueue(&sqs.CreateQueueInput{
+				QueueName: aws.String(prefix + "-" + randomHex()),
+				Attributes: aws.StringMap(map[string]string{
+					sqs.QueueAttributeNameVisibilityTimeout: fmt.Sprint(VisibilityTimeout),
+				}),
+			})
+			gomega.Expect(err).ToNot(gomega.HaveOccurred())
+			queueURL = aws.StringValue(output.QueueUrl)
+		})
+
+		ginkgo.AfterEach(func() {
+			if queueURL != "" {
+				_, err := client.DeleteQueue(&sqs.DeleteQueueInput{
+					QueueUrl: aws.String(queueURL),
+				})
+				gomega.Expect(err).ToNot(gomega.HaveOccurred())
+				queueURL = ""
+			}
+			if backend != nil && backend.Close != nil {
+				backend.Close()
+			}
+		})
+
+		send := func(body string) *sqs.SendMessageOutput {
+			output, err := client.SendMessage(&sqs.SendMessageInput{
+				QueueUrl:    aws.String(queueURL),
+				MessageBody: aws.String(body),
+			})
+			gomega.ExpectWithOffset(1, err).ToNot(gomega.HaveOccurred())
+			return output
+		}
+
+		receiveOnce := func(waitTimeSeconds int64) []*sqs.Message {
+			output, err := client.ReceiveMessage(&sqs.ReceiveMessageInput{
+				QueueUrl:              aws.String(queueURL),
+				AttributeNames:        []*string{aws.String(sqs.QueueAttributeNameAll)},
+				MessageAttributeNames: []*string{aws.String(sqs.QueueAttributeNameAll)},
+				MaxNumberOfMessages:   aws.Int64(10),
+				WaitTimeSeconds:       aws.Int64(waitTimeSeconds),
+			})
+			gomega.ExpectWithOffset(2, err).ToNot(gomega.HaveOccurred())
+			return output.Messages
+		}
+
+		// receive receives until n distinct messages come, failing if they do
+		// not within the ReceiveTimeout.
+		receive := func(n int) []*sqs.Message {
+			var messages []*sqs.Message
+			seen := make(map[string]bool)
+			deadline := time.Now().Add(ReceiveTimeout)
+			for len(messages) < n && time.Now().Before(deadline) {
+				for _, message := range receiveOnce(1) {
+					if !seen[aws.StringValue(message.MessageId)] {
+						seen[aws.StringValue(message.MessageId)] = true
+						messages = append(messages, message)
+					}
+				}
+			}
+			gomega.ExpectWithOffset(1, messages).To(gomega.HaveLen(n))
+			return messages
+		}
+
+		// expectEmpty checks that no message is visible. It does not wait, as
+		// the messages in flight become visible again after a second.
+		expectEmpty := func() {
+			gomega.ExpectWithOffset(1, receiveOnce(0)).To(gomega.BeEmpty())
+		}
+
+		// waitVisibilityTimeout waits for the messages in flight to be visible
+		// again.
+		waitVisibilityTimeout := func() {
+			time.Sleep(VisibilityTimeout*time.Second + 200*time.Millisecond)
+		}
+
+		ginkgo.Describe("SendMessage", func() {
+			ginkgo.It("should return the id and the MD5 of the body", func() {
+				output := send("message")
+				gomega.Expect(aws.StringValue(output.MessageId)).ToNot(gomega.BeEmpty())
+				gomega.Expect(aws.StringValue(output.MD5OfMessageBody)).To(gomega.Equal(md5Hex("message")))
+			})
+
+			ginkgo.It("should return the MD5 of the message attributes", func() {
+				output, err := client.SendMessage(&sqs.SendMessageInput{
+					QueueUrl:    aws.String(queueURL),
+					MessageBody: aws.String("message"),
+					MessageAttributes: map[string]*sqs.MessageAttributeValue{
+						"type": {DataType: aws.String("String"), StringValue: aws.String("welcome")},
+					},
+				})
+				gomega.Expect(err).ToNot(gomega.HaveOccurred())
+				gomega.Expect(aws.StringValue(output.MD5OfMessageAttributes)).ToNot(gomega.BeEmpty())
+			})
+
+			ginkgo.It("should reject a body larger than 256 KB", func() {
+				_, err := client.SendMessage(&sqs.SendMessageInput{
+					QueueUrl:    aws.String(queueURL),
+					MessageBody: aws.String(strings.Repeat("a", 256*1024+1)),
+				})
+				gomega.Expect(errorCode(err)).To(gomega.Equal("InvalidParameterValue"))
+			})
+
+			ginkgo.It("should fail for a queue that does not exist", func() {
+				_, err := client.SendMessage(&sqs.SendMessageInput{
+					QueueUrl:    aws.String(queueURL + "-missing"),
+					MessageBody: aws.String("message"),
+				})
+				gomega.Expect(errorCode(err)).To(gomega.Equal(sqs.ErrCodeQueueDoesNotExist))
+			})
+		})
+
+		ginkgo.Describe("SendMessageBatch", func() {
+			ginkgo.It("should send all the entries", func() {
+				output, err := client.SendMessageBatch(&sqs.SendMessageBatchInput{
+					QueueUrl: aws.String(queueURL),
+					Entries: []*sqs.SendMessageBatchRequestEntry{
+						{Id: aws.String("1"), MessageBody: aws.String("message 1")},
+						{Id: aws.String("2"), MessageBody: aws.String("message 2")},
+						{Id: aws.String("3"), MessageBody: aws.String("message 3")},
+					},
+				})
+				gomega.Expect(err).ToNot(gomega.HaveOccurred())
+				gomega.Expect(output.Failed).To(gomega.BeEmpty())
+				var ids []string
+				for _, entry := range output.Successful {
+					ids = append(ids, aws.StringValue(entry.Id))
+					gomega.Expect(aws.StringValue(entry.MessageId)).ToNot(gomega.BeEmpty())
+				}
+				gomega.Expect(ids).To(gomega.ConsistOf("1", "2", "3"))
+
+				var bodies []string
+				for _, message := range receive(3) {
+					bodies = append(bodies, aws.StringValue(message.Body))
+				}
+				gomega.Expect(bodies).To(gomega.ConsistOf("message 1", "message 2", "message 3"))
+			})
+
+			ginkgo.It("should reject more than 10 entries", func() {
+				var entries []*sqs.SendMessageBatchRequestEntry
+				for i := 0; i < 11; i++ {
+					entries = append(entries, &sqs.SendMessageBatchRequestEntry{
+						Id:          aws.String(fmt.Sprint(i)),
+						MessageBody: aws.String("message"),
+					})
+				}
+				_, err := client.SendMessageBatch(&sqs.SendMessageBatchInput{
+					QueueUrl: aws.String(queueURL),
+					Entries:  entries,
+				})
+				gomega.Expect(errorCode(err)).To(gomega.Equal(sqs.ErrCodeTooManyEntriesInBatchRequest))
+			})
+
+			ginkgo.It("should reject repeated ids", func() {
+				_, err := client.SendMessageBatch(&sqs.SendMessageBatchInput{
+					QueueUrl: aws.String(queueURL),
+					Entries: []*sqs.SendMessageBatchRequestEntry{
+						{Id: aws.String("1"), MessageBody: aws.String("message 1")},
+						{Id: aws.String("1"), MessageBody: aws.String("message 2")},
+					},
+				})
+				gomega.Expect(errorCode(err)).To(gomega.Equal(sqs.ErrCodeBatchEntryIdsNotDistinct))
+			})
+		})
+
+		ginkgo.Describe("ReceiveMessage", func() {
+			ginkgo.It("should return the message with its attributes", func() {
+				sent, err := client.SendMessage(&sqs.SendMessageInput{
+					QueueUrl:    aws.String(queueURL),
+					MessageBody: aws.String("message"),
+					MessageAttributes: map[string]*sqs.MessageAttributeValue{
+						"type": {DataType: aws.String("String"), StringValue: aws.String("welcome")},
+					},
+				})
+				gomega.Expect(err).ToNot(gomega.HaveOccurred())
+
+				message := receive(1)[0]
+				gomega.Expect(aws.StringValue(message.MessageId)).To(gomega.Equal(aws.StringValue(sent.MessageId)))
+				gomega.Expect(aws.StringValue(message.Body)).To(gomega.Equal("message"))
+				gomega.Expect(aws.StringValue(message.MD5OfBody)).To(gomega.Equal(md5Hex("message")))
+				gomega.Expect(aws.StringValue(message.ReceiptHandle)).ToNot(gomega.BeEmpty())
+				gomega.Expect(message.MessageAttributes).To(gomega.HaveKey("type"))
+				gomega.Expect(aws.StringValue(message.MessageAttributes["type"].StringValue)).To(gomega.Equal("welcome"))
+				gomega.Expect(aws.StringValue(message.MD5OfMessageAttributes)).To(gomega.Equal(aws.StringValue(sent.MD5OfMessageAttributes)))
+				gomega.Expect(aws.StringValueMap(message.Attributes)).To(gomega.HaveKeyWithValue(sqs.MessageSystemAttributeNameApproximateReceiveCount, "1"))
+			})
+
+			ginkgo.It("should return nothing from an empty queue", func() {
+				output, err := client.ReceiveMessage(&sqs.ReceiveMessageInput{
+					QueueUrl:        aws.String(queueURL),
+					WaitTimeSeconds: aws.Int64(0),
+				})
+				gomega.Expect(err).ToNot(gomega.HaveOccurred())
+				gomega.Expect(output.Messages).To(gomega.BeEmpty())
+			})
+
+			ginkgo.It("should return at most MaxNumberOfMessages messages", func() {
+				for i := 0; i < 3; i++ {
+					send("message")
+				}
+				deadline := time.Now().Add(ReceiveTimeout)
+				received := make(map[string]bool)
+				for len(received) < 3 && time.Now().Before(deadline) {
+					output, err := client.ReceiveMessage(&sqs.ReceiveMessageInput{
+						QueueUrl:            aws.String(queueURL),
+						MaxNumberOfMessages: aws.Int64(2),
+						WaitTimeSeconds:     aws.Int64(1),
+					})
+					gomega.Expect(err).ToNot(gomega.HaveOccurred())
+					gomega.Expect(len(output.Messages)).To(gomega.BeNumerically("<=", 2))
+					for _, message := range output.Messages {
+						received[aws.StringValue(message.MessageId)] = true
+					}
+				}
+				gomega.Expect(received).To(gomega.HaveLen(3))
+			})
+
+			ginkgo.It("should reject more than 10 messages", func() {
+				_, err := client.ReceiveMessage(&sqs.ReceiveMessageInput{
+					QueueUrl:            aws.String(queueURL),
+					MaxNumberOfMessages: aws.Int64(11),
+				})
+				gomega.Expect(errorCode(err)).To(gomega.Equal("InvalidParameterValue"))
+			})
+
+			ginkgo.It("should fail for a queue that does not exist", func() {
+				_, err := client.ReceiveMessage(&sqs.ReceiveMessageInput{
+					QueueUrl: aws.String(queueURL + "-missing"),
+				})
+				gomega.Expect(errorCode(err)).To(gomega.Equal(sqs.ErrCodeQueueDoesNotExist))
+			})
+		})
+
+		ginkgo.Describe("visibility timeout", func() {
+			ginkgo.It("should hide the message received until the timeout", func() {
+				send("message")
+				first := receive(1)[0]
+				expectEmpty()
+
+				waitVisibilityTimeout()
+				second := receive(1)[0]
+				gomega.Expect(aws.StringValue(second.MessageId)).To(gomega.Equal(aws.StringValue(first.MessageId)))
+				gomega.Expect(aws.StringValue(second.ReceiptHandle)).ToNot(gomega.Equal(aws.StringValue(first.ReceiptHandle)))
+				gomega.Expect(aws.StringValueMap(second.Attributes)).To(gomega.HaveKeyWithValue(sqs.MessageSystemAttributeNameApproximateReceiveCount, "2"))
+			})
+
+			ginkgo.It("should use the visibility timeout of the receive", func() {
+				send("message")
+				output, err := client.ReceiveMessage(&sqs.ReceiveMessageInput{
+					QueueUrl:          aws.String(queueURL),
+					VisibilityTimeout: aws.Int64(0),
+					WaitTimeSeconds:   aws.Int64(1),
+				})
+				gomega.Expect(err).ToNot(gomega.HaveOccurred())
+				gomega.Expect(output.Messages).To(gomega.HaveLen(1))
+				receive(1)
+			})
+		})
+
+		ginkgo.Describe("DeleteMessage", func() {
+			ginkgo.It("should delete the message", func() {
+				send("message")
+				message := receive(1)[0]
+				_, err := client.DeleteMessage(&sqs.DeleteMessageInput{
+					QueueUrl:      aws.String(queueURL),
+					ReceiptHandle: message.ReceiptHandle,
+				})
+				gomega.Expect(err).ToNot(gomega.HaveOccurred())
+
+				waitVisibilityTimeout()
+				expectEmpty()
+			})
+
+			ginkgo.It("should reject an invalid receipt handle", func() {
+				_, err := client.DeleteMessage(&sqs.DeleteMessageInput{
+					QueueUrl:      aws.String(queueURL),
+					ReceiptHandle: aws.String("invalid"),
+				})
+				gomega.Expect(errorCode(err)).To(gomega.Equal(sqs.ErrCodeReceiptHandleIsInvalid))
+			})
+		})
+
+		ginkgo.Describe("DeleteMessageBatch", func() {
+			ginkgo.It("should delete the messages, failing the invalid entries", func() {
+				send("message 1")
+				send("message 2")
+				messages := receive(2)
+				output, err := client.DeleteMessageBatch(&sqs.DeleteMessageBatchInput{
+					QueueUrl: aws.String(queueURL),
+					Entries: []*sqs.DeleteMessageBatchRequestEntry{
+						{Id: aws.String("1"), ReceiptHandle: messages[0].ReceiptHandle},
+						{Id: aws.String("2"), ReceiptHandle: messages[1].ReceiptHandle},
+						{Id: aws.String("3"), ReceiptHandle: aws.String("invalid")},
+					},
+				})
+				gomega.Expect(err).ToNot(gomega.HaveOccurred())
+				var successful []string
+				for _, entry := range output.Successful {
+					successful = append(successful, aws.StringValue(entry.Id))
+				}
+				gomega.Expect(successful).To(gomega.ConsistOf("1", "2"))
+				gomega.Expect(output.Failed).To(gomega.HaveLen(1))
+				gomega.Expect(aws.StringValue(output.Failed[0].Id)).To(gomega.Equal("3"))
+				gomega.Expect(aws.StringValue(output.Failed[0].Code)).To(gomega.Equal(sqs.ErrCodeReceiptHandleIsInvalid))
+				gomega.Expect(aws.BoolValue(output.Failed[0].SenderFault)).To(gomega.BeTrue())
+
+				waitVisibilityTimeout()
+				expectEmpty()
+			})
+
+			ginkgo.It("should reject repeated ids", func() {
+				_, err := client.DeleteMessageBatch(&sqs.DeleteMessageBatchInput{
+					QueueUrl: aws.String(queueURL),
+					Entries: []*sqs.DeleteMessageBatchRequestEntry{
+						{Id: aws.String("1"), ReceiptHandle: aws.String("invalid")},
+						{Id: aws.String("1"), ReceiptHandle: aws.String("invalid")},
+					},
+				})
+				gomega.Expect(errorCode(err)).To(gomega.Equal(sqs.ErrCodeBatchEntryIdsNotDistinct))
+			})
+		})
+
+		ginkgo.Describe("PurgeQueue", func() {
+			ginkgo.It("should delete all the messages", func() {
+				for i := 0; i < 3; i++ {
+					send("message")
+				}
+				_, err := client.PurgeQueue(&sqs.PurgeQueueInput{
+					QueueUrl: aws.String(queueURL),
+				})
+				gomega.Expect(err).ToNot(gomega.HaveOccurred())
+				expectEmpty()
+			})
+
+			ginkgo.It("should fail for a queue that does not exist", func() {
+				_, err := client.PurgeQueue(&sqs.PurgeQueueInput{
+					QueueUrl: aws.String(queueURL + "-missing"),
+				})
+				gomega.Expect(errorCode(err)).To(gomega.Equal(sqs.ErrCodeQueueDoesNotExist))
+			})
+		})
+
+		ginkgo.Describe("ListQueues", func() {
+			ginkgo.It("should list the queue by the prefix of its name", func() {
+				name := queueURL[strings.LastIndex(queueURL, "/")+1:]
+				output, err := client.ListQueues(&sqs.ListQueuesInput{
+					QueueNamePrefix: aws.String(name),
+				})
+				gomega.Expect(err).ToNot(gomega.HaveOccurred())
+				gomega.Expect(aws.StringValueSlice(output.QueueUrls)).To(gomega.ConsistOf(queueURL))
+			})
+		})
+	})
+}
+
+// errorCode returns the code of an AWS error, or the error message for the
+// other errors.
+func errorCode(err error) string {
+	if err == nil {
+		return ""
+	}
+	if awsErr, ok := err.(awserr.Error); ok {
+		return awsErr.Code()
+	}
+	return err.Error()
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,70 @@
+package sqscontract_test
+
+import (
+	"log"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/jamillosantos/macchiato"
+	"github.com/lab259/go-rscsrv-sqs/sqscontract"
+	"github.com/lab259/go-rscsrv-sqs/sqsmem"
+	"github.com/lab259/go-rscsrv-sqs/sqstest"
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/reporters"
+	. "github.com/onsi/gomega"
+)
+
+func TestContract(t *testing.T) {
+	log.SetOutput(GinkgoWriter)
+	RegisterFailHandler(Fail)
+
+	description := "SQS Contract Test Suite"
+	if os.Getenv("CI") == "" {
+		macchiato.RunSpecs(t, description)
+	} else {
+		reporterOutputDir := path.Join("./test-results/go-rscsrv-sqs")
+		os.MkdirAll(reporterOutputDir, os.ModePerm)
+		junitReporter := reporters.NewJUnitReporter(path.Join(reporterOutputDir, "results.xml"))
+		macchiatoReporter := macchiato.NewReporter()
+		RunSpecsWithCustomReporters(t, description, []Reporter{macchiatoReporter, junitReporter})
+	}
+}
+
+// newClient creates an AWS SDK client for the endpoint.
+func newClient(endpoint string) *sqs.SQS {
+	sess, err := session.NewSession(&aws.Config{
+		Endpoint:    aws.String(endpoint),
+		Region:      aws.String("us-east-1"),
+		Credentials: credentials.NewStaticCredentials("key", "secret", ""),
+		MaxRetries:  aws.Int(0),
+	})
+	Expect(err).ToNot(HaveOccurred())
+	return sqs.New(sess)
+}
+
+var _ = sqscontract.Describe("sqsmem.Backend", func() (*sqscontract.Backend, error) {
+	return &sqscontract.Backend{Client: sqsmem.New(nil)}, nil
+})
+
+var _ = sqscontract.Describe("sqstest.Server", func() (*sqscontract.Backend, error) {
+	server := sqstest.NewServer(nil)
+	return &sqscontract.Backend{
+		Client: newClient(server.URL),
+		Close:  server.Close,
+	}, nil
+})
+
+// The SQS of the SQS_ENDPOINT environment variable (e.g. the ElasticMQ of the
+// docker-compose.yml), if any.
+var _ = sqscontract.Describe("SQS_ENDPOINT", func() (*sqscontract.Backend, error) {
+	endpoint := os.Getenv("SQS_ENDPOINT")
+	if endpoint == "" {
+		Skip("SQS_ENDPOINT is not set")
+	}
+	return &sqscontract.Backend{Client: newClient(endpoint)}, nil
+})
@@ -0,0 +1,544 @@
+// Package sqsmem implements an in-memory SQS backend.
+//
+// The Backend implements the `sqsiface.SQSAPI` operations used by the
+// `sqssrv.SQSService` (queue management, send, receive with visibility timeout
+// and long polling, delete, change visibility and purge), so a service can run
+// entirely in process. Operations that are not supported panic.
+package sqsmem
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+)
+
+// Options configures a Backend.
+type Options struct {
+	// BaseURL is used to build the URL of the queues, which will be
+	// `BaseURL/queue/<name>`. Default: "http://sqs.memory".
+	BaseURL string
+
+	// Region is used to build the ARN of the queues. Default: "us-east-1".
+	Region string
+
+	// AccountID is used to build the ARN of the queues.
+	// Default: "000000000000".
+	AccountID string
+
+	// Clock is the source of time of the backend. Default: SystemClock.
+	Clock Clock
+}
+
+// Backend is an in-memory SQS. It is safe for concurrent use.
+type Backend struct {
+	// SQSAPI is never set. It is embedded so the Backend satisfies the whole
+	// interface; calling an operation that is not implemented panics.
+	sqsiface.SQSAPI
+
+	opts Options
+
+	m       sync.Mutex
+	queues  map[string]*queue
+	handles map[string]*message
+	changed chan struct{}
+}
+
+// New creates an empty Backend.
+func New(opts *Options) *Backend {
+	backend := &Backend{
+		queues:  make(map[string]*queue),
+		handles: make(map[string]*message),
+		changed: make(chan struct{}),
+	}
+	if opts != nil {
+		backend.opts = *opts
+	}
+	if backend.opts.BaseURL == "" {
+		backend.opts.BaseURL = "http://sqs.memory"
+	}
+	backend.opts.BaseURL = strings.TrimSuffix(backend.opts.BaseURL, "/")
+	if backend.opts.Region == "" {
+		backend.opts.Region = "us-east-1"
+	}
+	if backend.opts.AccountID == "" {
+		backend.opts.AccountID = "000000000000"
+	}
+	if backend.opts.Clock == nil {
+		backend.opts.Clock = SystemClock
+	}
+	return backend
+}
+
+// Clock returns the clock used by the backend.
+func (backend *Backend) Clock() Clock {
+	return backend.opts.Clock
+}
+
+// QueueURL returns the URL of a queue with the given name. The queue does not
+// need to exist.
+func (backend *Backend) QueueURL(name string) string {
+	return backend.opts.BaseURL + "/queue/" + name
+}
+
+// QueueARN returns the ARN of a queue with the given name. The queue does not
+// need to exist.
+func (backend *Backend) QueueARN(name string) string {
+	return fmt.Sprintf("arn:aws:sqs:%s:%s:%s", backend.opts.Region, backend.opts.AccountID, name)
+}
+
+// Queues returns the names of the existing queues, sorted.
+func (backend *Backend) Queues() []string {
+	backend.m.Lock()
+	defer backend.m.Unlock()
+
+	names := make([]string, 0, len(backend.queues))
+	for name := range backend.queues {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Message is a snapshot of a message stored in the backend.
+type Message struct {
+	MessageID         string
+	Body              string
+	MessageAttributes map[string]*sqs.MessageAttributeValue
+	GroupID           string
+	DeduplicationID   string
+	SequenceNumber    string
+	SentAt            time.Time
+	VisibleAt         time.Time
+	ReceiveCount      int
+	InFlight          bool
+}
+
+// Messages returns a snapshot of the messages stored in a queue, in the order
+// they were sent. The queue can be informed by its name or URL.
+func (backend *Backend) Messages(queue string) ([]Message, error) {
+	backend.m.Lock()
+	defer backend.m.Unlock()
+
+	q, err := backend.lookup(queue)
+	if err != nil {
+		return nil, err
+	}
+	now := backend.opts.Clock.Now()
+	q.expire(now)
+
+	messages := make([]Message, 0, len(q.messages))
+	for _, msg := range q.messages {
+		messages = append(messages, Message{
+			MessageID:         msg.id,
+			Body:              msg.body,
+			MessageAttributes: msg.attributes,
+			GroupID:           msg.groupID,
+			DeduplicationID:   msg.deduplicationID,
+			SequenceNumber:    msg.sequenceNumber,
+			SentAt:            msg.sentAt,
+			VisibleAt:         msg.visibleAt,
+			ReceiveCount:      msg.receiveCount,
+			InFlight:          msg.receiveCount > 0 && msg.visibleAt.After(now),
+		})
+	}
+	return messages, nil
+}
+
+// notify wakes up every receive waiting on a long poll. It must be called with
+// the lock held.
+func (backend *Backend) notify() {
+	close(backend.changed)
+	backend.changed = make(chan struct{})
+}
+
+// lookup finds a queue by its URL or name. As ElasticMQ does, only the last
+// segment of the URL is considered. It must be called with the lock held.
+func (backend *Backend) lookup(queueURL string) (*queue, error) {
+	name := queueURL
+	if u, err := url.Parse(queueURL); err == nil {
+		name = path.Base(u.Path)
+	}
+	q, ok := backend.queues[name]
+	if !ok {
+		return nil, awserr.New(sqs.ErrCodeQueueDoesNotExist, "The specified queue does not exist for this wsdl version.", nil)
+	}
+	return q, nil
+}
+
+// lookupARN finds a queue by its ARN. It must be called with the lock held.
+func (backend *Backend) lookupARN(arn string) (*queue, bool) {
+	i := strings.LastIndex(arn, ":")
+	q, ok := backend.queues[arn[i+1:]]
+	return q, ok
+}
+
+// CreateQueue creates a queue. Creating a queue that already exists with the
+// same attributes returns its URL.
+func (backend *Backend) CreateQueue(input *sqs.CreateQueueInput) (*sqs.CreateQueueOutput, error) {
+	return backend.CreateQueueWithContext(aws.BackgroundContext(), input)
+}
+
+// CreateQueueWithContext is the same as CreateQueue with a context.
+func (backend *Backend) CreateQueueWithContext(ctx aws.Context, input *sqs.CreateQueueInput, _ ...request.Option) (*sqs.CreateQueueOutput, error) {
+	if err := input.Validate(); err != nil {
+		return nil, err
+	}
+
+	backend.m.Lock()
+	defer backend.m.Unlock()
+
+	name := aws.StringValue(input.QueueName)
+	attributes := aws.StringValueMap(input.Attributes)
+	if err := validateQueueName(name, attributes); err != nil {
+		return nil, err
+	}
+	if err := validateQueueAttributes(attributes); err != nil {
+		return nil, err
+	}
+
+	if q, ok := backend.queues[name]; ok {
+		for key, value := range attributes {
+			if q.attributes[key] != value {
+				return nil, awserr.New(sqs.ErrCodeQueueNameExists, fmt.Sprintf("A queue already exists with the same name and a different value for attribute %s", key), nil)
+			}
+		}
+		return &sqs.CreateQueueOutput{
+			QueueUrl: aws.String(q.url),
+		}, nil
+	}
+
+	now := backend.opts.Clock.Now()
+	q := newQueue(name, backend.QueueURL(name), backend.QueueARN(name), now)
+	for key, value := range attributes {
+		q.attributes[key] = value
+	}
+	backend.queues[name] = q
+
+	return &sqs.CreateQueueOutput{
+		QueueUrl: aws.String(q.url),
+	}, nil
+}
+
+// DeleteQueue deletes a queue and all its messages.
+func (backend *Backend) DeleteQueue(input *sqs.DeleteQueueInput) (*sqs.DeleteQueueOutput, error) {
+	return backend.DeleteQueueWithContext(aws.BackgroundContext(), input)
+}
+
+// DeleteQueueWithContext is the same as DeleteQueue with a context.
+func (backend *Backend) DeleteQueueWithContext(ctx aws.Context, input *sqs.DeleteQueueInput, _ ...request.Option) (*sqs.DeleteQueueOutput, error) {
+	if err := input.Validate(); err != nil {
+		return nil, err
+	}
+
+	backend.m.Lock()
+	defer backend.m.Unlock()
+
+	q, err := backend.lookup(aws.StringValue(input.QueueUrl))
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range q.messages {
+		backend.forget(msg)
+	}
+	delete(backend.queues, q.name)
+	backend.notify()
+	return &sqs.DeleteQueueOutput{}, nil
+}
+
+// GetQueueUrl returns the URL of an existing queue.
+func (backend *Backend) GetQueueUrl(input *sqs.GetQueueUrlInput) (*sqs.GetQueueUrlOutput, error) {
+	return backend.GetQueueUrlWithContext(aws.BackgroundContext(), input)
+}
+
+// GetQueueUrlWithContext is the same as GetQueueUrl with a context.
+func (backend *Backend) GetQueueUrlWithContext(ctx aws.Context, input *sqs.GetQueueUrlInput, _ ...request.Option) (*sqs.GetQueueUrlOutput, error) {
+	if err := input.Validate(); err != nil {
+		return nil, err
+	}
+
+	backend.m.Lock()
+	defer backend.m.Unlock()
+
+	q, ok := backend.queues[aws.StringValue(input.QueueName)]
+	if !ok {
+		return nil, awserr.New(sqs.ErrCodeQueueDoesNotExist, "The specified queue does not exist for this wsdl version.", nil)
+	}
+	return &sqs.GetQueueUrlOutput{
+		QueueUrl: aws.String(q.url),
+	}, nil
+}
+
+// ListQueues lists the URL of the queues, optionally filtered by a prefix.
+func (backend *Backend) ListQueues(input *sqs.ListQueuesInput) (*sqs.ListQueuesOutput, error) {
+	return backend.ListQueuesWithContext(aws.BackgroundContext(), input)
+}
+
+// ListQueuesWithContext is the same as ListQueues with a context.
+func (backend *Backend) ListQueuesWithContext(ctx aws.Context, input *sqs.ListQueuesInput, _ ...request.Option) (*sqs.ListQueuesOutput, error) {
+	prefix := aws.StringValue(input.QueueNamePrefix)
+
+	output := &sqs.ListQueuesOutput{}
+	for _, name := range backend.Queues() {
+		if strings.HasPrefix(name, prefix) {
+			output.QueueUrls = append(output.QueueUrls, aws.String(backend.QueueURL(name)))
+		}
+	}
+	return output, nil
+}
+
+// ListDeadLetterSourceQueues lists the queues whose redrive policy points to
+// the given queue.
+func (backend *Backend) ListDeadLetterSourceQueues(input *sqs.ListDeadLetterSourceQueuesInput) (*sqs.ListDeadLetterSourceQueuesOutput, error) {
+	return backend.ListDeadLetterSourceQueuesWithContext(aws.BackgroundContext(), input)
+}
+
+// ListDeadLetterSourceQueuesWithContext is the same as
+// ListDeadLetterSourceQueues with a context.
+func (backend *Backend) ListDeadLetterSourceQueuesWithContext(ctx aws.Context, input *sqs.ListDeadLetterSourceQueuesInput, _ ...request.Option) (*sqs.ListDeadLetterSourceQueuesOutput, error) {
+	if err := input.Validate(); err != nil {
+		return nil, err
+	}
+
+	backend.m.Lock()
+	defer backend.m.Unlock()
+
+	dlq, err := backend.lookup(aws.StringValue(input.QueueUrl))
+	if err != nil {
+		return nil, err
+	}
+
+	output := &sqs.ListDeadLetterSourceQueuesOutput{
+		QueueUrls: []*string{},
+	}
+	for _, q := range backend.queues {
+		if policy, ok := q.redrivePolicy(); ok && policy.DeadLetterTargetArn == dlq.arn {
+			output.QueueUrls = append(output.QueueUrls, aws.String(q.url))
+		}
+	}
+	sort.Slice(output.QueueUrls, func(i, j int) bool {
+		return *output.QueueUrls[i] < *output.QueueUrls[j]
+	})
+	return output, nil
+}
+
+// GetQueueAttributes returns the attributes of a queue.
+func (backend *Backend) GetQueueAttributes(input *sqs.GetQueueAttributesInput) (*sqs.GetQueueAttributesOutput, error) {
+	return backend.GetQueueAttributesWithContext(aws.BackgroundContext(), input)
+}
+
+// GetQueueAttributesWithContext is the same as GetQueueAttributes with a
+// context.
+func (backend *Backend) GetQueueAttributesWithContext(ctx aws.Context, input *sqs.GetQueueAttributesInput, _ ...request.Option) (*sqs.GetQueueAttributesOutput, error) {
+	if err := input.Validate(); err != nil {
+		return nil, err
+	}
+
+	backend.m.Lock()
+	defer backend.m.Unlock()
+
+	q, err := backend.lookup(aws.StringValue(input.QueueUrl))
+	if err != nil {
+		return nil, err
+	}
+
+	all := q.allAttributes(backend.opts.Clock.Now())
+	attributes := make(map[string]*string)
+	for _, name := range aws.StringValueSlice(input.AttributeNames) {
+		if name == sqs.QueueAttributeNameAll {
+			for key, value := range all {
+				attributes[key] = aws.String(value)
+			}
+			continue
+		}
+		if !isQueueAttribute(name) {
+			return nil, awserr.New(sqs.ErrCodeInvalidAttributeName, fmt.Sprintf("Unknown Attribute %s.", name), nil)
+		}
+		if value, ok := all[name]; ok {
+			attributes[name] = aws.String(value)
+		}
+	}
+	return &sqs.GetQueueAttributesOutput{
+		Attributes: attributes,
+	}, nil
+}
+
+// SetQueueAttributes changes the attributes of a queue.
+func (backend *Backend) SetQueueAttributes(input *sqs.SetQueueAttributesInput) (*sqs.SetQueueAttributesOutput, error) {
+	return backend.SetQueueAttributesWithContext(aws.BackgroundContext(), input)
+}
+
+// SetQueueAttributesWithContext is the same as SetQueueAttributes with a
+// context.
+func (backend *Backend) SetQueueAttributesWithContext(ctx aws.Context, input *sqs.SetQueueAttributesInput, _ ...request.Option) (*sqs.SetQueueAttributesOutput, error) {
+	if err := input.Validate(); err != nil {
+		return nil, err
+	}
+
+	backend.m.Lock()
+	defer backend.m.Unlock()
+
+	q, err := backend.lookup(aws.StringValue(input.QueueUrl))
+	if err != nil {
+		return nil, err
+	}
+
+	attributes := aws.StringValueMap(input.Attributes)
+	if err := validateQueueAttributes(attributes); err != nil {
+		return nil, err
+	}
+	for key := range attributes {
+		if key == sqs.QueueAttributeNameFifoQueue {
+			return nil, awserr.New(sqs.ErrCodeInvalidAttributeName, "FifoQueue can only be set when creating a queue.", nil)
+		}
+	}
+	for key, value := range attributes {
+		if value == "" {
+			delete(q.attributes, key)
+			continue
+		}
+		q.attributes[key] = value
+	}
+	q.modified = backend.opts.Clock.Now()
+	backend.notify()
+	return &sqs.SetQueueAttributesOutput{}, nil
+}
+
+// TagQueue adds tags to a queue.
+func (backend *Backend) TagQueue(input *sqs.TagQueueInput) (*sqs.TagQueueOutput, error) {
+	return backend.TagQueueWithContext(aws.BackgroundContext(), input)
+}
+
+// TagQueueWithContext is the same as TagQueue with a context.
+func (backend *Backend) TagQueueWithContext(ctx aws.Context, input *sqs.TagQueueInput, _ ...request.Option) (*sqs.TagQueueOutput, error) {
+	if err := input.Validate(); err != nil {
+		return nil, err
+	}
+
+	backend.m.Lock()
+	defer backend.m.Unlock()
+
+	q, err := backend.lookup(aws.StringValue(input.QueueUrl))
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range aws.StringValueMap(input.Tags) {
+		q.tags[key] = value
+	}
+	return &sqs.TagQueueOutput{}, nil
+}
+
+// UntagQueue removes tags from a queue.
+func (backend *Backend) UntagQueue(input *sqs.UntagQueueInput) (*sqs.UntagQueueOutput, error) {
+	return backend.UntagQueueWithContext(aws.BackgroundContext(), input)
+}
+
+// UntagQueueWithContext is the same as UntagQueue with a context.
+func (backend *Backend) UntagQueueWithContext(ctx aws.Context, input *sqs.UntagQueueInput, _ ...request.Option) (*sqs.UntagQueueOutput, error) {
+	if err := input.Validate(); err != nil {
+		return nil, err
+	}
+
+	backend.m.Lock()
+	defer backend.m.Unlock()
+
+	q, err := backend.lookup(aws.StringValue(input.QueueUrl))
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range aws.StringValueSlice(input.TagKeys) {
+		delete(q.tags, key)
+	}
+	return &sqs.UntagQueueOutput{}, nil
+}
+
+// ListQueueTags returns the tags of a queue.
+func (backend *Backend) ListQueueTags(input *sqs.ListQueueTagsInput) (*sqs.ListQueueTagsOutput, error) {
+	return backend.ListQueueTagsWithContext(aws.BackgroundContext(), input)
+}
+
+// ListQueueTagsWithContext is the same as ListQueueTags with a context.
+func (backend *Backend) ListQueueTagsWithContext(ctx aws.Context, input *sqs.ListQueueTagsInput, _ ...request.Option) (*sqs.ListQueueTagsOutput, error) {
+	if err := input.Validate(); err != nil {
+		return nil, err
+	}
+
+	backend.m.Lock()
+	defer backend.m.Unlock()
+
+	q, err := backend.lookup(aws.StringValue(input.QueueUrl))
+	if err != nil {
+		return nil, err
+	}
+	tags := make(map[string]*string, len(q.tags))
+	for key, value := range q.tags {
+		tags[key] = aws.String(value)
+	}
+	return &sqs.ListQueueTagsOutput{
+		Tags: tags,
+	}, nil
+}
+
+// PurgeQueue deletes all the messages of a queue.
+func (backend *Backend) PurgeQueue(input *sqs.PurgeQueueInput) (*sqs.PurgeQueueOutput, error) {
+	return backend.PurgeQueueWithContext(aws.BackgroundContext(), input)
+}
+
+// PurgeQueueWithContext is the same as PurgeQueue with a context.
+func (backend *Backend) PurgeQueueWithContext(ctx aws.Context, input *sqs.PurgeQueueInput, _ ...request.Option) (*sqs.PurgeQueueOutput, error) {
+	if err := input.Validate(); err != nil {
+		return nil, err
+	}
+
+	backend.m.Lock()
+	defer backend.m.Unlock()
+
+	q, err := backend.lookup(aws.StringValue(input.QueueUrl))
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range q.messages {
+		backend.forget(msg)
+	}
+	q.messages = nil
+	return &sqs.PurgeQueueOutput{}, nil
+}
+
+// forget drops the receipt handles of a message. It must be called with the
+// lock held.
+func (backend *Backend) forget(msg *message) {
+	for _, handle := range msg.handles {
+		delete(backend.handles, handle)
+	}
+	msg.handles = nil
+}
+
+func newID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	h := hex.EncodeToString(b[:])
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+func newReceiptHandle() string {
+	var b [48]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,215 @@
+package sqsmem
+
+import (
+	"log"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/jamillosantos/macchiato"
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/reporters"
+	. "github.com/onsi/gomega"
+)
+
+func TestBackend(t *testing.T) {
+	log.SetOutput(GinkgoWriter)
+	RegisterFailHandler(Fail)
+
+	description := "SQS In-Memory Backend Test Suite"
+	if os.Getenv("CI") == "" {
+		macchiato.RunSpecs(t, description)
+	} else {
+		reporterOutputDir := path.Join("./test-results/go-rscsrv-sqs")
+		os.MkdirAll(reporterOutputDir, os.ModePerm)
+		junitReporter := reporters.NewJUnitReporter(path.Join(reporterOutputDir, "results.xml"))
+		macchiatoReporter := macchiato.NewReporter()
+		RunSpecsWithCustomReporters(t, description, []Reporter{macchiatoReporter, junitReporter})
+	}
+}
+
+// errorCode returns the AWS error code of an error.
+func errorCode(err error) string {
+	if err, ok := err.(awserr.Error); ok {
+		return err.Code()
+	}
+	return ""
+}
+
+var _ = Describe("Backend", func() {
+	var (
+		clock   *ManualClock
+		backend *Backend
+	)
+
+	BeforeEach(func() {
+		clock = NewManualClock(time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC))
+		backend = New(&Options{
+			Clock: clock,
+		})
+	})
+
+	create := func(name string, attributes map[string]string) string {
+		output, err := backend.CreateQueue(&sqs.CreateQueueInput{
+			QueueName:  aws.String(name),
+			Attributes: aws.StringMap(attributes),
+		})
+		Expect(err).ToNot(HaveOccurred())
+		return aws.StringValue(output.QueueUrl)
+	}
+
+	It("should create the queues", func() {
+		queueURL := create("queue-test", nil)
+		Expect(queueURL).To(Equal("http://sqs.memory/queue/queue-test"))
+		Expect(backend.Queues()).To(Equal([]string{"queue-test"}))
+
+		output, err := backend.GetQueueUrl(&sqs.GetQueueUrlInput{
+			QueueName: aws.String("queue-test"),
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(aws.StringValue(output.QueueUrl)).To(Equal(queueURL))
+	})
+
+	It("should return the existing queue when creating it again", func() {
+		queueURL := create("queue-test", map[string]string{"VisibilityTimeout": "10"})
+		Expect(create("queue-test", map[string]string{"VisibilityTimeout": "10"})).To(Equal(queueURL))
+
+		_, err := backend.CreateQueue(&sqs.CreateQueueInput{
+			QueueName:  aws.String("queue-test"),
+			Attributes: aws.StringMap(map[string]string{"VisibilityTimeout": "20"}),
+		})
+		Expect(errorCode(err)).To(Equal(sqs.ErrCodeQueueNameExists))
+	})
+
+	It("should fail creating queues with invalid names or attributes", func() {
+		_, err := backend.CreateQueue(&sqs.CreateQueueInput{
+			QueueName: aws.String("queue test"),
+		})
+		Expect(errorCode(err)).To(Equal("InvalidParameterValue"))
+
+		_, err = backend.CreateQueue(&sqs.CreateQueueInput{
+			QueueName:  aws.String("queue-test"),
+			Attributes: aws.StringMap(map[string]string{"VisibilityTimeout": "-1"}),
+		})
+		Expect(errorCode(err)).To(Equal("InvalidAttributeValue"))
+
+		_, err = backend.CreateQueue(&sqs.CreateQueueInput{
+			QueueName:  aws.String("queue-test"),
+			Attributes: aws.StringMap(map[string]string{"Unknown": "1"}),
+		})
+		Expect(errorCode(err)).To(Equal(sqs.ErrCodeInvalidAttributeName))
+	})
+
+	It("should list the queues by prefix", func() {
+		create("queue-a", nil)
+		create("queue-b", nil)
+		create("other", nil)
+
+		output, err := backend.ListQueues(&sqs.ListQueuesInput{
+			QueueNamePrefix: aws.String("queue-"),
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(aws.StringValueSlice(output.QueueUrls)).To(Equal([]string{
+			backend.QueueURL("queue-a"),
+			backend.QueueURL("queue-b"),
+		}))
+	})
+
+	It("should delete the queues", func() {
+		queueURL := create("queue-test", nil)
+		_, err := backend.DeleteQueue(&sqs.DeleteQueueInput{
+			QueueUrl: aws.String(queueURL),
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(backend.Queues()).To(BeEmpty())
+
+		_, err = backend.SendMessage(&sqs.SendMessageInput{
+			QueueUrl:    aws.String(queueURL),
+			MessageBody: aws.String("message"),
+		})
+		Expect(errorCode(err)).To(Equal(sqs.ErrCodeQueueDoesNotExist))
+	})
+
+	It("should find the queues by any URL ending with their name", func() {
+		create("queue-test", nil)
+		_, err := backend.SendMessage(&sqs.SendMessageInput{
+			QueueUrl:    aws.String("http://localhost:9324/queue/queue-test"),
+			MessageBody: aws.String("message"),
+		})
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("should get and set the attributes of the queues", func() {
+		queueURL := create("queue-test", nil)
+		_, err := backend.SetQueueAttributes(&sqs.SetQueueAttributesInput{
+			QueueUrl:   aws.String(queueURL),
+			Attributes: aws.StringMap(map[string]string{"DelaySeconds": "5"}),
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		output, err := backend.GetQueueAttributes(&sqs.GetQueueAttributesInput{
+			QueueUrl:       aws.String(queueURL),
+			AttributeNames: aws.StringSlice([]string{"All"}),
+		})
+		Expect(err).ToNot(HaveOccurred())
+		attributes := aws.StringValueMap(output.Attributes)
+		Expect(attributes).To(HaveKeyWithValue("DelaySeconds", "5"))
+		Expect(attributes).To(HaveKeyWithValue("VisibilityTimeout", "30"))
+		Expect(attributes).To(HaveKeyWithValue("QueueArn", "arn:aws:sqs:us-east-1:000000000000:queue-test"))
+		Expect(attributes).To(HaveKeyWithValue("ApproximateNumberOfMessages", "0"))
+	})
+
+	It("should tag the queues", func() {
+		queueURL := create("queue-test", nil)
+		_, err := backend.TagQueue(&sqs.TagQueueInput{
+			QueueUrl: aws.String(queueURL),
+			Tags:     aws.StringMap(map[string]string{"team": "lab259", "env": "test"}),
+		})
+		Expect(err).ToNot(HaveOccurred())
+		_, err = backend.UntagQueue(&sqs.UntagQueueInput{
+			QueueUrl: aws.String(queueURL),
+			TagKeys:  aws.StringSlice([]string{"env"}),
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		output, err := backend.ListQueueTags(&sqs.ListQueueTagsInput{
+			QueueUrl: aws.String(queueURL),
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(aws.StringValueMap(output.Tags)).To(Equal(map[string]string{"team": "lab259"}))
+	})
+
+	It("should list the dead letter source queues", func() {
+		dlqURL := create("queue-dlq", nil)
+		create("queue-test", map[string]string{
+			"RedrivePolicy": `{"deadLetterTargetArn":"` + backend.QueueARN("queue-dlq") + `","maxReceiveCount":"3"}`,
+		})
+		create("other", nil)
+
+		output, err := backend.ListDeadLetterSourceQueues(&sqs.ListDeadLetterSourceQueuesInput{
+			QueueUrl: aws.String(dlqURL),
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(aws.StringValueSlice(output.QueueUrls)).To(Equal([]string{backend.QueueURL("queue-test")}))
+	})
+
+	It("should purge the queues", func() {
+		queueURL := create("queue-test", nil)
+		for i := 0; i < 3; i++ {
+			_, err := backend.SendMessage(&sqs.SendMessageInput{
+				QueueUrl:    aws.String(queueURL),
+				MessageBody: aws.String("message"),
+			})
+			Expect(err).ToNot(HaveOccurred())
+		}
+		_, err := backend.PurgeQueue(&sqs.PurgeQueueInput{
+			QueueUrl: aws.String(queueURL),
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(backend.Messages("queue-test")).To(BeEmpty())
+	})
+})
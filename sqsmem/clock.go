@@ -0,0 +1,98 @@
+package sqsmem
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the source of time of the Backend. Visibility timeouts, delays,
+// retention periods and long polling are all measured with it.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// After waits for the duration to elapse and then sends the current time
+	// on the returned channel.
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// SystemClock is the Clock backed by the `time` package.
+var SystemClock Clock = systemClock{}
+
+type manualClockWaiter struct {
+	deadline time.Time
+	ch       chan time.Time
+}
+
+// ManualClock is a Clock that only moves when Advance or Set are called. It
+// makes visibility timeouts and delays deterministic in tests.
+type ManualClock struct {
+	m       sync.Mutex
+	now     time.Time
+	waiters []manualClockWaiter
+}
+
+// NewManualClock returns a ManualClock stopped at the given time.
+func NewManualClock(now time.Time) *ManualClock {
+	return &ManualClock{
+		now: now,
+	}
+}
+
+// Now returns the current time of the clock.
+func (clock *ManualClock) Now() time.Time {
+	clock.m.Lock()
+	defer clock.m.Unlock()
+	return clock.now
+}
+
+// After returns a channel that receives the time of the clock once it is
+// advanced by, at least, the given duration.
+func (clock *ManualClock) After(d time.Duration) <-chan time.Time {
+	clock.m.Lock()
+	defer clock.m.Unlock()
+
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- clock.now
+		return ch
+	}
+	clock.waiters = append(clock.waiters, manualClockWaiter{
+		deadline: clock.now.Add(d),
+		ch:       ch,
+	})
+	return ch
+}
+
+// Advance moves the clock forward by the given duration.
+func (clock *ManualClock) Advance(d time.Duration) {
+	clock.Set(clock.Now().Add(d))
+}
+
+// Set moves the clock to the given time, waking up everyone waiting for a
+// deadline that was reached.
+func (clock *ManualClock) Set(now time.Time) {
+	clock.m.Lock()
+	defer clock.m.Unlock()
+
+	clock.now = now
+	waiters := clock.waiters[:0]
+	for _, waiter := range clock.waiters {
+		if now.Before(waiter.deadline) {
+			waiters = append(waiters, waiter)
+			continue
+		}
+		waiter.ch <- now
+	}
+	clock.waiters = waiters
+}
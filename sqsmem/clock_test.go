@@ -0,0 +1,35 @@
+package sqsmem
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ManualClock", func() {
+	start := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	It("should only move when advanced", func() {
+		clock := NewManualClock(start)
+		Expect(clock.Now()).To(Equal(start))
+		clock.Advance(time.Minute)
+		Expect(clock.Now()).To(Equal(start.Add(time.Minute)))
+	})
+
+	It("should fire the waiters once their deadline is reached", func() {
+		clock := NewManualClock(start)
+		ch := clock.After(10 * time.Second)
+
+		clock.Advance(9 * time.Second)
+		Expect(ch).ToNot(Receive())
+
+		clock.Advance(time.Second)
+		Expect(ch).To(Receive(Equal(start.Add(10 * time.Second))))
+	})
+
+	It("should fire immediately without a duration", func() {
+		clock := NewManualClock(start)
+		Expect(clock.After(0)).To(Receive(Equal(start)))
+	})
+})
@@ -0,0 +1,629 @@
+package sqsmem
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+const (
+	maxBatchEntries   = 10
+	maxBatchSize      = 262144
+	maxReceiveWait    = 20
+	maxReceiveMessage = 10
+)
+
+type sendEntry struct {
+	body            *string
+	attributes      map[string]*sqs.MessageAttributeValue
+	delaySeconds    *int64
+	groupID         *string
+	deduplicationID *string
+}
+
+type sendResult struct {
+	messageID       string
+	md5OfBody       string
+	md5OfAttributes string
+	sequenceNumber  string
+}
+
+// send enqueues a message. It must be called with the lock held.
+func (backend *Backend) send(q *queue, now time.Time, entry sendEntry) (*sendResult, error) {
+	body := aws.StringValue(entry.body)
+	maxSize := q.intAttribute(sqs.QueueAttributeNameMaximumMessageSize, defaultMaximumMessageSize)
+	if len(body)+messageAttributesSize(entry.attributes) > maxSize {
+		return nil, awserr.New("InvalidParameterValue", fmt.Sprintf("One or more parameters are invalid. Reason: Message must be shorter than %d bytes.", maxSize), nil)
+	}
+	for name, value := range entry.attributes {
+		if value == nil || value.DataType == nil || (value.StringValue == nil && value.BinaryValue == nil) {
+			return nil, awserr.New("InvalidParameterValue", fmt.Sprintf("The message attribute '%s' must contain a non-empty message attribute value.", name), nil)
+		}
+	}
+
+	delay := time.Duration(q.intAttribute(sqs.QueueAttributeNameDelaySeconds, 0)) * time.Second
+	if entry.delaySeconds != nil {
+		if q.fifo() {
+			return nil, awserr.New("InvalidParameterValue", "Value for parameter DelaySeconds is invalid. Reason: The request include parameter that is not valid for this queue type.", nil)
+		}
+		if *entry.delaySeconds < 0 || *entry.delaySeconds > 900 {
+			return nil, awserr.New("InvalidParameterValue", "Value for parameter DelaySeconds is invalid. Reason: must be between 0 and 900.", nil)
+		}
+		delay = time.Duration(*entry.delaySeconds) * time.Second
+	}
+
+	msg := &message{
+		id:              newID(),
+		body:            body,
+		attributes:      entry.attributes,
+		md5OfBody:       md5Hex([]byte(body)),
+		md5OfAttributes: md5OfMessageAttributes(entry.attributes),
+		groupID:         aws.StringValue(entry.groupID),
+		sentAt:          now,
+		visibleAt:       now.Add(delay),
+	}
+
+	if q.fifo() {
+		if msg.groupID == "" {
+			return nil, awserr.New("MissingParameter", "The request must contain the parameter MessageGroupId.", nil)
+		}
+		msg.deduplicationID = aws.StringValue(entry.deduplicationID)
+		if msg.deduplicationID == "" {
+			if q.attributes[sqs.QueueAttributeNameContentBasedDeduplication] != "true" {
+				return nil, awserr.New("InvalidParameterValue", "The queue should either have ContentBasedDeduplication enabled or MessageDeduplicationId provided explicitly", nil)
+			}
+			sum := sha256.Sum256([]byte(body))
+			msg.deduplicationID = hex.EncodeToString(sum[:])
+		}
+		if d, ok := q.dedup[msg.deduplicationID]; ok && now.Before(d.expiresAt) {
+			return &sendResult{
+				messageID:       d.messageID,
+				md5OfBody:       msg.md5OfBody,
+				md5OfAttributes: msg.md5OfAttributes,
+				sequenceNumber:  d.sequenceNumber,
+			}, nil
+		}
+		q.sequence++
+		msg.sequenceNumber = fmt.Sprintf("%020d", q.sequence)
+		q.dedup[msg.deduplicationID] = deduplication{
+			messageID:      msg.id,
+			sequenceNumber: msg.sequenceNumber,
+			expiresAt:      now.Add(deduplicationInterval),
+		}
+	}
+
+	q.messages = append(q.messages, msg)
+	return &sendResult{
+		messageID:       msg.id,
+		md5OfBody:       msg.md5OfBody,
+		md5OfAttributes: msg.md5OfAttributes,
+		sequenceNumber:  msg.sequenceNumber,
+	}, nil
+}
+
+// SendMessage enqueues a message.
+func (backend *Backend) SendMessage(input *sqs.SendMessageInput) (*sqs.SendMessageOutput, error) {
+	return backend.SendMessageWithContext(aws.BackgroundContext(), input)
+}
+
+// SendMessageWithContext is the same as SendMessage with a context.
+func (backend *Backend) SendMessageWithContext(ctx aws.Context, input *sqs.SendMessageInput, _ ...request.Option) (*sqs.SendMessageOutput, error) {
+	if err := input.Validate(); err != nil {
+		return nil, err
+	}
+
+	backend.m.Lock()
+	defer backend.m.Unlock()
+
+	q, err := backend.lookup(aws.StringValue(input.QueueUrl))
+	if err != nil {
+		return nil, err
+	}
+	now := backend.opts.Clock.Now()
+	q.expire(now)
+
+	result, err := backend.send(q, now, sendEntry{
+		body:            input.MessageBody,
+		attributes:      input.MessageAttributes,
+		delaySeconds:    input.DelaySeconds,
+		groupID:         input.MessageGroupId,
+		deduplicationID: input.MessageDeduplicationId,
+	})
+	if err != nil {
+		return nil, err
+	}
+	backend.notify()
+
+	output := &sqs.SendMessageOutput{
+		MessageId:        aws.String(result.messageID),
+		MD5OfMessageBody: aws.String(result.md5OfBody),
+	}
+	if result.md5OfAttributes != "" {
+		output.MD5OfMessageAttributes = aws.String(result.md5OfAttributes)
+	}
+	if result.sequenceNumber != "" {
+		output.SequenceNumber = aws.String(result.sequenceNumber)
+	}
+	return output, nil
+}
+
+// validateBatch checks the constraints shared by all the batch operations.
+func validateBatch(ids []string) error {
+	if len(ids) == 0 {
+		return awserr.New(sqs.ErrCodeEmptyBatchRequest, "There should be at least one entry in the request.", nil)
+	}
+	if len(ids) > maxBatchEntries {
+		return awserr.New(sqs.ErrCodeTooManyEntriesInBatchRequest, fmt.Sprintf("Maximum number of entries per request are %d. You have sent %d.", maxBatchEntries, len(ids)), nil)
+	}
+	seen := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		if seen[id] {
+			return awserr.New(sqs.ErrCodeBatchEntryIdsNotDistinct, fmt.Sprintf("Id %s repeated.", id), nil)
+		}
+		seen[id] = true
+	}
+	return nil
+}
+
+func batchError(id string, err error) *sqs.BatchResultErrorEntry {
+	code, message := "InternalError", err.Error()
+	if awsErr, ok := err.(awserr.Error); ok {
+		code, message = awsErr.Code(), awsErr.Message()
+	}
+	return &sqs.BatchResultErrorEntry{
+		Id:          aws.String(id),
+		Code:        aws.String(code),
+		Message:     aws.String(message),
+		SenderFault: aws.Bool(true),
+	}
+}
+
+// SendMessageBatch enqueues up to 10 messages.
+func (backend *Backend) SendMessageBatch(input *sqs.SendMessageBatchInput) (*sqs.SendMessageBatchOutput, error) {
+	return backend.SendMessageBatchWithContext(aws.BackgroundContext(), input)
+}
+
+// SendMessageBatchWithContext is the same as SendMessageBatch with a context.
+func (backend *Backend) SendMessageBatchWithContext(ctx aws.Context, input *sqs.SendMessageBatchInput, _ ...request.Option) (*sqs.SendMessageBatchOutput, error) {
+	if err := input.Validate(); err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, len(input.Entries))
+	size := 0
+	for i, entry := range input.Entries {
+		ids[i] = aws.StringValue(entry.Id)
+		size += len(aws.StringValue(entry.MessageBody)) + messageAttributesSize(entry.MessageAttributes)
+	}
+	if err := validateBatch(ids); err != nil {
+		return nil, err
+	}
+	if size > maxBatchSize {
+		return nil, awserr.New(sqs.ErrCodeBatchRequestTooLong, fmt.Sprintf("Batch requests cannot be longer than %d bytes. You have sent %d bytes.", maxBatchSize, size), nil)
+	}
+
+	backend.m.Lock()
+	defer backend.m.Unlock()
+
+	q, err := backend.lookup(aws.StringValue(input.QueueUrl))
+	if err != nil {
+		return nil, err
+	}
+	now := backend.opts.Clock.Now()
+	q.expire(now)
+
+	output := &sqs.SendMessageBatchOutput{
+		Successful: []*sqs.SendMessageBatchResultEntry{},
+		Failed:     []*sqs.BatchResultErrorEntry{},
+	}
+	for _, entry := range input.Entries {
+		result, err := backend.send(q, now, sendEntry{
+			body:            entry.MessageBody,
+			attributes:      entry.MessageAttributes,
+			delaySeconds:    entry.DelaySeconds,
+			groupID:         entry.MessageGroupId,
+			deduplicationID: entry.MessageDeduplicationId,
+		})
+		if err != nil {
+			output.Failed = append(output.Failed, batchError(aws.StringValue(entry.Id), err))
+			continue
+		}
+		resultEntry := &sqs.SendMessageBatchResultEntry{
+			Id:               entry.Id,
+			MessageId:        aws.String(result.messageID),
+			MD5OfMessageBody: aws.String(result.md5OfBody),
+		}
+		if result.md5OfAttributes != "" {
+			resultEntry.MD5OfMessageAttributes = aws.String(result.md5OfAttributes)
+		}
+		if result.sequenceNumber != "" {
+			resultEntry.SequenceNumber = aws.String(result.sequenceNumber)
+		}
+		output.Successful = append(output.Successful, resultEntry)
+	}
+	backend.notify()
+	return output, nil
+}
+
+type receiveOptions struct {
+	max                   int
+	visibilityTimeout     time.Duration
+	attributeNames        []string
+	messageAttributeNames []string
+}
+
+// receive picks the visible messages of a queue, making them in flight. It
+// must be called with the lock held.
+func (backend *Backend) receive(q *queue, now time.Time, opts receiveOptions) []*sqs.Message {
+	q.expire(now)
+
+	policy, redrive := q.redrivePolicy()
+	var dlq *queue
+	if redrive {
+		dlq, redrive = backend.lookupARN(policy.DeadLetterTargetArn)
+	}
+
+	var received []*sqs.Message
+	blockedGroups := make(map[string]bool)
+	for _, msg := range append([]*message(nil), q.messages...) {
+		if len(received) >= opts.max {
+			break
+		}
+		if q.fifo() && blockedGroups[msg.groupID] {
+			continue
+		}
+		if msg.visibleAt.After(now) {
+			if q.fifo() {
+				blockedGroups[msg.groupID] = true
+			}
+			continue
+		}
+		if redrive && msg.receiveCount >= policy.MaxReceiveCount {
+			q.remove(msg)
+			backend.forget(msg)
+			msg.receiveCount = 0
+			msg.firstReceivedAt = time.Time{}
+			msg.receiptHandle = ""
+			msg.visibleAt = now
+			dlq.messages = append(dlq.messages, msg)
+			continue
+		}
+
+		msg.receiveCount++
+		if msg.firstReceivedAt.IsZero() {
+			msg.firstReceivedAt = now
+		}
+		msg.visibleAt = now.Add(opts.visibilityTimeout)
+		msg.receiptHandle = newReceiptHandle()
+		msg.handles = append(msg.handles, msg.receiptHandle)
+		backend.handles[msg.receiptHandle] = msg
+
+		received = append(received, msg.toSQS(opts))
+	}
+	return received
+}
+
+func (msg *message) toSQS(opts receiveOptions) *sqs.Message {
+	result := &sqs.Message{
+		MessageId:     aws.String(msg.id),
+		ReceiptHandle: aws.String(msg.receiptHandle),
+		Body:          aws.String(msg.body),
+		MD5OfBody:     aws.String(msg.md5OfBody),
+	}
+
+	system := map[string]string{
+		sqs.MessageSystemAttributeNameSenderId:                         "000000000000",
+		sqs.MessageSystemAttributeNameSentTimestamp:                    strconv.FormatInt(msg.sentAt.UnixNano()/int64(time.Millisecond), 10),
+		sqs.MessageSystemAttributeNameApproximateReceiveCount:          strconv.Itoa(msg.receiveCount),
+		sqs.MessageSystemAttributeNameApproximateFirstReceiveTimestamp: strconv.FormatInt(msg.firstReceivedAt.UnixNano()/int64(time.Millisecond), 10),
+	}
+	if msg.groupID != "" {
+		system[sqs.MessageSystemAttributeNameMessageGroupId] = msg.groupID
+	}
+	if msg.sequenceNumber != "" {
+		system[sqs.MessageSystemAttributeNameSequenceNumber] = msg.sequenceNumber
+		system[sqs.MessageSystemAttributeNameMessageDeduplicationId] = msg.deduplicationID
+	}
+	for _, name := range opts.attributeNames {
+		for key, value := range system {
+			if name == sqs.QueueAttributeNameAll || name == key {
+				if result.Attributes == nil {
+					result.Attributes = make(map[string]*string)
+				}
+				result.Attributes[key] = aws.String(value)
+			}
+		}
+	}
+
+	for key, value := range msg.attributes {
+		for _, name := range opts.messageAttributeNames {
+			if name == "All" || name == ".*" || name == key || (strings.HasSuffix(name, ".*") && strings.HasPrefix(key, strings.TrimSuffix(name, "*"))) {
+				if result.MessageAttributes == nil {
+					result.MessageAttributes = make(map[string]*sqs.MessageAttributeValue)
+				}
+				result.MessageAttributes[key] = value
+				break
+			}
+		}
+	}
+	if len(result.MessageAttributes) > 0 {
+		result.MD5OfMessageAttributes = aws.String(md5OfMessageAttributes(result.MessageAttributes))
+	}
+	return result
+}
+
+// ReceiveMessage receives up to 10 messages, waiting for them up to
+// `WaitTimeSeconds`.
+func (backend *Backend) ReceiveMessage(input *sqs.ReceiveMessageInput) (*sqs.ReceiveMessageOutput, error) {
+	return backend.ReceiveMessageWithContext(aws.BackgroundContext(), input)
+}
+
+// ReceiveMessageWithContext is the same as ReceiveMessage with a context.
+func (backend *Backend) ReceiveMessageWithContext(ctx aws.Context, input *sqs.ReceiveMessageInput, _ ...request.Option) (*sqs.ReceiveMessageOutput, error) {
+	if err := input.Validate(); err != nil {
+		return nil, err
+	}
+
+	max := int(aws.Int64Value(input.MaxNumberOfMessages))
+	if input.MaxNumberOfMessages == nil {
+		max = 1
+	}
+	if max < 1 || max > maxReceiveMessage {
+		return nil, awserr.New("InvalidParameterValue", fmt.Sprintf("Value %d for parameter MaxNumberOfMessages is invalid. Reason: must be between 1 and %d, if provided.", max, maxReceiveMessage), nil)
+	}
+	if input.WaitTimeSeconds != nil && (*input.WaitTimeSeconds < 0 || *input.WaitTimeSeconds > maxReceiveWait) {
+		return nil, awserr.New("InvalidParameterValue", fmt.Sprintf("Value %d for parameter WaitTimeSeconds is invalid. Reason: Must be >= 0 and <= %d, if provided.", *input.WaitTimeSeconds, maxReceiveWait), nil)
+	}
+	if input.VisibilityTimeout != nil && (*input.VisibilityTimeout < 0 || *input.VisibilityTimeout > 43200) {
+		return nil, awserr.New("InvalidParameterValue", "Value for parameter VisibilityTimeout is invalid. Reason: must be between 0 and 43200.", nil)
+	}
+
+	var deadline time.Time
+	for {
+		backend.m.Lock()
+		q, err := backend.lookup(aws.StringValue(input.QueueUrl))
+		if err != nil {
+			backend.m.Unlock()
+			return nil, err
+		}
+		now := backend.opts.Clock.Now()
+		if deadline.IsZero() {
+			wait := int64(q.intAttribute(sqs.QueueAttributeNameReceiveMessageWaitTimeSeconds, 0))
+			if input.WaitTimeSeconds != nil {
+				wait = *input.WaitTimeSeconds
+			}
+			deadline = now.Add(time.Duration(wait) * time.Second)
+		}
+
+		opts := receiveOptions{
+			max:                   max,
+			visibilityTimeout:     q.visibilityTimeout(),
+			attributeNames:        aws.StringValueSlice(input.AttributeNames),
+			messageAttributeNames: aws.StringValueSlice(input.MessageAttributeNames),
+		}
+		if input.VisibilityTimeout != nil {
+			opts.visibilityTimeout = time.Duration(*input.VisibilityTimeout) * time.Second
+		}
+		messages := backend.receive(q, now, opts)
+		next, hasNext := q.nextVisibleAt(now)
+		changed := backend.changed
+		backend.m.Unlock()
+
+		if len(messages) > 0 || !now.Before(deadline) {
+			return &sqs.ReceiveMessageOutput{
+				Messages: messages,
+			}, nil
+		}
+
+		timeout := deadline.Sub(now)
+		if hasNext && next.Sub(now) < timeout {
+			timeout = next.Sub(now)
+		}
+		select {
+		case <-changed:
+		case <-backend.opts.Clock.After(timeout):
+		case <-ctx.Done():
+			return nil, awserr.New(request.CanceledErrorCode, "request context canceled", ctx.Err())
+		}
+	}
+}
+
+// message finds the message of a queue by a receipt handle. Stale handles,
+// from previous receives, return the message and false. It must be called
+// with the lock held.
+func (backend *Backend) message(q *queue, receiptHandle string) (*message, bool, error) {
+	msg, ok := backend.handles[receiptHandle]
+	if !ok {
+		return nil, false, awserr.New(sqs.ErrCodeReceiptHandleIsInvalid, fmt.Sprintf("The input receipt handle \"%s\" is not a valid receipt handle.", receiptHandle), nil)
+	}
+	for _, m := range q.messages {
+		if m == msg {
+			return msg, msg.receiptHandle == receiptHandle, nil
+		}
+	}
+	return nil, false, awserr.New(sqs.ErrCodeReceiptHandleIsInvalid, fmt.Sprintf("The input receipt handle \"%s\" is not a valid receipt handle.", receiptHandle), nil)
+}
+
+// delete removes a message by its receipt handle. As SQS does, deleting with
+// a stale receipt handle succeeds without removing the message. It must be
+// called with the lock held.
+func (backend *Backend) delete(q *queue, receiptHandle string) error {
+	msg, current, err := backend.message(q, receiptHandle)
+	if err != nil {
+		return err
+	}
+	if current {
+		q.remove(msg)
+		backend.forget(msg)
+	}
+	return nil
+}
+
+// DeleteMessage removes a message from a queue.
+func (backend *Backend) DeleteMessage(input *sqs.DeleteMessageInput) (*sqs.DeleteMessageOutput, error) {
+	return backend.DeleteMessageWithContext(aws.BackgroundContext(), input)
+}
+
+// DeleteMessageWithContext is the same as DeleteMessage with a context.
+func (backend *Backend) DeleteMessageWithContext(ctx aws.Context, input *sqs.DeleteMessageInput, _ ...request.Option) (*sqs.DeleteMessageOutput, error) {
+	if err := input.Validate(); err != nil {
+		return nil, err
+	}
+
+	backend.m.Lock()
+	defer backend.m.Unlock()
+
+	q, err := backend.lookup(aws.StringValue(input.QueueUrl))
+	if err != nil {
+		return nil, err
+	}
+	if err := backend.delete(q, aws.StringValue(input.ReceiptHandle)); err != nil {
+		return nil, err
+	}
+	backend.notify()
+	return &sqs.DeleteMessageOutput{}, nil
+}
+
+// DeleteMessageBatch removes up to 10 messages from a queue.
+func (backend *Backend) DeleteMessageBatch(input *sqs.DeleteMessageBatchInput) (*sqs.DeleteMessageBatchOutput, error) {
+	return backend.DeleteMessageBatchWithContext(aws.BackgroundContext(), input)
+}
+
+// DeleteMessageBatchWithContext is the same as DeleteMessageBatch with a
+// context.
+func (backend *Backend) DeleteMessageBatchWithContext(ctx aws.Context, input *sqs.DeleteMessageBatchInput, _ ...request.Option) (*sqs.DeleteMessageBatchOutput, error) {
+	if err := input.Validate(); err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, len(input.Entries))
+	for i, entry := range input.Entries {
+		ids[i] = aws.StringValue(entry.Id)
+	}
+	if err := validateBatch(ids); err != nil {
+		return nil, err
+	}
+
+	backend.m.Lock()
+	defer backend.m.Unlock()
+
+	q, err := backend.lookup(aws.StringValue(input.QueueUrl))
+	if err != nil {
+		return nil, err
+	}
+
+	output := &sqs.DeleteMessageBatchOutput{
+		Successful: []*sqs.DeleteMessageBatchResultEntry{},
+		Failed:     []*sqs.BatchResultErrorEntry{},
+	}
+	for _, entry := range input.Entries {
+		if err := backend.delete(q, aws.StringValue(entry.ReceiptHandle)); err != nil {
+			output.Failed = append(output.Failed, batchError(aws.StringValue(entry.Id), err))
+			continue
+		}
+		output.Successful = append(output.Successful, &sqs.DeleteMessageBatchResultEntry{
+			Id: entry.Id,
+		})
+	}
+	backend.notify()
+	return output, nil
+}
+
+// changeVisibility changes when an in flight message becomes visible again. It
+// must be called with the lock held.
+func (backend *Backend) changeVisibility(q *queue, now time.Time, receiptHandle string, timeout int64) error {
+	if timeout < 0 || timeout > 43200 {
+		return awserr.New("InvalidParameterValue", "Value for parameter VisibilityTimeout is invalid. Reason: must be between 0 and 43200.", nil)
+	}
+	msg, current, err := backend.message(q, receiptHandle)
+	if err != nil {
+		return err
+	}
+	if !current || !msg.visibleAt.After(now) {
+		return awserr.New(sqs.ErrCodeMessageNotInflight, "The message referred to isn't in flight.", nil)
+	}
+	msg.visibleAt = now.Add(time.Duration(timeout) * time.Second)
+	return nil
+}
+
+// ChangeMessageVisibility changes the visibility timeout of an in flight
+// message.
+func (backend *Backend) ChangeMessageVisibility(input *sqs.ChangeMessageVisibilityInput) (*sqs.ChangeMessageVisibilityOutput, error) {
+	return backend.ChangeMessageVisibilityWithContext(aws.BackgroundContext(), input)
+}
+
+// ChangeMessageVisibilityWithContext is the same as ChangeMessageVisibility
+// with a context.
+func (backend *Backend) ChangeMessageVisibilityWithContext(ctx aws.Context, input *sqs.ChangeMessageVisibilityInput, _ ...request.Option) (*sqs.ChangeMessageVisibilityOutput, error) {
+	if err := input.Validate(); err != nil {
+		return nil, err
+	}
+
+	backend.m.Lock()
+	defer backend.m.Unlock()
+
+	q, err := backend.lookup(aws.StringValue(input.QueueUrl))
+	if err != nil {
+		return nil, err
+	}
+	if err := backend.changeVisibility(q, backend.opts.Clock.Now(), aws.StringValue(input.ReceiptHandle), aws.Int64Value(input.VisibilityTimeout)); err != nil {
+		return nil, err
+	}
+	backend.notify()
+	return &sqs.ChangeMessageVisibilityOutput{}, nil
+}
+
+// ChangeMessageVisibilityBatch changes the visibility timeout of up to 10 in
+// flight messages.
+func (backend *Backend) ChangeMessageVisibilityBatch(input *sqs.ChangeMessageVisibilityBatchInput) (*sqs.ChangeMessageVisibilityBatchOutput, error) {
+	return backend.ChangeMessageVisibilityBatchWithContext(aws.BackgroundContext(), input)
+}
+
+// ChangeMessageVisibilityBatchWithContext is the same as
+// ChangeMessageVisibilityBatch with a context.
+func (backend *Backend) ChangeMessageVisibilityBatchWithContext(ctx aws.Context, input *sqs.ChangeMessageVisibilityBatchInput, _ ...request.Option) (*sqs.ChangeMessageVisibilityBatchOutput, error) {
+	if err := input.Validate(); err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, len(input.Entries))
+	for i, entry := range input.Entries {
+		ids[i] = aws.StringValue(entry.Id)
+	}
+	if err := validateBatch(ids); err != nil {
+		return nil, err
+	}
+
+	backend.m.Lock()
+	defer backend.m.Unlock()
+
+	q, err := backend.lookup(aws.StringValue(input.QueueUrl))
+	if err != nil {
+		return nil, err
+	}
+
+	now := backend.opts.Clock.Now()
+	output := &sqs.ChangeMessageVisibilityBatchOutput{
+		Successful: []*sqs.ChangeMessageVisibilityBatchResultEntry{},
+		Failed:     []*sqs.BatchResultErrorEntry{},
+	}
+	for _, entry := range input.Entries {
+		if err := backend.changeVisibility(q, now, aws.StringValue(entry.ReceiptHandle), aws.Int64Value(entry.VisibilityTimeout)); err != nil {
+			output.Failed = append(output.Failed, batchError(aws.StringValue(entry.Id), err))
+			continue
+		}
+		output.Successful = append(output.Successful, &sqs.ChangeMessageVisibilityBatchResultEntry{
+			Id: entry.Id,
+		})
+	}
+	backend.notify()
+	return output, nil
+}
@@ -0,0 +1,304 @@
+package sqsmem
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Messages", func() {
+	var (
+		clock    *ManualClock
+		backend  *Backend
+		queueURL string
+	)
+
+	BeforeEach(func() {
+		clock = NewManualClock(time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC))
+		backend = New(&Options{
+			Clock: clock,
+		})
+		output, err := backend.CreateQueue(&sqs.CreateQueueInput{
+			QueueName: aws.String("queue-test"),
+		})
+		Expect(err).ToNot(HaveOccurred())
+		queueURL = aws.StringValue(output.QueueUrl)
+	})
+
+	send := func(body string) string {
+		output, err := backend.SendMessage(&sqs.SendMessageInput{
+			QueueUrl:    aws.String(queueURL),
+			MessageBody: aws.String(body),
+		})
+		Expect(err).ToNot(HaveOccurred())
+		return aws.StringValue(output.MessageId)
+	}
+
+	receive := func(input *sqs.ReceiveMessageInput) []*sqs.Message {
+		input.QueueUrl = aws.String(queueURL)
+		output, err := backend.ReceiveMessage(input)
+		Expect(err).ToNot(HaveOccurred())
+		return output.Messages
+	}
+
+	It("should send and receive messages", func() {
+		output, err := backend.SendMessage(&sqs.SendMessageInput{
+			QueueUrl:    aws.String(queueURL),
+			MessageBody: aws.String("message"),
+			MessageAttributes: map[string]*sqs.MessageAttributeValue{
+				"type": {DataType: aws.String("String"), StringValue: aws.String("welcome")},
+			},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(aws.StringValue(output.MD5OfMessageBody)).To(Equal("78e731027d8fd50ed642340b7c9a63b3"))
+
+		messages := receive(&sqs.ReceiveMessageInput{
+			AttributeNames:        aws.StringSlice([]string{"All"}),
+			MessageAttributeNames: aws.StringSlice([]string{"All"}),
+		})
+		Expect(messages).To(HaveLen(1))
+		Expect(aws.StringValue(messages[0].MessageId)).To(Equal(aws.StringValue(output.MessageId)))
+		Expect(aws.StringValue(messages[0].Body)).To(Equal("message"))
+		Expect(aws.StringValue(messages[0].MD5OfMessageAttributes)).To(Equal(aws.StringValue(output.MD5OfMessageAttributes)))
+		Expect(aws.StringValue(messages[0].MessageAttributes["type"].StringValue)).To(Equal("welcome"))
+		Expect(aws.StringValue(messages[0].Attributes["ApproximateReceiveCount"])).To(Equal("1"))
+	})
+
+	It("should send messages in batch", func() {
+		output, err := backend.SendMessageBatch(&sqs.SendMessageBatchInput{
+			QueueUrl: aws.String(queueURL),
+			Entries: []*sqs.SendMessageBatchRequestEntry{
+				{Id: aws.String("1"), MessageBody: aws.String("message 1")},
+				{Id: aws.String("2"), MessageBody: aws.String("message 2"), DelaySeconds: aws.Int64(1000)},
+			},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(output.Successful).To(HaveLen(1))
+		Expect(output.Failed).To(HaveLen(1))
+		Expect(aws.StringValue(output.Failed[0].Id)).To(Equal("2"))
+	})
+
+	It("should fail batches with too many entries", func() {
+		var entries []*sqs.SendMessageBatchRequestEntry
+		for i := 0; i < 11; i++ {
+			entries = append(entries, &sqs.SendMessageBatchRequestEntry{
+				Id:          aws.String(fmt.Sprint(i)),
+				MessageBody: aws.String("message"),
+			})
+		}
+		_, err := backend.SendMessageBatch(&sqs.SendMessageBatchInput{
+			QueueUrl: aws.String(queueURL),
+			Entries:  entries,
+		})
+		Expect(errorCode(err)).To(Equal(sqs.ErrCodeTooManyEntriesInBatchRequest))
+	})
+
+	It("should hide the messages received until their visibility timeout expires", func() {
+		send("message")
+		Expect(receive(&sqs.ReceiveMessageInput{VisibilityTimeout: aws.Int64(10)})).To(HaveLen(1))
+		Expect(receive(&sqs.ReceiveMessageInput{})).To(BeEmpty())
+
+		clock.Advance(9 * time.Second)
+		Expect(receive(&sqs.ReceiveMessageInput{})).To(BeEmpty())
+
+		clock.Advance(time.Second)
+		messages := receive(&sqs.ReceiveMessageInput{AttributeNames: aws.StringSlice([]string{"ApproximateReceiveCount"})})
+		Expect(messages).To(HaveLen(1))
+		Expect(aws.StringValue(messages[0].Attributes["ApproximateReceiveCount"])).To(Equal("2"))
+	})
+
+	It("should delay the messages", func() {
+		_, err := backend.SendMessage(&sqs.SendMessageInput{
+			QueueUrl:     aws.String(queueURL),
+			MessageBody:  aws.String("message"),
+			DelaySeconds: aws.Int64(5),
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(receive(&sqs.ReceiveMessageInput{})).To(BeEmpty())
+
+		clock.Advance(5 * time.Second)
+		Expect(receive(&sqs.ReceiveMessageInput{})).To(HaveLen(1))
+	})
+
+	It("should delete the messages", func() {
+		send("message")
+		messages := receive(&sqs.ReceiveMessageInput{})
+		Expect(messages).To(HaveLen(1))
+
+		_, err := backend.DeleteMessage(&sqs.DeleteMessageInput{
+			QueueUrl:      aws.String(queueURL),
+			ReceiptHandle: messages[0].ReceiptHandle,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(backend.Messages(queueURL)).To(BeEmpty())
+
+		_, err = backend.DeleteMessage(&sqs.DeleteMessageInput{
+			QueueUrl:      aws.String(queueURL),
+			ReceiptHandle: aws.String("invalid"),
+		})
+		Expect(errorCode(err)).To(Equal(sqs.ErrCodeReceiptHandleIsInvalid))
+	})
+
+	It("should not delete the messages with a stale receipt handle", func() {
+		send("message")
+		stale := receive(&sqs.ReceiveMessageInput{VisibilityTimeout: aws.Int64(1)})
+		clock.Advance(time.Second)
+		Expect(receive(&sqs.ReceiveMessageInput{})).To(HaveLen(1))
+
+		_, err := backend.DeleteMessage(&sqs.DeleteMessageInput{
+			QueueUrl:      aws.String(queueURL),
+			ReceiptHandle: stale[0].ReceiptHandle,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(backend.Messages(queueURL)).To(HaveLen(1))
+	})
+
+	It("should delete the messages in batch", func() {
+		send("message 1")
+		send("message 2")
+		messages := receive(&sqs.ReceiveMessageInput{MaxNumberOfMessages: aws.Int64(10)})
+		Expect(messages).To(HaveLen(2))
+
+		output, err := backend.DeleteMessageBatch(&sqs.DeleteMessageBatchInput{
+			QueueUrl: aws.String(queueURL),
+			Entries: []*sqs.DeleteMessageBatchRequestEntry{
+				{Id: aws.String("1"), ReceiptHandle: messages[0].ReceiptHandle},
+				{Id: aws.String("2"), ReceiptHandle: messages[1].ReceiptHandle},
+				{Id: aws.String("3"), ReceiptHandle: aws.String("invalid")},
+			},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(output.Successful).To(HaveLen(2))
+		Expect(output.Failed).To(HaveLen(1))
+		Expect(backend.Messages(queueURL)).To(BeEmpty())
+	})
+
+	It("should change the visibility of the messages", func() {
+		send("message")
+		messages := receive(&sqs.ReceiveMessageInput{VisibilityTimeout: aws.Int64(30)})
+
+		_, err := backend.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
+			QueueUrl:          aws.String(queueURL),
+			ReceiptHandle:     messages[0].ReceiptHandle,
+			VisibilityTimeout: aws.Int64(0),
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(receive(&sqs.ReceiveMessageInput{})).To(HaveLen(1))
+	})
+
+	It("should fail changing the visibility of messages not in flight", func() {
+		send("message")
+		messages := receive(&sqs.ReceiveMessageInput{VisibilityTimeout: aws.Int64(1)})
+		clock.Advance(time.Second)
+
+		output, err := backend.ChangeMessageVisibilityBatch(&sqs.ChangeMessageVisibilityBatchInput{
+			QueueUrl: aws.String(queueURL),
+			Entries: []*sqs.ChangeMessageVisibilityBatchRequestEntry{
+				{Id: aws.String("1"), ReceiptHandle: messages[0].ReceiptHandle, VisibilityTimeout: aws.Int64(10)},
+			},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(output.Failed).To(HaveLen(1))
+		Expect(aws.StringValue(output.Failed[0].Code)).To(Equal(sqs.ErrCodeMessageNotInflight))
+	})
+
+	It("should move the messages to the dead letter queue", func() {
+		_, err := backend.CreateQueue(&sqs.CreateQueueInput{
+			QueueName: aws.String("queue-dlq"),
+		})
+		Expect(err).ToNot(HaveOccurred())
+		_, err = backend.SetQueueAttributes(&sqs.SetQueueAttributesInput{
+			QueueUrl: aws.String(queueURL),
+			Attributes: aws.StringMap(map[string]string{
+				"RedrivePolicy": `{"deadLetterTargetArn":"` + backend.QueueARN("queue-dlq") + `","maxReceiveCount":2}`,
+			}),
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		send("message")
+		for i := 0; i < 2; i++ {
+			Expect(receive(&sqs.ReceiveMessageInput{VisibilityTimeout: aws.Int64(1)})).To(HaveLen(1))
+			clock.Advance(time.Second)
+		}
+		Expect(receive(&sqs.ReceiveMessageInput{})).To(BeEmpty())
+
+		messages, err := backend.Messages("queue-dlq")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(messages).To(HaveLen(1))
+		Expect(messages[0].Body).To(Equal("message"))
+		Expect(messages[0].ReceiveCount).To(Equal(0))
+	})
+
+	It("should drop the messages after the retention period", func() {
+		_, err := backend.SetQueueAttributes(&sqs.SetQueueAttributesInput{
+			QueueUrl:   aws.String(queueURL),
+			Attributes: aws.StringMap(map[string]string{"MessageRetentionPeriod": "60"}),
+		})
+		Expect(err).ToNot(HaveOccurred())
+		send("message")
+
+		clock.Advance(time.Minute)
+		Expect(receive(&sqs.ReceiveMessageInput{})).To(BeEmpty())
+	})
+
+	Context("long polling", func() {
+		It("should wait for the messages sent", func() {
+			received := make(chan []*sqs.Message, 1)
+			go func() {
+				defer GinkgoRecover()
+				received <- receive(&sqs.ReceiveMessageInput{WaitTimeSeconds: aws.Int64(20)})
+			}()
+
+			Consistently(received, 50*time.Millisecond).ShouldNot(Receive())
+			send("message")
+			Eventually(received).Should(Receive(HaveLen(1)))
+		})
+
+		It("should wait for the messages to become visible", func() {
+			send("message")
+			Expect(receive(&sqs.ReceiveMessageInput{VisibilityTimeout: aws.Int64(5)})).To(HaveLen(1))
+
+			received := make(chan []*sqs.Message, 1)
+			go func() {
+				defer GinkgoRecover()
+				received <- receive(&sqs.ReceiveMessageInput{WaitTimeSeconds: aws.Int64(20)})
+			}()
+
+			Consistently(received, 50*time.Millisecond).ShouldNot(Receive())
+			clock.Advance(5 * time.Second)
+			Eventually(received).Should(Receive(HaveLen(1)))
+		})
+
+		It("should return empty when the wait time is over", func() {
+			received := make(chan []*sqs.Message, 1)
+			go func() {
+				defer GinkgoRecover()
+				received <- receive(&sqs.ReceiveMessageInput{WaitTimeSeconds: aws.Int64(20)})
+			}()
+
+			Consistently(received, 50*time.Millisecond).ShouldNot(Receive())
+			clock.Advance(20 * time.Second)
+			Eventually(received).Should(Receive(BeEmpty()))
+		})
+
+		It("should stop waiting when the context is canceled", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			errs := make(chan error, 1)
+			go func() {
+				_, err := backend.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+					QueueUrl:        aws.String(queueURL),
+					WaitTimeSeconds: aws.Int64(20),
+				})
+				errs <- err
+			}()
+
+			cancel()
+			Eventually(errs).Should(Receive(HaveOccurred()))
+		})
+	})
+})
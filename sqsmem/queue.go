@@ -0,0 +1,342 @@
+package sqsmem
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+const (
+	defaultVisibilityTimeout      = 30
+	defaultMessageRetentionPeriod = 345600
+	defaultMaximumMessageSize     = 262144
+
+	// deduplicationInterval is the window in which FIFO queues discard
+	// messages with a repeated deduplication ID.
+	deduplicationInterval = 5 * time.Minute
+)
+
+type attributeRange struct {
+	min, max int
+}
+
+// settableAttributes are the attributes accepted by CreateQueue and
+// SetQueueAttributes. Numeric ones have their valid range.
+var settableAttributes = map[string]*attributeRange{
+	sqs.QueueAttributeNameVisibilityTimeout:             {0, 43200},
+	sqs.QueueAttributeNameMaximumMessageSize:            {1024, 262144},
+	sqs.QueueAttributeNameMessageRetentionPeriod:        {60, 1209600},
+	sqs.QueueAttributeNameDelaySeconds:                  {0, 900},
+	sqs.QueueAttributeNameReceiveMessageWaitTimeSeconds: {0, 20},
+	sqs.QueueAttributeNameKmsDataKeyReusePeriodSeconds:  {60, 86400},
+	sqs.QueueAttributeNamePolicy:                        nil,
+	sqs.QueueAttributeNameRedrivePolicy:                 nil,
+	sqs.QueueAttributeNameFifoQueue:                     nil,
+	sqs.QueueAttributeNameContentBasedDeduplication:     nil,
+	sqs.QueueAttributeNameKmsMasterKeyId:                nil,
+}
+
+// computedAttributes are the read only attributes of a queue.
+var computedAttributes = map[string]bool{
+	sqs.QueueAttributeNameApproximateNumberOfMessages:           true,
+	sqs.QueueAttributeNameApproximateNumberOfMessagesNotVisible: true,
+	sqs.QueueAttributeNameApproximateNumberOfMessagesDelayed:    true,
+	sqs.QueueAttributeNameCreatedTimestamp:                      true,
+	sqs.QueueAttributeNameLastModifiedTimestamp:                 true,
+	sqs.QueueAttributeNameQueueArn:                              true,
+}
+
+func isQueueAttribute(name string) bool {
+	_, ok := settableAttributes[name]
+	return ok || computedAttributes[name]
+}
+
+func invalidAttributeValue(name string) error {
+	return awserr.New("InvalidAttributeValue", fmt.Sprintf("Invalid value for the parameter %s.", name), nil)
+}
+
+func validateQueueName(name string, attributes map[string]string) error {
+	fifo := attributes[sqs.QueueAttributeNameFifoQueue] == "true"
+	base := strings.TrimSuffix(name, ".fifo")
+	if len(name) > 80 || base == "" || strings.TrimFunc(base, func(r rune) bool {
+		return r == '-' || r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9')
+	}) != "" {
+		return awserr.New("InvalidParameterValue", "Can only include alphanumeric characters, hyphens, or underscores. 1 to 80 in length", nil)
+	}
+	if fifo != strings.HasSuffix(name, ".fifo") {
+		return awserr.New("InvalidParameterValue", "The name of a FIFO queue can only include alphanumeric characters, hyphens, or underscores, must end with .fifo suffix", nil)
+	}
+	return nil
+}
+
+func validateQueueAttributes(attributes map[string]string) error {
+	for name, value := range attributes {
+		r, ok := settableAttributes[name]
+		if !ok {
+			return awserr.New(sqs.ErrCodeInvalidAttributeName, fmt.Sprintf("Unknown Attribute %s.", name), nil)
+		}
+		switch name {
+		case sqs.QueueAttributeNameFifoQueue, sqs.QueueAttributeNameContentBasedDeduplication:
+			if value != "true" && value != "false" {
+				return invalidAttributeValue(name)
+			}
+		case sqs.QueueAttributeNameRedrivePolicy:
+			if value == "" {
+				continue
+			}
+			if _, err := parseRedrivePolicy(value); err != nil {
+				return invalidAttributeValue(name)
+			}
+		}
+		if r != nil {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < r.min || n > r.max {
+				return invalidAttributeValue(name)
+			}
+		}
+	}
+	return nil
+}
+
+type redrivePolicy struct {
+	DeadLetterTargetArn string
+	MaxReceiveCount     int
+}
+
+// parseRedrivePolicy parses the JSON of a redrive policy. The
+// `maxReceiveCount` is accepted both as a number and as a string, as SQS does.
+func parseRedrivePolicy(value string) (redrivePolicy, error) {
+	var raw struct {
+		DeadLetterTargetArn string      `json:"deadLetterTargetArn"`
+		MaxReceiveCount     json.Number `json:"maxReceiveCount"`
+	}
+	var policy redrivePolicy
+	if err := json.Unmarshal([]byte(value), &raw); err != nil {
+		return policy, err
+	}
+	count, err := strconv.Atoi(raw.MaxReceiveCount.String())
+	if err != nil {
+		return policy, err
+	}
+	if raw.DeadLetterTargetArn == "" || count < 1 || count > 1000 {
+		return policy, fmt.Errorf("invalid redrive policy: %s", value)
+	}
+	policy.DeadLetterTargetArn = raw.DeadLetterTargetArn
+	policy.MaxReceiveCount = count
+	return policy, nil
+}
+
+type message struct {
+	id              string
+	body            string
+	attributes      map[string]*sqs.MessageAttributeValue
+	md5OfBody       string
+	md5OfAttributes string
+	groupID         string
+	deduplicationID string
+	sequenceNumber  string
+	sentAt          time.Time
+	visibleAt       time.Time
+	firstReceivedAt time.Time
+	receiveCount    int
+	receiptHandle   string
+	handles         []string
+}
+
+type deduplication struct {
+	messageID      string
+	sequenceNumber string
+	expiresAt      time.Time
+}
+
+type queue struct {
+	name       string
+	url        string
+	arn        string
+	attributes map[string]string
+	tags       map[string]string
+	created    time.Time
+	modified   time.Time
+	messages   []*message
+	sequence   uint64
+	dedup      map[string]deduplication
+}
+
+func newQueue(name, url, arn string, now time.Time) *queue {
+	return &queue{
+		name:       name,
+		url:        url,
+		arn:        arn,
+		attributes: make(map[string]string),
+		tags:       make(map[string]string),
+		created:    now,
+		modified:   now,
+		dedup:      make(map[string]deduplication),
+	}
+}
+
+func (q *queue) intAttribute(name string, def int) int {
+	if value, ok := q.attributes[name]; ok {
+		if n, err := strconv.Atoi(value); err == nil {
+			return n
+		}
+	}
+	return def
+}
+
+func (q *queue) fifo() bool {
+	return q.attributes[sqs.QueueAttributeNameFifoQueue] == "true"
+}
+
+func (q *queue) visibilityTimeout() time.Duration {
+	return time.Duration(q.intAttribute(sqs.QueueAttributeNameVisibilityTimeout, defaultVisibilityTimeout)) * time.Second
+}
+
+func (q *queue) redrivePolicy() (redrivePolicy, bool) {
+	value, ok := q.attributes[sqs.QueueAttributeNameRedrivePolicy]
+	if !ok {
+		return redrivePolicy{}, false
+	}
+	policy, err := parseRedrivePolicy(value)
+	return policy, err == nil
+}
+
+// expire drops the messages older than the retention period and the expired
+// deduplication IDs.
+func (q *queue) expire(now time.Time) {
+	retention := time.Duration(q.intAttribute(sqs.QueueAttributeNameMessageRetentionPeriod, defaultMessageRetentionPeriod)) * time.Second
+	messages := q.messages[:0]
+	for _, msg := range q.messages {
+		if now.Sub(msg.sentAt) < retention {
+			messages = append(messages, msg)
+		}
+	}
+	for i := len(messages); i < len(q.messages); i++ {
+		q.messages[i] = nil
+	}
+	q.messages = messages
+
+	for id, d := range q.dedup {
+		if !now.Before(d.expiresAt) {
+			delete(q.dedup, id)
+		}
+	}
+}
+
+func (q *queue) allAttributes(now time.Time) map[string]string {
+	q.expire(now)
+
+	attributes := map[string]string{
+		sqs.QueueAttributeNameVisibilityTimeout:             strconv.Itoa(defaultVisibilityTimeout),
+		sqs.QueueAttributeNameMaximumMessageSize:            strconv.Itoa(defaultMaximumMessageSize),
+		sqs.QueueAttributeNameMessageRetentionPeriod:        strconv.Itoa(defaultMessageRetentionPeriod),
+		sqs.QueueAttributeNameDelaySeconds:                  "0",
+		sqs.QueueAttributeNameReceiveMessageWaitTimeSeconds: "0",
+		sqs.QueueAttributeNameCreatedTimestamp:              strconv.FormatInt(q.created.Unix(), 10),
+		sqs.QueueAttributeNameLastModifiedTimestamp:         strconv.FormatInt(q.modified.Unix(), 10),
+		sqs.QueueAttributeNameQueueArn:                      q.arn,
+	}
+	for key, value := range q.attributes {
+		attributes[key] = value
+	}
+
+	var visible, inFlight, delayed int
+	for _, msg := range q.messages {
+		switch {
+		case !msg.visibleAt.After(now):
+			visible++
+		case msg.receiveCount > 0:
+			inFlight++
+		default:
+			delayed++
+		}
+	}
+	attributes[sqs.QueueAttributeNameApproximateNumberOfMessages] = strconv.Itoa(visible)
+	attributes[sqs.QueueAttributeNameApproximateNumberOfMessagesNotVisible] = strconv.Itoa(inFlight)
+	attributes[sqs.QueueAttributeNameApproximateNumberOfMessagesDelayed] = strconv.Itoa(delayed)
+	return attributes
+}
+
+// remove takes a message out of the queue.
+func (q *queue) remove(target *message) {
+	for i, msg := range q.messages {
+		if msg == target {
+			copy(q.messages[i:], q.messages[i+1:])
+			q.messages[len(q.messages)-1] = nil
+			q.messages = q.messages[:len(q.messages)-1]
+			return
+		}
+	}
+}
+
+// nextVisibleAt returns the earliest moment, after now, when a message of the
+// queue becomes visible.
+func (q *queue) nextVisibleAt(now time.Time) (time.Time, bool) {
+	var next time.Time
+	found := false
+	for _, msg := range q.messages {
+		if msg.visibleAt.After(now) && (!found || msg.visibleAt.Before(next)) {
+			next = msg.visibleAt
+			found = true
+		}
+	}
+	return next, found
+}
+
+func md5Hex(data []byte) string {
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// md5OfMessageAttributes computes the digest of the message attributes as
+// described in the SQS documentation.
+func md5OfMessageAttributes(attributes map[string]*sqs.MessageAttributeValue) string {
+	if len(attributes) == 0 {
+		return ""
+	}
+
+	names := make([]string, 0, len(attributes))
+	for name := range attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf []byte
+	appendBytes := func(b []byte) {
+		var size [4]byte
+		binary.BigEndian.PutUint32(size[:], uint32(len(b)))
+		buf = append(buf, size[:]...)
+		buf = append(buf, b...)
+	}
+	for _, name := range names {
+		value := attributes[name]
+		appendBytes([]byte(name))
+		appendBytes([]byte(aws.StringValue(value.DataType)))
+		if value.StringValue != nil {
+			buf = append(buf, 1)
+			appendBytes([]byte(*value.StringValue))
+		} else {
+			buf = append(buf, 2)
+			appendBytes(value.BinaryValue)
+		}
+	}
+	return md5Hex(buf)
+}
+
+func messageAttributesSize(attributes map[string]*sqs.MessageAttributeValue) int {
+	size := 0
+	for name, value := range attributes {
+		size += len(name) + len(aws.StringValue(value.DataType)) + len(aws.StringValue(value.StringValue)) + len(value.BinaryValue)
+	}
+	return size
+}
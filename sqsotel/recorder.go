@@ -0,0 +1,287 @@
+// Package sqsotel provides a `sqssrv.Recorder` that exports the metrics of the
+// SQSService using OpenTelemetry.
+//
+// It lives in its own module so the main package does not depend on the
+// OpenTelemetry SDK, which requires a newer Go version.
+package sqsotel
+
+import (
+	"context"
+	"strings"
+
+	sqssrv "github.com/lab259/go-rscsrv-sqs"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// InstrumentationName is the name of the meter used by the Recorder.
+const InstrumentationName = "github.com/lab259/go-rscsrv-sqs/sqsotel"
+
+// Opts configures a Recorder.
+type Opts struct {
+	// MeterProvider creates the meter of the instruments. Default: the global
+	// provider.
+	MeterProvider metric.MeterProvider
+	// Prefix is prepended, followed by a ".", to the name of the instruments.
+	Prefix string
+	// QueueLabel defines if the queues are identified by their URL or name.
+	// Default: sqssrv.QueueLabelURL.
+	QueueLabel sqssrv.QueueLabel
+	// Attributes are added to all the measurements. Useful for attributes like
+	// "service" or "environment".
+	Attributes []attribute.KeyValue
+}
+
+// Recorder is a `sqssrv.Recorder` that records the metrics as OpenTelemetry
+// instruments. The instruments have the same names of the
+// `sqssrv.SQSServiceCollector`, with "." separating the subsystem, and the
+// same attributes as its labels. The durations are histograms, in seconds.
+type Recorder struct {
+	calls         metric.Int64Counter
+	duration      metric.Float64Histogram
+	success       metric.Int64Counter
+	failures      metric.Int64Counter
+	trafficAmount metric.Int64Counter
+	trafficSize   metric.Int64Counter
+	emptyReceives metric.Int64Counter
+	requestUnits  metric.Int64Counter
+	faults        metric.Int64Counter
+
+	handlerDuration   metric.Float64Histogram
+	handlerOutcomes   metric.Int64Counter
+	handlerDeadLetter metric.Int64Counter
+	handlerInFlight   metric.Int64UpDownCounter
+	workers           metric.Int64Gauge
+	workerUtilization metric.Float64Gauge
+
+	serviceRunning            metric.Int64Gauge
+	serviceActions            metric.Int64Counter
+	serviceValidationDuration metric.Float64Histogram
+	queueAttributeDrift       metric.Int64Gauge
+	queueDriftCheckFailures   metric.Int64Counter
+
+	queueLabel sqssrv.QueueLabel
+	attributes []attribute.KeyValue
+}
+
+// NewRecorder creates the instruments of a Recorder.
+func NewRecorder(opts *Opts) (*Recorder, error) {
+	provider := opts.MeterProvider
+	if provider == nil {
+		provider = otel.GetMeterProvider()
+	}
+	prefix := opts.Prefix
+	if prefix != "" && !strings.HasSuffix(prefix, ".") {
+		prefix += "."
+	}
+	recorder := &Recorder{
+		queueLabel: opts.QueueLabel,
+		attributes: opts.Attributes,
+	}
+	if recorder.queueLabel == "" {
+		recorder.queueLabel = sqssrv.QueueLabelURL
+	}
+
+	meter := provider.Meter(InstrumentationName)
+	var err error
+	if recorder.calls, err = meter.Int64Counter(prefix+"sqs.message.calls",
+		metric.WithDescription("The total number of method called")); err != nil {
+		return nil, err
+	}
+	if recorder.duration, err = meter.Float64Histogram(prefix+"sqs.message.duration",
+		metric.WithDescription("The duration of method called"),
+		metric.WithUnit("s")); err != nil {
+		return nil, err
+	}
+	if recorder.success, err = meter.Int64Counter(prefix+"sqs.message.success",
+		metric.WithDescription("The number of methods executed with success")); err != nil {
+		return nil, err
+	}
+	if recorder.failures, err = meter.Int64Counter(prefix+"sqs.message.failures",
+		metric.WithDescription("The number of methods executed with failures")); err != nil {
+		return nil, err
+	}
+	if recorder.trafficAmount, err = meter.Int64Counter(prefix+"sqs.message.traffic_amount",
+		metric.WithDescription("The total number of messages trafficked")); err != nil {
+		return nil, err
+	}
+	if recorder.trafficSize, err = meter.Int64Counter(prefix+"sqs.message.traffic_size",
+		metric.WithDescription("The total size (number of characters) of messages trafficked")); err != nil {
+		return nil, err
+	}
+	if recorder.emptyReceives, err = meter.Int64Counter(prefix+"sqs.message.empty_receives",
+		metric.WithDescription("The number of receives that returned no messages")); err != nil {
+		return nil, err
+	}
+	if recorder.requestUnits, err = meter.Int64Counter(prefix+"sqs.message.request_units",
+		metric.WithDescription("The number of billable requests (64 KB chunks of payload) of methods called")); err != nil {
+		return nil, err
+	}
+	if recorder.faults, err = meter.Int64Counter(prefix+"sqs.message.injected_faults",
+		metric.WithDescription("The number of methods called with a fault injected, by fault")); err != nil {
+		return nil, err
+	}
+	if recorder.handlerDuration, err = meter.Float64Histogram(prefix+"sqs.consumer.handler_duration",
+		metric.WithDescription("The duration of the handling of messages by consumers"),
+		metric.WithUnit("s")); err != nil {
+		return nil, err
+	}
+	if recorder.handlerOutcomes, err = meter.Int64Counter(prefix+"sqs.consumer.messages_handled",
+		metric.WithDescription("The number of messages handled by consumers, by outcome")); err != nil {
+		return nil, err
+	}
+	if recorder.handlerDeadLetter, err = meter.Int64Counter(prefix+"sqs.consumer.messages_dead_lettered",
+		metric.WithDescription("The number of messages moved to the dead letter queue by consumers, by reason")); err != nil {
+		return nil, err
+	}
+	if recorder.handlerInFlight, err = meter.Int64UpDownCounter(prefix+"sqs.consumer.messages_in_flight",
+		metric.WithDescription("The number of messages being handled by consumers")); err != nil {
+		return nil, err
+	}
+	if recorder.workers, err = meter.Int64Gauge(prefix+"sqs.consumer.workers",
+		metric.WithDescription("The number of workers of consumers")); err != nil {
+		return nil, err
+	}
+	if recorder.workerUtilization, err = meter.Float64Gauge(prefix+"sqs.consumer.worker_utilization",
+		metric.WithDescription("The ratio of busy workers of consumers")); err != nil {
+		return nil, err
+	}
+	if recorder.serviceRunning, err = meter.Int64Gauge(prefix+"sqs.service.running",
+		metric.WithDescription("If the service is running (1) or not (0)")); err != nil {
+		return nil, err
+	}
+	if recorder.serviceActions, err = meter.Int64Counter(prefix+"sqs.service.actions",
+		metric.WithDescription("The number of starts, stops and restarts of the service, by outcome")); err != nil {
+		return nil, err
+	}
+	if recorder.serviceValidationDuration, err = meter.Float64Histogram(prefix+"sqs.service.queue_validation_duration",
+		metric.WithDescription("The duration of the validation of the queue when starting the service"),
+		metric.WithUnit("s")); err != nil {
+		return nil, err
+	}
+	if recorder.queueAttributeDrift, err = meter.Int64Gauge(prefix+"sqs.queue.attribute_drift",
+		metric.WithDescription("If the attribute of the queue differs (1) or not (0) from the configuration")); err != nil {
+		return nil, err
+	}
+	if recorder.queueDriftCheckFailures, err = meter.Int64Counter(prefix+"sqs.queue.drift_check_failures",
+		metric.WithDescription("The number of checks of the attributes of the queue that could not read them")); err != nil {
+		return nil, err
+	}
+	return recorder, nil
+}
+
+func (recorder *Recorder) attributeSet(attributes ...attribute.KeyValue) metric.MeasurementOption {
+	return metric.WithAttributeSet(attribute.NewSet(append(attributes, recorder.attributes...)...))
+}
+
+func (recorder *Recorder) operationAttributes(op sqssrv.Operation, attributes ...attribute.KeyValue) metric.MeasurementOption {
+	return recorder.attributeSet(append([]attribute.KeyValue{
+		attribute.String("queue", recorder.queueLabel.Value(op.Queue)),
+		attribute.String("method", op.Method),
+	}, attributes...)...)
+}
+
+func (recorder *Recorder) handlingAttributes(handling sqssrv.Handling, attributes ...attribute.KeyValue) metric.MeasurementOption {
+	return recorder.attributeSet(append([]attribute.KeyValue{
+		attribute.String("queue", recorder.queueLabel.Value(handling.Queue)),
+		attribute.String("type", handling.MessageType),
+	}, attributes...)...)
+}
+
+// Called implements `sqssrv.Recorder`.
+func (recorder *Recorder) Called(op sqssrv.Operation) {
+	recorder.calls.Add(context.Background(), 1, recorder.operationAttributes(op))
+}
+
+// Finished implements `sqssrv.Recorder`.
+func (recorder *Recorder) Finished(op sqssrv.Operation, result sqssrv.OperationResult) {
+	ctx := context.Background()
+	attributes := recorder.operationAttributes(op)
+	recorder.duration.Record(ctx, result.Duration.Seconds(), attributes)
+	if result.Err != nil {
+		recorder.failures.Add(ctx, 1, attributes)
+	} else {
+		recorder.success.Add(ctx, 1, attributes)
+	}
+	recorder.trafficAmount.Add(ctx, int64(result.Messages), attributes)
+	if result.Size > 0 {
+		recorder.trafficSize.Add(ctx, int64(result.Size), attributes)
+	}
+	if result.RequestUnits > 0 {
+		recorder.requestUnits.Add(ctx, int64(result.RequestUnits), attributes)
+	}
+	if result.IsEmptyReceive(op) {
+		recorder.emptyReceives.Add(ctx, 1, attributes)
+	}
+	if result.Fault != "" {
+		recorder.faults.Add(ctx, 1, recorder.operationAttributes(op, attribute.String("fault", result.Fault)))
+	}
+}
+
+// HandlerStarted implements `sqssrv.Recorder`.
+func (recorder *Recorder) HandlerStarted(handling sqssrv.Handling) {
+	recorder.handlerInFlight.Add(context.Background(), 1, recorder.handlingAttributes(handling))
+}
+
+// HandlerFinished implements `sqssrv.Recorder`.
+func (recorder *Recorder) HandlerFinished(handling sqssrv.Handling, result sqssrv.HandlerResult) {
+	ctx := context.Background()
+	attributes := recorder.handlingAttributes(handling)
+	recorder.handlerInFlight.Add(ctx, -1, attributes)
+	recorder.handlerDuration.Record(ctx, result.Duration.Seconds(), attributes)
+	recorder.handlerOutcomes.Add(ctx, 1, recorder.handlingAttributes(handling, attribute.String("outcome", string(result.Outcome))))
+	if result.Outcome == sqssrv.HandlerOutcomeDeadLettered {
+		recorder.handlerDeadLetter.Add(ctx, 1, recorder.handlingAttributes(handling, attribute.String("reason", string(result.DeadLetterReason))))
+	}
+}
+
+// WorkersUsed implements `sqssrv.Recorder`.
+func (recorder *Recorder) WorkersUsed(queue string, busy, workers int) {
+	ctx := context.Background()
+	attributes := recorder.attributeSet(attribute.String("queue", recorder.queueLabel.Value(queue)))
+	recorder.workers.Record(ctx, int64(workers), attributes)
+	if workers > 0 {
+		recorder.workerUtilization.Record(ctx, float64(busy)/float64(workers), attributes)
+	}
+}
+
+// Lifecycle implements `sqssrv.Recorder`.
+func (recorder *Recorder) Lifecycle(event sqssrv.LifecycleEvent) {
+	ctx := context.Background()
+	queue := attribute.String("queue", recorder.queueLabel.Value(event.Queue))
+	running := int64(0)
+	if event.Running {
+		running = 1
+	}
+	recorder.serviceRunning.Record(ctx, running, recorder.attributeSet(queue))
+	outcome := "success"
+	if event.Err != nil {
+		outcome = "failure"
+	}
+	recorder.serviceActions.Add(ctx, 1, recorder.attributeSet(queue, attribute.String("action", string(event.Action)), attribute.String("outcome", outcome)))
+	if event.ValidationDuration > 0 {
+		recorder.serviceValidationDuration.Record(ctx, event.ValidationDuration.Seconds(), recorder.attributeSet(queue))
+	}
+}
+
+// Drift implements `sqssrv.Recorder`.
+func (recorder *Recorder) Drift(event sqssrv.DriftEvent) {
+	ctx := context.Background()
+	queue := attribute.String("queue", recorder.queueLabel.Value(event.Queue))
+	if event.Err != nil {
+		recorder.queueDriftCheckFailures.Add(ctx, 1, recorder.attributeSet(queue))
+		return
+	}
+	drifted := make(map[string]bool, len(event.Drifts))
+	for _, drift := range event.Drifts {
+		drifted[drift.Name] = true
+	}
+	for _, name := range event.Checked {
+		value := int64(0)
+		if drifted[name] {
+			value = 1
+		}
+		recorder.queueAttributeDrift.Record(ctx, value, recorder.attributeSet(queue, attribute.String("attribute", name)))
+	}
+}
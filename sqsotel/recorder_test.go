@@ -0,0 +1,405 @@
+package sqsotel
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/jamillosantos/macchiato"
+	sqssrv "github.com/lab259/go-rscsrv-sqs"
+	"github.com/lab259/go-rscsrv-sqs/sqstest"
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/reporters"
+	. "github.com/onsi/gomega"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+func TestRecorder(t *testing.T) {
+	log.SetOutput(GinkgoWriter)
+	RegisterFailHandler(Fail)
+
+	description := "SQS OpenTelemetry Recorder Test Suite"
+	if os.Getenv("CI") == "" {
+		macchiato.RunSpecs(t, description)
+	} else {
+		reporterOutputDir := path.Join("./test-results/go-rscsrv-sqs")
+		os.MkdirAll(reporterOutputDir, os.ModePerm)
+		junitReporter := reporters.NewJUnitReporter(path.Join(reporterOutputDir, "results.xml"))
+		macchiatoReporter := macchiato.NewReporter()
+		RunSpecsWithCustomReporters(t, description, []Reporter{macchiatoReporter, junitReporter})
+	}
+}
+
+var (
+	validConfiguration = sqssrv.SQSServiceConfiguration{
+		Endpoint: "http://localhost:9324",
+		QUrl:     "http://localhost:9324/queue/queue-test",
+	}
+	sqsServer *sqstest.Server
+)
+
+var _ = BeforeSuite(func() {
+	if endpoint := os.Getenv("SQS_ENDPOINT"); endpoint != "" {
+		validConfiguration.Endpoint = endpoint
+		validConfiguration.QUrl = endpoint + "/queue/queue-test"
+		return
+	}
+	sqsServer = sqstest.NewServer(&sqstest.Options{
+		Queues: []string{"queue-test"},
+	})
+	validConfiguration.Endpoint = sqsServer.URL
+	validConfiguration.QUrl = sqsServer.QueueURL("queue-test")
+})
+
+var _ = AfterSuite(func() {
+	if sqsServer != nil {
+		sqsServer.Close()
+	}
+})
+
+// read returns the value of an instrument ("calls", "duration", "success",
+// "failures", "traffic_amount", "traffic_size" or "injected_faults") of a
+// queue and method. For
+// the duration, it is the sum of the histogram.
+func read(reader sdkmetric.Reader, metric, queue, method string, attributes ...attribute.KeyValue) float64 {
+	attributes = append(attributes, attribute.String("queue", queue), attribute.String("method", method))
+	return readInstrument(reader, "message."+metric, attributes...)
+}
+
+// readInstrument returns the value of an instrument with the given
+// attributes. For histograms, it is their sum.
+func readInstrument(reader sdkmetric.Reader, name string, attributes ...attribute.KeyValue) float64 {
+	var data metricdata.ResourceMetrics
+	Expect(reader.Collect(context.Background(), &data)).To(Succeed())
+
+	set := attribute.NewSet(attributes...)
+	for _, scope := range data.ScopeMetrics {
+		for _, m := range scope.Metrics {
+			if m.Name != "sqs."+name {
+				continue
+			}
+			switch d := m.Data.(type) {
+			case metricdata.Sum[int64]:
+				for _, point := range d.DataPoints {
+					if point.Attributes.Equals(&set) {
+						return float64(point.Value)
+					}
+				}
+			case metricdata.Gauge[int64]:
+				for _, point := range d.DataPoints {
+					if point.Attributes.Equals(&set) {
+						return float64(point.Value)
+					}
+				}
+			case metricdata.Gauge[float64]:
+				for _, point := range d.DataPoints {
+					if point.Attributes.Equals(&set) {
+						return point.Value
+					}
+				}
+			case metricdata.Histogram[float64]:
+				for _, point := range d.DataPoints {
+					if point.Attributes.Equals(&set) {
+						return point.Sum
+					}
+				}
+			}
+		}
+	}
+	return 0
+}
+
+// specNamePattern matches the names of the specs of a test file.
+var specNamePattern = regexp.MustCompile(`\bIt\("([^"]+)"`)
+
+// specNames returns the names of the specs of the source of a test file.
+func specNames(source string) []string {
+	var names []string
+	for _, match := range specNamePattern.FindAllStringSubmatch(source, -1) {
+		names = append(names, match[1])
+	}
+	return names
+}
+
+// The Recorder specs run, one for one, the specs the service runs for all its
+// recorders (the recorderBackends of its recorder_test.go), which cannot list
+// this one, as it lives in its own module.
+var _ = Describe("Recorder", func() {
+	var (
+		service *sqssrv.SQSService
+		reader  *sdkmetric.ManualReader
+	)
+
+	BeforeEach(func() {
+		reader = sdkmetric.NewManualReader()
+		recorder, err := NewRecorder(&Opts{
+			MeterProvider: sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)),
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		service = &sqssrv.SQSService{Recorder: recorder}
+		Expect(service.ApplyConfiguration(&validConfiguration)).To(Succeed())
+		Expect(service.Start()).To(Succeed())
+		_, err = service.PurgeQueue(&sqs.PurgeQueueInput{})
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(service.Stop()).To(Succeed())
+	})
+
+	It("should cover the specs of the recorders of the service", func() {
+		source, err := ioutil.ReadFile("../recorder_test.go")
+		Expect(err).ToNot(HaveOccurred())
+		shared := string(source)
+		shared = shared[strings.Index(shared, "range recorderBackends"):]
+		shared = shared[:strings.Index(shared, "\n\t}\n")]
+		Expect(specNames(shared)).ToNot(BeEmpty())
+
+		source, err = ioutil.ReadFile("recorder_test.go")
+		Expect(err).ToNot(HaveOccurred())
+		for _, name := range specNames(shared) {
+			Expect(specNames(string(source))).To(ContainElement(name))
+		}
+	})
+
+	It("should not create a collector", func() {
+		Expect(service.Collector).To(BeNil())
+	})
+
+	It("should record SendMessage", func() {
+		_, err := service.SendMessage(&sqs.SendMessageInput{
+			MessageBody: aws.String("testing message size 1"),
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		queue := validConfiguration.QUrl
+		Expect(read(reader, "calls", queue, sqssrv.MessageMetricMethodSendMessage)).To(BeEquivalentTo(1))
+		Expect(read(reader, "duration", queue, sqssrv.MessageMetricMethodSendMessage)).To(BeNumerically(">", 0))
+		Expect(read(reader, "success", queue, sqssrv.MessageMetricMethodSendMessage)).To(BeEquivalentTo(1))
+		Expect(read(reader, "failures", queue, sqssrv.MessageMetricMethodSendMessage)).To(BeEquivalentTo(0))
+		Expect(read(reader, "traffic_amount", queue, sqssrv.MessageMetricMethodSendMessage)).To(BeEquivalentTo(1))
+		Expect(read(reader, "traffic_size", queue, sqssrv.MessageMetricMethodSendMessage)).To(BeEquivalentTo(22))
+		Expect(read(reader, "request_units", queue, sqssrv.MessageMetricMethodSendMessage)).To(BeEquivalentTo(1))
+	})
+
+	It("should record SendMessageBatch", func() {
+		_, err := service.SendMessageBatch(&sqs.SendMessageBatchInput{
+			Entries: []*sqs.SendMessageBatchRequestEntry{
+				{Id: aws.String("message1"), MessageBody: aws.String("testing this body 1")},
+				{Id: aws.String("message2"), MessageBody: aws.String("testing this body 2")},
+			},
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		queue := validConfiguration.QUrl
+		Expect(read(reader, "calls", queue, sqssrv.MessageMetricMethodSendMessageBatch)).To(BeEquivalentTo(1))
+		Expect(read(reader, "duration", queue, sqssrv.MessageMetricMethodSendMessageBatch)).To(BeNumerically(">", 0))
+		Expect(read(reader, "success", queue, sqssrv.MessageMetricMethodSendMessageBatch)).To(BeEquivalentTo(1))
+		Expect(read(reader, "traffic_amount", queue, sqssrv.MessageMetricMethodSendMessageBatch)).To(BeEquivalentTo(2))
+		Expect(read(reader, "traffic_size", queue, sqssrv.MessageMetricMethodSendMessageBatch)).To(BeEquivalentTo(38))
+	})
+
+	It("should record ReceiveMessage, DeleteMessage and DeleteMessageBatch", func() {
+		_, err := service.SendMessageBatch(&sqs.SendMessageBatchInput{
+			Entries: []*sqs.SendMessageBatchRequestEntry{
+				{Id: aws.String("message1"), MessageBody: aws.String("testing this body 1")},
+				{Id: aws.String("message2"), MessageBody: aws.String("testing this body 2")},
+				{Id: aws.String("message3"), MessageBody: aws.String("testing this body 3")},
+			},
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		var messages []*sqs.Message
+		for len(messages) < 3 {
+			output, err := service.ReceiveMessage(&sqs.ReceiveMessageInput{
+				MaxNumberOfMessages: aws.Int64(10),
+				WaitTimeSeconds:     aws.Int64(1),
+			})
+			Expect(err).ToNot(HaveOccurred())
+			messages = append(messages, output.Messages...)
+		}
+
+		_, err = service.DeleteMessage(&sqs.DeleteMessageInput{
+			ReceiptHandle: messages[0].ReceiptHandle,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		_, err = service.DeleteMessageBatch(&sqs.DeleteMessageBatchInput{
+			Entries: []*sqs.DeleteMessageBatchRequestEntry{
+				{Id: aws.String("message2"), ReceiptHandle: messages[1].ReceiptHandle},
+				{Id: aws.String("message3"), ReceiptHandle: messages[2].ReceiptHandle},
+			},
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		queue := validConfiguration.QUrl
+		Expect(read(reader, "calls", queue, sqssrv.MessageMetricMethodReceiveMessage)).To(BeNumerically(">=", 1))
+		Expect(read(reader, "duration", queue, sqssrv.MessageMetricMethodReceiveMessage)).To(BeNumerically(">", 0))
+		Expect(read(reader, "traffic_amount", queue, sqssrv.MessageMetricMethodReceiveMessage)).To(BeEquivalentTo(3))
+		Expect(read(reader, "traffic_size", queue, sqssrv.MessageMetricMethodReceiveMessage)).To(BeEquivalentTo(57))
+
+		Expect(read(reader, "calls", queue, sqssrv.MessageMetricMethodDeleteMessage)).To(BeEquivalentTo(1))
+		Expect(read(reader, "success", queue, sqssrv.MessageMetricMethodDeleteMessage)).To(BeEquivalentTo(1))
+		Expect(read(reader, "traffic_amount", queue, sqssrv.MessageMetricMethodDeleteMessage)).To(BeEquivalentTo(1))
+
+		Expect(read(reader, "calls", queue, sqssrv.MessageMetricMethodDeleteMessageBatch)).To(BeEquivalentTo(1))
+		Expect(read(reader, "success", queue, sqssrv.MessageMetricMethodDeleteMessageBatch)).To(BeEquivalentTo(1))
+		Expect(read(reader, "traffic_amount", queue, sqssrv.MessageMetricMethodDeleteMessageBatch)).To(BeEquivalentTo(2))
+	})
+
+	It("should record the empty receives", func() {
+		_, err := service.ReceiveMessage(&sqs.ReceiveMessageInput{
+			WaitTimeSeconds: aws.Int64(0),
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		queue := validConfiguration.QUrl
+		Expect(read(reader, "empty_receives", queue, sqssrv.MessageMetricMethodReceiveMessage)).To(BeEquivalentTo(1))
+		Expect(read(reader, "success", queue, sqssrv.MessageMetricMethodReceiveMessage)).To(BeEquivalentTo(1))
+		Expect(read(reader, "traffic_amount", queue, sqssrv.MessageMetricMethodReceiveMessage)).To(BeEquivalentTo(0))
+		Expect(read(reader, "request_units", queue, sqssrv.MessageMetricMethodReceiveMessage)).To(BeEquivalentTo(1))
+	})
+
+	It("should record failures", func() {
+		service.Configuration.QUrl = "fake-url-to-return-error"
+		_, err := service.SendMessage(&sqs.SendMessageInput{
+			MessageBody: aws.String("this is the body of the message"),
+		})
+		Expect(err).To(HaveOccurred())
+
+		queue := service.Configuration.QUrl
+		Expect(read(reader, "calls", queue, sqssrv.MessageMetricMethodSendMessage)).To(BeEquivalentTo(1))
+		Expect(read(reader, "success", queue, sqssrv.MessageMetricMethodSendMessage)).To(BeEquivalentTo(0))
+		Expect(read(reader, "failures", queue, sqssrv.MessageMetricMethodSendMessage)).To(BeEquivalentTo(1))
+	})
+
+	It("should record the injected faults", func() {
+		Expect(service.Stop()).To(Succeed())
+		service.Configuration.Faults = []sqssrv.FaultRule{
+			{Method: sqssrv.MessageMetricMethodSendMessage, ErrorCode: "ThrottlingException"},
+		}
+		Expect(service.Start()).To(Succeed())
+
+		_, err := service.SendMessage(&sqs.SendMessageInput{
+			MessageBody: aws.String("this is the body of the message"),
+		})
+		Expect(err).To(HaveOccurred())
+		_, err = service.ReceiveMessage(&sqs.ReceiveMessageInput{
+			WaitTimeSeconds: aws.Int64(0),
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		queue := validConfiguration.QUrl
+		Expect(read(reader, "failures", queue, sqssrv.MessageMetricMethodSendMessage)).To(BeEquivalentTo(1))
+		Expect(read(reader, "injected_faults", queue, sqssrv.MessageMetricMethodSendMessage, attribute.String("fault", "ThrottlingException"))).To(BeEquivalentTo(1))
+		Expect(read(reader, "injected_faults", queue, sqssrv.MessageMetricMethodReceiveMessage, attribute.String("fault", "ThrottlingException"))).To(BeEquivalentTo(0))
+	})
+
+	It("should record the calls when the service is not running", func() {
+		Expect(service.Stop()).To(Succeed())
+		_, err := service.SendMessage(&sqs.SendMessageInput{
+			MessageBody: aws.String("this is the body of the message"),
+		})
+		Expect(err).To(HaveOccurred())
+		Expect(service.Start()).To(Succeed())
+
+		queue := validConfiguration.QUrl
+		Expect(read(reader, "calls", queue, sqssrv.MessageMetricMethodSendMessage)).To(BeEquivalentTo(1))
+		Expect(read(reader, "success", queue, sqssrv.MessageMetricMethodSendMessage)).To(BeEquivalentTo(0))
+		Expect(read(reader, "failures", queue, sqssrv.MessageMetricMethodSendMessage)).To(BeEquivalentTo(0))
+	})
+
+	It("should label the queue by its name and add the attributes", func() {
+		reader := sdkmetric.NewManualReader()
+		recorder, err := NewRecorder(&Opts{
+			MeterProvider: sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)),
+			QueueLabel:    sqssrv.QueueLabelName,
+			Attributes:    []attribute.KeyValue{attribute.String("service", "mail")},
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		recorder.Called(sqssrv.Operation{Queue: validConfiguration.QUrl, Method: sqssrv.MessageMetricMethodSendMessage})
+		Expect(read(reader, "calls", "queue-test", sqssrv.MessageMetricMethodSendMessage, attribute.String("service", "mail"))).To(BeEquivalentTo(1))
+	})
+
+	It("should record the consumer metrics", func() {
+		reader := sdkmetric.NewManualReader()
+		recorder, err := NewRecorder(&Opts{
+			MeterProvider: sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)),
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		queue := attribute.String("queue", validConfiguration.QUrl)
+		messageType := attribute.String("type", "welcome")
+		handling := sqssrv.Handling{Queue: validConfiguration.QUrl, MessageType: "welcome"}
+		recorder.HandlerStarted(handling)
+		recorder.HandlerStarted(handling)
+		recorder.HandlerFinished(handling, sqssrv.HandlerResult{Duration: time.Second, Outcome: sqssrv.HandlerOutcomeNacked})
+		recorder.WorkersUsed(validConfiguration.QUrl, 1, 4)
+
+		Expect(readInstrument(reader, "consumer.messages_in_flight", queue, messageType)).To(BeEquivalentTo(1))
+		Expect(readInstrument(reader, "consumer.handler_duration", queue, messageType)).To(BeEquivalentTo(1))
+		Expect(readInstrument(reader, "consumer.messages_handled", queue, messageType, attribute.String("outcome", "nacked"))).To(BeEquivalentTo(1))
+		Expect(readInstrument(reader, "consumer.workers", queue)).To(BeEquivalentTo(4))
+		Expect(readInstrument(reader, "consumer.worker_utilization", queue)).To(BeEquivalentTo(0.25))
+	})
+
+	It("should record the dead-lettered messages by reason", func() {
+		reader := sdkmetric.NewManualReader()
+		recorder, err := NewRecorder(&Opts{
+			MeterProvider: sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)),
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		queue := attribute.String("queue", validConfiguration.QUrl)
+		messageType := attribute.String("type", "welcome")
+		handling := sqssrv.Handling{Queue: validConfiguration.QUrl, MessageType: "welcome"}
+		recorder.HandlerFinished(handling, sqssrv.HandlerResult{
+			Outcome:          sqssrv.HandlerOutcomeDeadLettered,
+			DeadLetterReason: sqssrv.DeadLetterReasonPermanentError,
+		})
+
+		Expect(readInstrument(reader, "consumer.messages_handled", queue, messageType, attribute.String("outcome", "dead_lettered"))).To(BeEquivalentTo(1))
+		Expect(readInstrument(reader, "consumer.messages_dead_lettered", queue, messageType, attribute.String("reason", "permanent_error"))).To(BeEquivalentTo(1))
+	})
+
+	It("should record the lifecycle of the service", func() {
+		queue := attribute.String("queue", validConfiguration.QUrl)
+		Expect(readInstrument(reader, "service.running", queue)).To(BeEquivalentTo(1))
+		Expect(readInstrument(reader, "service.actions", queue, attribute.String("action", "start"), attribute.String("outcome", "success"))).To(BeEquivalentTo(1))
+		Expect(readInstrument(reader, "service.queue_validation_duration", queue)).To(BeNumerically(">", 0))
+
+		Expect(service.Stop()).To(Succeed())
+		Expect(readInstrument(reader, "service.running", queue)).To(BeEquivalentTo(0))
+	})
+	It("should record the drift of the attributes", func() {
+		reader := sdkmetric.NewManualReader()
+		recorder, err := NewRecorder(&Opts{
+			MeterProvider: sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)),
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		queue := attribute.String("queue", validConfiguration.QUrl)
+		recorder.Drift(sqssrv.DriftEvent{
+			Queue:   validConfiguration.QUrl,
+			Checked: []string{"DelaySeconds", "VisibilityTimeout"},
+			Drifts:  []sqssrv.AttributeDrift{{Name: "VisibilityTimeout", Current: "45", Expected: "30"}},
+		})
+		recorder.Drift(sqssrv.DriftEvent{Queue: validConfiguration.QUrl, Err: errors.New("failed")})
+
+		Expect(readInstrument(reader, "queue.attribute_drift", queue, attribute.String("attribute", "VisibilityTimeout"))).To(BeEquivalentTo(1))
+		Expect(readInstrument(reader, "queue.attribute_drift", queue, attribute.String("attribute", "DelaySeconds"))).To(BeEquivalentTo(0))
+		Expect(readInstrument(reader, "queue.drift_check_failures", queue)).To(BeEquivalentTo(1))
+	})
+})
@@ -0,0 +1,298 @@
+package sqstest
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/onsi/gomega"
+	"github.com/onsi/gomega/format"
+	"github.com/onsi/gomega/types"
+)
+
+// Receiver is the part of a `sqssrv.SQSService` used by the matchers. The
+// messages are received from its configured queue.
+type Receiver interface {
+	ReceiveMessageWithContext(ctx context.Context, input *sqs.ReceiveMessageInput) (*sqs.ReceiveMessageOutput, error)
+}
+
+// Client is the part of a `sqssrv.SQSService` used by Drain.
+type Client interface {
+	Receiver
+	DeleteMessageWithContext(ctx context.Context, input *sqs.DeleteMessageInput) (*sqs.DeleteMessageOutput, error)
+}
+
+// ReceiveTimeout is how long ReceiveMessageWithBody and EventuallyDrain keep
+// receiving messages.
+var ReceiveTimeout = 5 * time.Second
+
+// receive receives up to 10 messages, with all their attributes.
+func receive(ctx context.Context, receiver Receiver, waitTimeSeconds int64) ([]*sqs.Message, error) {
+	output, err := receiver.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+		AttributeNames:        []*string{aws.String(sqs.QueueAttributeNameAll)},
+		MessageAttributeNames: []*string{aws.String(sqs.QueueAttributeNameAll)},
+		MaxNumberOfMessages:   aws.Int64(10),
+		WaitTimeSeconds:       aws.Int64(waitTimeSeconds),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return output.Messages, nil
+}
+
+// peek receives the visible messages of the queue until no new message comes
+// back. A message that becomes visible again, e.g. due to a short visibility
+// timeout, is only counted once.
+//
+// The receives long poll, as a short poll samples only some of the servers of
+// SQS and can miss messages. So the last one, which comes back empty, takes a
+// second.
+func peek(receiver Receiver) ([]*sqs.Message, error) {
+	seen := make(map[string]bool)
+	var messages []*sqs.Message
+	for {
+		received, err := receive(context.Background(), receiver, 1)
+		if err != nil {
+			return nil, err
+		}
+		fresh := 0
+		for _, message := range received {
+			id := aws.StringValue(message.MessageId)
+			if !seen[id] {
+				seen[id] = true
+				messages = append(messages, message)
+				fresh++
+			}
+		}
+		if fresh == 0 {
+			return messages, nil
+		}
+	}
+}
+
+func toReceiver(actual interface{}, matcher string) (Receiver, error) {
+	receiver, ok := actual.(Receiver)
+	if !ok {
+		return nil, fmt.Errorf("%s expects a sqssrv.SQSService (or a sqstest.Receiver). Got:\n%s", matcher, format.Object(actual, 1))
+	}
+	return receiver, nil
+}
+
+// toMatcher wraps a value that is not a matcher in `Equal`.
+func toMatcher(expected interface{}) types.GomegaMatcher {
+	if matcher, ok := expected.(types.GomegaMatcher); ok {
+		return matcher
+	}
+	return gomega.Equal(expected)
+}
+
+func bodies(messages []*sqs.Message) []string {
+	result := make([]string, len(messages))
+	for i, message := range messages {
+		result[i] = aws.StringValue(message.Body)
+	}
+	return result
+}
+
+// HaveMessagesInQueue succeeds if the queue of the service has the expected
+// number of visible messages. The expectation is either a number or a matcher,
+// e.g. `BeNumerically(">", 1)`.
+//
+// The messages are received to be counted, so they stay in flight for the
+// visibility timeout of the queue. The receives long poll for a second, which
+// the matcher takes to confirm there are no more messages.
+func HaveMessagesInQueue(expected interface{}) types.GomegaMatcher {
+	if _, ok := expected.(types.GomegaMatcher); !ok {
+		expected = gomega.BeNumerically("==", expected)
+	}
+	return &haveMessagesInQueueMatcher{
+		expected: expected.(types.GomegaMatcher),
+	}
+}
+
+type haveMessagesInQueueMatcher struct {
+	expected types.GomegaMatcher
+	messages []*sqs.Message
+}
+
+func (matcher *haveMessagesInQueueMatcher) Match(actual interface{}) (bool, error) {
+	receiver, err := toReceiver(actual, "HaveMessagesInQueue")
+	if err != nil {
+		return false, err
+	}
+	matcher.messages, err = peek(receiver)
+	if err != nil {
+		return false, err
+	}
+	return matcher.expected.Match(len(matcher.messages))
+}
+
+func (matcher *haveMessagesInQueueMatcher) FailureMessage(actual interface{}) string {
+	return fmt.Sprintf("Expected the number of messages in the queue\n%s\nThe messages were:\n%s", matcher.expected.FailureMessage(len(matcher.messages)), format.Object(bodies(matcher.messages), 1))
+}
+
+func (matcher *haveMessagesInQueueMatcher) NegatedFailureMessage(actual interface{}) string {
+	return fmt.Sprintf("Expected the number of messages in the queue\n%s\nThe messages were:\n%s", matcher.expected.NegatedFailureMessage(len(matcher.messages)), format.Object(bodies(matcher.messages), 1))
+}
+
+// ReceiveMessageWithBody succeeds if a message whose body matches is received
+// from the queue of the service within the ReceiveTimeout. The expectation is
+// either a string or a matcher, e.g. `ContainSubstring("order")`.
+//
+// The message received is kept in the optional pointer, so it can be deleted
+// or inspected further. The other messages received meanwhile are left in
+// flight.
+func ReceiveMessageWithBody(expected interface{}, message ...**sqs.Message) types.GomegaMatcher {
+	matcher := &receiveMessageWithBodyMatcher{
+		expected: toMatcher(expected),
+	}
+	if len(message) > 0 {
+		matcher.into = message[0]
+	}
+	return matcher
+}
+
+type receiveMessageWithBodyMatcher struct {
+	expected types.GomegaMatcher
+	into     **sqs.Message
+	received []*sqs.Message
+}
+
+func (matcher *receiveMessageWithBodyMatcher) Match(actual interface{}) (bool, error) {
+	receiver, err := toReceiver(actual, "ReceiveMessageWithBody")
+	if err != nil {
+		return false, err
+	}
+
+	matcher.received = nil
+	ctx, cancel := context.WithTimeout(context.Background(), ReceiveTimeout)
+	defer cancel()
+	for ctx.Err() == nil {
+		// Long polls are kept short, so the timeout is respected even against
+		// servers that do not honor the cancellation.
+		messages, err := receive(ctx, receiver, 1)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			return false, err
+		}
+		for _, message := range messages {
+			ok, err := matcher.expected.Match(aws.StringValue(message.Body))
+			if err != nil {
+				return false, err
+			}
+			if ok {
+				if matcher.into != nil {
+					*matcher.into = message
+				}
+				return true, nil
+			}
+			matcher.received = append(matcher.received, message)
+		}
+	}
+	return false, nil
+}
+
+func (matcher *receiveMessageWithBodyMatcher) FailureMessage(actual interface{}) string {
+	return fmt.Sprintf("Expected to receive a message, within %s, whose body\n%s\nThe messages received were:\n%s", ReceiveTimeout, matcher.expected.FailureMessage("<body>"), format.Object(bodies(matcher.received), 1))
+}
+
+func (matcher *receiveMessageWithBodyMatcher) NegatedFailureMessage(actual interface{}) string {
+	return fmt.Sprintf("Expected not to receive a message, within %s, whose body\n%s", ReceiveTimeout, matcher.expected.NegatedFailureMessage("<body>"))
+}
+
+// HaveMessageAttribute succeeds if a `*sqs.Message` has the message attribute.
+// If an expectation is informed, a string or a matcher, the value of the
+// attribute (its StringValue or, if not set, its BinaryValue) must match it.
+func HaveMessageAttribute(name string, expected ...interface{}) types.GomegaMatcher {
+	matcher := &haveMessageAttributeMatcher{
+		name: name,
+	}
+	if len(expected) > 0 {
+		matcher.expected = toMatcher(expected[0])
+	}
+	return matcher
+}
+
+type haveMessageAttributeMatcher struct {
+	name     string
+	expected types.GomegaMatcher
+	value    interface{}
+}
+
+func (matcher *haveMessageAttributeMatcher) Match(actual interface{}) (bool, error) {
+	message, ok := actual.(*sqs.Message)
+	if !ok || message == nil {
+		return false, fmt.Errorf("HaveMessageAttribute expects a *sqs.Message. Got:\n%s", format.Object(actual, 1))
+	}
+	attribute, ok := message.MessageAttributes[matcher.name]
+	if !ok || attribute == nil {
+		return false, nil
+	}
+	if attribute.StringValue != nil {
+		matcher.value = aws.StringValue(attribute.StringValue)
+	} else {
+		matcher.value = attribute.BinaryValue
+	}
+	if matcher.expected == nil {
+		return true, nil
+	}
+	return matcher.expected.Match(matcher.value)
+}
+
+func (matcher *haveMessageAttributeMatcher) FailureMessage(actual interface{}) string {
+	if matcher.expected == nil || matcher.value == nil {
+		return format.Message(actual, fmt.Sprintf("to have the message attribute %q", matcher.name))
+	}
+	return fmt.Sprintf("Expected the message attribute %q\n%s", matcher.name, matcher.expected.FailureMessage(matcher.value))
+}
+
+func (matcher *haveMessageAttributeMatcher) NegatedFailureMessage(actual interface{}) string {
+	if matcher.expected == nil {
+		return format.Message(actual, fmt.Sprintf("not to have the message attribute %q", matcher.name))
+	}
+	return fmt.Sprintf("Expected the message attribute %q\n%s", matcher.name, matcher.expected.NegatedFailureMessage(matcher.value))
+}
+
+// Drain receives and deletes the messages of the queue of the client until a
+// receive comes back empty, returning the messages deleted.
+func Drain(ctx context.Context, client Client) ([]*sqs.Message, error) {
+	var drained []*sqs.Message
+	for {
+		messages, err := receive(ctx, client, 1)
+		if err != nil {
+			return drained, err
+		}
+		if len(messages) == 0 {
+			return drained, nil
+		}
+		for _, message := range messages {
+			_, err := client.DeleteMessageWithContext(ctx, &sqs.DeleteMessageInput{
+				ReceiptHandle: message.ReceiptHandle,
+			})
+			if err != nil {
+				return drained, err
+			}
+			drained = append(drained, message)
+		}
+	}
+}
+
+// EventuallyDrain drains the queue of the client, failing the spec if it
+// fails or is not empty within the timeout (default: ReceiveTimeout). It
+// returns the messages deleted.
+func EventuallyDrain(client Client, timeout ...time.Duration) []*sqs.Message {
+	d := ReceiveTimeout
+	if len(timeout) > 0 {
+		d = timeout[0]
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+
+	drained, err := Drain(ctx, client)
+	gomega.ExpectWithOffset(1, err).ToNot(gomega.HaveOccurred(), "draining the queue, %d messages were deleted", len(drained))
+	return drained
+}
@@ -0,0 +1,139 @@
+package sqstest
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/lab259/go-rscsrv-sqs/sqsmem"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// queueClient is a Client over a queue of a sqsmem.Backend, as a
+// `sqssrv.SQSService` would be.
+type queueClient struct {
+	backend  *sqsmem.Backend
+	queueURL string
+}
+
+func (client *queueClient) ReceiveMessageWithContext(ctx context.Context, input *sqs.ReceiveMessageInput) (*sqs.ReceiveMessageOutput, error) {
+	input.QueueUrl = aws.String(client.queueURL)
+	return client.backend.ReceiveMessageWithContext(ctx, input)
+}
+
+func (client *queueClient) DeleteMessageWithContext(ctx context.Context, input *sqs.DeleteMessageInput) (*sqs.DeleteMessageOutput, error) {
+	input.QueueUrl = aws.String(client.queueURL)
+	return client.backend.DeleteMessageWithContext(ctx, input)
+}
+
+var _ = Describe("Matchers", func() {
+	var client *queueClient
+
+	BeforeEach(func() {
+		backend := sqsmem.New(nil)
+		output, err := backend.CreateQueue(&sqs.CreateQueueInput{
+			QueueName: aws.String("queue-test"),
+			Attributes: aws.StringMap(map[string]string{
+				sqs.QueueAttributeNameVisibilityTimeout: "1",
+			}),
+		})
+		Expect(err).ToNot(HaveOccurred())
+		client = &queueClient{
+			backend:  backend,
+			queueURL: aws.StringValue(output.QueueUrl),
+		}
+	})
+
+	send := func(body string, attributes map[string]*sqs.MessageAttributeValue) {
+		_, err := client.backend.SendMessage(&sqs.SendMessageInput{
+			QueueUrl:          aws.String(client.queueURL),
+			MessageBody:       aws.String(body),
+			MessageAttributes: attributes,
+		})
+		Expect(err).ToNot(HaveOccurred())
+	}
+
+	Describe("HaveMessagesInQueue", func() {
+		It("should count the visible messages", func() {
+			Expect(client).To(HaveMessagesInQueue(0))
+			for i := 0; i < 12; i++ {
+				send("message", nil)
+			}
+			Expect(client).To(HaveMessagesInQueue(12))
+		})
+
+		It("should accept a matcher", func() {
+			send("message", nil)
+			Expect(client).To(HaveMessagesInQueue(BeNumerically(">", 0)))
+		})
+
+		It("should fail for something that is not a receiver", func() {
+			ok, err := HaveMessagesInQueue(1).Match("queue")
+			Expect(ok).To(BeFalse())
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("ReceiveMessageWithBody", func() {
+		It("should receive the message with the body", func() {
+			send("message 1", nil)
+			send("message 2", nil)
+
+			var message *sqs.Message
+			Expect(client).To(ReceiveMessageWithBody("message 2", &message))
+			Expect(aws.StringValue(message.Body)).To(Equal("message 2"))
+		})
+
+		It("should wait for the message", func() {
+			go func() {
+				time.Sleep(100 * time.Millisecond)
+				client.backend.SendMessage(&sqs.SendMessageInput{
+					QueueUrl:    aws.String(client.queueURL),
+					MessageBody: aws.String("message"),
+				})
+			}()
+			Expect(client).To(ReceiveMessageWithBody(ContainSubstring("mess")))
+		})
+
+		It("should fail when no message matches", func() {
+			defer func(timeout time.Duration) {
+				ReceiveTimeout = timeout
+			}(ReceiveTimeout)
+			ReceiveTimeout = 100 * time.Millisecond
+
+			send("message", nil)
+			matcher := ReceiveMessageWithBody("other")
+			Expect(matcher.Match(client)).To(BeFalse())
+			Expect(matcher.FailureMessage(client)).To(ContainSubstring("message"))
+		})
+	})
+
+	Describe("HaveMessageAttribute", func() {
+		It("should match the attributes of the messages", func() {
+			send("message", map[string]*sqs.MessageAttributeValue{
+				"type":    {DataType: aws.String("String"), StringValue: aws.String("welcome")},
+				"payload": {DataType: aws.String("Binary"), BinaryValue: []byte{1}},
+			})
+
+			var message *sqs.Message
+			Expect(client).To(ReceiveMessageWithBody("message", &message))
+			Expect(message).To(HaveMessageAttribute("type"))
+			Expect(message).To(HaveMessageAttribute("type", "welcome"))
+			Expect(message).To(HaveMessageAttribute("payload", Equal([]byte{1})))
+			Expect(message).ToNot(HaveMessageAttribute("type", "goodbye"))
+			Expect(message).ToNot(HaveMessageAttribute("tenant"))
+		})
+	})
+
+	Describe("EventuallyDrain", func() {
+		It("should delete all the messages", func() {
+			for i := 0; i < 12; i++ {
+				send("message", nil)
+			}
+			Expect(EventuallyDrain(client)).To(HaveLen(12))
+			Expect(client).To(HaveMessagesInQueue(0))
+		})
+	})
+})
@@ -0,0 +1,218 @@
+package sqstest
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// decodeQuery fills the input of an operation from the form values of a
+// request using the SQS query protocol. It is the inverse of the
+// `queryutil.Parse` used by the SDK to build the requests.
+func decodeQuery(values url.Values, dst interface{}) error {
+	keys := make(map[string]bool, len(values))
+	for key := range values {
+		keys[key] = true
+	}
+	d := queryDecoder{values: values, keys: keys}
+	return d.decodeValue(reflect.ValueOf(dst).Elem(), "", "")
+}
+
+type queryDecoder struct {
+	values url.Values
+	keys   map[string]bool
+}
+
+// has checks if there is any value under the given prefix.
+func (d *queryDecoder) has(prefix string) bool {
+	if d.keys[prefix] {
+		return true
+	}
+	for key := range d.keys {
+		if strings.HasPrefix(key, prefix+".") {
+			return true
+		}
+	}
+	return false
+}
+
+func join(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "." + name
+}
+
+func (d *queryDecoder) decodeValue(value reflect.Value, prefix string, tag reflect.StructTag) error {
+	t := tag.Get("type")
+	vt := value.Type()
+	if vt.Kind() == reflect.Ptr {
+		vt = vt.Elem()
+	}
+	if t == "" {
+		switch vt.Kind() {
+		case reflect.Struct:
+			t = "structure"
+		case reflect.Slice:
+			t = "list"
+		case reflect.Map:
+			t = "map"
+		}
+	}
+
+	switch t {
+	case "structure":
+		if value.Kind() == reflect.Ptr {
+			if value.IsNil() {
+				value.Set(reflect.New(vt))
+			}
+			value = value.Elem()
+		}
+		return d.decodeStruct(value, prefix)
+	case "list":
+		return d.decodeList(value, prefix, tag)
+	case "map":
+		return d.decodeMap(value, prefix, tag)
+	default:
+		return d.decodeScalar(value, prefix, tag)
+	}
+}
+
+func (d *queryDecoder) decodeStruct(value reflect.Value, prefix string) error {
+	t := value.Type()
+	for i := 0; i < value.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" || field.Tag.Get("ignore") != "" {
+			continue
+		}
+
+		name := field.Name
+		if field.Tag.Get("flattened") != "" && field.Tag.Get("locationNameList") != "" {
+			name = field.Tag.Get("locationNameList")
+		} else if locationName := field.Tag.Get("locationName"); locationName != "" {
+			name = locationName
+		}
+		name = join(prefix, name)
+		if !d.has(name) {
+			continue
+		}
+		if err := d.decodeValue(value.Field(i), name, field.Tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *queryDecoder) decodeList(value reflect.Value, prefix string, tag reflect.StructTag) error {
+	if value.Type().Elem().Kind() == reflect.Uint8 {
+		return d.decodeScalar(value, prefix, tag)
+	}
+
+	list := reflect.MakeSlice(value.Type(), 0, 0)
+	if tag.Get("flattened") == "" {
+		if listName := tag.Get("locationNameList"); listName != "" {
+			prefix += "." + listName
+		} else {
+			prefix += ".member"
+		}
+	}
+	for i := 1; d.has(join(prefix, strconv.Itoa(i))); i++ {
+		item := reflect.New(value.Type().Elem()).Elem()
+		if err := d.decodeValue(item, join(prefix, strconv.Itoa(i)), ""); err != nil {
+			return err
+		}
+		list = reflect.Append(list, item)
+	}
+	value.Set(list)
+	return nil
+}
+
+func (d *queryDecoder) decodeMap(value reflect.Value, prefix string, tag reflect.StructTag) error {
+	m := reflect.MakeMap(value.Type())
+	if tag.Get("flattened") == "" {
+		prefix += ".entry"
+	}
+	kname := tag.Get("locationNameKey")
+	if kname == "" {
+		kname = "key"
+	}
+	vname := tag.Get("locationNameValue")
+	if vname == "" {
+		vname = "value"
+	}
+	for i := 1; d.has(join(prefix, strconv.Itoa(i))); i++ {
+		entry := join(prefix, strconv.Itoa(i))
+		key := reflect.New(value.Type().Key()).Elem()
+		if err := d.decodeValue(key, entry+"."+kname, ""); err != nil {
+			return err
+		}
+		item := reflect.New(value.Type().Elem()).Elem()
+		if err := d.decodeValue(item, entry+"."+vname, ""); err != nil {
+			return err
+		}
+		m.SetMapIndex(key, item)
+	}
+	value.Set(m)
+	return nil
+}
+
+func (d *queryDecoder) decodeScalar(value reflect.Value, name string, tag reflect.StructTag) error {
+	raw, ok := d.values[name]
+	if !ok || len(raw) == 0 {
+		return nil
+	}
+	s := raw[0]
+
+	target := value
+	if value.Kind() == reflect.Ptr {
+		target = reflect.New(value.Type().Elem()).Elem()
+	}
+
+	switch target.Interface().(type) {
+	case string:
+		target.SetString(s)
+	case []byte:
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return fmt.Errorf("invalid value for %s: %s", name, err)
+		}
+		target.SetBytes(b)
+	case bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("invalid value for %s: %s", name, err)
+		}
+		target.SetBool(b)
+	case int64, int:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid value for %s: %s", name, err)
+		}
+		target.SetInt(n)
+	case float64, float32:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return fmt.Errorf("invalid value for %s: %s", name, err)
+		}
+		target.SetFloat(f)
+	case time.Time:
+		t, err := parseTime(tag.Get("timestampFormat"), s)
+		if err != nil {
+			return fmt.Errorf("invalid value for %s: %s", name, err)
+		}
+		target.Set(reflect.ValueOf(t))
+	default:
+		return fmt.Errorf("unsupported value for %s (%s)", name, target.Type())
+	}
+
+	if value.Kind() == reflect.Ptr {
+		ptr := reflect.New(target.Type())
+		ptr.Elem().Set(target)
+		value.Set(ptr)
+	}
+	return nil
+}
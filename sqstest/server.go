@@ -0,0 +1,271 @@
+// Package sqstest provides a fake SQS server and matchers for tests.
+//
+// The Server speaks the SQS query protocol over HTTP, so the AWS SDK (and
+// anything built on it, like the `sqssrv.SQSService`) can be pointed at it by
+// using its URL as the endpoint. Messages are kept by an in-memory
+// `sqsmem.Backend`, which can be inspected, and errors can be injected per
+// operation.
+//
+// It also provides Gomega matchers to assert on the queue of a running
+// `sqssrv.SQSService`, like HaveMessagesInQueue and ReceiveMessageWithBody.
+package sqstest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/lab259/go-rscsrv-sqs/sqsmem"
+)
+
+const xmlns = "http://queue.amazonaws.com/doc/2012-11-05/"
+
+// operations are the SQS actions supported by the server.
+var operations = map[string]bool{
+	"CreateQueue":                  true,
+	"DeleteQueue":                  true,
+	"GetQueueUrl":                  true,
+	"ListQueues":                   true,
+	"ListDeadLetterSourceQueues":   true,
+	"GetQueueAttributes":           true,
+	"SetQueueAttributes":           true,
+	"TagQueue":                     true,
+	"UntagQueue":                   true,
+	"ListQueueTags":                true,
+	"PurgeQueue":                   true,
+	"SendMessage":                  true,
+	"SendMessageBatch":             true,
+	"ReceiveMessage":               true,
+	"DeleteMessage":                true,
+	"DeleteMessageBatch":           true,
+	"ChangeMessageVisibility":      true,
+	"ChangeMessageVisibilityBatch": true,
+}
+
+// Error is an error replied by the server, as SQS would.
+type Error struct {
+	// Code is the SQS error code, e.g. `sqs.ErrCodeQueueDoesNotExist`.
+	Code string
+
+	// Message is the description of the error.
+	Message string
+
+	// StatusCode is the HTTP status of the response. Default: 400. Keep in
+	// mind that the SDK retries 5xx responses.
+	StatusCode int
+}
+
+// Error implements the error interface.
+func (err *Error) Error() string {
+	return fmt.Sprintf("%s: %s", err.Code, err.Message)
+}
+
+type fault struct {
+	err       *Error
+	remaining int
+}
+
+// Options configures a Server.
+type Options struct {
+	// Addr is the address the server listens on. Default: a random port on
+	// the loopback interface.
+	Addr string
+
+	// Clock is the clock of the backend. Default: sqsmem.SystemClock.
+	Clock sqsmem.Clock
+
+	// Queues are created, with the default attributes, when the server
+	// starts.
+	Queues []string
+}
+
+// Server is a fake SQS server. It must be closed after use.
+type Server struct {
+	*httptest.Server
+
+	// Backend stores the queues and messages of the server.
+	Backend *sqsmem.Backend
+
+	m      sync.Mutex
+	faults map[string]*fault
+	calls  map[string]int
+}
+
+// NewServer starts a new Server.
+func NewServer(opts *Options) *Server {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	server := &Server{
+		faults: make(map[string]*fault),
+		calls:  make(map[string]int),
+	}
+	server.Server = httptest.NewUnstartedServer(http.HandlerFunc(server.serveHTTP))
+	if opts.Addr != "" {
+		listener, err := net.Listen("tcp", opts.Addr)
+		if err != nil {
+			panic(fmt.Sprintf("sqstest: failed to listen on %s: %v", opts.Addr, err))
+		}
+		server.Server.Listener.Close()
+		server.Server.Listener = listener
+	}
+	server.Server.Start()
+
+	server.Backend = sqsmem.New(&sqsmem.Options{
+		BaseURL: server.URL,
+		Clock:   opts.Clock,
+	})
+	for _, name := range opts.Queues {
+		if _, err := server.CreateQueue(name, nil); err != nil {
+			panic(fmt.Sprintf("sqstest: failed to create the queue %s: %v", name, err))
+		}
+	}
+	return server
+}
+
+// CreateQueue creates a queue with the given attributes, returning its URL.
+func (server *Server) CreateQueue(name string, attributes map[string]string) (string, error) {
+	output, err := server.Backend.CreateQueue(&sqs.CreateQueueInput{
+		QueueName:  aws.String(name),
+		Attributes: aws.StringMap(attributes),
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(output.QueueUrl), nil
+}
+
+// QueueURL returns the URL of the queue with the given name.
+func (server *Server) QueueURL(name string) string {
+	return server.Backend.QueueURL(name)
+}
+
+// Messages returns the messages stored in a queue, informed by its name or
+// URL.
+func (server *Server) Messages(queue string) ([]sqsmem.Message, error) {
+	return server.Backend.Messages(queue)
+}
+
+// Fail makes the next `times` requests of the operation (e.g. "SendMessage")
+// fail with the given error. If times is zero, the operation fails until Reset
+// is called.
+func (server *Server) Fail(operation string, times int, err *Error) {
+	server.m.Lock()
+	defer server.m.Unlock()
+
+	server.faults[operation] = &fault{
+		err:       err,
+		remaining: times,
+	}
+}
+
+// Reset removes all the errors injected by Fail.
+func (server *Server) Reset() {
+	server.m.Lock()
+	defer server.m.Unlock()
+
+	server.faults = make(map[string]*fault)
+}
+
+// Calls returns how many requests of the operation the server received.
+func (server *Server) Calls(operation string) int {
+	server.m.Lock()
+	defer server.m.Unlock()
+
+	return server.calls[operation]
+}
+
+// called counts a request and returns the error injected for it, if any.
+func (server *Server) called(operation string) *Error {
+	server.m.Lock()
+	defer server.m.Unlock()
+
+	server.calls[operation]++
+	f, ok := server.faults[operation]
+	if !ok {
+		return nil
+	}
+	if f.remaining > 0 {
+		f.remaining--
+		if f.remaining == 0 {
+			delete(server.faults, operation)
+		}
+	}
+	return f.err
+}
+
+func (server *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	requestID := newRequestID()
+	w.Header().Set("X-Amzn-Requestid", requestID)
+
+	if err := r.ParseForm(); err != nil {
+		writeError(w, requestID, &Error{Code: "MalformedQueryString", Message: err.Error()})
+		return
+	}
+
+	action := r.Form.Get("Action")
+	if !operations[action] {
+		writeError(w, requestID, &Error{Code: "InvalidAction", Message: fmt.Sprintf("The action %s is not valid for this endpoint.", action)})
+		return
+	}
+	if err := server.called(action); err != nil {
+		writeError(w, requestID, err)
+		return
+	}
+
+	method := reflect.ValueOf(server.Backend).MethodByName(action + "WithContext")
+	input := reflect.New(method.Type().In(1).Elem())
+	if err := decodeQuery(r.Form, input.Interface()); err != nil {
+		writeError(w, requestID, &Error{Code: "MalformedQueryString", Message: err.Error()})
+		return
+	}
+
+	results := method.Call([]reflect.Value{reflect.ValueOf(context.Context(r.Context())), input})
+	if err, _ := results[1].Interface().(error); err != nil {
+		if awsErr, ok := err.(awserr.Error); ok {
+			writeError(w, requestID, &Error{Code: awsErr.Code(), Message: awsErr.Message()})
+			return
+		}
+		writeError(w, requestID, &Error{Code: "InternalError", Message: err.Error(), StatusCode: http.StatusInternalServerError})
+		return
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<?xml version="1.0"?><%sResponse xmlns="%s"><%sResult>`, action, xmlns, action)
+	if err := encodeXML(&buf, results[0]); err != nil {
+		writeError(w, requestID, &Error{Code: "InternalError", Message: err.Error(), StatusCode: http.StatusInternalServerError})
+		return
+	}
+	fmt.Fprintf(&buf, `</%sResult><ResponseMetadata><RequestId>%s</RequestId></ResponseMetadata></%sResponse>`, action, requestID, action)
+
+	w.Header().Set("Content-Type", "text/xml")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
+
+func writeError(w http.ResponseWriter, requestID string, err *Error) {
+	status := err.StatusCode
+	if status == 0 {
+		status = http.StatusBadRequest
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<?xml version="1.0"?><ErrorResponse xmlns="%s"><Error><Type>Sender</Type><Code>`, xmlns)
+	xmlEscape(&buf, err.Code)
+	buf.WriteString("</Code><Message>")
+	xmlEscape(&buf, err.Message)
+	fmt.Fprintf(&buf, "</Message><Detail/></Error><RequestId>%s</RequestId></ErrorResponse>", requestID)
+
+	w.Header().Set("Content-Type", "text/xml")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,195 @@
+package sqstest
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/jamillosantos/macchiato"
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/reporters"
+	. "github.com/onsi/gomega"
+)
+
+func TestServer(t *testing.T) {
+	log.SetOutput(GinkgoWriter)
+	RegisterFailHandler(Fail)
+
+	description := "SQS Fake Server Test Suite"
+	if os.Getenv("CI") == "" {
+		macchiato.RunSpecs(t, description)
+	} else {
+		reporterOutputDir := path.Join("./test-results/go-rscsrv-sqs")
+		os.MkdirAll(reporterOutputDir, os.ModePerm)
+		junitReporter := reporters.NewJUnitReporter(path.Join(reporterOutputDir, "results.xml"))
+		macchiatoReporter := macchiato.NewReporter()
+		RunSpecsWithCustomReporters(t, description, []Reporter{macchiatoReporter, junitReporter})
+	}
+}
+
+var _ = Describe("Server", func() {
+	var (
+		server   *Server
+		client   *sqs.SQS
+		queueURL string
+	)
+
+	BeforeEach(func() {
+		server = NewServer(&Options{
+			Queues: []string{"queue-test"},
+		})
+		queueURL = server.QueueURL("queue-test")
+
+		sess, err := session.NewSession(&aws.Config{
+			Endpoint:    aws.String(server.URL),
+			Region:      aws.String("us-east-1"),
+			Credentials: credentials.NewStaticCredentials("key", "secret", ""),
+			MaxRetries:  aws.Int(0),
+		})
+		Expect(err).ToNot(HaveOccurred())
+		client = sqs.New(sess)
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("should create the queues of the options", func() {
+		output, err := client.ListQueues(&sqs.ListQueuesInput{})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(aws.StringValueSlice(output.QueueUrls)).To(Equal([]string{queueURL}))
+	})
+
+	It("should send and receive messages through the SDK", func() {
+		sent, err := client.SendMessage(&sqs.SendMessageInput{
+			QueueUrl:    aws.String(queueURL),
+			MessageBody: aws.String("<message & body>"),
+			MessageAttributes: map[string]*sqs.MessageAttributeValue{
+				"type":    {DataType: aws.String("String"), StringValue: aws.String("welcome")},
+				"payload": {DataType: aws.String("Binary"), BinaryValue: []byte{0, 1, 2}},
+			},
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		// The SDK validates the MD5 of the body and attributes.
+		output, err := client.ReceiveMessage(&sqs.ReceiveMessageInput{
+			QueueUrl:              aws.String(queueURL),
+			AttributeNames:        aws.StringSlice([]string{"All"}),
+			MessageAttributeNames: aws.StringSlice([]string{"All"}),
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(output.Messages).To(HaveLen(1))
+		Expect(aws.StringValue(output.Messages[0].MessageId)).To(Equal(aws.StringValue(sent.MessageId)))
+		Expect(aws.StringValue(output.Messages[0].Body)).To(Equal("<message & body>"))
+		Expect(aws.StringValue(output.Messages[0].MessageAttributes["type"].StringValue)).To(Equal("welcome"))
+		Expect(output.Messages[0].MessageAttributes["payload"].BinaryValue).To(Equal([]byte{0, 1, 2}))
+		Expect(aws.StringValue(output.Messages[0].Attributes["ApproximateReceiveCount"])).To(Equal("1"))
+
+		_, err = client.DeleteMessage(&sqs.DeleteMessageInput{
+			QueueUrl:      aws.String(queueURL),
+			ReceiptHandle: output.Messages[0].ReceiptHandle,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(server.Messages("queue-test")).To(BeEmpty())
+	})
+
+	It("should handle the batch operations", func() {
+		output, err := client.SendMessageBatch(&sqs.SendMessageBatchInput{
+			QueueUrl: aws.String(queueURL),
+			Entries: []*sqs.SendMessageBatchRequestEntry{
+				{Id: aws.String("1"), MessageBody: aws.String("message 1")},
+				{Id: aws.String("2"), MessageBody: aws.String("message 2")},
+			},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(output.Successful).To(HaveLen(2))
+
+		messages, err := server.Messages(queueURL)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(messages).To(HaveLen(2))
+		Expect(messages[0].Body).To(Equal("message 1"))
+		Expect(messages[1].Body).To(Equal("message 2"))
+	})
+
+	It("should handle the queue attributes", func() {
+		_, err := client.SetQueueAttributes(&sqs.SetQueueAttributesInput{
+			QueueUrl:   aws.String(queueURL),
+			Attributes: aws.StringMap(map[string]string{"VisibilityTimeout": "10"}),
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		output, err := client.GetQueueAttributes(&sqs.GetQueueAttributesInput{
+			QueueUrl:       aws.String(queueURL),
+			AttributeNames: aws.StringSlice([]string{"VisibilityTimeout"}),
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(aws.StringValueMap(output.Attributes)).To(Equal(map[string]string{"VisibilityTimeout": "10"}))
+	})
+
+	It("should reply the errors of the backend", func() {
+		_, err := client.SendMessage(&sqs.SendMessageInput{
+			QueueUrl:    aws.String(server.QueueURL("missing")),
+			MessageBody: aws.String("message"),
+		})
+		Expect(err).To(HaveOccurred())
+		Expect(err.(awserr.Error).Code()).To(Equal(sqs.ErrCodeQueueDoesNotExist))
+	})
+
+	It("should inject errors", func() {
+		server.Fail("SendMessage", 1, &Error{
+			Code:    "ThrottlingException",
+			Message: "Rate exceeded",
+		})
+
+		send := func() error {
+			_, err := client.SendMessage(&sqs.SendMessageInput{
+				QueueUrl:    aws.String(queueURL),
+				MessageBody: aws.String("message"),
+			})
+			return err
+		}
+		err := send()
+		Expect(err).To(HaveOccurred())
+		Expect(err.(awserr.Error).Code()).To(Equal("ThrottlingException"))
+		Expect(send()).To(Succeed())
+		Expect(server.Calls("SendMessage")).To(Equal(2))
+	})
+
+	It("should inject errors until reset", func() {
+		server.Fail("ReceiveMessage", 0, &Error{
+			Code:       "InternalError",
+			Message:    "failed",
+			StatusCode: http.StatusInternalServerError,
+		})
+
+		for i := 0; i < 3; i++ {
+			_, err := client.ReceiveMessage(&sqs.ReceiveMessageInput{
+				QueueUrl: aws.String(queueURL),
+			})
+			Expect(err).To(HaveOccurred())
+		}
+		server.Reset()
+		_, err := client.ReceiveMessage(&sqs.ReceiveMessageInput{
+			QueueUrl: aws.String(queueURL),
+		})
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("should reject unknown actions", func() {
+		_, err := client.AddPermission(&sqs.AddPermissionInput{
+			QueueUrl:      aws.String(queueURL),
+			Label:         aws.String("label"),
+			AWSAccountIds: aws.StringSlice([]string{"000000000000"}),
+			Actions:       aws.StringSlice([]string{"SendMessage"}),
+		})
+		Expect(err).To(HaveOccurred())
+		Expect(err.(awserr.Error).Code()).To(Equal("InvalidAction"))
+	})
+})
@@ -0,0 +1,48 @@
+package sqstest
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// The timestampFormat tags of the shapes of the SDK, as its protocols encode
+// them.
+const (
+	timestampFormatRFC822  = "rfc822"
+	timestampFormatISO8601 = "iso8601"
+	timestampFormatUnix    = "unixTimestamp"
+)
+
+// formatTime encodes a timestamp in the format of its timestampFormat tag,
+// ISO 8601 when the tag is empty.
+func formatTime(format string, t time.Time) (string, error) {
+	t = t.UTC()
+	switch format {
+	case timestampFormatRFC822:
+		return t.Format("Mon, 2 Jan 2006 15:04:05 GMT"), nil
+	case timestampFormatISO8601, "":
+		return t.Format("2006-01-02T15:04:05Z"), nil
+	case timestampFormatUnix:
+		return strconv.FormatInt(t.Unix(), 10), nil
+	}
+	return "", fmt.Errorf("unknown timestamp format %s", format)
+}
+
+// parseTime decodes a timestamp in the format of its timestampFormat tag,
+// ISO 8601 when the tag is empty.
+func parseTime(format, s string) (time.Time, error) {
+	switch format {
+	case timestampFormatRFC822:
+		return time.Parse("Mon, 2 Jan 2006 15:04:05 GMT", s)
+	case timestampFormatISO8601, "":
+		return time.Parse("2006-01-02T15:04:05Z", s)
+	case timestampFormatUnix:
+		seconds, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Unix(int64(seconds), 0), nil
+	}
+	return time.Time{}, fmt.Errorf("unknown timestamp format %s", format)
+}
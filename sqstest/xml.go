@@ -0,0 +1,186 @@
+package sqstest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// encodeXML writes the output of an operation as the children of the current
+// element, following the shapes expected by the `xmlutil` unmarshaler of the
+// SDK.
+func encodeXML(buf *bytes.Buffer, value reflect.Value) error {
+	for value.Kind() == reflect.Ptr {
+		if value.IsNil() {
+			return nil
+		}
+		value = value.Elem()
+	}
+	return encodeStructFields(buf, value)
+}
+
+func encodeStructFields(buf *bytes.Buffer, value reflect.Value) error {
+	t := value.Type()
+	for i := 0; i < value.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" || field.Tag.Get("ignore") != "" {
+			continue
+		}
+		name := field.Name
+		if field.Tag.Get("flattened") != "" && field.Tag.Get("locationNameList") != "" {
+			name = field.Tag.Get("locationNameList")
+		} else if locationName := field.Tag.Get("locationName"); locationName != "" {
+			name = locationName
+		}
+		if err := encodeValue(buf, name, value.Field(i), field.Tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func encodeValue(buf *bytes.Buffer, name string, value reflect.Value, tag reflect.StructTag) error {
+	for value.Kind() == reflect.Ptr {
+		if value.IsNil() {
+			return nil
+		}
+		value = value.Elem()
+	}
+
+	t := tag.Get("type")
+	if t == "" {
+		switch value.Kind() {
+		case reflect.Struct:
+			if _, ok := value.Interface().(time.Time); !ok {
+				t = "structure"
+			}
+		case reflect.Slice:
+			if value.Type().Elem().Kind() != reflect.Uint8 {
+				t = "list"
+			}
+		case reflect.Map:
+			t = "map"
+		}
+	}
+
+	switch t {
+	case "structure":
+		openTag(buf, name)
+		if err := encodeStructFields(buf, value); err != nil {
+			return err
+		}
+		closeTag(buf, name)
+		return nil
+	case "list":
+		if value.IsNil() {
+			return nil
+		}
+		if tag.Get("flattened") != "" {
+			for i := 0; i < value.Len(); i++ {
+				if err := encodeValue(buf, name, value.Index(i), ""); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		member := tag.Get("locationNameList")
+		if member == "" {
+			member = "member"
+		}
+		openTag(buf, name)
+		for i := 0; i < value.Len(); i++ {
+			if err := encodeValue(buf, member, value.Index(i), ""); err != nil {
+				return err
+			}
+		}
+		closeTag(buf, name)
+		return nil
+	case "map":
+		if value.IsNil() {
+			return nil
+		}
+		kname, vname := "key", "value"
+		if n := tag.Get("locationNameKey"); n != "" {
+			kname = n
+		}
+		if n := tag.Get("locationNameValue"); n != "" {
+			vname = n
+		}
+		keys := make([]string, 0, value.Len())
+		for _, key := range value.MapKeys() {
+			keys = append(keys, key.String())
+		}
+		sort.Strings(keys)
+
+		flattened := tag.Get("flattened") != ""
+		if !flattened {
+			openTag(buf, name)
+		}
+		for _, key := range keys {
+			entry := "entry"
+			if flattened {
+				entry = name
+			}
+			openTag(buf, entry)
+			openTag(buf, kname)
+			xml.EscapeText(buf, []byte(key))
+			closeTag(buf, kname)
+			if err := encodeValue(buf, vname, value.MapIndex(reflect.ValueOf(key)), ""); err != nil {
+				return err
+			}
+			closeTag(buf, entry)
+		}
+		if !flattened {
+			closeTag(buf, name)
+		}
+		return nil
+	}
+
+	var s string
+	switch v := value.Interface().(type) {
+	case string:
+		s = v
+	case []byte:
+		s = base64.StdEncoding.EncodeToString(v)
+	case bool:
+		s = strconv.FormatBool(v)
+	case int64:
+		s = strconv.FormatInt(v, 10)
+	case int:
+		s = strconv.Itoa(v)
+	case float64:
+		s = strconv.FormatFloat(v, 'f', -1, 64)
+	case time.Time:
+		var err error
+		if s, err = formatTime(tag.Get("timestampFormat"), v); err != nil {
+			return fmt.Errorf("invalid value for %s: %s", name, err)
+		}
+	default:
+		return fmt.Errorf("unsupported value for %s (%s)", name, value.Type())
+	}
+	openTag(buf, name)
+	xml.EscapeText(buf, []byte(s))
+	closeTag(buf, name)
+	return nil
+}
+
+func openTag(buf *bytes.Buffer, name string) {
+	buf.WriteByte('<')
+	buf.WriteString(name)
+	buf.WriteByte('>')
+}
+
+func closeTag(buf *bytes.Buffer, name string) {
+	buf.WriteString("</")
+	buf.WriteString(name)
+	buf.WriteByte('>')
+}
+
+func xmlEscape(buf *bytes.Buffer, s string) {
+	xml.EscapeText(buf, []byte(s))
+}
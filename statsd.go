@@ -0,0 +1,282 @@
+package sqssrv
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultStatsDAddress is the address used by the StatsDRecorder when none is
+// informed.
+const DefaultStatsDAddress = "127.0.0.1:8125"
+
+// StatsDRecorderOpts configures a StatsDRecorder.
+type StatsDRecorderOpts struct {
+	// Address is the UDP address of the StatsD daemon. Default:
+	// DefaultStatsDAddress.
+	Address string
+	// Writer, when set, receives the metrics instead of the UDP connection.
+	// Each write is a packet with one or more metrics separated by "\n".
+	Writer io.Writer
+	// Prefix is prepended, followed by a ".", to the name of the metrics.
+	Prefix string
+	// QueueLabel defines if the queues are identified by their URL or name.
+	// Default: QueueLabelURL.
+	QueueLabel QueueLabel
+	// Tags sends the queue and method as DogStatsD tags. Otherwise, they are
+	// appended to the name of the metrics, e.g.
+	// "sqs.message.calls.queue-test.SendMessage".
+	Tags bool
+	// ConstTags are added to all the metrics. They are only sent when Tags is
+	// enabled.
+	ConstTags map[string]string
+}
+
+// StatsDRecorder is a Recorder that sends the metrics to a StatsD daemon. The
+// metrics are named after the ones of the SQSServiceCollector, with "."
+// separating the subsystem (e.g. "sqs.message.calls"). Durations are sent as
+// timers, in milliseconds.
+//
+// Metrics are sent on a best-effort basis: errors writing them are ignored.
+type StatsDRecorder struct {
+	prefix     string
+	queueLabel QueueLabel
+	tags       bool
+	constTags  string
+
+	m      sync.Mutex
+	writer io.Writer
+	closer io.Closer
+}
+
+// NewStatsDRecorder creates a StatsDRecorder. It must be closed after use.
+func NewStatsDRecorder(opts *StatsDRecorderOpts) (*StatsDRecorder, error) {
+	recorder := &StatsDRecorder{
+		prefix:     opts.Prefix,
+		queueLabel: opts.QueueLabel,
+		tags:       opts.Tags,
+		writer:     opts.Writer,
+	}
+	if recorder.prefix != "" && !strings.HasSuffix(recorder.prefix, ".") {
+		recorder.prefix += "."
+	}
+	if recorder.queueLabel == "" {
+		recorder.queueLabel = QueueLabelURL
+	}
+
+	if len(opts.ConstTags) > 0 {
+		keys := make([]string, 0, len(opts.ConstTags))
+		for key := range opts.ConstTags {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			recorder.constTags += "," + key + ":" + opts.ConstTags[key]
+		}
+	}
+
+	if recorder.writer == nil {
+		address := opts.Address
+		if address == "" {
+			address = DefaultStatsDAddress
+		}
+		conn, err := net.Dial("udp", address)
+		if err != nil {
+			return nil, err
+		}
+		recorder.writer = conn
+		recorder.closer = conn
+	}
+	return recorder, nil
+}
+
+// Close closes the UDP connection. It does nothing when a Writer was informed.
+func (recorder *StatsDRecorder) Close() error {
+	if recorder.closer != nil {
+		return recorder.closer.Close()
+	}
+	return nil
+}
+
+// statsDSanitizer replaces the characters that have meaning in the StatsD
+// protocol.
+var statsDSanitizer = strings.NewReplacer(":", "_", "|", "_", "@", "_", "#", "_", ",", "_", "\n", "_", "/", "_", ".", "_")
+
+// statsDTagSanitizer replaces the characters that cannot be part of a tag.
+var statsDTagSanitizer = strings.NewReplacer(",", "_", "|", "_", "\n", "_")
+
+// statsDTag is a tag of a metric. Without DogStatsD tags, the values are
+// appended to the name of the metric, in order.
+type statsDTag struct {
+	key, value string
+}
+
+func (recorder *StatsDRecorder) write(buf *bytes.Buffer, name, value, kind string, tags ...statsDTag) {
+	if buf.Len() > 0 {
+		buf.WriteByte('\n')
+	}
+	buf.WriteString(recorder.prefix)
+	buf.WriteString("sqs.")
+	buf.WriteString(name)
+	if !recorder.tags {
+		for _, tag := range tags {
+			if tag.value == "" {
+				continue
+			}
+			buf.WriteByte('.')
+			buf.WriteString(statsDSanitizer.Replace(tag.value))
+		}
+	}
+	buf.WriteByte(':')
+	buf.WriteString(value)
+	buf.WriteByte('|')
+	buf.WriteString(kind)
+	if recorder.tags {
+		buf.WriteString("|#")
+		for i, tag := range tags {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			buf.WriteString(tag.key)
+			buf.WriteByte(':')
+			buf.WriteString(statsDTagSanitizer.Replace(tag.value))
+		}
+		buf.WriteString(recorder.constTags)
+	}
+}
+
+func (recorder *StatsDRecorder) operationTags(op Operation) []statsDTag {
+	return []statsDTag{
+		{"queue", recorder.queueLabel.Value(op.Queue)},
+		{"method", op.Method},
+	}
+}
+
+func (recorder *StatsDRecorder) handlingTags(handling Handling) []statsDTag {
+	return []statsDTag{
+		{"queue", recorder.queueLabel.Value(handling.Queue)},
+		{"type", handling.MessageType},
+	}
+}
+
+func (recorder *StatsDRecorder) send(buf *bytes.Buffer) {
+	recorder.m.Lock()
+	defer recorder.m.Unlock()
+	recorder.writer.Write(buf.Bytes())
+}
+
+// Called implements Recorder.
+func (recorder *StatsDRecorder) Called(op Operation) {
+	var buf bytes.Buffer
+	recorder.write(&buf, "message.calls", "1", "c", recorder.operationTags(op)...)
+	recorder.send(&buf)
+}
+
+// Finished implements Recorder.
+func (recorder *StatsDRecorder) Finished(op Operation, result OperationResult) {
+	var buf bytes.Buffer
+	tags := recorder.operationTags(op)
+	recorder.write(&buf, "message.duration", strconv.FormatFloat(result.Duration.Seconds()*1000, 'f', -1, 64), "ms", tags...)
+	if result.Err != nil {
+		recorder.write(&buf, "message.failures", "1", "c", tags...)
+	} else {
+		recorder.write(&buf, "message.success", "1", "c", tags...)
+	}
+	recorder.write(&buf, "message.traffic_amount", strconv.Itoa(result.Messages), "c", tags...)
+	if result.Size > 0 {
+		recorder.write(&buf, "message.traffic_size", strconv.Itoa(result.Size), "c", tags...)
+	}
+	if result.RequestUnits > 0 {
+		recorder.write(&buf, "message.request_units", strconv.Itoa(result.RequestUnits), "c", tags...)
+	}
+	if result.IsEmptyReceive(op) {
+		recorder.write(&buf, "message.empty_receives", "1", "c", tags...)
+	}
+	if result.Fault != "" {
+		recorder.write(&buf, "message.injected_faults", "1", "c", append(tags, statsDTag{"fault", result.Fault})...)
+	}
+	recorder.send(&buf)
+}
+
+// HandlerStarted implements Recorder. The messages in flight are a gauge,
+// changed by deltas.
+func (recorder *StatsDRecorder) HandlerStarted(handling Handling) {
+	var buf bytes.Buffer
+	recorder.write(&buf, "consumer.messages_in_flight", "+1", "g", recorder.handlingTags(handling)...)
+	recorder.send(&buf)
+}
+
+// HandlerFinished implements Recorder. The outcome is the last tag of the
+// handled messages counter, as the reason is of the dead-lettered messages
+// one.
+func (recorder *StatsDRecorder) HandlerFinished(handling Handling, result HandlerResult) {
+	var buf bytes.Buffer
+	tags := recorder.handlingTags(handling)
+	recorder.write(&buf, "consumer.messages_in_flight", "-1", "g", tags...)
+	recorder.write(&buf, "consumer.handler_duration", strconv.FormatFloat(result.Duration.Seconds()*1000, 'f', -1, 64), "ms", tags...)
+	recorder.write(&buf, "consumer.messages_handled", "1", "c", append(tags, statsDTag{"outcome", string(result.Outcome)})...)
+	if result.Outcome == HandlerOutcomeDeadLettered {
+		recorder.write(&buf, "consumer.messages_dead_lettered", "1", "c", append(tags, statsDTag{"reason", string(result.DeadLetterReason)})...)
+	}
+	recorder.send(&buf)
+}
+
+// WorkersUsed implements Recorder.
+func (recorder *StatsDRecorder) WorkersUsed(queue string, busy, workers int) {
+	var buf bytes.Buffer
+	tags := []statsDTag{{"queue", recorder.queueLabel.Value(queue)}}
+	recorder.write(&buf, "consumer.workers", strconv.Itoa(workers), "g", tags...)
+	if workers > 0 {
+		recorder.write(&buf, "consumer.worker_utilization", strconv.FormatFloat(float64(busy)/float64(workers), 'f', -1, 64), "g", tags...)
+	}
+	recorder.send(&buf)
+}
+
+// Lifecycle implements Recorder. The outcome is the last tag of the actions
+// counter.
+func (recorder *StatsDRecorder) Lifecycle(event LifecycleEvent) {
+	var buf bytes.Buffer
+	tags := []statsDTag{{"queue", recorder.queueLabel.Value(event.Queue)}}
+	running := "0"
+	if event.Running {
+		running = "1"
+	}
+	recorder.write(&buf, "service.running", running, "g", tags...)
+	outcome := "success"
+	if event.Err != nil {
+		outcome = "failure"
+	}
+	recorder.write(&buf, "service.actions", "1", "c", append(tags, statsDTag{"action", string(event.Action)}, statsDTag{"outcome", outcome})...)
+	if event.ValidationDuration > 0 {
+		recorder.write(&buf, "service.queue_validation_duration", strconv.FormatFloat(event.ValidationDuration.Seconds()*1000, 'f', -1, 64), "ms", tags...)
+	}
+	recorder.send(&buf)
+}
+
+// Drift implements Recorder. The attribute is the last tag of the drift
+// gauge.
+func (recorder *StatsDRecorder) Drift(event DriftEvent) {
+	var buf bytes.Buffer
+	tags := []statsDTag{{"queue", recorder.queueLabel.Value(event.Queue)}}
+	if event.Err != nil {
+		recorder.write(&buf, "queue.drift_check_failures", "1", "c", tags...)
+		recorder.send(&buf)
+		return
+	}
+	drifted := make(map[string]bool, len(event.Drifts))
+	for _, drift := range event.Drifts {
+		drifted[drift.Name] = true
+	}
+	for _, name := range event.Checked {
+		value := "0"
+		if drifted[name] {
+			value = "1"
+		}
+		recorder.write(&buf, "queue.attribute_drift", value, "g", append(tags, statsDTag{"attribute", name})...)
+	}
+	recorder.send(&buf)
+}
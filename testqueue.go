@@ -0,0 +1,191 @@
+package sqssrv
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+)
+
+// TestQueueOpts configures a TestQueue.
+type TestQueueOpts struct {
+	// Prefix of the name of the queues. Default: "sqssrv-test".
+	Prefix string
+	// Attributes of the queue, e.g. a short VisibilityTimeout.
+	Attributes map[string]string
+	// DeadLetterQueue creates a dead letter queue for the queue.
+	DeadLetterQueue bool
+	// MaxReceiveCount of the redrive policy to the dead letter queue.
+	// Default: 3.
+	MaxReceiveCount int
+	// FIFO creates FIFO queues, named with the ".fifo" suffix.
+	FIFO bool
+}
+
+// TestQueue is a uniquely named queue, and optionally its dead letter queue,
+// created for a single test. As no other test uses it, the tests can run in
+// parallel against the same SQS (e.g. the ginkgo parallel nodes against the
+// ElasticMQ).
+type TestQueue struct {
+	// Service is started for the queue.
+	Service *SQSService
+	// QueueURL is the URL of the queue.
+	QueueURL string
+	// DeadLetterQueueURL is the URL of the dead letter queue, if created.
+	DeadLetterQueueURL string
+
+	client sqsiface.SQSAPI
+	name   string
+	// others are the URLs of the queues created by AddQueue.
+	others []string
+}
+
+// NewTestQueue creates the queues and starts the service (not started yet)
+// for them. The configuration of the service is kept, except for its QUrl.
+//
+// Close must be called after the test:
+//
+//	BeforeEach(func() {
+//		service := &sqssrv.SQSService{}
+//		Expect(service.ApplyConfiguration(&configuration)).To(Succeed())
+//		queue, err = sqssrv.NewTestQueue(service, &sqssrv.TestQueueOpts{})
+//		Expect(err).ToNot(HaveOccurred())
+//	})
+//
+//	AfterEach(func() {
+//		Expect(queue.Close()).To(Succeed())
+//	})
+func NewTestQueue(service *SQSService, opts *TestQueueOpts) (*TestQueue, error) {
+	if opts == nil {
+		opts = &TestQueueOpts{}
+	}
+	prefix := opts.Prefix
+	if prefix == "" {
+		prefix = "sqssrv-test"
+	}
+	maxReceiveCount := opts.MaxReceiveCount
+	if maxReceiveCount == 0 {
+		maxReceiveCount = 3
+	}
+
+	client := service.Client
+	if client == nil {
+		awsSQS, err := service.newClient()
+		if err != nil {
+			return nil, err
+		}
+		client = awsSQS
+	}
+
+	name, err := testQueueName(prefix)
+	if err != nil {
+		return nil, err
+	}
+	queue := &TestQueue{
+		Service: service,
+		client:  client,
+		name:    name,
+	}
+
+	suffix := ""
+	attributes := make(map[string]string, len(opts.Attributes)+2)
+	for key, value := range opts.Attributes {
+		attributes[key] = value
+	}
+	var deadLetterAttributes map[string]string
+	if opts.FIFO {
+		suffix = ".fifo"
+		attributes[sqs.QueueAttributeNameFifoQueue] = "true"
+		deadLetterAttributes = map[string]string{sqs.QueueAttributeNameFifoQueue: "true"}
+	}
+	if opts.DeadLetterQueue {
+		queue.DeadLetterQueueURL, err = queue.create(name+"-dlq"+suffix, deadLetterAttributes)
+		if err != nil {
+			return nil, err
+		}
+		output, err := client.GetQueueAttributes(&sqs.GetQueueAttributesInput{
+			QueueUrl:       aws.String(queue.DeadLetterQueueURL),
+			AttributeNames: []*string{aws.String(sqs.QueueAttributeNameQueueArn)},
+		})
+		if err != nil {
+			queue.Close()
+			return nil, err
+		}
+		policy, err := json.Marshal(map[string]string{
+			"deadLetterTargetArn": aws.StringValue(output.Attributes[sqs.QueueAttributeNameQueueArn]),
+			"maxReceiveCount":     strconv.Itoa(maxReceiveCount),
+		})
+		if err != nil {
+			queue.Close()
+			return nil, err
+		}
+		attributes[sqs.QueueAttributeNameRedrivePolicy] = string(policy)
+	}
+	queue.QueueURL, err = queue.create(name+suffix, attributes)
+	if err != nil {
+		queue.Close()
+		return nil, err
+	}
+
+	service.Configuration.QUrl = queue.QueueURL
+	if err := service.Start(); err != nil {
+		queue.Close()
+		return nil, err
+	}
+	return queue, nil
+}
+
+// testQueueName returns a name that is unique across processes.
+func testQueueName(prefix string) (string, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s-%s", prefix, hex.EncodeToString(b[:])), nil
+}
+
+func (queue *TestQueue) create(name string, attributes map[string]string) (string, error) {
+	output, err := queue.client.CreateQueue(&sqs.CreateQueueInput{
+		QueueName:  aws.String(name),
+		Attributes: aws.StringMap(attributes),
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(output.QueueUrl), nil
+}
+
+// AddQueue creates another queue for the test, e.g. a retry queue, named after
+// the queue with the suffix. It is deleted by Close.
+func (queue *TestQueue) AddQueue(suffix string, attributes map[string]string) (string, error) {
+	queueURL, err := queue.create(queue.name+suffix, attributes)
+	if err != nil {
+		return "", err
+	}
+	queue.others = append(queue.others, queueURL)
+	return queueURL, nil
+}
+
+// Close stops the service and deletes the queues.
+func (queue *TestQueue) Close() error {
+	if err := queue.Service.Stop(); err != nil {
+		return err
+	}
+	for _, queueURL := range append([]string{queue.QueueURL, queue.DeadLetterQueueURL}, queue.others...) {
+		if queueURL == "" {
+			continue
+		}
+		_, err := queue.client.DeleteQueue(&sqs.DeleteQueueInput{
+			QueueUrl: aws.String(queueURL),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package sqssrv
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// deleteTestQueues deletes the queues whose names start with the prefix, for
+// the tests whose queues are created by the service itself, e.g. by Start.
+func deleteTestQueues(service *SQSService, prefix string) error {
+	return service.RunWithClient(func(client sqsiface.SQSAPI) error {
+		output, err := client.ListQueues(&sqs.ListQueuesInput{
+			QueueNamePrefix: aws.String(prefix),
+		})
+		if err != nil {
+			return err
+		}
+		for _, queueURL := range output.QueueUrls {
+			if _, err := client.DeleteQueue(&sqs.DeleteQueueInput{QueueUrl: queueURL}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+var _ = Describe("TestQueue", func() {
+	var (
+		service *SQSService
+		client  sqsiface.SQSAPI
+		queue   *TestQueue
+	)
+
+	BeforeEach(func() {
+		service = &SQSService{}
+		Expect(service.ApplyConfiguration(validConfiguration)).To(Succeed())
+		var err error
+		client, err = service.newClient()
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		if queue != nil {
+			Expect(queue.Close()).To(Succeed())
+		}
+		queue = nil
+	})
+
+	attributes := func(queueURL string) map[string]string {
+		output, err := client.GetQueueAttributes(&sqs.GetQueueAttributesInput{
+			QueueUrl:       aws.String(queueURL),
+			AttributeNames: []*string{aws.String(sqs.QueueAttributeNameAll)},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		return aws.StringValueMap(output.Attributes)
+	}
+
+	It("should start the service for a queue of its own", func() {
+		var err error
+		queue, err = NewTestQueue(service, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(service.isRunning()).To(BeTrue())
+		Expect(service.Configuration.QUrl).To(Equal(queue.QueueURL))
+		Expect(queue.QueueURL).To(ContainSubstring("sqssrv-test-"))
+		Expect(queue.DeadLetterQueueURL).To(BeEmpty())
+
+		_, err = service.SendMessage(&sqs.SendMessageInput{
+			MessageBody: aws.String("message"),
+		})
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("should create a different queue every time", func() {
+		var err error
+		queue, err = NewTestQueue(service, &TestQueueOpts{Prefix: "prefix"})
+		Expect(err).ToNot(HaveOccurred())
+
+		other := &SQSService{}
+		Expect(other.ApplyConfiguration(validConfiguration)).To(Succeed())
+		otherQueue, err := NewTestQueue(other, &TestQueueOpts{Prefix: "prefix"})
+		Expect(err).ToNot(HaveOccurred())
+		defer otherQueue.Close()
+
+		Expect(queue.QueueURL).To(ContainSubstring("prefix-"))
+		Expect(otherQueue.QueueURL).ToNot(Equal(queue.QueueURL))
+	})
+
+	It("should set the attributes of the queue", func() {
+		var err error
+		queue, err = NewTestQueue(service, &TestQueueOpts{
+			Attributes: map[string]string{
+				sqs.QueueAttributeNameVisibilityTimeout: "7",
+			},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(attributes(queue.QueueURL)).To(HaveKeyWithValue(sqs.QueueAttributeNameVisibilityTimeout, "7"))
+	})
+
+	It("should create a dead letter queue", func() {
+		var err error
+		queue, err = NewTestQueue(service, &TestQueueOpts{
+			DeadLetterQueue: true,
+			MaxReceiveCount: 5,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(queue.DeadLetterQueueURL).To(Equal(queue.QueueURL + "-dlq"))
+
+		var policy struct {
+			DeadLetterTargetArn string      `json:"deadLetterTargetArn"`
+			MaxReceiveCount     json.Number `json:"maxReceiveCount"`
+		}
+		Expect(json.Unmarshal([]byte(attributes(queue.QueueURL)[sqs.QueueAttributeNameRedrivePolicy]), &policy)).To(Succeed())
+		Expect(policy.DeadLetterTargetArn).To(Equal(attributes(queue.DeadLetterQueueURL)[sqs.QueueAttributeNameQueueArn]))
+		Expect(policy.MaxReceiveCount.String()).To(Equal("5"))
+	})
+
+	It("should create FIFO queues", func() {
+		var err error
+		queue, err = NewTestQueue(service, &TestQueueOpts{
+			FIFO:            true,
+			DeadLetterQueue: true,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(queue.QueueURL).To(HaveSuffix(".fifo"))
+		Expect(queue.DeadLetterQueueURL).To(Equal(strings.TrimSuffix(queue.QueueURL, ".fifo") + "-dlq.fifo"))
+		Expect(attributes(queue.QueueURL)).To(HaveKeyWithValue(sqs.QueueAttributeNameFifoQueue, "true"))
+		Expect(attributes(queue.DeadLetterQueueURL)).To(HaveKeyWithValue(sqs.QueueAttributeNameFifoQueue, "true"))
+	})
+
+	It("should stop the service and delete the queues on close", func() {
+		testQueue, err := NewTestQueue(service, &TestQueueOpts{DeadLetterQueue: true})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(testQueue.Close()).To(Succeed())
+		Expect(service.isRunning()).To(BeFalse())
+
+		for _, queueURL := range []string{testQueue.QueueURL, testQueue.DeadLetterQueueURL} {
+			_, err := client.GetQueueAttributes(&sqs.GetQueueAttributesInput{
+				QueueUrl:       aws.String(queueURL),
+				AttributeNames: []*string{aws.String(sqs.QueueAttributeNameAll)},
+			})
+			Expect(err).To(HaveOccurred())
+		}
+	})
+
+	It("should delete the queues added on close", func() {
+		testQueue, err := NewTestQueue(service, nil)
+		Expect(err).ToNot(HaveOccurred())
+		parking, err := testQueue.AddQueue("-parking", map[string]string{
+			sqs.QueueAttributeNameVisibilityTimeout: "7",
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(parking).To(Equal(testQueue.QueueURL + "-parking"))
+		Expect(attributes(parking)).To(HaveKeyWithValue(sqs.QueueAttributeNameVisibilityTimeout, "7"))
+
+		Expect(testQueue.Close()).To(Succeed())
+		_, err = client.GetQueueAttributes(&sqs.GetQueueAttributesInput{
+			QueueUrl:       aws.String(parking),
+			AttributeNames: []*string{aws.String(sqs.QueueAttributeNameAll)},
+		})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should fail when the SQS cannot be reached", func() {
+		service.Configuration.Endpoint = "http://localhost:1"
+		queue, err := NewTestQueue(service, nil)
+		Expect(err).To(HaveOccurred())
+		Expect(queue).To(BeNil())
+	})
+})
@@ -0,0 +1,506 @@
+package sqssrv
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	rscsrv "github.com/lab259/go-rscsrv"
+)
+
+// Topology declares a set of queues, e.g. all the queues (and dead letter
+// queues) of an application:
+//
+//	queues:
+//	  - name: mail-dlq
+//	    attributes:
+//	      message_retention_period: 336h
+//	  - name: mail
+//	    attributes:
+//	      visibility_timeout: 30s
+//	    redrive:
+//	      dead_letter_queue: mail-dlq
+//	      max_receive_count: 5
+//	    tags:
+//	      team: mail
+type Topology struct {
+	Queues []QueueDefinition `yaml:"queues"`
+}
+
+// QueueDefinition is a queue of a Topology. A queue whose name ends with
+// ".fifo" is a FIFO queue.
+type QueueDefinition struct {
+	Name string `yaml:"name"`
+	// Attributes of the queue, including its access policy.
+	Attributes QueueAttributes `yaml:"attributes"`
+	// ContentBasedDeduplication of a FIFO queue.
+	ContentBasedDeduplication bool `yaml:"content_based_deduplication"`
+	// Tags of the queue. Tags not listed are kept.
+	Tags map[string]string `yaml:"tags"`
+	// Redrive sets the redrive policy to a dead letter queue, by name. It
+	// takes precedence over the RedrivePolicy of the Attributes.
+	Redrive *Redrive `yaml:"redrive"`
+}
+
+// Redrive is the redrive policy of a QueueDefinition.
+type Redrive struct {
+	// DeadLetterQueue is the name of the dead letter queue, of the topology
+	// or not.
+	DeadLetterQueue string `yaml:"dead_letter_queue"`
+	// MaxReceiveCount of the redrive policy. Default: 3.
+	MaxReceiveCount int `yaml:"max_receive_count"`
+}
+
+func (redrive *Redrive) maxReceiveCount() int {
+	if redrive.MaxReceiveCount == 0 {
+		return 3
+	}
+	return redrive.MaxReceiveCount
+}
+
+// LoadTopology reads a Topology from a YAML file.
+func LoadTopology(path string) (*Topology, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var topology Topology
+	if err := (&rscsrv.ConfigurationUnmarshalerYaml{}).Unmarshal(data, &topology); err != nil {
+		return nil, fmt.Errorf("could not parse the topology %s: %s", path, err.Error())
+	}
+	if err := topology.Validate(); err != nil {
+		return nil, err
+	}
+	return &topology, nil
+}
+
+// Validate checks the names and the attributes of the queues, and that their
+// redrive policies do not form cycles.
+func (topology *Topology) Validate() error {
+	_, err := topology.ordered()
+	return err
+}
+
+// ordered returns the queues with the dead letter queues before the queues
+// redriven to them, validating them.
+func (topology *Topology) ordered() ([]*QueueDefinition, error) {
+	queues := make(map[string]*QueueDefinition, len(topology.Queues))
+	for i := range topology.Queues {
+		queue := &topology.Queues[i]
+		if queue.Name == "" {
+			return nil, fmt.Errorf("the queue #%d of the topology has no name", i+1)
+		}
+		if _, ok := queues[queue.Name]; ok {
+			return nil, fmt.Errorf("the queue %s is declared twice", queue.Name)
+		}
+		if _, err := queue.Attributes.Map(); err != nil {
+			return nil, fmt.Errorf("queue %s: %s", queue.Name, err.Error())
+		}
+		if queue.Redrive != nil {
+			if queue.Redrive.DeadLetterQueue == "" {
+				return nil, fmt.Errorf("queue %s: the redrive has no dead_letter_queue", queue.Name)
+			}
+			if strings.HasSuffix(queue.Name, ".fifo") != strings.HasSuffix(queue.Redrive.DeadLetterQueue, ".fifo") {
+				return nil, fmt.Errorf("queue %s: the dead letter queue %s must be of the same type (standard or FIFO)", queue.Name, queue.Redrive.DeadLetterQueue)
+			}
+		}
+		queues[queue.Name] = queue
+	}
+
+	var (
+		ordered  = make([]*QueueDefinition, 0, len(topology.Queues))
+		visited  = make(map[string]bool, len(topology.Queues))
+		visiting = make(map[string]bool)
+		visit    func(queue *QueueDefinition) error
+	)
+	visit = func(queue *QueueDefinition) error {
+		if visited[queue.Name] {
+			return nil
+		}
+		if visiting[queue.Name] {
+			return fmt.Errorf("the redrive of the queue %s is a cycle", queue.Name)
+		}
+		visiting[queue.Name] = true
+		if queue.Redrive != nil {
+			if dlq, ok := queues[queue.Redrive.DeadLetterQueue]; ok {
+				if err := visit(dlq); err != nil {
+					return err
+				}
+			}
+		}
+		visiting[queue.Name] = false
+		visited[queue.Name] = true
+		ordered = append(ordered, queue)
+		return nil
+	}
+	for i := range topology.Queues {
+		if err := visit(&topology.Queues[i]); err != nil {
+			return nil, err
+		}
+	}
+	return ordered, nil
+}
+
+// TopologyAction is the kind of a TopologyChange.
+type TopologyAction string
+
+const (
+	// TopologyActionCreate creates a queue.
+	TopologyActionCreate TopologyAction = "create"
+	// TopologyActionSetAttribute changes an attribute of a queue.
+	TopologyActionSetAttribute TopologyAction = "set_attribute"
+	// TopologyActionTag adds or changes a tag of a queue.
+	TopologyActionTag TopologyAction = "tag"
+)
+
+// TopologyChange is a change to a queue needed to match a Topology.
+type TopologyChange struct {
+	Action TopologyAction
+	// Queue is the name of the queue.
+	Queue string
+	// Name of the attribute or of the tag. Empty when creating a queue.
+	Name string
+	// Current value, empty when there is none.
+	Current string
+	// Expected value, empty when creating a queue.
+	Expected string
+}
+
+func (change TopologyChange) String() string {
+	switch change.Action {
+	case TopologyActionCreate:
+		return fmt.Sprintf("create queue %s", change.Queue)
+	case TopologyActionTag:
+		return fmt.Sprintf("tag queue %s: %s = %q (was %q)", change.Queue, change.Name, change.Expected, change.Current)
+	}
+	return fmt.Sprintf("set attribute of queue %s: %s = %q (was %q)", change.Queue, change.Name, change.Expected, change.Current)
+}
+
+// Plan returns the changes Reconcile would apply to match the topology,
+// without applying them.
+func (service *SQSService) Plan(ctx context.Context, topology *Topology) ([]TopologyChange, error) {
+	return service.reconcile(ctx, topology, false)
+}
+
+// Reconcile creates the queues of the topology that do not exist and updates
+// the attributes and tags that differ, returning the changes applied. The
+// queues are never deleted and the tags not in the topology are kept.
+//
+// The dead letter queues are reconciled before the queues redriven to them.
+// If a change fails, the changes applied so far are returned with the error.
+func (service *SQSService) Reconcile(ctx context.Context, topology *Topology) ([]TopologyChange, error) {
+	return service.reconcile(ctx, topology, true)
+}
+
+func (service *SQSService) reconcile(ctx context.Context, topology *Topology, apply bool) ([]TopologyChange, error) {
+	queues, err := topology.ordered()
+	if err != nil {
+		return nil, err
+	}
+	changes := make([]TopologyChange, 0)
+	// arns of the queues already reconciled, by name.
+	arns := make(map[string]string, len(queues))
+	for _, queue := range queues {
+		queueURL, err := service.lookupQueue(ctx, queue.Name)
+		if err != nil {
+			return changes, err
+		}
+
+		var live map[string]string
+		if queueURL != "" {
+			output, err := service.invoke(ctx, MessageMetricMethodGetQueueAttributes, aws.String(queueURL), &sqs.GetQueueAttributesInput{
+				QueueUrl:       aws.String(queueURL),
+				AttributeNames: []*string{aws.String(sqs.QueueAttributeNameAll)},
+			})
+			if err != nil {
+				return changes, err
+			}
+			out, ok := output.(*sqs.GetQueueAttributesOutput)
+			if !ok || out == nil {
+				return changes, unexpectedOutputError(Operation{Queue: queueURL, Method: MessageMetricMethodGetQueueAttributes}, output)
+			}
+			live = aws.StringValueMap(out.Attributes)
+			arns[queue.Name] = live[sqs.QueueAttributeNameQueueArn]
+		}
+
+		if queueURL == "" && !apply {
+			changes = append(changes, TopologyChange{
+				Action: TopologyActionCreate,
+				Queue:  queue.Name,
+			})
+			continue
+		}
+
+		expected, err := service.expectedAttributes(ctx, queue, arns, live[sqs.QueueAttributeNameQueueArn])
+		if err != nil {
+			return changes, err
+		}
+
+		if queueURL == "" {
+			creation := &CreateQueueConfiguration{Tags: queue.Tags}
+			queueURL, err = creation.create(ctx, service.getInvoker(), queue.Name, aws.StringMap(expected))
+			if err != nil {
+				return changes, err
+			}
+			changes = append(changes, TopologyChange{
+				Action: TopologyActionCreate,
+				Queue:  queue.Name,
+			})
+			output, err := service.invoke(ctx, MessageMetricMethodGetQueueAttributes, aws.String(queueURL), &sqs.GetQueueAttributesInput{
+				QueueUrl:       aws.String(queueURL),
+				AttributeNames: []*string{aws.String(sqs.QueueAttributeNameQueueArn)},
+			})
+			if err != nil {
+				return changes, err
+			}
+			out, ok := output.(*sqs.GetQueueAttributesOutput)
+			if !ok || out == nil {
+				return changes, unexpectedOutputError(Operation{Queue: queueURL, Method: MessageMetricMethodGetQueueAttributes}, output)
+			}
+			arns[queue.Name] = aws.StringValue(out.Attributes[sqs.QueueAttributeNameQueueArn])
+			continue
+		}
+
+		var attributeChanges []TopologyChange
+		for _, name := range sortedKeys(expected) {
+			if !sameAttribute(name, live[name], expected[name]) {
+				attributeChanges = append(attributeChanges, TopologyChange{
+					Action:   TopologyActionSetAttribute,
+					Queue:    queue.Name,
+					Name:     name,
+					Current:  live[name],
+					Expected: expected[name],
+				})
+			}
+		}
+		var tagChanges []TopologyChange
+		if len(queue.Tags) > 0 {
+			output, err := service.invoke(ctx, MessageMetricMethodListQueueTags, aws.String(queueURL), &sqs.ListQueueTagsInput{
+				QueueUrl: aws.String(queueURL),
+			})
+			if err != nil {
+				return changes, err
+			}
+			out, ok := output.(*sqs.ListQueueTagsOutput)
+			if !ok || out == nil {
+				return changes, unexpectedOutputError(Operation{Queue: queueURL, Method: MessageMetricMethodListQueueTags}, output)
+			}
+			tags := aws.StringValueMap(out.Tags)
+			for _, name := range sortedKeys(queue.Tags) {
+				if current, ok := tags[name]; !ok || current != queue.Tags[name] {
+					tagChanges = append(tagChanges, TopologyChange{
+						Action:   TopologyActionTag,
+						Queue:    queue.Name,
+						Name:     name,
+						Current:  current,
+						Expected: queue.Tags[name],
+					})
+				}
+			}
+		}
+
+		if apply && len(attributeChanges) > 0 {
+			attributes := make(map[string]*string, len(attributeChanges))
+			for _, change := range attributeChanges {
+				attributes[change.Name] = aws.String(change.Expected)
+			}
+			_, err := service.invoke(ctx, MessageMetricMethodSetQueueAttributes, aws.String(queueURL), &sqs.SetQueueAttributesInput{
+				QueueUrl:   aws.String(queueURL),
+				Attributes: attributes,
+			})
+			if err != nil {
+				return changes, err
+			}
+		}
+		changes = append(changes, attributeChanges...)
+		if apply && len(tagChanges) > 0 {
+			tags := make(map[string]*string, len(tagChanges))
+			for _, change := range tagChanges {
+				tags[change.Name] = aws.String(change.Expected)
+			}
+			_, err := service.invoke(ctx, MessageMetricMethodTagQueue, aws.String(queueURL), &sqs.TagQueueInput{
+				QueueUrl: aws.String(queueURL),
+				Tags:     tags,
+			})
+			if err != nil {
+				return changes, err
+			}
+		}
+		changes = append(changes, tagChanges...)
+	}
+	return changes, nil
+}
+
+// lookupQueue returns the URL of a queue, empty if it does not exist.
+func (service *SQSService) lookupQueue(ctx context.Context, name string) (string, error) {
+	output, err := service.invoke(ctx, MessageMetricMethodGetQueueUrl, aws.String(name), &sqs.GetQueueUrlInput{
+		QueueName: aws.String(name),
+	})
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == sqs.ErrCodeQueueDoesNotExist {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	out, ok := output.(*sqs.GetQueueUrlOutput)
+	if !ok || out == nil {
+		return "", unexpectedOutputError(Operation{Queue: name, Method: MessageMetricMethodGetQueueUrl}, output)
+	}
+	return aws.StringValue(out.QueueUrl), nil
+}
+
+// expectedAttributes returns the attributes a queue of the topology must
+// have. The ARN of a dead letter queue not reconciled yet is looked up or,
+// if it does not exist, derived from the ARN of the queue (which is in the
+// same account and region).
+func (service *SQSService) expectedAttributes(ctx context.Context, queue *QueueDefinition, arns map[string]string, queueArn string) (map[string]string, error) {
+	attributes, err := queue.Attributes.Map()
+	if err != nil {
+		return nil, err
+	}
+	if redrive := queue.Redrive; redrive != nil {
+		arn, ok := arns[redrive.DeadLetterQueue]
+		if !ok {
+			dlqURL, err := service.lookupQueue(ctx, redrive.DeadLetterQueue)
+			if err != nil {
+				return nil, err
+			}
+			if dlqURL != "" {
+				output, err := service.invoke(ctx, MessageMetricMethodGetQueueAttributes, aws.String(dlqURL), &sqs.GetQueueAttributesInput{
+					QueueUrl:       aws.String(dlqURL),
+					AttributeNames: []*string{aws.String(sqs.QueueAttributeNameQueueArn)},
+				})
+				if err != nil {
+					return nil, err
+				}
+				out, ok := output.(*sqs.GetQueueAttributesOutput)
+				if !ok || out == nil {
+					return nil, unexpectedOutputError(Operation{Queue: dlqURL, Method: MessageMetricMethodGetQueueAttributes}, output)
+				}
+				arn = aws.StringValue(out.Attributes[sqs.QueueAttributeNameQueueArn])
+			} else if i := strings.LastIndex(queueArn, ":"); i >= 0 {
+				arn = queueArn[:i+1] + redrive.DeadLetterQueue
+			}
+		}
+		if arn == "" {
+			return nil, fmt.Errorf("queue %s: the dead letter queue %s does not exist", queue.Name, redrive.DeadLetterQueue)
+		}
+		redrivePolicy, err := (&QueueAttributes{
+			RedrivePolicy: &RedrivePolicy{
+				DeadLetterTargetArn: arn,
+				MaxReceiveCount:     redrive.maxReceiveCount(),
+			},
+		}).Map()
+		if err != nil {
+			return nil, fmt.Errorf("queue %s: %s", queue.Name, err.Error())
+		}
+		attributes[sqs.QueueAttributeNameRedrivePolicy] = redrivePolicy[sqs.QueueAttributeNameRedrivePolicy]
+	}
+	if strings.HasSuffix(queue.Name, ".fifo") {
+		attributes[sqs.QueueAttributeNameFifoQueue] = aws.String("true")
+		attributes[sqs.QueueAttributeNameContentBasedDeduplication] = aws.String(fmt.Sprint(queue.ContentBasedDeduplication))
+	}
+	return aws.StringValueMap(attributes), nil
+}
+
+// sameAttribute compares the values of an attribute. The JSON ones are
+// compared by their content.
+func sameAttribute(name, current, expected string) bool {
+	switch name {
+	case sqs.QueueAttributeNameRedrivePolicy:
+		if current == "" || expected == "" {
+			return current == expected
+		}
+		currentPolicy, err := parseRedrivePolicy(current)
+		if err != nil {
+			return false
+		}
+		expectedPolicy, err := parseRedrivePolicy(expected)
+		if err != nil {
+			return false
+		}
+		return *currentPolicy == *expectedPolicy
+	case sqs.QueueAttributeNamePolicy:
+		var currentPolicy, expectedPolicy interface{}
+		if json.Unmarshal([]byte(current), &currentPolicy) != nil || json.Unmarshal([]byte(expected), &expectedPolicy) != nil {
+			return current == expected
+		}
+		return reflect.DeepEqual(currentPolicy, expectedPolicy)
+	}
+	return current == expected
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// WriteElasticMQConfig writes the topology as an ElasticMQ configuration
+// (like the .docker/elasticmq/custom.conf), to run it locally. ElasticMQ has
+// no access policies, message retention or maximum message size, so they are
+// left out.
+func (topology *Topology) WriteElasticMQConfig(w io.Writer) error {
+	if err := topology.Validate(); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	buf.WriteString("include classpath(\"application.conf\")\n\nqueues {\n")
+	for i, queue := range topology.Queues {
+		if i > 0 {
+			buf.WriteString("\n")
+		}
+		fmt.Fprintf(&buf, "    %s {\n", hoconKey(queue.Name))
+		seconds := func(key string, d *time.Duration) {
+			if d != nil {
+				fmt.Fprintf(&buf, "        %s = %d seconds\n", key, *d/time.Second)
+			}
+		}
+		seconds("defaultVisibilityTimeout", queue.Attributes.VisibilityTimeout)
+		seconds("delay", queue.Attributes.Delay)
+		seconds("receiveMessageWait", queue.Attributes.ReceiveMessageWaitTime)
+		if redrive := queue.Redrive; redrive != nil {
+			fmt.Fprintf(&buf, "        deadLettersQueue {\n            name = %q\n            maxReceiveCount = %d\n        }\n", redrive.DeadLetterQueue, redrive.maxReceiveCount())
+		}
+		if strings.HasSuffix(queue.Name, ".fifo") {
+			buf.WriteString("        fifo = true\n")
+			fmt.Fprintf(&buf, "        contentBasedDeduplication = %t\n", queue.ContentBasedDeduplication)
+		}
+		if len(queue.Tags) > 0 {
+			buf.WriteString("        tags {\n")
+			for _, name := range sortedKeys(queue.Tags) {
+				fmt.Fprintf(&buf, "            %s = %q\n", hoconKey(name), queue.Tags[name])
+			}
+			buf.WriteString("        }\n")
+		}
+		buf.WriteString("    }\n")
+	}
+	buf.WriteString("}\n")
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// hoconKey quotes a key of the ElasticMQ configuration when it is not made of
+// only letters, digits, hyphens and underscores (e.g. the names of FIFO
+// queues, as the dot separates the path of the keys).
+func hoconKey(key string) string {
+	if key != "" && strings.TrimFunc(key, func(r rune) bool {
+		return r == '-' || r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9')
+	}) == "" {
+		return key
+	}
+	return fmt.Sprintf("%q", key)
+}
@@ -0,0 +1,340 @@
+package sqssrv
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Topology", func() {
+	Context("validating", func() {
+		It("should validate a topology", func() {
+			Expect((&Topology{Queues: []QueueDefinition{
+				{Name: "mail-dlq"},
+				{Name: "mail", Redrive: &Redrive{DeadLetterQueue: "mail-dlq"}},
+				{Name: "other", Redrive: &Redrive{DeadLetterQueue: "external-dlq"}},
+			}}).Validate()).To(Succeed())
+		})
+
+		It("should reject the invalid topologies", func() {
+			invalid := map[string]*Topology{
+				"has no name": {Queues: []QueueDefinition{{}}},
+				"declared twice": {Queues: []QueueDefinition{
+					{Name: "mail"},
+					{Name: "mail"},
+				}},
+				"DelaySeconds": {Queues: []QueueDefinition{
+					{Name: "mail", Attributes: QueueAttributes{Delay: duration(time.Hour)}},
+				}},
+				"no dead_letter_queue": {Queues: []QueueDefinition{
+					{Name: "mail", Redrive: &Redrive{}},
+				}},
+				"same type": {Queues: []QueueDefinition{
+					{Name: "mail.fifo", Redrive: &Redrive{DeadLetterQueue: "mail-dlq"}},
+				}},
+				"cycle": {Queues: []QueueDefinition{
+					{Name: "a", Redrive: &Redrive{DeadLetterQueue: "b"}},
+					{Name: "b", Redrive: &Redrive{DeadLetterQueue: "a"}},
+				}},
+			}
+			for message, topology := range invalid {
+				err := topology.Validate()
+				Expect(err).To(HaveOccurred(), message)
+				Expect(err.Error()).To(ContainSubstring(message))
+			}
+		})
+
+		It("should order the dead letter queues first", func() {
+			queues, err := (&Topology{Queues: []QueueDefinition{
+				{Name: "mail", Redrive: &Redrive{DeadLetterQueue: "mail-dlq"}},
+				{Name: "mail-dlq", Redrive: &Redrive{DeadLetterQueue: "last-resort"}},
+				{Name: "last-resort"},
+			}}).ordered()
+			Expect(err).ToNot(HaveOccurred())
+			var names []string
+			for _, queue := range queues {
+				names = append(names, queue.Name)
+			}
+			Expect(names).To(Equal([]string{"last-resort", "mail-dlq", "mail"}))
+		})
+	})
+
+	It("should load a topology", func() {
+		dir, err := ioutil.TempDir("", "topology")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "topology.yml")
+		Expect(ioutil.WriteFile(path, []byte(`
+queues:
+  - name: mail-dlq
+    attributes:
+      message_retention_period: 336h
+  - name: mail
+    attributes:
+      visibility_timeout: 30s
+      policy: '{"Version":"2012-10-17"}'
+    redrive:
+      dead_letter_queue: mail-dlq
+      max_receive_count: 5
+    tags:
+      team: mail
+`), 0644)).To(Succeed())
+
+		topology, err := LoadTopology(path)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(topology.Queues).To(HaveLen(2))
+		Expect(*topology.Queues[0].Attributes.MessageRetentionPeriod).To(Equal(14 * 24 * time.Hour))
+		mail := topology.Queues[1]
+		Expect(*mail.Attributes.VisibilityTimeout).To(Equal(30 * time.Second))
+		Expect(*mail.Attributes.Policy).To(Equal(`{"Version":"2012-10-17"}`))
+		Expect(mail.Redrive).To(Equal(&Redrive{DeadLetterQueue: "mail-dlq", MaxReceiveCount: 5}))
+		Expect(mail.Tags).To(Equal(map[string]string{"team": "mail"}))
+
+		Expect(ioutil.WriteFile(path, []byte("queues:\n  - name: a\n  - name: a\n"), 0644)).To(Succeed())
+		_, err = LoadTopology(path)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should write the ElasticMQ configuration", func() {
+		var buf bytes.Buffer
+		Expect((&Topology{Queues: []QueueDefinition{
+			{
+				Name:       "mail-dlq",
+				Attributes: QueueAttributes{MessageRetentionPeriod: duration(time.Hour)},
+			},
+			{
+				Name: "mail",
+				Attributes: QueueAttributes{
+					VisibilityTimeout:      duration(30 * time.Second),
+					Delay:                  duration(5 * time.Second),
+					ReceiveMessageWaitTime: duration(20 * time.Second),
+				},
+				Redrive: &Redrive{DeadLetterQueue: "mail-dlq"},
+				Tags:    map[string]string{"team": "mail", "env": "local"},
+			},
+			{
+				Name:                      "orders.fifo",
+				ContentBasedDeduplication: true,
+			},
+		}}).WriteElasticMQConfig(&buf)).To(Succeed())
+		Expect(buf.String()).To(Equal(`include classpath("application.conf")
+
+queues {
+    mail-dlq {
+    }
+
+    mail {
+        defaultVisibilityTimeout = 30 seconds
+        delay = 5 seconds
+        receiveMessageWait = 20 seconds
+        deadLettersQueue {
+            name = "mail-dlq"
+            maxReceiveCount = 3
+        }
+        tags {
+            env = "local"
+            team = "mail"
+        }
+    }
+
+    "orders.fifo" {
+        fifo = true
+        contentBasedDeduplication = true
+    }
+}
+`))
+	})
+
+	Context("reconciling", func() {
+		var (
+			service *SQSService
+			prefix  string
+		)
+
+		BeforeEach(func() {
+			service = &SQSService{}
+			Expect(service.ApplyConfiguration(&validConfiguration)).To(Succeed())
+			Expect(service.Start()).To(Succeed())
+			var err error
+			prefix, err = testQueueName("sqssrv-topology")
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			Expect(deleteTestQueues(service, prefix)).To(Succeed())
+			Expect(service.Stop()).To(Succeed())
+		})
+
+		topology := func() *Topology {
+			return &Topology{Queues: []QueueDefinition{
+				{
+					Name: prefix + "-mail",
+					Attributes: QueueAttributes{
+						VisibilityTimeout: duration(30 * time.Second),
+						Policy:            aws.String(`{"Version": "2012-10-17", "Statement": []}`),
+					},
+					Redrive: &Redrive{DeadLetterQueue: prefix + "-mail-dlq", MaxReceiveCount: 5},
+					Tags:    map[string]string{"team": "mail"},
+				},
+				{
+					Name:       prefix + "-mail-dlq",
+					Attributes: QueueAttributes{MessageRetentionPeriod: duration(14 * 24 * time.Hour)},
+				},
+			}}
+		}
+
+		attributes := func(name string) *QueueAttributes {
+			queueURL, err := service.lookupQueue(context.Background(), name)
+			Expect(err).ToNot(HaveOccurred())
+			attributes, err := service.QueueAttributes(context.Background(), aws.String(queueURL))
+			Expect(err).ToNot(HaveOccurred())
+			return attributes
+		}
+
+		It("should plan the creation of the queues without creating them", func() {
+			changes, err := service.Plan(context.Background(), topology())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(changes).To(Equal([]TopologyChange{
+				{Action: TopologyActionCreate, Queue: prefix + "-mail-dlq"},
+				{Action: TopologyActionCreate, Queue: prefix + "-mail"},
+			}))
+
+			changes, err = service.Plan(context.Background(), topology())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(changes).To(HaveLen(2))
+		})
+
+		It("should create the queues", func() {
+			changes, err := service.Reconcile(context.Background(), topology())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(changes).To(Equal([]TopologyChange{
+				{Action: TopologyActionCreate, Queue: prefix + "-mail-dlq"},
+				{Action: TopologyActionCreate, Queue: prefix + "-mail"},
+			}))
+
+			dlq := attributes(prefix + "-mail-dlq")
+			Expect(*dlq.MessageRetentionPeriod).To(Equal(14 * 24 * time.Hour))
+			mail := attributes(prefix + "-mail")
+			Expect(*mail.VisibilityTimeout).To(Equal(30 * time.Second))
+			Expect(mail.RedrivePolicy).To(Equal(&RedrivePolicy{
+				DeadLetterTargetArn: aws.StringValue(dlq.QueueArn),
+				MaxReceiveCount:     5,
+			}))
+
+			changes, err = service.Plan(context.Background(), topology())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(changes).To(BeEmpty())
+		})
+
+		It("should update the drifted attributes and tags", func() {
+			_, err := service.Reconcile(context.Background(), topology())
+			Expect(err).ToNot(HaveOccurred())
+			mailURL, err := service.lookupQueue(context.Background(), prefix+"-mail")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(service.UpdateQueueAttributes(context.Background(), aws.String(mailURL), &QueueAttributes{
+				VisibilityTimeout: duration(10 * time.Second),
+			})).To(Succeed())
+			Expect(service.RunWithClient(func(client sqsiface.SQSAPI) error {
+				_, err := client.TagQueue(&sqs.TagQueueInput{
+					QueueUrl: aws.String(mailURL),
+					Tags:     aws.StringMap(map[string]string{"team": "other", "extra": "kept"}),
+				})
+				return err
+			})).To(Succeed())
+
+			expected := []TopologyChange{
+				{
+					Action:   TopologyActionSetAttribute,
+					Queue:    prefix + "-mail",
+					Name:     sqs.QueueAttributeNameVisibilityTimeout,
+					Current:  "10",
+					Expected: "30",
+				},
+				{
+					Action:   TopologyActionTag,
+					Queue:    prefix + "-mail",
+					Name:     "team",
+					Current:  "other",
+					Expected: "mail",
+				},
+			}
+			changes, err := service.Plan(context.Background(), topology())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(changes).To(Equal(expected))
+			Expect(*attributes(prefix + "-mail").VisibilityTimeout).To(Equal(10 * time.Second))
+
+			changes, err = service.Reconcile(context.Background(), topology())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(changes).To(Equal(expected))
+			Expect(*attributes(prefix + "-mail").VisibilityTimeout).To(Equal(30 * time.Second))
+
+			Expect(service.RunWithClient(func(client sqsiface.SQSAPI) error {
+				output, err := client.ListQueueTags(&sqs.ListQueueTagsInput{QueueUrl: aws.String(mailURL)})
+				Expect(aws.StringValueMap(output.Tags)).To(Equal(map[string]string{"team": "mail", "extra": "kept"}))
+				return err
+			})).To(Succeed())
+
+			changes, err = service.Plan(context.Background(), topology())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(changes).To(BeEmpty())
+		})
+
+		It("should plan the redrive to a dead letter queue not created yet", func() {
+			t := topology()
+			t.Queues[0].Redrive = nil
+			_, err := service.Reconcile(context.Background(), t)
+			Expect(err).ToNot(HaveOccurred())
+
+			t = topology()
+			t.Queues[1].Name = prefix + "-new-dlq"
+			t.Queues[0].Redrive.DeadLetterQueue = prefix + "-new-dlq"
+			changes, err := service.Plan(context.Background(), t)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(changes).To(HaveLen(2))
+			Expect(changes[0]).To(Equal(TopologyChange{Action: TopologyActionCreate, Queue: prefix + "-new-dlq"}))
+			Expect(changes[1].Name).To(Equal(sqs.QueueAttributeNameRedrivePolicy))
+			Expect(changes[1].Expected).To(ContainSubstring(":" + prefix + "-new-dlq"))
+
+			changes, err = service.Reconcile(context.Background(), t)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(changes).To(HaveLen(2))
+			Expect(aws.StringValue(attributes(prefix + "-new-dlq").QueueArn)).To(Equal(attributes(prefix + "-mail").RedrivePolicy.DeadLetterTargetArn))
+		})
+
+		It("should fail on an unexpected output", func() {
+			_, err := service.Reconcile(context.Background(), topology())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(service.Stop()).To(Succeed())
+			service.Configuration.Interceptors = []Interceptor{
+				func(ctx context.Context, op Operation, input interface{}, next Invoker) (interface{}, error) {
+					if op.Method == MessageMetricMethodListQueueTags {
+						return &sqs.GetQueueAttributesOutput{}, nil
+					}
+					return next(ctx, op, input)
+				},
+			}
+			Expect(service.Start()).To(Succeed())
+
+			_, err = service.Plan(context.Background(), topology())
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(HavePrefix("unexpected output *sqs.GetQueueAttributesOutput of ListQueueTags on "))
+		})
+
+		It("should fail when the dead letter queue out of the topology does not exist", func() {
+			_, err := service.Reconcile(context.Background(), &Topology{Queues: []QueueDefinition{
+				{Name: prefix + "-mail", Redrive: &Redrive{DeadLetterQueue: prefix + "-missing"}},
+			}})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("does not exist"))
+		})
+	})
+})